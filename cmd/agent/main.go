@@ -170,6 +170,7 @@ func initConfig() {
 	viper.SetDefault("agent.health_check_interval", "10s")
 	viper.SetDefault("server.timeout", "30s")
 	viper.SetDefault("server.tls_verify", true)
+	viper.BindEnv("server.token", "IPSEC_AGENT_TOKEN")
 
 	if err := viper.ReadInConfig(); err == nil {
 		log.Debug().Str("config", viper.ConfigFileUsed()).Msg("Using config file")
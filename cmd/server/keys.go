@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+	"github.com/swavlamban/ipsec-manager/internal/server"
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the master keys that encrypt secrets at rest",
+	Long: `Tunnel secrets are stored encrypted with a master key, read from
+IPSEC_MASTER_KEY or from the file named by secrets.master_key_file
+(IPSEC_MASTER_KEY_FILE). Either holds one key per line as "<id>:<base64 key>";
+the first key encrypts new secrets, the others only decrypt existing ones.
+
+To rotate, put a new key first, keeping the old ones after it, and run
+"keys rotate". Once it has finished, the old keys can be removed.`,
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:          "generate",
+	Short:        "Print a new random master key",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, _ := cmd.Flags().GetString("id")
+		if id == "" {
+			id = time.Now().UTC().Format("20060102-150405")
+		}
+
+		// A second key with the same ID would make the keyring unreadable
+		keys, err := server.LoadKeyring()
+		if err != nil {
+			return err
+		}
+		if keys != nil && keys.HasKey(id) {
+			return fmt.Errorf("master key %s is already configured, choose another ID with --id", id)
+		}
+
+		key, err := policy.GenerateMasterKey(id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), key)
+		return nil
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:          "rotate",
+	Short:        "Re-encrypt all stored secrets with the current master key",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		storage, err := server.OpenStorage()
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+
+		rewritten, err := storage.RotateKeys(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		tables := make([]string, 0, len(rewritten))
+		for table := range rewritten {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+
+		out := cmd.OutOrStdout()
+		for _, table := range tables {
+			fmt.Fprintf(out, "%-18s %d rows re-encrypted\n", table, rewritten[table])
+		}
+		fmt.Fprintf(out, "All secrets are encrypted with master key %s\n", storage.MasterKeyID())
+		return nil
+	},
+}
+
+func init() {
+	keysGenerateCmd.Flags().String("id", "", "key ID (default: the current UTC date and time)")
+}
@@ -60,16 +60,6 @@ var policyCmd = &cobra.Command{
 	Short: "Manage policies",
 }
 
-var policyListCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List all policies",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		// TODO: Implement policy list
-		fmt.Println("Policy list not yet implemented")
-		return nil
-	},
-}
-
 func init() {
 	cobra.OnInitialize(initConfig)
 
@@ -87,6 +77,14 @@ func init() {
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(policyCmd)
 	policyCmd.AddCommand(policyListCmd)
+	policyCmd.AddCommand(policyImportCmd)
+	policyCmd.AddCommand(policyExportCmd)
+	rootCmd.AddCommand(schemaCmd)
+	schemaCmd.AddCommand(schemaOpenAPICmd)
+	schemaCmd.AddCommand(schemaPolicyCmd)
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysCmd.AddCommand(keysRotateCmd)
 }
 
 func initConfig() {
@@ -106,6 +104,9 @@ func initConfig() {
 	viper.SetDefault("server.listen", ":8080")
 	viper.SetDefault("server.db_path", "./data/ipsec.db")
 	viper.SetDefault("log.level", "info")
+	viper.BindEnv("secrets.master_key_file", "IPSEC_MASTER_KEY_FILE")
+	viper.BindEnv("auth.agent_token", "IPSEC_AGENT_TOKEN")
+	viper.BindEnv("auth.admin_token", "IPSEC_ADMIN_TOKEN")
 
 	if err := viper.ReadInConfig(); err == nil {
 		log.Debug().Str("config", viper.ConfigFileUsed()).Msg("Using config file")
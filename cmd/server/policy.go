@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+	"github.com/swavlamban/ipsec-manager/internal/server"
+)
+
+var policyListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List all policies",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		storage, err := server.OpenStorage()
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+
+		policies, err := storage.ListPolicies(cmd.Context(), false)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tVERSION\tENABLED\tPRIORITY\tTUNNELS")
+		for _, pol := range policies {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%t\t%d\t%d\n",
+				pol.ID, pol.Name, pol.Version, pol.Enabled, pol.Priority, len(pol.Tunnels))
+		}
+		return w.Flush()
+	},
+}
+
+var policyImportCmd = &cobra.Command{
+	Use:          "import -f FILE",
+	Short:        "Import policies from a YAML or JSON policy file",
+	SilenceUsage: true,
+	Long: `Import policies from a policy file: multi-document YAML, or JSON holding
+a single policy or an array. Every policy is validated first; if any is
+rejected, nothing is imported. Policies whose name already exists are
+rejected unless --upsert is given, in which case they are updated.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, _ := cmd.Flags().GetString("file")
+		format, _ := cmd.Flags().GetString("format")
+		upsert, _ := cmd.Flags().GetBool("upsert")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		var in io.Reader = cmd.InOrStdin()
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+			if format == "" {
+				format = policy.FormatForPath(file)
+			}
+		}
+		if format == "" {
+			format = policy.FormatYAML
+		}
+
+		policies, err := policy.DecodePolicies(in, format)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		engine, err := server.NewPolicyEngine()
+		if err != nil {
+			return err
+		}
+
+		storage, err := server.OpenStorage()
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+
+		result, err := server.ImportPolicies(cmd.Context(), storage, engine, policies, server.ImportOptions{
+			Upsert: upsert,
+			DryRun: dryRun,
+			Source: file,
+		})
+		var importErr *server.ImportError
+		if errors.As(err, &importErr) {
+			printImportProblems(cmd.ErrOrStderr(), importErr)
+			return fmt.Errorf("%d of %d policies rejected, nothing imported", len(importErr.Problems), len(policies))
+		}
+		if err != nil {
+			return err
+		}
+
+		out := cmd.OutOrStdout()
+		if dryRun {
+			fmt.Fprintln(out, "Dry run, nothing was written")
+		}
+		fmt.Fprintf(out, "Created:   %d %s\n", len(result.Created), strings.Join(result.Created, ", "))
+		fmt.Fprintf(out, "Updated:   %d %s\n", len(result.Updated), strings.Join(result.Updated, ", "))
+		fmt.Fprintf(out, "Unchanged: %d %s\n", len(result.Unchanged), strings.Join(result.Unchanged, ", "))
+		return nil
+	},
+}
+
+func printImportProblems(w io.Writer, importErr *server.ImportError) {
+	for _, problem := range importErr.Problems {
+		fmt.Fprintf(w, "policy %d (%s): %s\n", problem.Index, problem.Name, problem.Message)
+		for _, finding := range problem.Findings {
+			fmt.Fprintf(w, "  %s [%s] %s\n", finding.Severity, finding.Code, finding.Error())
+		}
+	}
+}
+
+var policyExportCmd = &cobra.Command{
+	Use:          "export",
+	Short:        "Export all policies as a YAML or JSON policy file",
+	SilenceUsage: true,
+	Long: `Export all policies, ordered by name, without server-assigned versions
+and timestamps. The output can be imported again with --upsert, and
+exporting again afterwards gives identical output.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, _ := cmd.Flags().GetString("output")
+		format, _ := cmd.Flags().GetString("format")
+		if format == "" {
+			format = policy.FormatYAML
+			if file != "-" {
+				format = policy.FormatForPath(file)
+			}
+		}
+
+		storage, err := server.OpenStorage()
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+
+		policies, err := storage.ListPolicies(cmd.Context(), false)
+		if err != nil {
+			return err
+		}
+
+		if file == "-" {
+			return policy.EncodePolicies(cmd.OutOrStdout(), policies, format)
+		}
+
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		if err := policy.EncodePolicies(f, policies, format); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	},
+}
+
+func init() {
+	policyImportCmd.Flags().StringP("file", "f", "", "policy file to import, or - for stdin")
+	policyImportCmd.Flags().String("format", "", "yaml or json (default: from the file extension)")
+	policyImportCmd.Flags().Bool("upsert", false, "update existing policies with the same name")
+	policyImportCmd.Flags().Bool("dry-run", false, "validate and report without writing")
+	policyImportCmd.MarkFlagRequired("file")
+
+	policyExportCmd.Flags().StringP("output", "o", "-", "file to write, or - for stdout")
+	policyExportCmd.Flags().String("format", "", "yaml or json (default: from the file extension, yaml for stdout)")
+}
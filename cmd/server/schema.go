@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+	"github.com/swavlamban/ipsec-manager/internal/server"
+)
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the API and policy file schemas",
+}
+
+var schemaOpenAPICmd = &cobra.Command{
+	Use:          "openapi",
+	Short:        "Print the OpenAPI document of the REST API",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeSchema(cmd, server.OpenAPISpec())
+	},
+}
+
+var schemaPolicyCmd = &cobra.Command{
+	Use:          "policy",
+	Short:        "Print the JSON Schema of policy files",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeSchema(cmd, policy.PolicyFileSchema())
+	},
+}
+
+// writeSchema writes a schema to the --output file, or to stdout
+func writeSchema(cmd *cobra.Command, schema policy.JSONSchema) error {
+	data, err := marshalSchema(schema)
+	if err != nil {
+		return err
+	}
+
+	file, _ := cmd.Flags().GetString("output")
+	if file == "-" {
+		_, err = cmd.OutOrStdout().Write(data)
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// marshalSchema encodes a schema the way the checked-in files are written
+func marshalSchema(schema policy.JSONSchema) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(schema); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func init() {
+	schemaOpenAPICmd.Flags().StringP("output", "o", "-", "file to write, or - for stdout")
+	schemaPolicyCmd.Flags().StringP("output", "o", "-", "file to write, or - for stdout")
+}
@@ -6,9 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,13 +27,19 @@ import (
 type Agent struct {
 	id            string
 	manager       ipsec.IPsecManager
+	engine        *policy.PolicyEngine
 	serverURL     string
+	token         string // Agent token, needed to receive tunnel secrets
+	secretDir     string // Directory agent:file: secret references are read from
+	pkiDir        string // Directory of the key and certificate from the server's CA
 	syncInterval  time.Duration
 	healthInterval time.Duration
 	httpClient    *http.Client
 	
 	currentPolicies []policy.Policy
 	currentTunnels  map[string]ipsec.TunnelConfig
+	tunnelSources   map[string]string // Tunnel name -> policy ID
+	applyErrors     map[string]string // Tunnel name -> last create/update error
 	mu              sync.RWMutex
 	
 	stopCh chan struct{}
@@ -59,6 +68,16 @@ func New(manager ipsec.IPsecManager) (*Agent, error) {
 		timeout = 30 * time.Second
 	}
 
+	secretDir := viper.GetString("agent.secret_dir")
+	if secretDir == "" {
+		secretDir = policy.DefaultSecretDir
+	}
+
+	pkiDir := viper.GetString("agent.pki_dir")
+	if pkiDir == "" {
+		pkiDir = DefaultPKIDir
+	}
+
 	// Get or generate peer ID
 	peerID := viper.GetString("peer.id")
 	if peerID == "" {
@@ -69,7 +88,11 @@ func New(manager ipsec.IPsecManager) (*Agent, error) {
 	return &Agent{
 		id:              peerID,
 		manager:         manager,
+		engine:          policy.NewPolicyEngine(),
 		serverURL:       serverURL,
+		token:           viper.GetString("server.token"),
+		secretDir:       secretDir,
+		pkiDir:          pkiDir,
 		syncInterval:    syncInterval,
 		healthInterval:  healthInterval,
 		currentTunnels:  make(map[string]ipsec.TunnelConfig),
@@ -132,12 +155,14 @@ func (a *Agent) Stop(ctx context.Context) error {
 // register registers the agent with the server
 func (a *Agent) register(ctx context.Context) error {
 	hostname, _ := os.Hostname()
+	addresses := localAddresses()
 	
 	peerInfo := policy.PeerInfo{
 		ID:           a.id,
 		Hostname:     hostname,
 		Platform:     runtime.GOOS,
-		IPAddress:    a.getLocalIP(),
+		IPAddress:    primaryAddress(addresses),
+		Addresses:    addresses,
 		Version:      "0.1.0", // TODO: Get from build info
 		RegisteredAt: time.Now(),
 		LastSeenAt:   time.Now(),
@@ -148,7 +173,20 @@ func (a *Agent) register(ctx context.Context) error {
 		},
 	}
 
-	jsonData, err := json.Marshal(peerInfo)
+	// Ask the server's CA for a certificate along with registering
+	request := struct {
+		policy.PeerInfo
+		CSR string `json:"csr,omitempty"`
+	}{PeerInfo: peerInfo}
+	var keyPEM string
+	if a.enrolls() && a.certificateDue(ctx) {
+		var err error
+		if keyPEM, request.CSR, err = policy.NewPeerKey(a.id); err != nil {
+			log.Warn().Err(err).Msg("Failed to generate key, registering without a CSR")
+		}
+	}
+
+	jsonData, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("failed to marshal peer info: %w", err)
 	}
@@ -159,6 +197,7 @@ func (a *Agent) register(ctx context.Context) error {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	a.authorize(req)
 
 	resp, err := a.httpClient.Do(req)
 	if err != nil {
@@ -172,6 +211,23 @@ func (a *Agent) register(ctx context.Context) error {
 	}
 
 	log.Info().Str("peer_id", a.id).Msg("Registered with server")
+
+	if request.CSR != "" {
+		var registered struct {
+			Certificate      *policy.IssuedCertificate `json:"certificate"`
+			CertificateError string                    `json:"certificate_error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+			return fmt.Errorf("failed to decode registration: %w", err)
+		}
+		if registered.Certificate == nil {
+			log.Warn().Str("error", registered.CertificateError).Msg("Server did not issue a certificate")
+			return nil
+		}
+		if err := a.saveCertificate(keyPEM, registered.Certificate); err != nil {
+			log.Error().Err(err).Msg("Failed to install certificate")
+		}
+	}
 	return nil
 }
 
@@ -179,11 +235,17 @@ func (a *Agent) register(ctx context.Context) error {
 func (a *Agent) syncPolicies(ctx context.Context) error {
 	log.Debug().Msg("Syncing policies")
 
+	// Renew the certificate first, so tunnels are configured with the new one
+	if err := a.renewCertificate(ctx); err != nil {
+		log.Warn().Err(err).Msg("Failed to renew certificate")
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "GET", 
 		fmt.Sprintf("%s/api/policies?peer_id=%s", a.serverURL, a.id), nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
+	a.authorize(req)
 
 	resp, err := a.httpClient.Do(req)
 	if err != nil {
@@ -192,7 +254,8 @@ func (a *Agent) syncPolicies(ctx context.Context) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to fetch policies: %s", resp.Status)
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to fetch policies: %s: %s", resp.Status, body)
 	}
 
 	var policies []policy.Policy
@@ -211,23 +274,33 @@ func (a *Agent) syncPolicies(ctx context.Context) error {
 	a.currentPolicies = policies
 	a.mu.Unlock()
 
+	// Let staged rollouts know which versions were applied
+	a.checkHealth(ctx)
+
 	return nil
 }
 
 // applyPolicies applies the fetched policies
 func (a *Agent) applyPolicies(ctx context.Context, policies []policy.Policy) error {
-	// Extract all tunnel configurations
+	// Merge tunnel configurations using the same precedence rules as the server
+	merged := a.engine.MergeTunnels(policies)
+	for _, conflict := range merged.Conflicts {
+		log.Warn().
+			Str("tunnel", conflict.Tunnel).
+			Str("policy_id", conflict.PolicyID).
+			Strs("overridden", conflict.Overridden).
+			Msg("Tunnel defined by multiple policies")
+	}
+
 	var desiredTunnels = make(map[string]ipsec.TunnelConfig)
-	
-	for _, pol := range policies {
-		if !pol.Enabled {
-			continue
-		}
-		for _, tunnel := range pol.Tunnels {
-			desiredTunnels[tunnel.Name] = tunnel
-		}
+	for _, tunnel := range merged.Tunnels {
+		desiredTunnels[tunnel.Name] = tunnel
 	}
 
+	a.mu.RLock()
+	previous := a.currentTunnels
+	a.mu.RUnlock()
+
 	// Get current tunnels
 	currentTunnels, err := a.manager.ListTunnels(ctx)
 	if err != nil {
@@ -240,18 +313,52 @@ func (a *Agent) applyPolicies(ctx context.Context, policies []policy.Policy) err
 	}
 
 	// Create or update tunnels
+	applyErrors := make(map[string]string)
 	for name, tunnel := range desiredTunnels {
+		// PSKs kept on this host are read here and never sent to the server
+		if tunnel.Auth.Type == ipsec.AuthPSK && tunnel.Auth.SecretRef != "" && tunnel.Auth.Secret == "" {
+			secret, err := a.resolveSecretRef(tunnel.Auth.SecretRef)
+			if err != nil {
+				log.Error().Err(err).Str("tunnel", name).Msg("Failed to resolve the tunnel's PSK")
+				applyErrors[name] = fmt.Sprintf("secret_ref %s: %v", tunnel.Auth.SecretRef, err)
+				continue
+			}
+			tunnel.Auth.Secret = secret
+			desiredTunnels[name] = tunnel
+		}
+
+		// Certificates from the server's CA are kept in the PKI directory
+		if tunnel.Auth.Type == ipsec.AuthCertificate && tunnel.Auth.Issuer == ipsec.IssuerBuiltin {
+			if err := a.builtinCertificate(&tunnel.Auth); err != nil {
+				log.Error().Err(err).Str("tunnel", name).Msg("No certificate for the tunnel")
+				applyErrors[name] = fmt.Sprintf("issuer %s: %v", ipsec.IssuerBuiltin, err)
+				continue
+			}
+			desiredTunnels[name] = tunnel
+		}
+
+		// Without the agent token the server sends secrets redacted
+		if tunnel.Auth.Type == ipsec.AuthPSK && tunnel.Auth.Secret == policy.RedactedSecret {
+			log.Error().Str("tunnel", name).Msg("Server withheld the tunnel's PSK, check the agent token")
+			applyErrors[name] = "PSK withheld by the server: the agent token is missing or not configured on the server"
+			continue
+		}
+
 		if currentNames[name] {
 			// Update existing
 			if err := a.manager.UpdateTunnel(ctx, tunnel); err != nil {
-				log.Error().Err(err).Str("tunnel", name).Msg("Failed to update tunnel")
+				message := applyError(err, tunnel)
+				log.Error().Str("error", message).Str("tunnel", name).Msg("Failed to update tunnel")
+				applyErrors[name] = message
 				continue
 			}
 			log.Info().Str("tunnel", name).Msg("Updated tunnel")
 		} else {
 			// Create new
 			if err := a.manager.CreateTunnel(ctx, tunnel); err != nil {
-				log.Error().Err(err).Str("tunnel", name).Msg("Failed to create tunnel")
+				message := applyError(err, tunnel)
+				log.Error().Str("error", message).Str("tunnel", name).Msg("Failed to create tunnel")
+				applyErrors[name] = message
 				continue
 			}
 			log.Info().Str("tunnel", name).Msg("Created tunnel")
@@ -269,13 +376,65 @@ func (a *Agent) applyPolicies(ctx context.Context, policies []policy.Policy) err
 		}
 	}
 
+	// A tunnel that failed to apply keeps its previous configuration while
+	// the backend still has it, and is otherwise left out until a later sync
+	// applies it, so the watchdog does not start a tunnel that is not there
+	applied := make(map[string]ipsec.TunnelConfig, len(desiredTunnels))
+	for name, tunnel := range desiredTunnels {
+		if _, failed := applyErrors[name]; !failed {
+			applied[name] = tunnel
+		} else if prev, ok := previous[name]; ok && currentNames[name] {
+			applied[name] = prev
+		}
+	}
+
 	a.mu.Lock()
-	a.currentTunnels = desiredTunnels
+	a.currentTunnels = applied
+	a.tunnelSources = merged.Sources
+	a.applyErrors = applyErrors
 	a.mu.Unlock()
 
 	return nil
 }
 
+// resolveSecretRef reads a PSK the policy leaves to the agent
+func (a *Agent) resolveSecretRef(value string) (string, error) {
+	ref, err := policy.ParseSecretRef(value)
+	if err != nil {
+		return "", err
+	}
+	if !ref.Agent {
+		return "", fmt.Errorf("the server resolves this reference but sent no PSK")
+	}
+	return ref.ReadLocal(a.secretDir)
+}
+
+// applyError returns the message of an error configuring a tunnel with the
+// tunnel's secrets masked, as tool output may quote the configuration
+func applyError(err error, tunnel ipsec.TunnelConfig) string {
+	message := err.Error()
+	for _, secret := range []string{tunnel.Auth.Secret, tunnel.Auth.StandbySecret} {
+		if secret != "" {
+			message = strings.ReplaceAll(message, secret, policy.RedactedSecret)
+		}
+	}
+	return message
+}
+
+// holdsStandbySecret reports whether the platform's backend configures the
+// standby PSK of a tunnel being rotated
+func (a *Agent) holdsStandbySecret() bool {
+	caps, ok := policy.LookupPlatformCapabilities(runtime.GOOS)
+	return ok && caps.Rotation
+}
+
+// authorize adds the agent token to a request to the server
+func (a *Agent) authorize(req *http.Request) {
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+}
+
 // policySyncLoop periodically syncs policies
 func (a *Agent) policySyncLoop(ctx context.Context) {
 	defer a.wg.Done()
@@ -316,26 +475,95 @@ func (a *Agent) healthCheckLoop(ctx context.Context) {
 	}
 }
 
-// checkHealth checks the health of all tunnels
+// checkHealth checks the health of all tunnels and reports it to the server
 func (a *Agent) checkHealth(ctx context.Context) {
 	a.mu.RLock()
 	tunnels := make(map[string]ipsec.TunnelConfig)
 	for k, v := range a.currentTunnels {
 		tunnels[k] = v
 	}
+	report := policy.PeerReport{
+		PeerID:   a.id,
+		Policies: make(map[string]int, len(a.currentPolicies)),
+	}
+	for _, pol := range a.currentPolicies {
+		report.Policies[pol.ID] = pol.Version
+	}
+	sources := a.tunnelSources
+	applyErrors := a.applyErrors
 	a.mu.RUnlock()
 
-	for name := range tunnels {
+	// Tunnels that were never applied are still reported, with their error
+	for name := range applyErrors {
+		if _, ok := tunnels[name]; !ok {
+			tunnels[name] = ipsec.TunnelConfig{Name: name}
+		}
+	}
+
+	for name, config := range tunnels {
+		tunnel := policy.TunnelReport{
+			Name:      name,
+			PolicyID:  sources[name],
+			AutoStart: config.AutoStartEnabled(),
+		}
+
 		status, err := a.manager.GetTunnelStatus(ctx, name)
-		if err != nil {
-			log.Warn().Err(err).Str("tunnel", name).Msg("Failed to get tunnel status")
-			continue
+		// A rotation step counts as applied once the tunnel was configured
+		// with it, which needs a backend that accepts the standby PSK
+		if applyErrors[name] == "" && (config.Auth.StandbySecret == "" || a.holdsStandbySecret()) {
+			tunnel.Rotation = config.Auth.Rotation
 		}
 
-		if status.State == ipsec.StateError {
-			log.Error().Str("tunnel", name).Str("error", status.ErrorMessage).Msg("Tunnel in error state")
+		switch {
+		case applyErrors[name] != "":
+			tunnel.State = ipsec.StateError
+			tunnel.Error = applyErrors[name]
+		case err != nil:
+			log.Warn().Err(err).Str("tunnel", name).Msg("Failed to get tunnel status")
+			tunnel.State = ipsec.StateError
+			tunnel.Error = err.Error()
+		default:
+			tunnel.State = status.State
+			tunnel.Error = status.ErrorMessage
+			if status.State == ipsec.StateError {
+				log.Error().Str("tunnel", name).Str("error", status.ErrorMessage).Msg("Tunnel in error state")
+			}
 		}
+		report.Tunnels = append(report.Tunnels, tunnel)
+	}
+
+	if err := a.report(ctx, &report); err != nil {
+		log.Warn().Err(err).Msg("Failed to report tunnel health")
+	}
+}
+
+// report sends the applied policy versions and tunnel health to the server
+func (a *Agent) report(ctx context.Context, report *policy.PeerReport) error {
+	jsonData, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("%s/api/peers/%s/report", a.serverURL, a.id), bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	a.authorize(req)
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send report: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("report rejected: %s: %s", resp.Status, body)
+	}
+
+	return nil
 }
 
 // watchdogLoop monitors and restarts failed tunnels
@@ -367,7 +595,7 @@ func (a *Agent) watchdogCheck(ctx context.Context) {
 	a.mu.RUnlock()
 
 	for name, config := range tunnels {
-		if !config.AutoStart {
+		if !config.AutoStartEnabled() {
 			continue
 		}
 
@@ -388,10 +616,41 @@ func (a *Agent) watchdogCheck(ctx context.Context) {
 	}
 }
 
-// getLocalIP attempts to get the local IP address
-func (a *Agent) getLocalIP() string {
-	// Simplified implementation - in production, use proper network detection
-	return "127.0.0.1"
+// localAddresses returns the host's unicast addresses, IPv4 before IPv6.
+// Loopback and link-local addresses cannot be tunnel endpoints and are left
+// out.
+func localAddresses() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list interface addresses")
+		return nil
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		ips = append(ips, ipnet.IP)
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return ips[i].To4() != nil && ips[j].To4() == nil
+	})
+
+	addresses := make([]string, len(ips))
+	for i, ip := range ips {
+		addresses[i] = ip.String()
+	}
+	return addresses
+}
+
+// primaryAddress picks the address the agent registers as its own
+func primaryAddress(addresses []string) string {
+	if len(addresses) == 0 {
+		return "127.0.0.1"
+	}
+	return addresses[0]
 }
 
 // Service wraps the agent as a system service
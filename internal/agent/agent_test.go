@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// fakeManager keeps tunnels in memory and can be told to fail updates
+type fakeManager struct {
+	tunnels    map[string]ipsec.TunnelConfig
+	failUpdate bool
+	started    []string
+}
+
+func (m *fakeManager) CreateTunnel(ctx context.Context, config ipsec.TunnelConfig) error {
+	m.tunnels[config.Name] = config
+	return nil
+}
+
+func (m *fakeManager) DeleteTunnel(ctx context.Context, name string) error {
+	delete(m.tunnels, name)
+	return nil
+}
+
+func (m *fakeManager) UpdateTunnel(ctx context.Context, config ipsec.TunnelConfig) error {
+	if m.failUpdate {
+		return errors.New("backend refused the update")
+	}
+	m.tunnels[config.Name] = config
+	return nil
+}
+
+func (m *fakeManager) StartTunnel(ctx context.Context, name string) error {
+	m.started = append(m.started, name)
+	return nil
+}
+
+func (m *fakeManager) StopTunnel(ctx context.Context, name string) error { return nil }
+
+func (m *fakeManager) GetTunnelStatus(ctx context.Context, name string) (*ipsec.TunnelStatus, error) {
+	if _, ok := m.tunnels[name]; !ok {
+		return nil, errors.New("tunnel not found")
+	}
+	return &ipsec.TunnelStatus{Name: name, State: ipsec.StateDown}, nil
+}
+
+func (m *fakeManager) ListTunnels(ctx context.Context) ([]ipsec.TunnelStatus, error) {
+	var list []ipsec.TunnelStatus
+	for name := range m.tunnels {
+		list = append(list, ipsec.TunnelStatus{Name: name})
+	}
+	return list, nil
+}
+
+func (m *fakeManager) GetStatistics(ctx context.Context, name string) (*ipsec.TrafficStats, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *fakeManager) GetSAInfo(ctx context.Context, name string) ([]ipsec.SAInfo, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *fakeManager) ValidateConfig(config ipsec.TunnelConfig) error { return nil }
+func (m *fakeManager) Initialize(ctx context.Context) error           { return nil }
+func (m *fakeManager) Cleanup(ctx context.Context) error              { return nil }
+
+func TestApplyPoliciesTracksAppliedTunnels(t *testing.T) {
+	ctx := context.Background()
+	secretDir := t.TempDir()
+	manager := &fakeManager{tunnels: make(map[string]ipsec.TunnelConfig)}
+
+	var reports []policy.PeerReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report policy.PeerReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("decoding report: %v", err)
+		}
+		reports = append(reports, report)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	a := &Agent{
+		id:             "peer-1",
+		manager:        manager,
+		engine:         policy.NewPolicyEngine(),
+		serverURL:      server.URL,
+		secretDir:      secretDir,
+		currentTunnels: make(map[string]ipsec.TunnelConfig),
+		httpClient:     server.Client(),
+	}
+
+	autoStart := true
+	tunnel := func(name, remote string, auth ipsec.AuthConfig) ipsec.TunnelConfig {
+		return ipsec.TunnelConfig{Name: name, Mode: ipsec.ModeESPTunnel, RemoteAddress: remote, Auth: auth, AutoStart: &autoStart}
+	}
+	secretFile := filepath.Join(secretDir, "b")
+	policies := func(remote string) []policy.Policy {
+		return []policy.Policy{{ID: "p", Enabled: true, Tunnels: []ipsec.TunnelConfig{
+			tunnel("a", remote, ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: "inline-secret"}),
+			tunnel("b", "198.51.100.2", ipsec.AuthConfig{Type: ipsec.AuthPSK, SecretRef: "agent:file:" + secretFile}),
+		}}}
+	}
+
+	// The secret file is missing, so b cannot be applied
+	if err := a.applyPolicies(ctx, policies("198.51.100.1")); err != nil {
+		t.Fatalf("applyPolicies: %v", err)
+	}
+	if _, ok := a.currentTunnels["b"]; ok {
+		t.Error("tunnel b is tracked although it was not applied")
+	}
+	if _, ok := a.currentTunnels["a"]; !ok || a.applyErrors["b"] == "" {
+		t.Errorf("tracked %v with errors %v, want a tracked and b failed", a.currentTunnels, a.applyErrors)
+	}
+
+	// The watchdog leaves the missing tunnel alone, and health reports it
+	a.watchdogCheck(ctx)
+	if len(manager.started) != 1 || manager.started[0] != "a" {
+		t.Errorf("watchdog started %v, want a only", manager.started)
+	}
+	a.checkHealth(ctx)
+	if len(reports) != 1 || len(reports[0].Tunnels) != 2 {
+		t.Fatalf("reports %+v, want one with both tunnels", reports)
+	}
+	for _, report := range reports[0].Tunnels {
+		if report.Name == "b" && (report.State != ipsec.StateError || report.Error == "" || report.PolicyID != "p") {
+			t.Errorf("tunnel b reported as %+v", report)
+		}
+	}
+
+	// Once the secret is there, the next sync applies it
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.applyPolicies(ctx, policies("198.51.100.1")); err != nil {
+		t.Fatalf("applyPolicies: %v", err)
+	}
+	if b, ok := a.currentTunnels["b"]; !ok || b.Auth.Secret != "file-secret" || len(a.applyErrors) != 0 {
+		t.Errorf("tunnel b tracked as %+v with errors %v", b, a.applyErrors)
+	}
+	if manager.tunnels["b"].Auth.Secret != "file-secret" {
+		t.Error("tunnel b was not created with the secret")
+	}
+
+	// A failed update keeps the configuration the backend still runs
+	manager.failUpdate = true
+	if err := a.applyPolicies(ctx, policies("198.51.100.9")); err != nil {
+		t.Fatalf("applyPolicies: %v", err)
+	}
+	if a.currentTunnels["a"].RemoteAddress != "198.51.100.1" || a.applyErrors["a"] == "" {
+		t.Errorf("tunnel a tracked as %+v with errors %v, want the previous configuration", a.currentTunnels["a"], a.applyErrors)
+	}
+}
@@ -0,0 +1,311 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// Tunnels with "issuer: builtin" authenticate with a certificate from the
+// server's CA. The agent keeps its key, certificate and the CA certificate
+// in the PKI directory. The key is generated here and never leaves the
+// host: the agent sends a CSR when it registers, and again with a new key
+// before each policy sync that finds its certificate missing, expired,
+// revoked or two thirds through its lifetime. The new key replaces the old
+// one only once the server has issued its certificate.
+//
+// Each certificate is written with its key to a directory of its own, and
+// the "current" symlink, which tunnel configurations point through, is
+// switched to it with a single rename, so the key and certificate in use
+// always belong together. The previous directory is kept until the next
+// renewal.
+
+// DefaultPKIDir is the directory the agent keeps its certificate in unless
+// configured otherwise
+const DefaultPKIDir = "/etc/ipsec/pki"
+
+// Files in the PKI directory
+const (
+	currentLink  = "current" // Symlink to the directory in use
+	certDirGlob  = "cert-*"  // Directories named after their certificate's serial
+	peerKeyFile  = "peer.key"
+	peerCertFile = "peer.crt"
+	caCertFile   = "ca.crt"
+)
+
+// errCertificateUnknown is returned when the server did not issue a
+// certificate, as when it has a different CA
+var errCertificateUnknown = errors.New("certificate not issued by the server")
+
+// enrolls reports whether the agent requests certificates from the
+// server's CA: it needs the agent token, and a platform whose backend can
+// use them
+func (a *Agent) enrolls() bool {
+	if a.token == "" {
+		return false
+	}
+	caps, ok := policy.LookupPlatformCapabilities(runtime.GOOS)
+	if !ok {
+		return false
+	}
+	for _, issuer := range caps.Issuers {
+		if issuer == ipsec.IssuerBuiltin {
+			return true
+		}
+	}
+	return false
+}
+
+// pkiPath returns the path of a file in the directory in use
+func (a *Agent) pkiPath(name string) string {
+	return filepath.Join(a.pkiDir, currentLink, name)
+}
+
+// loadCertificate reads the agent's certificate and checks that its key
+// belongs to it
+func (a *Agent) loadCertificate() (*x509.Certificate, error) {
+	data, err := os.ReadFile(a.pkiPath(peerCertFile))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := policy.ParseCertificatePEM(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := os.ReadFile(a.pkiPath(peerKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.CheckKeyPair(cert, string(key)); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// certificateDue reports whether the agent needs a new certificate
+func (a *Agent) certificateDue(ctx context.Context) bool {
+	cert, err := a.loadCertificate()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Msg("Certificate is unusable")
+		}
+		return true
+	}
+	if policy.CertificateDue(cert, time.Now()) {
+		return true
+	}
+
+	issued, err := a.fetchCertificate(ctx, cert.SerialNumber.Text(16))
+	if errors.Is(err, errCertificateUnknown) {
+		log.Warn().Str("serial", cert.SerialNumber.Text(16)).Msg("Server does not know the certificate")
+		return true
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to check certificate revocation")
+		return false
+	}
+	if issued.RevokedAt != nil {
+		log.Warn().Str("serial", issued.Serial).Str("reason", issued.RevocationReason).Msg("Certificate was revoked")
+		return true
+	}
+	return false
+}
+
+// fetchCertificate reads an issued certificate from the server
+func (a *Agent) fetchCertificate(ctx context.Context, serial string) (*policy.IssuedCertificate, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s/api/certificates/%s", a.serverURL, serial), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	a.authorize(req)
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errCertificateUnknown
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to fetch certificate: %s: %s", resp.Status, body)
+	}
+
+	var issued policy.IssuedCertificate
+	if err := json.NewDecoder(resp.Body).Decode(&issued); err != nil {
+		return nil, fmt.Errorf("failed to decode certificate: %w", err)
+	}
+	return &issued, nil
+}
+
+// renewCertificate requests a new certificate if the current one is due
+func (a *Agent) renewCertificate(ctx context.Context) error {
+	if !a.enrolls() || !a.certificateDue(ctx) {
+		return nil
+	}
+
+	keyPEM, csrPEM, err := policy.NewPeerKey(a.id)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	jsonData, err := json.Marshal(map[string]string{"csr": csrPEM})
+	if err != nil {
+		return fmt.Errorf("failed to marshal CSR: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("%s/api/peers/%s/certificate", a.serverURL, a.id), bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.authorize(req)
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("certificate request rejected: %s: %s", resp.Status, body)
+	}
+
+	var issued policy.IssuedCertificate
+	if err := json.NewDecoder(resp.Body).Decode(&issued); err != nil {
+		return fmt.Errorf("failed to decode certificate: %w", err)
+	}
+	return a.saveCertificate(keyPEM, &issued)
+}
+
+// saveCertificate writes a new key with the certificate issued for it to
+// a directory of their own and switches the current symlink to it
+func (a *Agent) saveCertificate(keyPEM string, issued *policy.IssuedCertificate) error {
+	if err := os.MkdirAll(a.pkiDir, 0700); err != nil {
+		return fmt.Errorf("failed to create PKI directory: %w", err)
+	}
+
+	name := "cert-" + issued.Serial
+	dir := filepath.Join(a.pkiDir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear %s: %w", dir, err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	files := []struct {
+		name string
+		data string
+		perm os.FileMode
+	}{
+		{caCertFile, issued.Chain, 0644},
+		{peerCertFile, issued.Certificate, 0644},
+		{peerKeyFile, keyPEM, 0600},
+	}
+	for _, file := range files {
+		if err := writeFileSynced(filepath.Join(dir, file.name), []byte(file.data), file.perm); err != nil {
+			return err
+		}
+	}
+
+	previous, _ := os.Readlink(filepath.Join(a.pkiDir, currentLink))
+	if err := switchSymlink(filepath.Join(a.pkiDir, currentLink), name); err != nil {
+		return err
+	}
+	a.removeCertificateDirs(name, previous)
+
+	log.Info().
+		Str("serial", issued.Serial).
+		Time("not_after", issued.NotAfter).
+		Msg("Installed certificate from the server's CA")
+	return nil
+}
+
+// removeCertificateDirs deletes the certificate directories other than the
+// ones named
+func (a *Agent) removeCertificateDirs(keep ...string) {
+	dirs, _ := filepath.Glob(filepath.Join(a.pkiDir, certDirGlob))
+	for _, dir := range dirs {
+		if slices.Contains(keep, filepath.Base(dir)) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warn().Err(err).Str("dir", dir).Msg("Failed to remove old certificate")
+		}
+	}
+}
+
+// builtinCertificate fills in the paths of a tunnel authenticating with the
+// certificate from the server's CA
+func (a *Agent) builtinCertificate(auth *ipsec.AuthConfig) error {
+	if !a.enrolls() {
+		return fmt.Errorf("this agent does not request certificates: it needs the agent token and a platform that supports issuer %s", ipsec.IssuerBuiltin)
+	}
+	cert, err := a.loadCertificate()
+	if err != nil {
+		return fmt.Errorf("no certificate from the server's CA yet: %w", err)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("certificate %s expired at %s", cert.SerialNumber.Text(16), cert.NotAfter.Format(time.RFC3339))
+	}
+
+	auth.CertPath = a.pkiPath(peerCertFile)
+	auth.KeyPath = a.pkiPath(peerKeyFile)
+	auth.CACertPath = a.pkiPath(caCertFile)
+	return nil
+}
+
+// writeFileSynced writes a new file and flushes it to disk, so that it is
+// complete before anything points to it
+func writeFileSynced(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// switchSymlink points a symlink at target, replacing it in one rename
+func switchSymlink(link, target string) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", link, os.Getpid())
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("failed to link %s: %w", link, err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to link %s: %w", link, err)
+	}
+	return nil
+}
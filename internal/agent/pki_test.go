@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// issue has a new CA sign a certificate for a new peer key
+func issue(t *testing.T, ca *policy.CertificateAuthority) (string, *policy.IssuedCertificate) {
+	t.Helper()
+	keyPEM, csrPEM, err := policy.NewPeerKey("peer-1")
+	if err != nil {
+		t.Fatalf("NewPeerKey: %v", err)
+	}
+	issued, err := ca.Issue(csrPEM, &policy.PeerInfo{ID: "peer-1"}, policy.IssueOptions{Validity: 24 * time.Hour}, time.Now())
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	return keyPEM, issued
+}
+
+func TestSaveCertificate(t *testing.T) {
+	pair, err := policy.GenerateCA("test CA", time.Now())
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	ca, err := policy.LoadCA(pair)
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	a := &Agent{pkiDir: t.TempDir()}
+
+	if _, err := a.loadCertificate(); !os.IsNotExist(err) {
+		t.Fatalf("loadCertificate before enrolling: %v, want not exist", err)
+	}
+
+	// Each renewal switches to a new directory, keeping the previous one
+	var serials []string
+	for i := 0; i < 3; i++ {
+		keyPEM, issued := issue(t, ca)
+		if err := a.saveCertificate(keyPEM, issued); err != nil {
+			t.Fatalf("saveCertificate: %v", err)
+		}
+		serials = append(serials, issued.Serial)
+
+		cert, err := a.loadCertificate()
+		if err != nil {
+			t.Fatalf("loadCertificate: %v", err)
+		}
+		if cert.SerialNumber.Text(16) != issued.Serial {
+			t.Errorf("loaded certificate %s, want %s", cert.SerialNumber.Text(16), issued.Serial)
+		}
+	}
+
+	target, err := os.Readlink(filepath.Join(a.pkiDir, currentLink))
+	if err != nil || target != "cert-"+serials[2] {
+		t.Errorf("current links to %q (%v), want cert-%s", target, err, serials[2])
+	}
+	dirs, _ := filepath.Glob(filepath.Join(a.pkiDir, certDirGlob))
+	want := []string{"cert-" + serials[1], "cert-" + serials[2]}
+	slices.Sort(want)
+	var got []string
+	for _, dir := range dirs {
+		got = append(got, filepath.Base(dir))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("certificate directories %v, want %v", got, want)
+	}
+	info, err := os.Stat(a.pkiPath(peerKeyFile))
+	if err != nil {
+		t.Fatalf("key file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestLoadCertificateKeyMismatch(t *testing.T) {
+	pair, err := policy.GenerateCA("test CA", time.Now())
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	ca, err := policy.LoadCA(pair)
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	a := &Agent{pkiDir: t.TempDir()}
+
+	keyPEM, issued := issue(t, ca)
+	if err := a.saveCertificate(keyPEM, issued); err != nil {
+		t.Fatalf("saveCertificate: %v", err)
+	}
+
+	// A key left over from another certificate is not used
+	otherKey, _ := issue(t, ca)
+	if err := os.WriteFile(a.pkiPath(peerKeyFile), []byte(otherKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.loadCertificate(); err == nil || !strings.Contains(err.Error(), "key does not match") {
+		t.Errorf("loadCertificate with a mismatched key: %v", err)
+	}
+}
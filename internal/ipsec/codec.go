@@ -0,0 +1,222 @@
+package ipsec
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CryptoConfig.Lifetime, DPDConfig.Delay and the SAConfig durations are
+// written as Go duration strings ("1h0m0s", "30s") in both JSON and YAML. Either format also accepts
+// an integer number of nanoseconds, which is how JSON clients and stored
+// policies encoded them before, so "lifetime": 3600000000000 and
+// lifetime: "1h" mean the same. yaml.v3 already writes durations as strings,
+// so only decoding needs help there.
+
+func (c CryptoConfig) MarshalJSON() ([]byte, error) {
+	type plain CryptoConfig
+	return json.Marshal(struct {
+		plain
+		Lifetime string `json:"lifetime"`
+	}{plain(c), c.Lifetime.String()})
+}
+
+func (c *CryptoConfig) UnmarshalJSON(data []byte) error {
+	type plain CryptoConfig
+	aux := struct {
+		*plain
+		Lifetime json.RawMessage `json:"lifetime"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	lifetime, err := jsonDuration(aux.Lifetime)
+	if err != nil {
+		return fmt.Errorf("lifetime: %w", err)
+	}
+	c.Lifetime = lifetime
+	return nil
+}
+
+func (c *CryptoConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain CryptoConfig
+	lifetime, rest, err := takeYAMLDuration(value, "lifetime")
+	if err != nil {
+		return err
+	}
+	if err := rest.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.Lifetime = lifetime
+	return nil
+}
+
+func (d DPDConfig) MarshalJSON() ([]byte, error) {
+	type plain DPDConfig
+	return json.Marshal(struct {
+		plain
+		Delay string `json:"delay"`
+	}{plain(d), d.Delay.String()})
+}
+
+func (d *DPDConfig) UnmarshalJSON(data []byte) error {
+	type plain DPDConfig
+	aux := struct {
+		*plain
+		Delay json.RawMessage `json:"delay"`
+	}{plain: (*plain)(d)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	delay, err := jsonDuration(aux.Delay)
+	if err != nil {
+		return fmt.Errorf("delay: %w", err)
+	}
+	d.Delay = delay
+	return nil
+}
+
+func (d *DPDConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain DPDConfig
+	delay, rest, err := takeYAMLDuration(value, "delay")
+	if err != nil {
+		return err
+	}
+	if err := rest.Decode((*plain)(d)); err != nil {
+		return err
+	}
+	d.Delay = delay
+	return nil
+}
+
+func (s SAConfig) MarshalJSON() ([]byte, error) {
+	type plain SAConfig
+	aux := struct {
+		plain
+		Lifetime    string `json:"lifetime,omitempty"`
+		RekeyMargin string `json:"rekey_margin,omitempty"`
+	}{plain: plain(s)}
+	if s.Lifetime != 0 {
+		aux.Lifetime = s.Lifetime.String()
+	}
+	if s.RekeyMargin != 0 {
+		aux.RekeyMargin = s.RekeyMargin.String()
+	}
+	return json.Marshal(aux)
+}
+
+func (s *SAConfig) UnmarshalJSON(data []byte) error {
+	type plain SAConfig
+	aux := struct {
+		*plain
+		Lifetime    json.RawMessage `json:"lifetime"`
+		RekeyMargin json.RawMessage `json:"rekey_margin"`
+	}{plain: (*plain)(s)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	lifetime, err := jsonDuration(aux.Lifetime)
+	if err != nil {
+		return fmt.Errorf("lifetime: %w", err)
+	}
+	margin, err := jsonDuration(aux.RekeyMargin)
+	if err != nil {
+		return fmt.Errorf("rekey_margin: %w", err)
+	}
+	s.Lifetime, s.RekeyMargin = lifetime, margin
+	return nil
+}
+
+func (s *SAConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain SAConfig
+	lifetime, rest, err := takeYAMLDuration(value, "lifetime")
+	if err != nil {
+		return err
+	}
+	margin, rest, err := takeYAMLDuration(rest, "rekey_margin")
+	if err != nil {
+		return err
+	}
+	if err := rest.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	s.Lifetime, s.RekeyMargin = lifetime, margin
+	return nil
+}
+
+// jsonDuration decodes a duration string or integer nanoseconds; a missing
+// or null value is zero
+func jsonDuration(raw json.RawMessage) (time.Duration, error) {
+	text := strings.TrimSpace(string(raw))
+	if text == "" || text == "null" {
+		return 0, nil
+	}
+
+	if strings.HasPrefix(text, `"`) {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return 0, err
+		}
+		return parseDuration(s)
+	}
+
+	ns, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is neither a duration string nor integer nanoseconds", text)
+	}
+	return time.Duration(ns), nil
+}
+
+// takeYAMLDuration decodes the duration under key in a mapping node and
+// returns a copy of the mapping without it, for decoding the other fields
+func takeYAMLDuration(value *yaml.Node, key string) (time.Duration, *yaml.Node, error) {
+	if value.Kind != yaml.MappingNode {
+		return 0, value, nil
+	}
+
+	rest := *value
+	rest.Content = make([]*yaml.Node, 0, len(value.Content))
+	var duration time.Duration
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		k, v := value.Content[i], value.Content[i+1]
+		if k.Value != key {
+			rest.Content = append(rest.Content, k, v)
+			continue
+		}
+
+		switch {
+		case v.Tag == "!!null":
+		case v.Kind == yaml.ScalarNode && v.Tag == "!!int":
+			ns, err := strconv.ParseInt(v.Value, 10, 64)
+			if err != nil {
+				return 0, nil, fmt.Errorf("line %d: %s: %w", v.Line, key, err)
+			}
+			duration = time.Duration(ns)
+		case v.Kind == yaml.ScalarNode:
+			d, err := parseDuration(v.Value)
+			if err != nil {
+				return 0, nil, fmt.Errorf("line %d: %s: %w", v.Line, key, err)
+			}
+			duration = d
+		default:
+			return 0, nil, fmt.Errorf("line %d: %s must be a duration", v.Line, key)
+		}
+	}
+
+	return duration, &rest, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,170 @@
+package ipsec
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestDurationJSON(t *testing.T) {
+	config := TunnelConfig{
+		Name: "t",
+		Crypto: CryptoConfig{
+			Lifetime: time.Hour,
+			IKE:      &SAConfig{Lifetime: 24 * time.Hour, RekeyMargin: 90 * time.Minute},
+			Child:    &SAConfig{Proposals: []Proposal{{Encryption: EncryptionAES256GCM}}},
+		},
+		DPD: DPDConfig{Delay: 30 * time.Second, Action: "restart"},
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, want := range []string{
+		`"lifetime":"1h0m0s"`,
+		`"ike":{"lifetime":"24h0m0s","rekey_margin":"1h30m0s"}`,
+		`"delay":"30s"`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("encoded tunnel %s does not contain %s", data, want)
+		}
+	}
+
+	// Unset SA durations are left out
+	var generic struct {
+		Crypto struct {
+			Child map[string]interface{} `json:"child"`
+		} `json:"crypto"`
+	}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	for _, key := range []string{"lifetime", "rekey_margin"} {
+		if _, ok := generic.Crypto.Child[key]; ok {
+			t.Errorf("encoded child SA %v has %s", generic.Crypto.Child, key)
+		}
+	}
+
+	var decoded TunnelConfig
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if decoded.Crypto.Lifetime != time.Hour || decoded.Crypto.IKE.RekeyMargin != 90*time.Minute ||
+		decoded.Crypto.Child.Proposals[0].Encryption != EncryptionAES256GCM || decoded.DPD.Delay != 30*time.Second {
+		t.Errorf("round trip gave %+v", decoded)
+	}
+}
+
+func TestDurationJSONDecode(t *testing.T) {
+	tests := []struct {
+		json string
+		want time.Duration
+		err  string
+	}{
+		{`{"lifetime":"1h"}`, time.Hour, ""},
+		{`{"lifetime":"90m"}`, 90 * time.Minute, ""},
+		{`{"lifetime":3600000000000}`, time.Hour, ""},
+		{`{"lifetime":null}`, 0, ""},
+		{`{}`, 0, ""},
+		{`{"lifetime":"1 hour"}`, 0, `lifetime: invalid duration "1 hour"`},
+		{`{"lifetime":1.5}`, 0, "neither a duration string nor integer nanoseconds"},
+		{`{"lifetime":true}`, 0, "neither a duration string nor integer nanoseconds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			var crypto CryptoConfig
+			err := json.Unmarshal([]byte(tt.json), &crypto)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Unmarshal(%s) error = %v, want %q", tt.json, err, tt.err)
+				}
+				return
+			}
+			if err != nil || crypto.Lifetime != tt.want {
+				t.Errorf("Unmarshal(%s) = %v, %v, want %v", tt.json, crypto.Lifetime, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationYAMLDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want time.Duration
+		err  string
+	}{
+		{"string", "lifetime: 1h\nencryption: aes256", time.Hour, ""},
+		{"quoted", `lifetime: "45s"`, 45 * time.Second, ""},
+		{"nanoseconds", "lifetime: 3600000000000", time.Hour, ""},
+		{"null", "lifetime: null", 0, ""},
+		{"missing", "encryption: aes256", 0, ""},
+		{"invalid", "encryption: aes256\nlifetime: soon", 0, `line 2: lifetime: invalid duration "soon"`},
+		{"list", "lifetime: [1h]", 0, "line 1: lifetime must be a duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var crypto CryptoConfig
+			err := yaml.Unmarshal([]byte(tt.yaml), &crypto)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Unmarshal error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || crypto.Lifetime != tt.want {
+				t.Errorf("Unmarshal = %v, %v, want %v", crypto.Lifetime, err, tt.want)
+			}
+			if strings.Contains(tt.yaml, "encryption") && crypto.Encryption != EncryptionAES256 {
+				t.Errorf("other fields were not decoded: %+v", crypto)
+			}
+		})
+	}
+}
+
+func TestDurationYAMLNested(t *testing.T) {
+	text := `
+name: t
+crypto:
+  lifetime: 1h
+  child:
+    lifetime: 30m
+    rekey_margin: 5m
+    proposals:
+      - encryption: aes128
+dpd:
+  delay: 10s
+  action: clear
+`
+	var config TunnelConfig
+	if err := yaml.Unmarshal([]byte(text), &config); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	child := config.Crypto.Child
+	if config.Crypto.Lifetime != time.Hour || child == nil || child.Lifetime != 30*time.Minute ||
+		child.RekeyMargin != 5*time.Minute || len(child.Proposals) != 1 {
+		t.Errorf("decoded crypto %+v, child %+v", config.Crypto, child)
+	}
+	if config.DPD.Delay != 10*time.Second || config.DPD.Action != "clear" {
+		t.Errorf("decoded DPD %+v", config.DPD)
+	}
+
+	// yaml.v3 writes durations as strings, which decode again
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var again TunnelConfig
+	if err := yaml.Unmarshal(data, &again); err != nil {
+		t.Fatalf("Unmarshal of %s: %v", data, err)
+	}
+	if again.Crypto.Child.RekeyMargin != 5*time.Minute || again.DPD.Delay != 10*time.Second {
+		t.Errorf("round trip of %s gave %+v", data, again)
+	}
+}
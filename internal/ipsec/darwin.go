@@ -69,52 +69,121 @@ func (m *DarwinManager) createRacoonConfig(config TunnelConfig) error {
 	// Production implementation should use VPN configuration profiles
 
 	configPath := filepath.Join(m.configDir, fmt.Sprintf("%s.conf", config.Name))
-	
-	configContent := fmt.Sprintf(`# IPsec tunnel configuration: %s
+
+	if err := os.WriteFile(configPath, []byte(m.buildRacoonConfig(config)), 0600); err != nil {
+		return fmt.Errorf("failed to write configuration: %w", err)
+	}
+
+	return nil
+}
+
+// buildRacoonConfig renders the racoon configuration of a tunnel
+func (m *DarwinManager) buildRacoonConfig(config TunnelConfig) string {
+	ike := config.Crypto.IKESA()
+	child := config.Crypto.ChildSA()
+
+	return fmt.Sprintf(`# IPsec tunnel configuration: %s
 remote %s {
 	exchange_mode main;
 	doi ipsec_doi;
 	situation identity_only;
-	
 	%s
-	
+	%s
+%s}
+%s`,
+		config.Name,
+		config.RemoteAddress,
+		m.buildLifetime(ike.Lifetime),
+		m.buildAuthConfig(config.Auth),
+		m.buildProposals(ike, config.Auth.Type),
+		m.buildSAInfo(config.TrafficSelectors, child),
+	)
+}
+
+// buildProposals renders one phase 1 proposal block per IKE proposal; racoon
+// offers them in the order they appear
+func (m *DarwinManager) buildProposals(ike SAConfig, authType AuthType) string {
+	var b strings.Builder
+	for _, p := range ike.Proposals {
+		fmt.Fprintf(&b, `
 	proposal {
 		encryption_algorithm %s;
 		hash_algorithm %s;
 		authentication_method %s;
 		dh_group %s;
 	}
+`, m.convertEncryption(p.Encryption), m.convertIntegrity(p.Integrity), m.convertAuthMethod(authType), m.convertDHGroup(p.DHGroup))
+	}
+	return b.String()
 }
 
-sainfo address %s any address %s any {
-	pfs_group %s;
+// buildSAInfo renders one phase 2 block per traffic selector. racoon takes
+// IPv4 and IPv6 subnets in the same syntax, so selectors of both families
+// can share a tunnel.
+func (m *DarwinManager) buildSAInfo(selectors []TrafficSelector, child SAConfig) string {
+	var b strings.Builder
+	for _, ts := range selectors {
+		fmt.Fprintf(&b, `
+sainfo address %s %s address %s %s {
+	%s
+	%s
 	encryption_algorithm %s;
 	authentication_algorithm %s;
 	compression_algorithm deflate;
 }
 `,
-		config.Name,
-		config.RemoteAddress,
-		m.buildAuthConfig(config.Auth),
-		m.convertEncryption(config.Crypto.Encryption),
-		m.convertIntegrity(config.Crypto.Integrity),
-		m.convertAuthMethod(config.Auth.Type),
-		m.convertDHGroup(config.Crypto.DHGroup),
-		config.LocalAddress,
-		config.RemoteAddress,
-		m.convertDHGroup(config.Crypto.DHGroup),
-		m.convertEncryption(config.Crypto.Encryption),
-		m.convertIntegrity(config.Crypto.Integrity),
-	)
+			m.convertSelector(ts.LocalSubnet, ts.LocalPort), m.convertProtocol(ts.Protocol),
+			m.convertSelector(ts.RemoteSubnet, ts.RemotePort), m.convertProtocol(ts.Protocol),
+			m.buildPFSGroup(child),
+			m.buildLifetime(child.Lifetime),
+			m.joinUnique(child.Proposals, func(p Proposal) string { return m.convertEncryption(p.Encryption) }),
+			m.joinUnique(child.Proposals, func(p Proposal) string { return m.convertIntegrity(p.Integrity) }),
+		)
+	}
+	return b.String()
+}
 
-	if err := os.WriteFile(configPath, []byte(configContent), 0600); err != nil {
-		return fmt.Errorf("failed to write configuration: %w", err)
+// buildPFSGroup renders the phase 2 PFS group. racoon negotiates one group
+// per sainfo, so the preferred proposal's group is used.
+func (m *DarwinManager) buildPFSGroup(child SAConfig) string {
+	if !child.PFSEnabled() || child.Proposals[0].DHGroup == "" {
+		return "# PFS disabled"
 	}
+	return fmt.Sprintf("pfs_group %s;", m.convertDHGroup(child.Proposals[0].DHGroup))
+}
 
-	return nil
+// buildLifetime renders a lifetime statement. racoon has no rekey margin and
+// rekeys shortly before the lifetime ends.
+func (m *DarwinManager) buildLifetime(lifetime time.Duration) string {
+	if lifetime <= 0 {
+		return "# default lifetime"
+	}
+	return fmt.Sprintf("lifetime time %d sec;", int(lifetime.Seconds()))
+}
+
+// joinUnique renders a racoon algorithm list from the child proposals, most
+// preferred first. racoon combines the lists freely rather than per proposal.
+func (m *DarwinManager) joinUnique(proposals []Proposal, name func(Proposal) string) string {
+	var names []string
+	for _, p := range proposals {
+		n := name(p)
+		found := false
+		for _, existing := range names {
+			if existing == n {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, ", ")
 }
 
-// buildAuthConfig builds authentication configuration
+// buildAuthConfig builds authentication configuration. racoon takes a single
+// pre-shared key per peer, so a standby secret is not configured and the
+// tunnel only accepts the new PSK once the rotation switches to it.
 func (m *DarwinManager) buildAuthConfig(auth AuthConfig) string {
 	if auth.Type == AuthPSK {
 		return fmt.Sprintf("my_identifier address;\n\tpeers_identifier address;\n\tpre_shared_key \"%s\";", auth.Secret)
@@ -351,6 +420,22 @@ func (m *DarwinManager) convertDHGroup(group DHGroup) string {
 	}
 }
 
+// convertSelector renders a subnet with an optional port, e.g. 10.0.1.0/24
+// or 2001:db8::/64[443]
+func (m *DarwinManager) convertSelector(subnet string, port uint16) string {
+	if port == 0 {
+		return subnet
+	}
+	return fmt.Sprintf("%s[%d]", subnet, port)
+}
+
+func (m *DarwinManager) convertProtocol(protocol string) string {
+	if protocol == "" {
+		return "any"
+	}
+	return protocol
+}
+
 func (m *DarwinManager) convertAuthMethod(authType AuthType) string {
 	if authType == AuthPSK {
 		return "pre_shared_key"
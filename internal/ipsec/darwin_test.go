@@ -0,0 +1,15 @@
+//go:build darwin
+// +build darwin
+
+package ipsec
+
+import "testing"
+
+func TestRacoonConfigGolden(t *testing.T) {
+	m := &DarwinManager{}
+	for _, tt := range goldenTunnels {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGolden(t, "darwin-"+tt.name, m.buildRacoonConfig(tt.config))
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package ipsec
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Run "go test ./internal/ipsec -update" on each platform to rewrite the
+// golden files after an intended change to a generator.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// autoStart is what the golden tunnels that start when loaded point to
+var autoStart = true
+
+// goldenTunnels are the tunnels each platform's generator renders into
+// testdata/<platform>-<name>.golden
+var goldenTunnels = []struct {
+	name   string
+	config TunnelConfig
+}{
+	{
+		name: "ipv4-psk",
+		config: TunnelConfig{
+			Name:          "site-a",
+			Mode:          ModeESPTunnel,
+			LocalAddress:  "192.0.2.1",
+			RemoteAddress: "198.51.100.1",
+			Crypto: CryptoConfig{
+				Encryption: EncryptionAES256GCM,
+				Integrity:  IntegritySHA256,
+				DHGroup:    DHGroupECP256,
+				IKEVersion: IKEv2,
+				Lifetime:   time.Hour,
+			},
+			Auth: AuthConfig{Type: AuthPSK, Secret: "golden-secret"},
+			TrafficSelectors: []TrafficSelector{
+				{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24"},
+			},
+			DPD:       DPDConfig{Delay: 30 * time.Second, Action: "restart"},
+			AutoStart: &autoStart,
+		},
+	},
+	{
+		name: "ipv6-certificate",
+		config: TunnelConfig{
+			Name:          "site-b",
+			Mode:          ModeESPTunnel,
+			LocalAddress:  "2001:db8::1",
+			RemoteAddress: "2001:db8:1::1",
+			LocalID:       "gw-a.example.com",
+			RemoteID:      "gw-b.example.com",
+			Crypto: CryptoConfig{
+				Encryption: EncryptionAES256,
+				Integrity:  IntegritySHA384,
+				DHGroup:    DHGroupECP384,
+				IKEVersion: IKEv2,
+				Lifetime:   8 * time.Hour,
+			},
+			Auth: AuthConfig{
+				Type:       AuthCertificate,
+				CertPath:   "/etc/ipsec/site-b.crt",
+				KeyPath:    "/etc/ipsec/site-b.key",
+				CACertPath: "/etc/ipsec/ca.crt",
+			},
+			TrafficSelectors: []TrafficSelector{
+				{LocalSubnet: "2001:db8:a::/64", RemoteSubnet: "2001:db8:b::/64", Protocol: "tcp", RemotePort: 443},
+			},
+			DPD: DPDConfig{Delay: time.Minute, Action: "clear"},
+		},
+	},
+	{
+		name: "dual-stack",
+		config: TunnelConfig{
+			Name:          "site-c",
+			Mode:          ModeESPTunnel,
+			LocalAddress:  "2001:db8::1",
+			RemoteAddress: "2001:db8:2::1",
+			Crypto: CryptoConfig{
+				IKEVersion: IKEv2,
+				IKE: &SAConfig{
+					Proposals: []Proposal{
+						{Encryption: EncryptionAES256GCM, Integrity: IntegritySHA384, DHGroup: DHGroupECP384},
+						{Encryption: EncryptionAES128, Integrity: IntegritySHA256, DHGroup: DHGroupModp2048},
+					},
+					Lifetime:    24 * time.Hour,
+					RekeyMargin: time.Hour,
+				},
+				Child: &SAConfig{
+					Proposals: []Proposal{
+						{Encryption: EncryptionAES256GCM, Integrity: IntegritySHA256, DHGroup: DHGroupECP256},
+					},
+					Lifetime: time.Hour,
+				},
+			},
+			Auth: AuthConfig{Type: AuthPSK, Secret: "golden-secret", StandbySecret: "golden-standby"},
+			TrafficSelectors: []TrafficSelector{
+				{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.3.0.0/24"},
+				{LocalSubnet: "2001:db8:a::/64", RemoteSubnet: "2001:db8:c::/64"},
+			},
+			DPD: DPDConfig{Delay: 30 * time.Second, Action: "restart"},
+		},
+	},
+}
+
+// checkGolden compares got with testdata/<name>.golden, or rewrites the
+// file with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the test with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s (run the test with -update after an intended change)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"text/template"
 	"time"
 
@@ -90,7 +91,7 @@ func (m *LinuxManager) CreateTunnel(ctx context.Context, config TunnelConfig) er
 	}
 
 	// Optionally start tunnel immediately
-	if config.AutoStart {
+	if config.AutoStartEnabled() {
 		if err := m.StartTunnel(ctx, config.Name); err != nil {
 			log.Warn().Err(err).Str("tunnel", config.Name).Msg("Failed to auto-start tunnel")
 		}
@@ -102,6 +103,26 @@ func (m *LinuxManager) CreateTunnel(ctx context.Context, config TunnelConfig) er
 
 // generateSwanctlConfig generates swanctl.conf for the tunnel
 func (m *LinuxManager) generateSwanctlConfig(config TunnelConfig) error {
+	content, err := renderSwanctlConfig(config)
+	if err != nil {
+		return err
+	}
+
+	// Write configuration file
+	configPath := filepath.Join(swanctlConfDir, fmt.Sprintf("conf.d/%s.conf", config.Name))
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	return nil
+}
+
+// renderSwanctlConfig renders the swanctl configuration of a tunnel
+func renderSwanctlConfig(config TunnelConfig) (string, error) {
 	// Template for swanctl.conf
 	const swanctlTemplate = `
 connections {
@@ -109,6 +130,9 @@ connections {
         version = {{.IKEVersion}}
         local_addrs = {{.LocalAddress}}
         remote_addrs = {{.RemoteAddress}}
+        proposals = {{.IKEProposals}}
+        {{if .IKELifetime}}rekey_time = {{.IKERekeyTime}}s
+        over_time = {{.IKEOverTime}}s{{end}}
         {{if .LocalID}}local {
             id = {{.LocalID}}
         }{{end}}
@@ -122,17 +146,17 @@ connections {
         }
         
         remote {
-            {{if eq .AuthType "psk"}}auth = psk{{else}}auth = pubkey{{end}}
+            {{if eq .AuthType "psk"}}auth = psk{{else}}auth = pubkey
+            {{if .CACertPath}}cacerts = {{.CACertPath}}{{end}}{{end}}
         }
         
         children {
             {{.Name}}-child {
                 {{if or (eq .Mode "esp-tunnel") (eq .Mode "esp-ah-tunnel")}}mode = tunnel{{else}}mode = transport{{end}}
-                {{range .TrafficSelectors}}local_ts = {{.LocalSubnet}}
-                remote_ts = {{.RemoteSubnet}}
-                {{end}}
-                esp_proposals = {{.ESPProposal}}
-                {{if .UseAH}}ah_proposals = {{.AHProposal}}{{end}}
+                local_ts = {{.LocalTS}}
+                remote_ts = {{.RemoteTS}}
+                esp_proposals = {{.ESPProposals}}
+                {{if .UseAH}}ah_proposals = {{.AHProposals}}{{end}}
                 dpd_action = {{.DPDAction}}
                 life_time = {{.Lifetime}}s
                 rekey_time = {{.RekeyTime}}s
@@ -151,15 +175,29 @@ secrets {
         {{if .RemoteID}}id-remote = {{.RemoteID}}{{end}}
         secret = "{{.Secret}}"
     }
+    {{if .StandbySecret}}ike-{{.Name}}-standby {
+        {{if .LocalID}}id-local = {{.LocalID}}{{end}}
+        {{if .RemoteID}}id-remote = {{.RemoteID}}{{end}}
+        secret = "{{.StandbySecret}}"
+    }{{end}}
+}
+{{else if .KeyPath}}
+secrets {
+    private-{{.Name}} {
+        file = {{.KeyPath}}
+    }
 }
 {{end}}
 `
 
 	tmpl, err := template.New("swanctl").Parse(swanctlTemplate)
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %w", err)
+		return "", fmt.Errorf("failed to parse template: %w", err)
 	}
 
+	ike := config.Crypto.IKESA()
+	child := config.Crypto.ChildSA()
+
 	// Prepare template data
 	data := map[string]interface{}{
 		"Name":          config.Name,
@@ -171,35 +209,32 @@ secrets {
 		"Mode":          config.Mode,
 		"AuthType":      config.Auth.Type,
 		"Secret":        config.Auth.Secret,
+		"StandbySecret": config.Auth.StandbySecret, // strongSwan tries every secret matching the identities
 		"CertPath":      config.Auth.CertPath,
-		"ESPProposal":   buildESPProposal(config.Crypto),
-		"AHProposal":    buildAHProposal(config.Crypto),
+		"KeyPath":       config.Auth.KeyPath,
+		"CACertPath":    config.Auth.CACertPath,
+		"IKEProposals":  buildIKEProposals(ike),
+		"IKELifetime":   int(ike.Lifetime.Seconds()),
+		"IKERekeyTime":  int(ike.RekeyTime().Seconds()),
+		"IKEOverTime":   int((ike.Lifetime - ike.RekeyTime()).Seconds()),
+		"ESPProposals":  buildESPProposals(child),
+		"AHProposals":   buildAHProposals(child),
 		"UseAH":         config.Mode == ModeAHTunnel || config.Mode == ModeAHTransport || config.Mode == ModeESPAHTunnel,
 		"DPDDelay":      int(config.DPD.Delay.Seconds()),
 		"DPDAction":     config.DPD.Action,
-		"Lifetime":      int(config.Crypto.Lifetime.Seconds()),
-		"RekeyTime":     int(config.Crypto.Lifetime.Seconds() * 9 / 10), // Rekey at 90% of lifetime
-		"AutoStart":     config.AutoStart,
-		"TrafficSelectors": config.TrafficSelectors,
+		"Lifetime":      int(child.Lifetime.Seconds()),
+		"RekeyTime":     int(child.RekeyTime().Seconds()),
+		"AutoStart":     config.AutoStartEnabled(),
+		"LocalTS":       buildTrafficSelectors(config.TrafficSelectors, func(ts TrafficSelector) string { return ts.LocalSubnet }),
+		"RemoteTS":      buildTrafficSelectors(config.TrafficSelectors, func(ts TrafficSelector) string { return ts.RemoteSubnet }),
 	}
 
-	// Write configuration file
-	configPath := filepath.Join(swanctlConfDir, fmt.Sprintf("conf.d/%s.conf", config.Name))
-	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
-		return fmt.Errorf("failed to create config directory: %w", err)
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render config: %w", err)
 	}
 
-	f, err := os.OpenFile(configPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("failed to create config file: %w", err)
-	}
-	defer f.Close()
-
-	if err := tmpl.Execute(f, data); err != nil {
-		return fmt.Errorf("failed to write config: %w", err)
-	}
-
-	return nil
+	return b.String(), nil
 }
 
 // loadSwanctlConfig loads configuration using swanctl
@@ -449,10 +484,50 @@ func convertIKEVersion(version IKEVersion) int {
 	return 2
 }
 
-func buildESPProposal(crypto CryptoConfig) string {
-	return fmt.Sprintf("%s-%s-%s", crypto.Encryption, crypto.Integrity, crypto.DHGroup)
+// buildTrafficSelectors renders one side of the traffic selectors as a
+// single swanctl list. IPv4 and IPv6 subnets may be mixed; repeating the
+// setting instead would keep only the last one.
+func buildTrafficSelectors(selectors []TrafficSelector, subnet func(TrafficSelector) string) string {
+	var subnets []string
+	seen := make(map[string]bool)
+	for _, ts := range selectors {
+		if s := subnet(ts); !seen[s] {
+			seen[s] = true
+			subnets = append(subnets, s)
+		}
+	}
+	return strings.Join(subnets, ", ")
+}
+
+// buildIKEProposals renders IKE proposals in order of preference
+func buildIKEProposals(ike SAConfig) string {
+	proposals := make([]string, len(ike.Proposals))
+	for i, p := range ike.Proposals {
+		proposals[i] = fmt.Sprintf("%s-%s-%s", p.Encryption, p.Integrity, p.DHGroup)
+	}
+	return strings.Join(proposals, ", ")
 }
 
-func buildAHProposal(crypto CryptoConfig) string {
-	return fmt.Sprintf("%s-%s", crypto.Integrity, crypto.DHGroup)
+// buildESPProposals renders ESP proposals in order of preference. The DH
+// group is what enables PFS on rekeys, so it is left out when PFS is off.
+func buildESPProposals(child SAConfig) string {
+	proposals := make([]string, len(child.Proposals))
+	for i, p := range child.Proposals {
+		proposals[i] = fmt.Sprintf("%s-%s", p.Encryption, p.Integrity)
+		if child.PFSEnabled() && p.DHGroup != "" {
+			proposals[i] += "-" + string(p.DHGroup)
+		}
+	}
+	return strings.Join(proposals, ", ")
+}
+
+func buildAHProposals(child SAConfig) string {
+	proposals := make([]string, len(child.Proposals))
+	for i, p := range child.Proposals {
+		proposals[i] = string(p.Integrity)
+		if child.PFSEnabled() && p.DHGroup != "" {
+			proposals[i] += "-" + string(p.DHGroup)
+		}
+	}
+	return strings.Join(proposals, ", ")
 }
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import "testing"
+
+func TestSwanctlConfigGolden(t *testing.T) {
+	for _, tt := range goldenTunnels {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderSwanctlConfig(tt.config)
+			if err != nil {
+				t.Fatalf("renderSwanctlConfig: %v", err)
+			}
+			checkGolden(t, "linux-"+tt.name, got)
+		})
+	}
+}
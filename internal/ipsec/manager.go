@@ -24,6 +24,10 @@ const (
 	AuthCertificate AuthType = "certificate"
 )
 
+// IssuerBuiltin has the agent authenticate with the certificate the server's
+// built-in CA issued it, instead of certificate files named in the policy
+const IssuerBuiltin = "builtin"
+
 // EncryptionAlgorithm represents encryption algorithm
 type EncryptionAlgorithm string
 
@@ -86,15 +90,40 @@ type CryptoConfig struct {
 	DHGroup    DHGroup             `json:"dhgroup" yaml:"dhgroup"`
 	IKEVersion IKEVersion          `json:"ikeversion" yaml:"ikeversion"`
 	Lifetime   time.Duration       `json:"lifetime" yaml:"lifetime"` // SA lifetime
+	IKE        *SAConfig           `json:"ike,omitempty" yaml:"ike,omitempty"`     // IKE SA; the fields above when unset
+	Child      *SAConfig           `json:"child,omitempty" yaml:"child,omitempty"` // Child (ESP/AH) SA; the fields above when unset
+}
+
+// Proposal is one set of algorithms offered during negotiation
+type Proposal struct {
+	Encryption EncryptionAlgorithm `json:"encryption" yaml:"encryption"`
+	Integrity  IntegrityAlgorithm  `json:"integrity" yaml:"integrity"`
+	DHGroup    DHGroup             `json:"dhgroup,omitempty" yaml:"dhgroup,omitempty"`
+}
+
+// SAConfig defines the proposals and lifetime of the IKE SA or the child SA
+type SAConfig struct {
+	Proposals   []Proposal    `json:"proposals,omitempty" yaml:"proposals,omitempty"`       // Most preferred first; later ones are fallbacks
+	Lifetime    time.Duration `json:"lifetime,omitempty" yaml:"lifetime,omitempty"`         // Hard lifetime
+	RekeyMargin time.Duration `json:"rekey_margin,omitempty" yaml:"rekey_margin,omitempty"` // Rekey this long before the lifetime ends; 10% when unset
+	PFS         *bool         `json:"pfs,omitempty" yaml:"pfs,omitempty"`                   // Child SA only: fresh DH exchange on rekey; on when unset
 }
 
 // AuthConfig defines authentication configuration
 type AuthConfig struct {
 	Type       AuthType `json:"type" yaml:"type"`
 	Secret     string   `json:"secret,omitempty" yaml:"secret,omitempty"`         // PSK
+	SecretRef  string   `json:"secret_ref,omitempty" yaml:"secret_ref,omitempty"` // Where to read the PSK instead, e.g. store:NAME or agent:file:/path
 	CertPath   string   `json:"cert_path,omitempty" yaml:"cert_path,omitempty"`   // Certificate path
 	KeyPath    string   `json:"key_path,omitempty" yaml:"key_path,omitempty"`     // Private key path
 	CACertPath string   `json:"ca_cert_path,omitempty" yaml:"ca_cert_path,omitempty"` // CA certificate path
+	Issuer     string   `json:"issuer,omitempty" yaml:"issuer,omitempty"`             // "builtin" for the server CA's certificate; the agent fills in the paths
+
+	// PSK rotation. The standby secret is accepted alongside Secret while the
+	// server rotates it; it and Rotation are set by the server only.
+	RotateEvery   string `json:"rotate_every,omitempty" yaml:"rotate_every,omitempty"`     // Rotate the PSK on this schedule, e.g. 720h or 30d
+	StandbySecret string `json:"standby_secret,omitempty" yaml:"standby_secret,omitempty"` // Second PSK accepted during a rotation
+	Rotation      string `json:"rotation,omitempty" yaml:"rotation,omitempty"`             // Rotation step the tunnel is at, "<rotation ID>/<state>"
 }
 
 // TrafficSelector defines which traffic should be encrypted
@@ -124,10 +153,16 @@ type TunnelConfig struct {
 	Auth             AuthConfig        `json:"auth" yaml:"auth"`
 	TrafficSelectors []TrafficSelector `json:"traffic_selectors" yaml:"traffic_selectors"`
 	DPD              DPDConfig         `json:"dpd" yaml:"dpd"`
-	AutoStart        bool              `json:"autostart" yaml:"autostart"`
+	AutoStart        *bool             `json:"autostart,omitempty" yaml:"autostart,omitempty"` // Start when loaded rather than on traffic; off when unset
 	Mark             string            `json:"mark,omitempty" yaml:"mark,omitempty"` // For routing mark
 }
 
+// AutoStartEnabled reports whether the tunnel is started as soon as it is
+// loaded rather than when traffic first matches it
+func (c TunnelConfig) AutoStartEnabled() bool {
+	return c.AutoStart != nil && *c.AutoStart
+}
+
 // TunnelStatus represents the current status of a tunnel
 type TunnelStatus struct {
 	Name            string        `json:"name"`
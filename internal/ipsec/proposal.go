@@ -0,0 +1,57 @@
+package ipsec
+
+import "time"
+
+// Without a rekey margin, SAs are rekeyed with 1/defaultRekeyDivisor of
+// their lifetime left
+const defaultRekeyDivisor = 10
+
+// IKESA returns the effective IKE SA settings. Without IKE proposals the
+// tunnel offers the single proposal made of the flat Encryption, Integrity
+// and DHGroup fields. A zero lifetime leaves the IKE SA lifetime to the
+// backend's default.
+func (c CryptoConfig) IKESA() SAConfig {
+	var sa SAConfig
+	if c.IKE != nil {
+		sa = *c.IKE
+	}
+	if len(sa.Proposals) == 0 {
+		sa.Proposals = []Proposal{c.baseProposal()}
+	}
+	sa.PFS = nil
+	return sa
+}
+
+// ChildSA returns the effective child SA settings, falling back to the flat
+// fields like IKESA does. The child lifetime falls back to Lifetime.
+func (c CryptoConfig) ChildSA() SAConfig {
+	var sa SAConfig
+	if c.Child != nil {
+		sa = *c.Child
+	}
+	if len(sa.Proposals) == 0 {
+		sa.Proposals = []Proposal{c.baseProposal()}
+	}
+	if sa.Lifetime == 0 {
+		sa.Lifetime = c.Lifetime
+	}
+	return sa
+}
+
+func (c CryptoConfig) baseProposal() Proposal {
+	return Proposal{Encryption: c.Encryption, Integrity: c.Integrity, DHGroup: c.DHGroup}
+}
+
+// PFSEnabled reports whether child SA rekeys run a fresh DH exchange
+func (s SAConfig) PFSEnabled() bool {
+	return s.PFS == nil || *s.PFS
+}
+
+// RekeyTime returns when the SA is rekeyed, measured from its creation:
+// RekeyMargin before the lifetime ends, or at 90% of it by default
+func (s SAConfig) RekeyTime() time.Duration {
+	if s.RekeyMargin > 0 {
+		return s.Lifetime - s.RekeyMargin
+	}
+	return s.Lifetime - s.Lifetime/defaultRekeyDivisor
+}
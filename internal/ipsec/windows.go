@@ -82,10 +82,8 @@ func (m *WindowsManager) CreateTunnel(ctx context.Context, config TunnelConfig)
 
 // buildCreateTunnelScript builds PowerShell script for tunnel creation
 func (m *WindowsManager) buildCreateTunnelScript(config TunnelConfig) string {
-	// Build encryption algorithm
-	encAlg := m.convertEncryptionAlgorithm(config.Crypto.Encryption)
-	intAlg := m.convertIntegrityAlgorithm(config.Crypto.Integrity)
-	dhGroup := m.convertDHGroup(config.Crypto.DHGroup)
+	ike := config.Crypto.IKESA()
+	child := config.Crypto.ChildSA()
 
 	// Determine tunnel mode
 	tunnelMode := "Transport"
@@ -115,43 +113,103 @@ func (m *WindowsManager) buildCreateTunnelScript(config TunnelConfig) string {
 	}
 
 	script := fmt.Sprintf(`
-# Remove existing rules with the same name
+# Remove existing rules and crypto sets with the same name
 Remove-NetIPsecRule -Name '%s' -ErrorAction SilentlyContinue
 Remove-NetIPsecMainModeRule -Name '%s-MM' -ErrorAction SilentlyContinue
+Remove-NetIPsecQuickModeCryptoSet -Name '%s-QM' -ErrorAction SilentlyContinue
+Remove-NetIPsecMainModeCryptoSet -Name '%s-MM' -ErrorAction SilentlyContinue
 
-# Create Phase 1 (Main Mode) proposal
-$Phase1Proposal = New-NetIPsecMainModeCryptoProposal -Encryption %s -Hash %s -DHGroup %s
+# Create Phase 1 (Main Mode) proposals, most preferred first
+$Phase1Proposals = @(%s)
+New-NetIPsecMainModeCryptoSet -Name '%s-MM' -DisplayName '%s Main Mode' -Proposal $Phase1Proposals%s
 
 # Create Phase 1 Authentication
 $Phase1Auth = New-NetIPsecAuthProposal -Machine -Cert -Authority 'CN=Root' -AuthorityType Root
 %s
 
 # Create Phase 1 Main Mode Rule
-New-NetIPsecMainModeRule -Name '%s-MM' -DisplayName '%s Main Mode' -MainModeCryptoSet $Phase1Proposal -Phase1AuthSet $Phase1Auth -LocalAddress %s -RemoteAddress %s
+New-NetIPsecMainModeRule -Name '%s-MM' -DisplayName '%s Main Mode' -MainModeCryptoSet '%s-MM' -Phase1AuthSet $Phase1Auth -LocalAddress '%s' -RemoteAddress '%s'
 
-# Create Phase 2 (Quick Mode) proposal
-$Phase2Proposal = New-NetIPsecQuickModeCryptoProposal -Encapsulation %s -Encryption %s -Hash %s -PfsGroup %s
+# Create Phase 2 (Quick Mode) proposals, most preferred first
+$Phase2Proposals = @(%s)
+New-NetIPsecQuickModeCryptoSet -Name '%s-QM' -DisplayName '%s Quick Mode' -Proposal $Phase2Proposals -PerfectForwardSecrecyGroup %s
 
 # Create connection security rule
-New-NetIPsecRule -Name '%s' -DisplayName '%s' -Mode %s -LocalAddress @(%s) -RemoteAddress @(%s) -QuickModeCryptoSet $Phase2Proposal -InboundSecurity Require -OutboundSecurity Require -Phase2AuthSet Computer
+New-NetIPsecRule -Name '%s' -DisplayName '%s' -Mode %s%s -LocalAddress @(%s) -RemoteAddress @(%s) -QuickModeCryptoSet '%s-QM' -InboundSecurity Require -OutboundSecurity Require -Phase2AuthSet Computer
 
 Write-Output 'Tunnel created successfully'
 `,
-		config.Name, config.Name,
-		encAlg, intAlg, dhGroup,
+		config.Name, config.Name, config.Name, config.Name,
+		m.buildMainModeProposals(ike),
+		config.Name, config.Name, m.maxMinutes(ike.Lifetime),
 		m.buildAuthScript(config.Auth),
-		config.Name, config.Name,
+		config.Name, config.Name, config.Name,
 		config.LocalAddress, config.RemoteAddress,
-		m.getEncapsulation(useESP, useAH), encAlg, intAlg, dhGroup,
+		m.buildQuickModeProposals(child, m.getEncapsulation(useESP, useAH)),
+		config.Name, config.Name, m.pfsGroup(child),
 		config.Name, config.Name,
-		tunnelMode,
+		tunnelMode, m.tunnelEndpoints(tunnelMode, config),
 		m.quoteArray(localSubnets), m.quoteArray(remoteSubnets),
+		config.Name,
 	)
 
 	return script
 }
 
-// buildAuthScript builds authentication configuration
+// buildMainModeProposals renders the IKE proposals as a PowerShell list
+func (m *WindowsManager) buildMainModeProposals(ike SAConfig) string {
+	var proposals []string
+	for _, p := range ike.Proposals {
+		proposals = append(proposals, fmt.Sprintf("(New-NetIPsecMainModeCryptoProposal -Encryption %s -Hash %s -DHGroup %s)",
+			m.convertEncryptionAlgorithm(p.Encryption), m.convertIntegrityAlgorithm(p.Integrity), m.convertDHGroup(p.DHGroup)))
+	}
+	return strings.Join(proposals, ", ")
+}
+
+// buildQuickModeProposals renders the child SA proposals as a PowerShell
+// list. Windows has no rekey margin; quick mode SAs rekey at their lifetime.
+func (m *WindowsManager) buildQuickModeProposals(child SAConfig, encapsulation string) string {
+	var proposals []string
+	for _, p := range child.Proposals {
+		proposals = append(proposals, fmt.Sprintf("(New-NetIPsecQuickModeCryptoProposal -Encapsulation %s -Encryption %s -Hash %s%s)",
+			encapsulation, m.convertEncryptionAlgorithm(p.Encryption), m.convertIntegrityAlgorithm(p.Integrity), m.maxMinutes(child.Lifetime)))
+	}
+	return strings.Join(proposals, ", ")
+}
+
+// pfsGroup returns the quick mode PFS group. Windows sets one group for the
+// whole crypto set, so the preferred proposal's group is used.
+func (m *WindowsManager) pfsGroup(child SAConfig) string {
+	if !child.PFSEnabled() || child.Proposals[0].DHGroup == "" {
+		return "None"
+	}
+	return m.convertDHGroup(child.Proposals[0].DHGroup)
+}
+
+// tunnelEndpoints renders the tunnel endpoints of a tunnel mode rule. The
+// IPv4 or IPv6 endpoints may carry subnets of either family.
+func (m *WindowsManager) tunnelEndpoints(tunnelMode string, config TunnelConfig) string {
+	if tunnelMode != "Tunnel" {
+		return ""
+	}
+	return fmt.Sprintf(" -LocalTunnelEndpoint '%s' -RemoteTunnelEndpoint '%s'", config.LocalAddress, config.RemoteAddress)
+}
+
+// maxMinutes renders a lifetime parameter, or nothing to keep the default
+func (m *WindowsManager) maxMinutes(lifetime time.Duration) string {
+	if lifetime <= 0 {
+		return ""
+	}
+	minutes := int(lifetime.Minutes())
+	if minutes < 1 {
+		minutes = 1
+	}
+	return fmt.Sprintf(" -MaxMinutes %d", minutes)
+}
+
+// buildAuthScript builds authentication configuration. A main mode rule
+// takes a single pre-shared key, so a standby secret is not configured; the
+// server does not rotate PSKs of tunnels delivered to Windows peers.
 func (m *WindowsManager) buildAuthScript(auth AuthConfig) string {
 	if auth.Type == AuthPSK {
 		// For PSK, we need to create a pre-shared key
@@ -169,8 +227,10 @@ func (m *WindowsManager) DeleteTunnel(ctx context.Context, name string) error {
 	script := fmt.Sprintf(`
 Remove-NetIPsecRule -Name '%s' -ErrorAction SilentlyContinue
 Remove-NetIPsecMainModeRule -Name '%s-MM' -ErrorAction SilentlyContinue
+Remove-NetIPsecQuickModeCryptoSet -Name '%s-QM' -ErrorAction SilentlyContinue
+Remove-NetIPsecMainModeCryptoSet -Name '%s-MM' -ErrorAction SilentlyContinue
 Write-Output 'Tunnel deleted'
-`, name, name)
+`, name, name, name, name)
 
 	if _, err := m.executePowerShell(script); err != nil {
 		return fmt.Errorf("failed to delete tunnel: %w", err)
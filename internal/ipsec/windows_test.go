@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package ipsec
+
+import "testing"
+
+func TestCreateTunnelScriptGolden(t *testing.T) {
+	m := &WindowsManager{}
+	for _, tt := range goldenTunnels {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGolden(t, "windows-"+tt.name, m.buildCreateTunnelScript(tt.config))
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// Tunnels may mix IPv4 and IPv6. The two endpoints must share a family, and
+// so must the two sides of each traffic selector, but a tunnel-mode tunnel
+// may carry selectors of either family over endpoints of either family.
+// Transport mode protects traffic between the endpoints themselves, so its
+// selectors must match the endpoints' family.
+
+// AddressValidator parses tunnel endpoints and traffic selectors. Templated
+// fields are skipped here and checked per peer by CheckCompatibility.
+type AddressValidator struct{}
+
+func (v *AddressValidator) Validate(policy *Policy) []Finding {
+	var findings []Finding
+	for i, tunnel := range policy.Tunnels {
+		findings = append(findings, validateTunnelAddresses(i, tunnel)...)
+	}
+	return findings
+}
+
+func validateTunnelAddresses(index int, tunnel ipsec.TunnelConfig) []Finding {
+	var findings []Finding
+	report := func(field, code, format string, args ...interface{}) {
+		findings = append(findings, errorFinding(tunnelPath(index, field), code, format, args...))
+	}
+
+	local, localOK, err := parseEndpoint(tunnel.LocalAddress)
+	if err != nil {
+		report("local_address", "address.invalid", "%v", err)
+	}
+	remote, remoteOK, err := parseEndpoint(tunnel.RemoteAddress)
+	if err != nil {
+		report("remote_address", "address.invalid", "%v", err)
+	}
+	if localOK && remoteOK && addressFamily(local) != addressFamily(remote) {
+		report("remote_address", "address.family_mismatch",
+			"remote address %s is %s but local address %s is %s",
+			remote, addressFamily(remote), local, addressFamily(local))
+	}
+
+	transport := tunnel.Mode == ipsec.ModeESPTransport || tunnel.Mode == ipsec.ModeAHTransport
+	for i, ts := range tunnel.TrafficSelectors {
+		localField := fmt.Sprintf("traffic_selectors[%d].local_subnet", i)
+		remoteField := fmt.Sprintf("traffic_selectors[%d].remote_subnet", i)
+
+		localNet, localNetOK, err := parseSubnet(ts.LocalSubnet)
+		if err != nil {
+			report(localField, subnetErrorCode(err), "%v", err)
+		}
+		remoteNet, remoteNetOK, err := parseSubnet(ts.RemoteSubnet)
+		if err != nil {
+			report(remoteField, subnetErrorCode(err), "%v", err)
+		}
+
+		if localNetOK && remoteNetOK && prefixFamily(localNet) != prefixFamily(remoteNet) {
+			report(remoteField, "address.family_mismatch",
+				"remote subnet %s is %s but local subnet %s is %s",
+				remoteNet, prefixFamily(remoteNet), localNet, prefixFamily(localNet))
+			continue
+		}
+		if transport && localNetOK && localOK && prefixFamily(localNet) != addressFamily(local) {
+			report(localField, "address.family_mismatch",
+				"%s selectors need %s subnets like the endpoints, got %s", tunnel.Mode, addressFamily(local), localNet)
+		}
+	}
+
+	return findings
+}
+
+// hostBitsError is returned for a CIDR with bits set past its prefix length
+type hostBitsError struct {
+	value  string
+	masked netip.Prefix
+}
+
+func (e *hostBitsError) Error() string {
+	return fmt.Sprintf("%s has host bits set (did you mean %s?)", e.value, e.masked)
+}
+
+func subnetErrorCode(err error) string {
+	if _, ok := err.(*hostBitsError); ok {
+		return "address.host_bits"
+	}
+	return "address.invalid"
+}
+
+// parseEndpoint parses a tunnel endpoint address. ok is false for empty and
+// templated values, which are not checked.
+func parseEndpoint(s string) (addr netip.Addr, ok bool, err error) {
+	if s == "" || IsTemplate(s) {
+		return netip.Addr{}, false, nil
+	}
+	addr, err = netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false, fmt.Errorf("%q is not an IPv4 or IPv6 address", s)
+	}
+	return addr, true, nil
+}
+
+// parseSubnet parses a traffic selector subnet: a CIDR without host bits or
+// a single address. ok is false for empty and templated values.
+func parseSubnet(s string) (prefix netip.Prefix, ok bool, err error) {
+	if s == "" || IsTemplate(s) {
+		return netip.Prefix{}, false, nil
+	}
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, false, fmt.Errorf("%q is not an IPv4 or IPv6 address or CIDR", s)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), true, nil
+	}
+	prefix, err = netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, false, fmt.Errorf("%q is not an IPv4 or IPv6 CIDR", s)
+	}
+	if prefix != prefix.Masked() {
+		return netip.Prefix{}, false, &hostBitsError{value: s, masked: prefix.Masked()}
+	}
+	return prefix, true, nil
+}
+
+func addressFamily(addr netip.Addr) string {
+	if addr.Unmap().Is4() {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+func prefixFamily(prefix netip.Prefix) string {
+	return addressFamily(prefix.Addr())
+}
+
+// checkPeerAddresses checks a policy's tunnels with their templates resolved
+// for a peer. It reports problems in resolved fields, e.g. a metadata CIDR
+// with host bits set, and local addresses that are not an address of the
+// peer. Unspecified local addresses (0.0.0.0, ::) match any address; peers
+// that did not report their addresses are not checked for ownership.
+func checkPeerAddresses(policy *Policy, peer *PeerInfo) []Finding {
+	var findings []Finding
+	data := TemplateData{Peer: peer}
+
+	owned := make(map[netip.Addr]bool)
+	for _, s := range append([]string{peer.IPAddress}, peer.Addresses...) {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			owned[addr.Unmap().WithZone("")] = true
+		}
+	}
+	if len(peer.Addresses) == 0 {
+		findings = append(findings, Finding{
+			Severity: SeverityInfo,
+			Code:     "address.peer_unknown",
+			Message:  "peer did not report its addresses; local addresses were not checked",
+		})
+	}
+
+	for i, tunnel := range policy.Tunnels {
+		// Findings the unresolved tunnel also has are about literal fields,
+		// which AddressValidator already reports for the whole policy
+		resolved, _ := resolveTunnel(tunnel, data)
+		reported := make(map[Finding]bool)
+		for _, finding := range validateTunnelAddresses(i, tunnel) {
+			reported[finding] = true
+		}
+		for _, finding := range validateTunnelAddresses(i, resolved) {
+			if !reported[finding] {
+				findings = append(findings, finding)
+			}
+		}
+
+		if len(peer.Addresses) == 0 {
+			continue
+		}
+		addr, ok, err := parseEndpoint(resolved.LocalAddress)
+		if !ok || err != nil || addr.IsUnspecified() {
+			continue
+		}
+		if !owned[addr.Unmap().WithZone("")] {
+			findings = append(findings, errorFinding(tunnelPath(i, "local_address"), "address.not_on_peer",
+				"local address %s is not an address of peer %s (%s)", addr, peer.ID, strings.Join(peer.Addresses, ", ")))
+		}
+	}
+	return findings
+}
@@ -0,0 +1,136 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+func addressTunnel(mode ipsec.IPsecMode, local, remote string, selectors ...string) ipsec.TunnelConfig {
+	tunnel := ipsec.TunnelConfig{Name: "t", Mode: mode, LocalAddress: local, RemoteAddress: remote}
+	for i := 0; i+1 < len(selectors); i += 2 {
+		tunnel.TrafficSelectors = append(tunnel.TrafficSelectors,
+			ipsec.TrafficSelector{LocalSubnet: selectors[i], RemoteSubnet: selectors[i+1]})
+	}
+	return tunnel
+}
+
+func TestAddressValidator(t *testing.T) {
+	tests := []struct {
+		name     string
+		tunnel   ipsec.TunnelConfig
+		findings []string // "path code", in order
+	}{
+		{
+			name:   "IPv4",
+			tunnel: addressTunnel(ipsec.ModeESPTunnel, "192.0.2.1", "198.51.100.1", "10.1.0.0/24", "10.2.0.0/24"),
+		},
+		{
+			name:   "IPv6",
+			tunnel: addressTunnel(ipsec.ModeESPTunnel, "2001:db8::1", "2001:db8:1::1", "2001:db8:a::/64", "2001:db8:b::/64"),
+		},
+		{
+			name: "dual-stack selectors over IPv6",
+			tunnel: addressTunnel(ipsec.ModeESPTunnel, "2001:db8::1", "2001:db8:1::1",
+				"10.1.0.0/24", "10.2.0.0/24", "2001:db8:a::/64", "2001:db8:b::/64"),
+		},
+		{
+			name:   "single addresses and templates",
+			tunnel: addressTunnel(ipsec.ModeESPTunnel, "{{ .Peer.IPAddress }}", "198.51.100.1", "10.1.0.1", "{{ .Peer.Metadata.lan }}"),
+		},
+		{
+			name:     "invalid endpoint",
+			tunnel:   addressTunnel(ipsec.ModeESPTunnel, "192.0.2.300", "gw.example.com"),
+			findings: []string{"tunnels[0].local_address address.invalid", "tunnels[0].remote_address address.invalid"},
+		},
+		{
+			name:     "endpoint families differ",
+			tunnel:   addressTunnel(ipsec.ModeESPTunnel, "192.0.2.1", "2001:db8::1"),
+			findings: []string{"tunnels[0].remote_address address.family_mismatch"},
+		},
+		{
+			name:     "host bits",
+			tunnel:   addressTunnel(ipsec.ModeESPTunnel, "192.0.2.1", "198.51.100.1", "10.1.0.1/24", "2001:db8:b::1/64"),
+			findings: []string{"tunnels[0].traffic_selectors[0].local_subnet address.host_bits", "tunnels[0].traffic_selectors[0].remote_subnet address.host_bits"},
+		},
+		{
+			name:     "selector families differ",
+			tunnel:   addressTunnel(ipsec.ModeESPTunnel, "192.0.2.1", "198.51.100.1", "10.1.0.0/24", "2001:db8:b::/64"),
+			findings: []string{"tunnels[0].traffic_selectors[0].remote_subnet address.family_mismatch"},
+		},
+		{
+			name:     "transport selectors follow the endpoints",
+			tunnel:   addressTunnel(ipsec.ModeESPTransport, "192.0.2.1", "198.51.100.1", "2001:db8:a::/64", "2001:db8:b::/64"),
+			findings: []string{"tunnels[0].traffic_selectors[0].local_subnet address.family_mismatch"},
+		},
+		{
+			name:     "invalid CIDR",
+			tunnel:   addressTunnel(ipsec.ModeESPTunnel, "192.0.2.1", "198.51.100.1", "10.1.0.0/33", "lan"),
+			findings: []string{"tunnels[0].traffic_selectors[0].local_subnet address.invalid", "tunnels[0].traffic_selectors[0].remote_subnet address.invalid"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol := &Policy{Tunnels: []ipsec.TunnelConfig{tt.tunnel}}
+			var got []string
+			for _, f := range (&AddressValidator{}).Validate(pol) {
+				got = append(got, f.Path+" "+f.Code)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.findings, "\n") {
+				t.Errorf("got findings %q, want %q", got, tt.findings)
+			}
+		})
+	}
+}
+
+func TestCheckPeerAddresses(t *testing.T) {
+	peer := &PeerInfo{
+		ID:        "peer-1",
+		IPAddress: "192.0.2.1",
+		Addresses: []string{"192.0.2.1", "2001:db8::1"},
+		Metadata:  map[string]string{"lan": "10.1.0.1/24"},
+	}
+
+	tests := []struct {
+		name     string
+		tunnel   ipsec.TunnelConfig
+		findings []string
+	}{
+		{"own address", addressTunnel(ipsec.ModeESPTunnel, "2001:db8::1", "2001:db8:1::1"), nil},
+		{"unspecified address", addressTunnel(ipsec.ModeESPTunnel, "::", "2001:db8:1::1"), nil},
+		{"template", addressTunnel(ipsec.ModeESPTunnel, "{{ .Peer.IPAddress }}", "198.51.100.1"), nil},
+		{
+			name:     "another host's address",
+			tunnel:   addressTunnel(ipsec.ModeESPTunnel, "192.0.2.9", "198.51.100.1"),
+			findings: []string{"tunnels[0].local_address address.not_on_peer"},
+		},
+		{
+			name:     "resolved CIDR with host bits",
+			tunnel:   addressTunnel(ipsec.ModeESPTunnel, "192.0.2.1", "198.51.100.1", "{{ .Peer.Metadata.lan }}", "10.2.0.0/24"),
+			findings: []string{"tunnels[0].traffic_selectors[0].local_subnet address.host_bits"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol := &Policy{Tunnels: []ipsec.TunnelConfig{tt.tunnel}}
+			var got []string
+			for _, f := range checkPeerAddresses(pol, peer) {
+				got = append(got, f.Path+" "+f.Code)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.findings, "\n") {
+				t.Errorf("got findings %q, want %q", got, tt.findings)
+			}
+		})
+	}
+
+	// Peers that did not report their addresses are not checked
+	unknown := &PeerInfo{ID: "peer-2", IPAddress: "192.0.2.2"}
+	pol := &Policy{Tunnels: []ipsec.TunnelConfig{addressTunnel(ipsec.ModeESPTunnel, "192.0.2.9", "198.51.100.1")}}
+	findings := checkPeerAddresses(pol, unknown)
+	if len(findings) != 1 || findings[0].Code != "address.peer_unknown" {
+		t.Errorf("got findings %v for a peer without addresses, want address.peer_unknown", findings)
+	}
+}
@@ -0,0 +1,263 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// SelectorConflictKind classifies how two traffic selectors collide
+type SelectorConflictKind string
+
+const (
+	// SelectorOverlap means some, but not all, traffic matches both selectors
+	SelectorOverlap SelectorConflictKind = "overlap"
+	// SelectorShadowed means all traffic of B also matches A
+	SelectorShadowed SelectorConflictKind = "shadowed"
+	// SelectorDuplicate means both selectors match exactly the same traffic
+	SelectorDuplicate SelectorConflictKind = "duplicate"
+)
+
+// SelectorRef identifies one traffic selector of one tunnel
+type SelectorRef struct {
+	PolicyID string                `json:"policy_id"`
+	Tunnel   string                `json:"tunnel"`
+	Index    int                   `json:"index"`
+	Selector ipsec.TrafficSelector `json:"selector"`
+}
+
+// SelectorConflict is a pair of selectors, in different tunnels, that claim
+// the same traffic. For SelectorShadowed, A is the broader selector.
+type SelectorConflict struct {
+	Kind  SelectorConflictKind `json:"kind"`
+	A     SelectorRef          `json:"a"`
+	B     SelectorRef          `json:"b"`
+	Peers []string             `json:"peers,omitempty"` // Peers that receive both tunnels
+}
+
+// PeerSelectorConflicts lists the conflicts in one peer's effective tunnel set
+type PeerSelectorConflicts struct {
+	PeerID    string             `json:"peer_id"`
+	Hostname  string             `json:"hostname"`
+	Conflicts []SelectorConflict `json:"conflicts"`
+}
+
+// SelectorAnalysis is the result of a fleet-wide traffic selector audit
+type SelectorAnalysis struct {
+	Peers    []PeerSelectorConflicts `json:"peers"`    // Per peer, after templates and merging
+	Policies []SelectorConflict      `json:"policies"` // Between tunnels of enabled policies
+}
+
+// AnalyzeSelectors audits traffic selectors across the fleet. Each peer's
+// merged tunnel set is checked after templates are resolved, and every pair
+// of tunnels from enabled policies is checked as written, listing the peers
+// that would receive both. Tunnels with the same name are never compared with
+// each other, since merging keeps only one of them.
+func (e *PolicyEngine) AnalyzeSelectors(policies []Policy, peers []PeerInfo) *SelectorAnalysis {
+	analysis := &SelectorAnalysis{
+		Peers:    []PeerSelectorConflicts{},
+		Policies: []SelectorConflict{},
+	}
+
+	// Which policies each peer receives, for the cross-policy pass
+	peerPolicies := make(map[string]map[string]bool, len(peers))
+
+	for i := range peers {
+		peer := &peers[i]
+
+		// Schedules are ignored: a policy activating later still conflicts
+		resolved, _ := resolveForPeer(targetedPolicies(policies, peer), peer)
+		received := make(map[string]bool, len(resolved))
+		for _, policy := range resolved {
+			received[policy.ID] = true
+		}
+		peerPolicies[peer.ID] = received
+
+		merged := e.MergeTunnels(resolved)
+		var refs []SelectorRef
+		for _, tunnel := range merged.Tunnels {
+			refs = append(refs, tunnelSelectorRefs(merged.Sources[tunnel.Name], tunnel)...)
+		}
+
+		if conflicts := FindSelectorConflicts(refs); len(conflicts) > 0 {
+			analysis.Peers = append(analysis.Peers, PeerSelectorConflicts{
+				PeerID:    peer.ID,
+				Hostname:  peer.Hostname,
+				Conflicts: conflicts,
+			})
+		}
+	}
+
+	var refs []SelectorRef
+	for _, policy := range policies {
+		if !policy.Enabled {
+			continue
+		}
+		for _, tunnel := range policy.Tunnels {
+			refs = append(refs, tunnelSelectorRefs(policy.ID, tunnel)...)
+		}
+	}
+
+	for _, conflict := range FindSelectorConflicts(refs) {
+		for _, peer := range peers {
+			received := peerPolicies[peer.ID]
+			if received[conflict.A.PolicyID] && received[conflict.B.PolicyID] {
+				conflict.Peers = append(conflict.Peers, peer.ID)
+			}
+		}
+		analysis.Policies = append(analysis.Policies, conflict)
+	}
+
+	return analysis
+}
+
+// FindSelectorConflicts compares every pair of selectors that belong to
+// different tunnels. Selectors that are still templated or do not parse as
+// addresses are skipped; other validators report those.
+func FindSelectorConflicts(refs []SelectorRef) []SelectorConflict {
+	type parsed struct {
+		ref           SelectorRef
+		local, remote netip.Prefix
+	}
+
+	var items []parsed
+	for _, ref := range refs {
+		local, err := parseSelectorPrefix(ref.Selector.LocalSubnet)
+		if err != nil {
+			continue
+		}
+		remote, err := parseSelectorPrefix(ref.Selector.RemoteSubnet)
+		if err != nil {
+			continue
+		}
+		items = append(items, parsed{ref: ref, local: local, remote: remote})
+	}
+
+	var conflicts []SelectorConflict
+	for i := 0; i < len(items); i++ {
+		for j := i + 1; j < len(items); j++ {
+			a, b := items[i], items[j]
+			if a.ref.Tunnel == b.ref.Tunnel {
+				continue
+			}
+
+			if !a.local.Overlaps(b.local) || !a.remote.Overlaps(b.remote) ||
+				!portsOverlap(a.ref.Selector, b.ref.Selector) {
+				continue
+			}
+
+			aCoversB := prefixContains(a.local, b.local) && prefixContains(a.remote, b.remote) &&
+				portsContain(a.ref.Selector, b.ref.Selector)
+			bCoversA := prefixContains(b.local, a.local) && prefixContains(b.remote, a.remote) &&
+				portsContain(b.ref.Selector, a.ref.Selector)
+
+			conflict := SelectorConflict{Kind: SelectorOverlap, A: a.ref, B: b.ref}
+			switch {
+			case aCoversB && bCoversA:
+				conflict.Kind = SelectorDuplicate
+			case aCoversB:
+				conflict.Kind = SelectorShadowed
+			case bCoversA:
+				conflict.Kind = SelectorShadowed
+				conflict.A, conflict.B = b.ref, a.ref
+			}
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	return conflicts
+}
+
+// SelectorOverlapValidator rejects policies whose own tunnels claim
+// overlapping traffic. Conflicts with other policies depend on which peers
+// receive them and are checked with AnalyzeSelectors.
+type SelectorOverlapValidator struct{}
+
+func (v *SelectorOverlapValidator) Validate(policy *Policy) []Finding {
+	var refs []SelectorRef
+	index := make(map[string]int, len(policy.Tunnels))
+	for i, tunnel := range policy.Tunnels {
+		refs = append(refs, tunnelSelectorRefs(policy.ID, tunnel)...)
+		index[tunnel.Name] = i
+	}
+
+	var findings []Finding
+	for _, c := range FindSelectorConflicts(refs) {
+		path := tunnelPath(index[c.B.Tunnel], fmt.Sprintf("traffic_selectors[%d]", c.B.Index))
+		findings = append(findings, errorFinding(path, "selectors."+string(c.Kind),
+			"traffic selectors %s[%d] and %s[%d] conflict (%s)", c.A.Tunnel, c.A.Index, c.B.Tunnel, c.B.Index, c.Kind))
+	}
+	return findings
+}
+
+// ConflictsInvolving returns the per-peer conflicts that include the given policy
+func (a *SelectorAnalysis) ConflictsInvolving(policyID string) []PeerSelectorConflicts {
+	var out []PeerSelectorConflicts
+	for _, peer := range a.Peers {
+		var conflicts []SelectorConflict
+		for _, c := range peer.Conflicts {
+			if c.A.PolicyID == policyID || c.B.PolicyID == policyID {
+				conflicts = append(conflicts, c)
+			}
+		}
+		if len(conflicts) > 0 {
+			out = append(out, PeerSelectorConflicts{
+				PeerID:    peer.PeerID,
+				Hostname:  peer.Hostname,
+				Conflicts: conflicts,
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PeerID < out[j].PeerID })
+	return out
+}
+
+func tunnelSelectorRefs(policyID string, tunnel ipsec.TunnelConfig) []SelectorRef {
+	refs := make([]SelectorRef, 0, len(tunnel.TrafficSelectors))
+	for i, ts := range tunnel.TrafficSelectors {
+		refs = append(refs, SelectorRef{PolicyID: policyID, Tunnel: tunnel.Name, Index: i, Selector: ts})
+	}
+	return refs
+}
+
+// parseSelectorPrefix accepts a CIDR or a single address
+func parseSelectorPrefix(s string) (netip.Prefix, error) {
+	if IsTemplate(s) {
+		return netip.Prefix{}, fmt.Errorf("unresolved template")
+	}
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// prefixContains reports whether every address in b is also in a
+func prefixContains(a, b netip.Prefix) bool {
+	return a.Bits() <= b.Bits() && a.Contains(b.Addr())
+}
+
+// portsOverlap reports whether two selectors can match the same protocol and
+// ports. An empty protocol or zero port matches anything.
+func portsOverlap(a, b ipsec.TrafficSelector) bool {
+	return (a.Protocol == "" || b.Protocol == "" || a.Protocol == b.Protocol) &&
+		(a.LocalPort == 0 || b.LocalPort == 0 || a.LocalPort == b.LocalPort) &&
+		(a.RemotePort == 0 || b.RemotePort == 0 || a.RemotePort == b.RemotePort)
+}
+
+// portsContain reports whether a's protocol and ports include all of b's
+func portsContain(a, b ipsec.TrafficSelector) bool {
+	return (a.Protocol == "" || a.Protocol == b.Protocol) &&
+		(a.LocalPort == 0 || a.LocalPort == b.LocalPort) &&
+		(a.RemotePort == 0 || a.RemotePort == b.RemotePort)
+}
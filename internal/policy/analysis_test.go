@@ -0,0 +1,233 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// selectorRef returns a reference to the first selector of a tunnel
+func selectorRef(policyID, tunnel string, ts ipsec.TrafficSelector) SelectorRef {
+	return SelectorRef{PolicyID: policyID, Tunnel: tunnel, Selector: ts}
+}
+
+// selectorPolicy returns an enabled policy with one tunnel per selector,
+// named <id>-t0, <id>-t1 and so on
+func selectorPolicy(id string, appliesTo []string, selectors ...ipsec.TrafficSelector) Policy {
+	pol := Policy{ID: id, Name: id, Enabled: true, AppliesTo: appliesTo}
+	for i, ts := range selectors {
+		pol.Tunnels = append(pol.Tunnels, ipsec.TunnelConfig{
+			Name:             id + "-t" + string(rune('0'+i)),
+			TrafficSelectors: []ipsec.TrafficSelector{ts},
+		})
+	}
+	return pol
+}
+
+func TestFindSelectorConflicts(t *testing.T) {
+	sel := func(local, remote string) ipsec.TrafficSelector {
+		return ipsec.TrafficSelector{LocalSubnet: local, RemoteSubnet: remote}
+	}
+	withPorts := func(ts ipsec.TrafficSelector, protocol string, local, remote uint16) ipsec.TrafficSelector {
+		ts.Protocol, ts.LocalPort, ts.RemotePort = protocol, local, remote
+		return ts
+	}
+
+	tests := []struct {
+		name string
+		a, b ipsec.TrafficSelector
+		kind SelectorConflictKind // Empty for no conflict
+		swap bool                 // The conflict names b first, as the broader selector
+	}{
+		{name: "exact duplicate", a: sel("10.1.0.0/24", "10.2.0.0/24"), b: sel("10.1.0.0/24", "10.2.0.0/24"), kind: SelectorDuplicate},
+		{name: "duplicate up to host bits", a: sel("10.1.0.7/24", "10.2.0.0/24"), b: sel("10.1.0.0/24", "10.2.0.0/24"), kind: SelectorDuplicate},
+		{name: "a shadows b", a: sel("10.1.0.0/16", "10.2.0.0/16"), b: sel("10.1.1.0/24", "10.2.0.0/24"), kind: SelectorShadowed},
+		{name: "b shadows a", a: sel("10.1.1.0/24", "10.2.0.0/24"), b: sel("10.1.0.0/16", "10.2.0.0/16"), kind: SelectorShadowed, swap: true},
+		{name: "single address inside a subnet", a: sel("10.1.1.0/24", "10.2.0.0/24"), b: sel("10.1.1.5", "10.2.0.9"), kind: SelectorShadowed},
+		{name: "partial overlap", a: sel("10.1.0.0/16", "10.2.0.0/24"), b: sel("10.1.0.0/24", "10.2.0.0/16"), kind: SelectorOverlap},
+		{name: "disjoint local subnets", a: sel("10.1.0.0/24", "10.2.0.0/24"), b: sel("10.3.0.0/24", "10.2.0.0/24")},
+		{name: "disjoint remote subnets", a: sel("10.1.0.0/24", "10.2.0.0/24"), b: sel("10.1.0.0/24", "10.4.0.0/24")},
+		{name: "adjacent subnets", a: sel("10.1.0.0/25", "10.2.0.0/24"), b: sel("10.1.0.128/25", "10.2.0.0/24")},
+
+		{name: "different protocols", a: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "tcp", 0, 0), b: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "udp", 0, 0)},
+		{name: "any protocol shadows one", a: sel("10.1.0.0/24", "10.2.0.0/24"), b: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "tcp", 0, 0), kind: SelectorShadowed},
+		{name: "different remote ports", a: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "tcp", 0, 443), b: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "tcp", 0, 80)},
+		{name: "different local ports", a: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "udp", 500, 0), b: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "udp", 4500, 0)},
+		{name: "any port shadows one", a: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "tcp", 0, 443), b: withPorts(sel("10.1.0.0/24", "10.2.0.0/24"), "tcp", 0, 0), kind: SelectorShadowed, swap: true},
+		{name: "wider subnets but narrower ports", a: withPorts(sel("10.1.0.0/16", "10.2.0.0/16"), "tcp", 0, 443), b: sel("10.1.0.0/24", "10.2.0.0/24"), kind: SelectorOverlap},
+
+		{name: "IPv6 duplicate", a: sel("2001:db8:a::/64", "2001:db8:b::/64"), b: sel("2001:db8:a::/64", "2001:db8:b::/64"), kind: SelectorDuplicate},
+		{name: "IPv6 shadowed", a: sel("2001:db8::/32", "2001:db8:b::/48"), b: sel("2001:db8:a::/64", "2001:db8:b:1::/64"), kind: SelectorShadowed},
+		{name: "IPv6 partial overlap", a: sel("2001:db8::/32", "2001:db8:b::/64"), b: sel("2001:db8:a::/64", "2001:db8::/32"), kind: SelectorOverlap},
+		{name: "IPv6 disjoint", a: sel("2001:db8:a::/64", "2001:db8:b::/64"), b: sel("2001:db8:c::/64", "2001:db8:b::/64")},
+		{name: "IPv4 and IPv6", a: sel("10.1.0.0/24", "10.2.0.0/24"), b: sel("::ffff:10.1.0.0/120", "::ffff:10.2.0.0/120")},
+
+		{name: "templated selector", a: sel("{{ .Peer.Metadata.lan }}", "10.2.0.0/24"), b: sel("10.1.0.0/24", "10.2.0.0/24")},
+		{name: "unparsable selector", a: sel("lan", "10.2.0.0/24"), b: sel("10.1.0.0/24", "10.2.0.0/24")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := selectorRef("p", "a", tt.a), selectorRef("q", "b", tt.b)
+			conflicts := FindSelectorConflicts([]SelectorRef{a, b})
+			if tt.kind == "" {
+				if len(conflicts) != 0 {
+					t.Errorf("got conflicts %+v, want none", conflicts)
+				}
+				return
+			}
+			if len(conflicts) != 1 {
+				t.Fatalf("got %d conflicts, want one %s", len(conflicts), tt.kind)
+			}
+			wantA, wantB := a, b
+			if tt.swap {
+				wantA, wantB = b, a
+			}
+			got := conflicts[0]
+			if got.Kind != tt.kind || !reflect.DeepEqual(got.A, wantA) || !reflect.DeepEqual(got.B, wantB) {
+				t.Errorf("got %s between %s and %s, want %s between %s and %s",
+					got.Kind, got.A.Tunnel, got.B.Tunnel, tt.kind, wantA.Tunnel, wantB.Tunnel)
+			}
+		})
+	}
+
+	// Selectors of the same tunnel are never compared
+	same := ipsec.TrafficSelector{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24"}
+	if conflicts := FindSelectorConflicts([]SelectorRef{selectorRef("p", "a", same), selectorRef("p", "a", same)}); len(conflicts) != 0 {
+		t.Errorf("selectors of one tunnel conflict: %+v", conflicts)
+	}
+}
+
+func TestSelectorOverlapValidator(t *testing.T) {
+	ts := func(local, remote string) ipsec.TrafficSelector {
+		return ipsec.TrafficSelector{LocalSubnet: local, RemoteSubnet: remote}
+	}
+
+	tests := []struct {
+		name     string
+		tunnels  []ipsec.TunnelConfig
+		findings []string // "path code"
+	}{
+		{
+			name: "separate tunnels",
+			tunnels: []ipsec.TunnelConfig{
+				{Name: "a", TrafficSelectors: []ipsec.TrafficSelector{ts("10.1.0.0/24", "10.2.0.0/24")}},
+				{Name: "b", TrafficSelectors: []ipsec.TrafficSelector{ts("10.1.0.0/24", "10.3.0.0/24")}},
+			},
+		},
+		{
+			name: "overlapping selectors in one tunnel",
+			tunnels: []ipsec.TunnelConfig{
+				{Name: "a", TrafficSelectors: []ipsec.TrafficSelector{ts("10.1.0.0/16", "10.2.0.0/24"), ts("10.1.0.0/24", "10.2.0.0/24")}},
+			},
+		},
+		{
+			name: "duplicate across tunnels",
+			tunnels: []ipsec.TunnelConfig{
+				{Name: "a", TrafficSelectors: []ipsec.TrafficSelector{ts("10.1.0.0/24", "10.2.0.0/24")}},
+				{Name: "b", TrafficSelectors: []ipsec.TrafficSelector{ts("10.5.0.0/24", "10.6.0.0/24"), ts("10.1.0.0/24", "10.2.0.0/24")}},
+			},
+			findings: []string{"tunnels[1].traffic_selectors[1] selectors.duplicate"},
+		},
+		{
+			name: "later tunnel shadows an earlier one",
+			tunnels: []ipsec.TunnelConfig{
+				{Name: "a", TrafficSelectors: []ipsec.TrafficSelector{ts("10.1.1.0/24", "10.2.0.0/24")}},
+				{Name: "b", TrafficSelectors: []ipsec.TrafficSelector{ts("10.1.0.0/16", "10.2.0.0/16")}},
+			},
+			findings: []string{"tunnels[0].traffic_selectors[0] selectors.shadowed"},
+		},
+		{
+			name: "IPv6 overlap",
+			tunnels: []ipsec.TunnelConfig{
+				{Name: "a", TrafficSelectors: []ipsec.TrafficSelector{ts("2001:db8::/32", "2001:db8:b::/64")}},
+				{Name: "b", TrafficSelectors: []ipsec.TrafficSelector{ts("2001:db8:a::/64", "2001:db8::/32")}},
+			},
+			findings: []string{"tunnels[1].traffic_selectors[0] selectors.overlap"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range (&SelectorOverlapValidator{}).Validate(&Policy{ID: "p", Tunnels: tt.tunnels}) {
+				if f.Severity != SeverityError {
+					t.Errorf("finding %s is a %s, want an error", f.Code, f.Severity)
+				}
+				got = append(got, f.Path+" "+f.Code)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.findings, "\n") {
+				t.Errorf("got findings %q, want %q", got, tt.findings)
+			}
+		})
+	}
+}
+
+func TestAnalyzeSelectors(t *testing.T) {
+	engine := NewPolicyEngine()
+	lan := ipsec.TrafficSelector{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24"}
+	peers := []PeerInfo{
+		{ID: "peer-1", Hostname: "one", Metadata: map[string]string{"lan": "10.1.0.0/24"}},
+		{ID: "peer-2", Hostname: "two", Metadata: map[string]string{"lan": "10.9.0.0/24"}},
+	}
+
+	everywhere := selectorPolicy("everywhere", nil, lan)
+	onlyOne := selectorPolicy("only-one", []string{"peer-1"}, lan)
+	onlyTwo := selectorPolicy("only-two", []string{"peer-2"}, ipsec.TrafficSelector{LocalSubnet: "10.1.0.0/16", RemoteSubnet: "10.2.0.0/16"})
+	templated := selectorPolicy("templated", nil, ipsec.TrafficSelector{LocalSubnet: "{{ .Peer.Metadata.lan }}", RemoteSubnet: "10.2.0.0/24"})
+	disabled := selectorPolicy("disabled", nil, lan)
+	disabled.Enabled = false
+
+	analysis := engine.AnalyzeSelectors([]Policy{everywhere, onlyOne, onlyTwo, templated, disabled}, peers)
+
+	// Cross-policy conflicts as written; the templated selector cannot be compared
+	var policyConflicts []string
+	for _, c := range analysis.Policies {
+		policyConflicts = append(policyConflicts, string(c.Kind)+" "+c.A.PolicyID+" "+c.B.PolicyID+" "+strings.Join(c.Peers, ","))
+	}
+	wantPolicies := []string{
+		"duplicate everywhere only-one peer-1",
+		"shadowed only-two everywhere peer-2",
+		"shadowed only-two only-one ",
+	}
+	if strings.Join(policyConflicts, "\n") != strings.Join(wantPolicies, "\n") {
+		t.Errorf("policy conflicts:\n%s\nwant:\n%s", strings.Join(policyConflicts, "\n"), strings.Join(wantPolicies, "\n"))
+	}
+
+	// Per peer, after templates are resolved
+	peerConflicts := make(map[string][]string)
+	for _, peer := range analysis.Peers {
+		for _, c := range peer.Conflicts {
+			peerConflicts[peer.PeerID] = append(peerConflicts[peer.PeerID], string(c.Kind)+" "+c.A.PolicyID+" "+c.B.PolicyID)
+		}
+	}
+	wantPeers := map[string][]string{
+		"peer-1": {"duplicate everywhere only-one", "duplicate everywhere templated", "duplicate only-one templated"},
+		"peer-2": {"shadowed only-two everywhere"},
+	}
+	if !reflect.DeepEqual(peerConflicts, wantPeers) {
+		t.Errorf("peer conflicts %v, want %v", peerConflicts, wantPeers)
+	}
+
+	tests := []struct {
+		policyID string
+		peers    []string
+	}{
+		{"everywhere", []string{"peer-1", "peer-2"}},
+		{"only-one", []string{"peer-1"}},
+		{"only-two", []string{"peer-2"}},
+		{"templated", []string{"peer-1"}},
+		{"disabled", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, peer := range analysis.ConflictsInvolving(tt.policyID) {
+			got = append(got, peer.PeerID)
+		}
+		if !reflect.DeepEqual(got, tt.peers) {
+			t.Errorf("ConflictsInvolving(%s) on peers %v, want %v", tt.policyID, got, tt.peers)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package policy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// The server embeds a small certificate authority for tunnels with
+// "auth: certificate, issuer: builtin". Agents generate their key pair
+// locally and send a certificate signing request (CSR) when they register;
+// the CA issues a certificate naming the peer's ID and hostname as DNS names
+// and its addresses as IP addresses in the subject alternative name, and
+// returns it with the CA certificate as the chain. Only the public key of a
+// CSR is used: the CA chooses every name. Agents renew with a new key once
+// two thirds of a certificate's lifetime have passed, and revoked
+// certificates are listed in the CRL the server serves.
+
+// DefaultCAName is the common name of a generated CA certificate
+const DefaultCAName = "IPsec Manager CA"
+
+// caValidity is the lifetime of a generated CA certificate
+const caValidity = 10 * 365 * 24 * time.Hour
+
+// ikeIntermediateOID is the "IP security IKE intermediate" extended key
+// usage, which Windows and some gateways expect on IKE certificates
+var ikeIntermediateOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 8, 2, 2}
+
+var dnsNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// Revocation reasons, with their CRL reason codes
+var revocationReasons = map[string]int{
+	"unspecified":            0,
+	"key_compromise":         1,
+	"ca_compromise":          2,
+	"affiliation_changed":    3,
+	"superseded":             4,
+	"cessation_of_operation": 5,
+}
+
+// CAKeyPair is the stored form of the built-in CA: its certificate and
+// private key, PEM-encoded. The key is sealed at rest like the PSKs.
+type CAKeyPair struct {
+	Certificate string    `json:"certificate"`
+	Key         string    `json:"key"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CertificateAuthority issues peer certificates and signs CRLs
+type CertificateAuthority struct {
+	cert    *x509.Certificate
+	certPEM string
+	key     crypto.Signer
+}
+
+// CAInfo describes the built-in CA
+type CAInfo struct {
+	Subject     string    `json:"subject"`
+	Certificate string    `json:"certificate"` // PEM
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	CRLURL      string    `json:"crl_url,omitempty"` // Written into issued certificates
+}
+
+// IssuedCertificate is a certificate the CA issued to a peer
+type IssuedCertificate struct {
+	Serial           string     `json:"serial"` // Hexadecimal
+	PeerID           string     `json:"peer_id"`
+	DNSNames         []string   `json:"dns_names"`
+	IPAddresses      []string   `json:"ip_addresses,omitempty"`
+	NotBefore        time.Time  `json:"not_before"`
+	NotAfter         time.Time  `json:"not_after"`
+	Certificate      string     `json:"certificate"`     // PEM
+	Chain            string     `json:"chain,omitempty"` // PEM CA certificate; returned when issued
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+}
+
+// IssueOptions are the settings of issued certificates
+type IssueOptions struct {
+	Validity time.Duration
+	CRLURL   string // CRL distribution point; none when empty
+}
+
+// GenerateCA creates a self-signed CA certificate with a new ECDSA P-256
+// key
+func GenerateCA(name string, now time.Time) (*CAKeyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CAKeyPair{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:         keyPEM,
+		CreatedAt:   now,
+	}, nil
+}
+
+// LoadCA reads a stored CA
+func LoadCA(pair *CAKeyPair) (*CertificateAuthority, error) {
+	cert, err := ParseCertificatePEM(pair.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("CA certificate: %w", err)
+	}
+	key, err := parsePrivateKey(pair.Key)
+	if err != nil {
+		return nil, fmt.Errorf("CA key: %w", err)
+	}
+	return &CertificateAuthority{cert: cert, certPEM: pair.Certificate, key: key}, nil
+}
+
+// Info describes the CA
+func (ca *CertificateAuthority) Info(crlURL string) CAInfo {
+	return CAInfo{
+		Subject:     ca.cert.Subject.String(),
+		Certificate: ca.certPEM,
+		NotBefore:   ca.cert.NotBefore,
+		NotAfter:    ca.cert.NotAfter,
+		CRLURL:      crlURL,
+	}
+}
+
+// Issue signs a certificate for a peer with the public key of a CSR
+func (ca *CertificateAuthority) Issue(csrPEM string, peer *PeerInfo, opts IssueOptions, now time.Time) (*IssuedCertificate, error) {
+	csr, err := ParseCertificateRequest(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames, ips := peerCertificateNames(peer)
+	if len(dnsNames) == 0 {
+		return nil, fmt.Errorf("neither the peer ID nor the hostname of peer %s is a DNS name", peer.ID)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := now.Add(opts.Validity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:       serial,
+		Subject:            pkix.Name{CommonName: peer.ID},
+		NotBefore:          now.Add(-5 * time.Minute),
+		NotAfter:           notAfter,
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{ikeIntermediateOID},
+		DNSNames:           dnsNames,
+		IPAddresses:        ips,
+	}
+	if opts.CRLURL != "" {
+		template.CRLDistributionPoints = []string{opts.CRLURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	issued := &IssuedCertificate{
+		Serial:      serial.Text(16),
+		PeerID:      peer.ID,
+		DNSNames:    dnsNames,
+		NotBefore:   template.NotBefore,
+		NotAfter:    template.NotAfter,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Chain:       ca.certPEM,
+	}
+	for _, ip := range ips {
+		issued.IPAddresses = append(issued.IPAddresses, ip.String())
+	}
+	return issued, nil
+}
+
+// peerCertificateNames returns the names a peer's certificate carries: its
+// ID and hostname where they are DNS names, and its routable addresses,
+// which are its IKE identity when a tunnel sets no local_id
+func peerCertificateNames(peer *PeerInfo) ([]string, []net.IP) {
+	var dnsNames []string
+	for _, name := range []string{peer.ID, peer.Hostname} {
+		if !dnsNamePattern.MatchString(name) || len(name) > 253 {
+			continue
+		}
+		name = strings.ToLower(name)
+		if len(dnsNames) == 0 || dnsNames[0] != name {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+
+	var ips []net.IP
+	seen := make(map[string]bool)
+	for _, address := range append([]string{peer.IPAddress}, peer.Addresses...) {
+		ip := net.ParseIP(address)
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip)
+	}
+	return dnsNames, ips
+}
+
+// CRL returns the DER-encoded CRL listing the revoked certificates, valid
+// until now plus validity
+func (ca *CertificateAuthority) CRL(revoked []IssuedCertificate, now time.Time, validity time.Duration) ([]byte, error) {
+	list := &x509.RevocationList{
+		Number:     big.NewInt(now.Unix()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(validity),
+	}
+	for _, cert := range revoked {
+		if cert.RevokedAt == nil {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(cert.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %q", cert.Serial)
+		}
+		list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: *cert.RevokedAt,
+			ReasonCode:     revocationReasons[cert.RevocationReason],
+		})
+	}
+	return x509.CreateRevocationList(rand.Reader, list, ca.cert, ca.key)
+}
+
+// ValidRevocationReason reports whether reason is a known revocation reason
+func ValidRevocationReason(reason string) bool {
+	_, ok := revocationReasons[reason]
+	return ok
+}
+
+// ParseCertificateRequest reads a PEM-encoded CSR and checks its signature
+// and key. ECDSA P-256 and P-384 keys and RSA keys of at least 2048 bits are
+// accepted.
+func ParseCertificateRequest(csrPEM string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("CSR is not a PEM CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %w", err)
+	}
+
+	switch key := csr.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() && key.Curve != elliptic.P384() {
+			return nil, fmt.Errorf("CSR key: only ECDSA P-256 and P-384 are accepted")
+		}
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("CSR key: RSA keys must be at least 2048 bits")
+		}
+	default:
+		return nil, fmt.Errorf("CSR key: only ECDSA and RSA keys are accepted")
+	}
+	return csr, nil
+}
+
+// ParseCertificatePEM reads the first certificate of a PEM document
+func ParseCertificatePEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM CERTIFICATE")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// CheckKeyPair checks that a PEM-encoded private key belongs to a certificate
+func CheckKeyPair(cert *x509.Certificate, keyPEM string) error {
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return err
+	}
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(cert.PublicKey) {
+		return fmt.Errorf("key does not match certificate %s", cert.SerialNumber.Text(16))
+	}
+	return nil
+}
+
+// NewPeerKey generates a peer's ECDSA P-256 key and a CSR for it. The CA
+// ignores the CSR's names, so it only carries the peer ID as common name.
+// Both are PEM-encoded.
+func NewPeerKey(peerID string) (keyPEM, csrPEM string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: peerID},
+	}, key)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create CSR: %w", err)
+	}
+	if keyPEM, err = encodePrivateKey(key); err != nil {
+		return "", "", err
+	}
+	return keyPEM, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// checkIssuer validates a certificate tunnel with an issuer, whose agent
+// supplies the certificate files
+func checkIssuer(index int, auth ipsec.AuthConfig) []Finding {
+	if auth.Issuer != ipsec.IssuerBuiltin {
+		return []Finding{errorFinding(tunnelPath(index, "auth.issuer"), "security.issuer",
+			"unknown issuer %q: only %q is supported", auth.Issuer, ipsec.IssuerBuiltin)}
+	}
+
+	var findings []Finding
+	paths := []struct{ field, value string }{
+		{"cert_path", auth.CertPath}, {"key_path", auth.KeyPath}, {"ca_cert_path", auth.CACertPath},
+	}
+	for _, path := range paths {
+		if path.value != "" {
+			findings = append(findings, errorFinding(tunnelPath(index, "auth."+path.field), "security.issuer",
+				"%s is set by the agent for certificates from the %s issuer", path.field, auth.Issuer))
+		}
+	}
+	return findings
+}
+
+// CertificateDue reports whether a certificate should be renewed: once two
+// thirds of its lifetime have passed
+func CertificateDue(cert *x509.Certificate, now time.Time) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return now.After(cert.NotBefore.Add(lifetime * 2 / 3))
+}
+
+func encodePrivateKey(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// parsePrivateKey reads a PEM-encoded PKCS #8 private key
+func parsePrivateKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type")
+	}
+	return key, nil
+}
+
+// randomSerial returns a random positive 128-bit serial number
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
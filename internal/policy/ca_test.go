@@ -0,0 +1,304 @@
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+func testCA(t *testing.T, now time.Time) *CertificateAuthority {
+	t.Helper()
+	pair, err := GenerateCA("Test CA", now)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	ca, err := LoadCA(pair)
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	return ca
+}
+
+func testCSR(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "ignored"},
+		DNSNames: []string{"ignored.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatalf("CreateCertificateRequest: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestIssueNames(t *testing.T) {
+	now := time.Now()
+	ca := testCA(t, now)
+	_, csr, err := NewPeerKey("peer")
+	if err != nil {
+		t.Fatalf("NewPeerKey: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		peer PeerInfo
+		dns  []string
+		ips  []string
+		err  string
+	}{
+		{
+			name: "id and hostname",
+			peer: PeerInfo{ID: "gw-1", Hostname: "GW1.Example.com", IPAddress: "203.0.113.1"},
+			dns:  []string{"gw-1", "gw1.example.com"},
+			ips:  []string{"203.0.113.1"},
+		},
+		{
+			name: "same id and hostname",
+			peer: PeerInfo{ID: "gw1", Hostname: "GW1"},
+			dns:  []string{"gw1"},
+		},
+		{
+			name: "uuid id",
+			peer: PeerInfo{ID: "6f1c2d3e-1111-2222-3333-444455556666", Hostname: "gw_1"},
+			dns:  []string{"6f1c2d3e-1111-2222-3333-444455556666"},
+		},
+		{
+			name: "addresses skip loopback, link-local and duplicates",
+			peer: PeerInfo{ID: "gw", IPAddress: "198.51.100.7", Addresses: []string{"127.0.0.1", "fe80::1", "2001:db8::7", "198.51.100.7", "0.0.0.0", "bogus"}},
+			dns:  []string{"gw"},
+			ips:  []string{"198.51.100.7", "2001:db8::7"},
+		},
+		{
+			name: "no dns name",
+			peer: PeerInfo{ID: "gw 1", Hostname: "-gw"},
+			err:  "is a DNS name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued, err := ca.Issue(csr, &tt.peer, IssueOptions{Validity: 24 * time.Hour}, now)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Issue error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Issue: %v", err)
+			}
+
+			cert, err := ParseCertificatePEM(issued.Certificate)
+			if err != nil {
+				t.Fatalf("ParseCertificatePEM: %v", err)
+			}
+			if !slices.Equal(cert.DNSNames, tt.dns) || !slices.Equal(issued.DNSNames, tt.dns) {
+				t.Errorf("DNS names %v / %v, want %v", cert.DNSNames, issued.DNSNames, tt.dns)
+			}
+			var ips []string
+			for _, ip := range cert.IPAddresses {
+				ips = append(ips, ip.String())
+			}
+			if !slices.Equal(ips, tt.ips) || !slices.Equal(issued.IPAddresses, tt.ips) {
+				t.Errorf("IP addresses %v / %v, want %v", ips, issued.IPAddresses, tt.ips)
+			}
+			if cert.Subject.CommonName != tt.peer.ID {
+				t.Errorf("common name %q, want %q", cert.Subject.CommonName, tt.peer.ID)
+			}
+		})
+	}
+}
+
+func TestIssueCertificate(t *testing.T) {
+	now := time.Now()
+	ca := testCA(t, now)
+	keyPEM, csr, err := NewPeerKey("gw-1")
+	if err != nil {
+		t.Fatalf("NewPeerKey: %v", err)
+	}
+
+	peer := &PeerInfo{ID: "gw-1"}
+	issued, err := ca.Issue(csr, peer, IssueOptions{Validity: 90 * 24 * time.Hour, CRLURL: "http://ca.example.com/api/ca/crl"}, now)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	cert, err := ParseCertificatePEM(issued.Certificate)
+	if err != nil {
+		t.Fatalf("ParseCertificatePEM: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(issued.Chain)) {
+		t.Fatalf("chain holds no certificate")
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "gw-1", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("certificate does not verify against the chain: %v", err)
+	}
+	if err := CheckKeyPair(cert, keyPEM); err != nil {
+		t.Errorf("CheckKeyPair: %v", err)
+	}
+	otherKey, _, _ := NewPeerKey("gw-1")
+	if err := CheckKeyPair(cert, otherKey); err == nil {
+		t.Errorf("CheckKeyPair accepted another key")
+	}
+
+	if !slices.Equal(cert.CRLDistributionPoints, []string{"http://ca.example.com/api/ca/crl"}) {
+		t.Errorf("CRL distribution points %v", cert.CRLDistributionPoints)
+	}
+	if !slices.ContainsFunc(cert.UnknownExtKeyUsage, ikeIntermediateOID.Equal) {
+		t.Errorf("extended key usages %v lack IKE intermediate", cert.UnknownExtKeyUsage)
+	}
+	if issued.Serial != cert.SerialNumber.Text(16) || issued.PeerID != "gw-1" {
+		t.Errorf("issued %s for %s, certificate serial %s", issued.Serial, issued.PeerID, cert.SerialNumber.Text(16))
+	}
+
+	// Validity is capped at the CA's
+	long, err := ca.Issue(csr, peer, IssueOptions{Validity: 20 * 365 * 24 * time.Hour}, now)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if !long.NotAfter.Equal(ca.cert.NotAfter) {
+		t.Errorf("not after %v, want the CA's %v", long.NotAfter, ca.cert.NotAfter)
+	}
+}
+
+func TestParseCertificateRequest(t *testing.T) {
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p224, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	rsa1024, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, p256CSR, _ := NewPeerKey("peer")
+
+	// A CSR whose signature no longer matches its content
+	block, _ := pem.Decode([]byte(p256CSR))
+	tampered := append([]byte(nil), block.Bytes...)
+	tampered[len(tampered)-5] ^= 0xff
+
+	tests := []struct {
+		name string
+		csr  string
+		err  string
+	}{
+		{"p256", p256CSR, ""},
+		{"p384", testCSR(t, p384), ""},
+		{"p224", testCSR(t, p224), "only ECDSA P-256 and P-384"},
+		{"rsa1024", testCSR(t, rsa1024), "at least 2048 bits"},
+		{"not pem", "csr", "not a PEM CERTIFICATE REQUEST"},
+		{"wrong type", strings.Replace(p256CSR, "CERTIFICATE REQUEST", "CERTIFICATE", 2), "not a PEM CERTIFICATE REQUEST"},
+		{"signature", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: tampered})), "invalid CSR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCertificateRequest(tt.csr)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("ParseCertificateRequest failed: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("ParseCertificateRequest error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCRL(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	ca := testCA(t, now)
+	revokedAt := now.Add(-time.Hour)
+
+	certs := []IssuedCertificate{
+		{Serial: "1a", RevokedAt: &revokedAt, RevocationReason: "key_compromise"},
+		{Serial: "2b", RevokedAt: &revokedAt, RevocationReason: "superseded"},
+		{Serial: "3c"}, // Not revoked
+	}
+	der, err := ca.CRL(certs, now, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("CRL: %v", err)
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("ParseRevocationList: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(ca.cert); err != nil {
+		t.Errorf("CRL signature: %v", err)
+	}
+	if !crl.NextUpdate.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("next update %v, want %v", crl.NextUpdate, now.Add(24*time.Hour))
+	}
+
+	want := map[string]int{"1a": 1, "2b": 4}
+	if len(crl.RevokedCertificateEntries) != len(want) {
+		t.Fatalf("CRL lists %d certificates, want %d", len(crl.RevokedCertificateEntries), len(want))
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		reason, ok := want[entry.SerialNumber.Text(16)]
+		if !ok || entry.ReasonCode != reason || !entry.RevocationTime.Equal(revokedAt) {
+			t.Errorf("entry %s: reason %d at %v", entry.SerialNumber.Text(16), entry.ReasonCode, entry.RevocationTime)
+		}
+	}
+
+	if _, err := ca.CRL([]IssuedCertificate{{Serial: "xyz", RevokedAt: &revokedAt}}, now, time.Hour); err == nil {
+		t.Errorf("CRL accepted an invalid serial")
+	}
+}
+
+func TestCertificateDue(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: start, NotAfter: start.Add(90 * 24 * time.Hour)}
+
+	tests := []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, false},
+		{59 * 24 * time.Hour, false},
+		{60*24*time.Hour + time.Second, true},
+		{100 * 24 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		if got := CertificateDue(cert, start.Add(tt.at)); got != tt.want {
+			t.Errorf("CertificateDue after %v = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestCheckIssuer(t *testing.T) {
+	tests := []struct {
+		name  string
+		auth  ipsec.AuthConfig
+		paths []string
+	}{
+		{"builtin", ipsec.AuthConfig{Issuer: ipsec.IssuerBuiltin}, nil},
+		{"unknown", ipsec.AuthConfig{Issuer: "acme"}, []string{"tunnels[0].auth.issuer"}},
+		{
+			"paths set",
+			ipsec.AuthConfig{Issuer: ipsec.IssuerBuiltin, CertPath: "a", KeyPath: "b", CACertPath: "c"},
+			[]string{"tunnels[0].auth.cert_path", "tunnels[0].auth.key_path", "tunnels[0].auth.ca_cert_path"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			for _, f := range checkIssuer(0, tt.auth) {
+				if f.Code != "security.issuer" {
+					t.Errorf("finding code %s, want security.issuer", f.Code)
+				}
+				paths = append(paths, f.Path)
+			}
+			if !slices.Equal(paths, tt.paths) {
+				t.Errorf("findings at %v, want %v", paths, tt.paths)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// Built-in compliance profile names
+const (
+	ProfileLegacy   = "legacy"
+	ProfileFIPS1403 = "fips-140-3"
+	ProfileCNSA20   = "cnsa-2.0"
+)
+
+// Compliance rule names, used in violation messages
+const (
+	RuleEncryption  = "encryption"
+	RuleIntegrity   = "integrity"
+	RuleDHGroup     = "dh_group"
+	RuleIKEVersion  = "ike_version"
+	RuleLifetimeMin = "lifetime_min"
+	RuleLifetimeMax = "lifetime_max"
+)
+
+// ComplianceProfile is a named set of allowed algorithms and SA lifetime limits
+type ComplianceProfile struct {
+	Name         string                      `json:"name"`
+	Description  string                      `json:"description"`
+	Encryption   []ipsec.EncryptionAlgorithm `json:"encryption"`
+	Integrity    []ipsec.IntegrityAlgorithm  `json:"integrity"`
+	DHGroups     []ipsec.DHGroup             `json:"dh_groups"`
+	RequireIKEv2 bool                        `json:"require_ikev2"`
+	MinLifetime  time.Duration               `json:"min_lifetime"`
+	MaxLifetime  time.Duration               `json:"max_lifetime"`
+}
+
+var complianceProfiles = map[string]*ComplianceProfile{
+	ProfileLegacy: {
+		Name:        ProfileLegacy,
+		Description: "Every supported algorithm, including 3DES, SHA-1 and modp1024; the server-wide default",
+		Encryption: []ipsec.EncryptionAlgorithm{
+			ipsec.EncryptionAES128, ipsec.EncryptionAES256,
+			ipsec.EncryptionAES128GCM, ipsec.EncryptionAES256GCM,
+			ipsec.Encryption3DES,
+		},
+		Integrity: []ipsec.IntegrityAlgorithm{
+			ipsec.IntegritySHA1, ipsec.IntegritySHA256, ipsec.IntegritySHA384, ipsec.IntegritySHA512,
+		},
+		DHGroups: []ipsec.DHGroup{
+			ipsec.DHGroupModp1024, ipsec.DHGroupModp1536,
+			ipsec.DHGroupModp2048, ipsec.DHGroupModp3072, ipsec.DHGroupModp4096, ipsec.DHGroupModp8192,
+			ipsec.DHGroupECP256, ipsec.DHGroupECP384, ipsec.DHGroupECP521,
+		},
+		MinLifetime: 5 * time.Minute,
+		MaxLifetime: 24 * time.Hour,
+	},
+	ProfileFIPS1403: {
+		Name:        ProfileFIPS1403,
+		Description: "FIPS 140-3 approved algorithms (SP 800-77r1)",
+		Encryption: []ipsec.EncryptionAlgorithm{
+			ipsec.EncryptionAES128, ipsec.EncryptionAES256,
+			ipsec.EncryptionAES128GCM, ipsec.EncryptionAES256GCM,
+		},
+		Integrity: []ipsec.IntegrityAlgorithm{
+			ipsec.IntegritySHA256, ipsec.IntegritySHA384, ipsec.IntegritySHA512,
+		},
+		DHGroups: []ipsec.DHGroup{
+			ipsec.DHGroupModp2048, ipsec.DHGroupModp3072, ipsec.DHGroupModp4096, ipsec.DHGroupModp8192,
+			ipsec.DHGroupECP256, ipsec.DHGroupECP384, ipsec.DHGroupECP521,
+		},
+		RequireIKEv2: true,
+		MinLifetime:  5 * time.Minute,
+		MaxLifetime:  24 * time.Hour,
+	},
+	ProfileCNSA20: {
+		Name:        ProfileCNSA20,
+		Description: "CNSA suite for national security systems (RFC 9206): AES-256, SHA-384+, P-384 or 3072-bit+ MODP, IKEv2",
+		Encryption: []ipsec.EncryptionAlgorithm{
+			ipsec.EncryptionAES256, ipsec.EncryptionAES256GCM,
+		},
+		Integrity: []ipsec.IntegrityAlgorithm{
+			ipsec.IntegritySHA384, ipsec.IntegritySHA512,
+		},
+		DHGroups: []ipsec.DHGroup{
+			ipsec.DHGroupModp3072, ipsec.DHGroupModp4096, ipsec.DHGroupModp8192,
+			ipsec.DHGroupECP384,
+		},
+		RequireIKEv2: true,
+		MinLifetime:  5 * time.Minute,
+		MaxLifetime:  8 * time.Hour,
+	},
+}
+
+// LookupComplianceProfile returns a built-in profile by name
+func LookupComplianceProfile(name string) (*ComplianceProfile, bool) {
+	profile, ok := complianceProfiles[name]
+	return profile, ok
+}
+
+// ComplianceProfiles returns every built-in profile, sorted by name
+func ComplianceProfiles() []ComplianceProfile {
+	profiles := make([]ComplianceProfile, 0, len(complianceProfiles))
+	for _, profile := range complianceProfiles {
+		profiles = append(profiles, *profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// ComplianceViolation is a tunnel setting that breaks a rule of a profile
+type ComplianceViolation struct {
+	Profile string `json:"profile"`
+	Rule    string `json:"rule"`
+	Tunnel  string `json:"tunnel"`
+	Index   int    `json:"index"`
+	Field   string `json:"field"` // Offending tunnel field, e.g. crypto.child.proposals[1].dhgroup
+	Message string `json:"message"`
+}
+
+func (v ComplianceViolation) Error() string {
+	return fmt.Sprintf("tunnel %d (%s): violates compliance profile %s, rule %s: %s",
+		v.Index, v.Tunnel, v.Profile, v.Rule, v.Message)
+}
+
+// Finding converts the violation to a validation finding
+func (v ComplianceViolation) Finding() Finding {
+	return errorFinding(tunnelPath(v.Index, v.Field), "compliance."+v.Rule,
+		"violates compliance profile %s, rule %s: %s", v.Profile, v.Rule, v.Message)
+}
+
+// Check returns every rule a tunnel breaks. Every IKE and child proposal is
+// checked, including fallbacks, and so is every SA lifetime.
+func (p *ComplianceProfile) Check(index int, tunnel ipsec.TunnelConfig) []ComplianceViolation {
+	var violations []ComplianceViolation
+	violation := func(rule, field, format string, args ...interface{}) {
+		violations = append(violations, ComplianceViolation{
+			Profile: p.Name,
+			Rule:    rule,
+			Tunnel:  tunnel.Name,
+			Index:   index,
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	crypto := tunnel.Crypto
+
+	for _, proposal := range offeredProposals(crypto) {
+		if !containsString(encryptionNames(p.Encryption), string(proposal.Encryption)) {
+			violation(RuleEncryption, proposal.Path+".encryption", "%s is not allowed (allowed: %s)",
+				proposal.Encryption, strings.Join(encryptionNames(p.Encryption), ", "))
+		}
+		if !containsString(integrityNames(p.Integrity), string(proposal.Integrity)) {
+			violation(RuleIntegrity, proposal.Path+".integrity", "%s is not allowed (allowed: %s)",
+				proposal.Integrity, strings.Join(integrityNames(p.Integrity), ", "))
+		}
+		if proposal.UsesDH && !containsString(dhGroupNames(p.DHGroups), string(proposal.DHGroup)) {
+			violation(RuleDHGroup, proposal.Path+".dhgroup", "%s is not allowed (allowed: %s)",
+				proposal.DHGroup, strings.Join(dhGroupNames(p.DHGroups), ", "))
+		}
+	}
+	if p.RequireIKEv2 && crypto.IKEVersion != ipsec.IKEv2 {
+		violation(RuleIKEVersion, "crypto.ikeversion", "%s is not allowed (requires %s)", crypto.IKEVersion, ipsec.IKEv2)
+	}
+	for _, lifetime := range saLifetimes(crypto) {
+		if p.MinLifetime > 0 && lifetime.Lifetime < p.MinLifetime {
+			violation(RuleLifetimeMin, lifetime.Path, "SA lifetime %s is shorter than %s", lifetime.Lifetime, p.MinLifetime)
+		}
+		if p.MaxLifetime > 0 && lifetime.Lifetime > p.MaxLifetime {
+			violation(RuleLifetimeMax, lifetime.Path, "SA lifetime %s is longer than %s", lifetime.Lifetime, p.MaxLifetime)
+		}
+	}
+
+	return violations
+}
+
+// offeredProposal is a proposal a tunnel offers, with the path of the crypto
+// fields it comes from
+type offeredProposal struct {
+	ipsec.Proposal
+	Path   string // e.g. crypto, or crypto.child.proposals[1]
+	UsesDH bool   // False for child proposals when PFS is off
+}
+
+// offeredProposals lists the IKE and child proposals of a tunnel. The flat
+// crypto fields are listed once if either SA falls back to them.
+func offeredProposals(crypto ipsec.CryptoConfig) []offeredProposal {
+	base := ipsec.Proposal{Encryption: crypto.Encryption, Integrity: crypto.Integrity, DHGroup: crypto.DHGroup}
+	var proposals []offeredProposal
+	if crypto.IKE == nil || len(crypto.IKE.Proposals) == 0 ||
+		crypto.Child == nil || len(crypto.Child.Proposals) == 0 {
+		proposals = append(proposals, offeredProposal{Proposal: base, Path: "crypto", UsesDH: true})
+	}
+	if crypto.IKE != nil {
+		for i, proposal := range crypto.IKE.Proposals {
+			proposals = append(proposals, offeredProposal{
+				Proposal: proposal,
+				Path:     fmt.Sprintf("crypto.ike.proposals[%d]", i),
+				UsesDH:   true,
+			})
+		}
+	}
+	if crypto.Child != nil {
+		for i, proposal := range crypto.Child.Proposals {
+			proposals = append(proposals, offeredProposal{
+				Proposal: proposal,
+				Path:     fmt.Sprintf("crypto.child.proposals[%d]", i),
+				UsesDH:   crypto.Child.PFSEnabled(),
+			})
+		}
+	}
+	return proposals
+}
+
+// saLifetime is an SA lifetime set on a tunnel, with the path of its field
+type saLifetime struct {
+	Path     string
+	Lifetime time.Duration
+}
+
+// saLifetimes lists the IKE lifetime, if set, and the child lifetime, which
+// is the flat lifetime unless the child section overrides it
+func saLifetimes(crypto ipsec.CryptoConfig) []saLifetime {
+	var lifetimes []saLifetime
+	if crypto.IKE != nil && crypto.IKE.Lifetime != 0 {
+		lifetimes = append(lifetimes, saLifetime{Path: "crypto.ike.lifetime", Lifetime: crypto.IKE.Lifetime})
+	}
+	if crypto.Child != nil && crypto.Child.Lifetime != 0 {
+		lifetimes = append(lifetimes, saLifetime{Path: "crypto.child.lifetime", Lifetime: crypto.Child.Lifetime})
+	} else {
+		lifetimes = append(lifetimes, saLifetime{Path: "crypto.lifetime", Lifetime: crypto.Lifetime})
+	}
+	return lifetimes
+}
+
+// ComplianceSettings selects the profiles policies are validated against.
+// Every policy must meet its own profile (Policy.Compliance, or Default when
+// unset). A peer carrying a tag listed in Tags must additionally meet that
+// tag's profile for every tunnel it receives, whatever the policy says.
+type ComplianceSettings struct {
+	Default string            // Server-wide profile
+	Tags    map[string]string // Peer tag -> profile
+}
+
+// SetCompliance replaces the engine's compliance settings after checking that
+// every profile they name exists. It is meant to be called during startup.
+func (e *PolicyEngine) SetCompliance(settings ComplianceSettings) error {
+	if settings.Default == "" {
+		settings.Default = ProfileLegacy
+	}
+	if _, ok := LookupComplianceProfile(settings.Default); !ok {
+		return fmt.Errorf("unknown compliance profile: %s", settings.Default)
+	}
+	for tag, name := range settings.Tags {
+		if _, ok := LookupComplianceProfile(name); !ok {
+			return fmt.Errorf("tag %s: unknown compliance profile: %s", tag, name)
+		}
+	}
+
+	*e.compliance = settings
+	return nil
+}
+
+func (s *ComplianceSettings) policyProfile(policy *Policy) (*ComplianceProfile, error) {
+	name := s.Default
+	if policy.Compliance != "" {
+		name = policy.Compliance
+	}
+	profile, ok := LookupComplianceProfile(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown compliance profile: %s", name)
+	}
+	return profile, nil
+}
+
+// CheckPeerCompliance returns the violations of a policy against the
+// profiles required by a peer's tags. Policies that do not apply to the peer
+// have none.
+func (e *PolicyEngine) CheckPeerCompliance(policy *Policy, peer *PeerInfo) []ComplianceViolation {
+	if len(targetedPolicies([]Policy{*policy}, peer)) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, tag := range peer.Tags {
+		if name, ok := e.compliance.Tags[tag]; ok && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var violations []ComplianceViolation
+	for _, name := range names {
+		profile, ok := LookupComplianceProfile(name)
+		if !ok {
+			continue
+		}
+		for i, tunnel := range policy.Tunnels {
+			violations = append(violations, profile.Check(i, tunnel)...)
+		}
+	}
+	return violations
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func encryptionNames(algs []ipsec.EncryptionAlgorithm) []string {
+	names := make([]string, len(algs))
+	for i, alg := range algs {
+		names[i] = string(alg)
+	}
+	return names
+}
+
+func integrityNames(algs []ipsec.IntegrityAlgorithm) []string {
+	names := make([]string, len(algs))
+	for i, alg := range algs {
+		names[i] = string(alg)
+	}
+	return names
+}
+
+func dhGroupNames(groups []ipsec.DHGroup) []string {
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		names[i] = string(group)
+	}
+	return names
+}
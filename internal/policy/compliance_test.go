@@ -0,0 +1,258 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// suiteTunnel returns a tunnel offering a single suite with a one hour lifetime
+func suiteTunnel(enc ipsec.EncryptionAlgorithm, integ ipsec.IntegrityAlgorithm, dh ipsec.DHGroup, ike ipsec.IKEVersion) ipsec.TunnelConfig {
+	tunnel := pskTunnel("t", "compliance-secret")
+	tunnel.Mode = ipsec.ModeESPTunnel
+	tunnel.LocalAddress = "192.0.2.1"
+	tunnel.RemoteAddress = "198.51.100.1"
+	tunnel.Crypto = ipsec.CryptoConfig{Encryption: enc, Integrity: integ, DHGroup: dh, IKEVersion: ike, Lifetime: time.Hour}
+	return tunnel
+}
+
+// violationList formats violations as "rule field"
+func violationList(violations []ComplianceViolation) []string {
+	var list []string
+	for _, v := range violations {
+		list = append(list, v.Rule+" "+v.Field)
+	}
+	return list
+}
+
+func TestComplianceProfileCheck(t *testing.T) {
+	modern := suiteTunnel(ipsec.EncryptionAES256GCM, ipsec.IntegritySHA384, ipsec.DHGroupECP384, ipsec.IKEv2)
+	fips := suiteTunnel(ipsec.EncryptionAES128, ipsec.IntegritySHA256, ipsec.DHGroupModp2048, ipsec.IKEv2)
+	old := suiteTunnel(ipsec.Encryption3DES, ipsec.IntegritySHA1, ipsec.DHGroupModp1024, ipsec.IKEv1)
+	with := func(tunnel ipsec.TunnelConfig, change func(*ipsec.TunnelConfig)) ipsec.TunnelConfig {
+		change(&tunnel)
+		return tunnel
+	}
+	pfs := func(on bool) *bool { return &on }
+
+	tests := []struct {
+		name    string
+		profile string
+		tunnel  ipsec.TunnelConfig
+		want    []string // "rule field"
+	}{
+		{name: "legacy allows old suites", profile: ProfileLegacy, tunnel: old},
+		{name: "legacy allows modern suites", profile: ProfileLegacy, tunnel: modern},
+		{
+			name:    "legacy lifetime limits",
+			profile: ProfileLegacy,
+			tunnel: with(modern, func(t *ipsec.TunnelConfig) {
+				t.Crypto.IKE = &ipsec.SAConfig{Lifetime: time.Minute}
+				t.Crypto.Lifetime = 48 * time.Hour
+			}),
+			want: []string{"lifetime_min crypto.ike.lifetime", "lifetime_max crypto.lifetime"},
+		},
+
+		{name: "FIPS allows approved suites", profile: ProfileFIPS1403, tunnel: fips},
+		{name: "FIPS allows CNSA suites", profile: ProfileFIPS1403, tunnel: modern},
+		{
+			name:    "FIPS rejects old suites",
+			profile: ProfileFIPS1403,
+			tunnel:  old,
+			want: []string{
+				"encryption crypto.encryption", "integrity crypto.integrity",
+				"dh_group crypto.dhgroup", "ike_version crypto.ikeversion",
+			},
+		},
+		{
+			name:    "FIPS checks fallback proposals",
+			profile: ProfileFIPS1403,
+			tunnel: with(fips, func(t *ipsec.TunnelConfig) {
+				t.Crypto.IKE = &ipsec.SAConfig{Proposals: []ipsec.Proposal{
+					{Encryption: ipsec.EncryptionAES256, Integrity: ipsec.IntegritySHA256, DHGroup: ipsec.DHGroupECP256},
+					{Encryption: ipsec.EncryptionAES256, Integrity: ipsec.IntegritySHA1, DHGroup: ipsec.DHGroupModp1536},
+				}}
+			}),
+			want: []string{"integrity crypto.ike.proposals[1].integrity", "dh_group crypto.ike.proposals[1].dhgroup"},
+		},
+		{
+			name:    "child DH groups only count with PFS",
+			profile: ProfileFIPS1403,
+			tunnel: with(fips, func(t *ipsec.TunnelConfig) {
+				t.Crypto.Child = &ipsec.SAConfig{PFS: pfs(false), Proposals: []ipsec.Proposal{
+					{Encryption: ipsec.EncryptionAES128GCM, Integrity: ipsec.IntegritySHA256, DHGroup: ipsec.DHGroupModp1024},
+				}}
+			}),
+		},
+		{
+			name:    "child DH groups with PFS",
+			profile: ProfileFIPS1403,
+			tunnel: with(fips, func(t *ipsec.TunnelConfig) {
+				t.Crypto.Child = &ipsec.SAConfig{PFS: pfs(true), Proposals: []ipsec.Proposal{
+					{Encryption: ipsec.EncryptionAES128GCM, Integrity: ipsec.IntegritySHA256, DHGroup: ipsec.DHGroupModp1024},
+				}}
+			}),
+			want: []string{"dh_group crypto.child.proposals[0].dhgroup"},
+		},
+
+		{name: "CNSA allows its suite", profile: ProfileCNSA20, tunnel: modern},
+		{
+			name:    "CNSA rejects FIPS-only suites",
+			profile: ProfileCNSA20,
+			tunnel:  fips,
+			want:    []string{"encryption crypto.encryption", "integrity crypto.integrity", "dh_group crypto.dhgroup"},
+		},
+		{
+			name:    "CNSA rejects P-256",
+			profile: ProfileCNSA20,
+			tunnel:  with(modern, func(t *ipsec.TunnelConfig) { t.Crypto.DHGroup = ipsec.DHGroupECP256 }),
+			want:    []string{"dh_group crypto.dhgroup"},
+		},
+		{
+			name:    "CNSA lifetime limit",
+			profile: ProfileCNSA20,
+			tunnel:  with(modern, func(t *ipsec.TunnelConfig) { t.Crypto.Child = &ipsec.SAConfig{Lifetime: 12 * time.Hour} }),
+			want:    []string{"lifetime_max crypto.child.lifetime"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, ok := LookupComplianceProfile(tt.profile)
+			if !ok {
+				t.Fatalf("no profile %s", tt.profile)
+			}
+			violations := profile.Check(2, tt.tunnel)
+			if got := violationList(violations); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got violations %q, want %q", got, tt.want)
+			}
+			for _, v := range violations {
+				finding := v.Finding()
+				if finding.Code != "compliance."+v.Rule || !strings.HasPrefix(finding.Path, "tunnels[2].crypto") ||
+					finding.Severity != SeverityError || v.Profile != tt.profile {
+					t.Errorf("finding %+v for %+v", finding, v)
+				}
+			}
+		})
+	}
+}
+
+// complianceFindings returns the compliance findings of a check as "path code"
+func complianceFindings(findings Findings) []string {
+	var list []string
+	for _, f := range findings {
+		if strings.HasPrefix(f.Code, "compliance.") {
+			list = append(list, f.Path+" "+f.Code)
+		}
+	}
+	return list
+}
+
+func TestPolicyComplianceProfile(t *testing.T) {
+	engine := NewPolicyEngine()
+	pol := &Policy{
+		Name:    "p",
+		Enabled: true,
+		Tunnels: []ipsec.TunnelConfig{suiteTunnel(ipsec.EncryptionAES256, ipsec.IntegritySHA1, ipsec.DHGroupECP256, ipsec.IKEv2)},
+	}
+
+	// The server default is legacy
+	if got := complianceFindings(engine.Check(pol)); len(got) != 0 {
+		t.Errorf("legacy default: %q", got)
+	}
+
+	pol.Compliance = ProfileFIPS1403
+	if got := complianceFindings(engine.Check(pol)); !reflect.DeepEqual(got, []string{"tunnels[0].crypto.integrity compliance.integrity"}) {
+		t.Errorf("policy profile: %q", got)
+	}
+
+	// A policy's own profile wins over the server default
+	if err := engine.SetCompliance(ComplianceSettings{Default: ProfileCNSA20}); err != nil {
+		t.Fatalf("SetCompliance: %v", err)
+	}
+	if got := complianceFindings(engine.Check(pol)); len(got) != 1 {
+		t.Errorf("policy profile over a CNSA default: %q", got)
+	}
+	pol.Compliance = ""
+	want := []string{"tunnels[0].crypto.integrity compliance.integrity", "tunnels[0].crypto.dhgroup compliance.dh_group"}
+	if got := complianceFindings(engine.Check(pol)); !reflect.DeepEqual(got, want) {
+		t.Errorf("CNSA default: %q, want %q", got, want)
+	}
+
+	pol.Compliance = "fips"
+	if got := complianceFindings(engine.Check(pol)); !reflect.DeepEqual(got, []string{"compliance compliance.unknown_profile"}) {
+		t.Errorf("unknown profile: %q", got)
+	}
+}
+
+func TestCheckPeerCompliance(t *testing.T) {
+	engine := NewPolicyEngine()
+	if err := engine.SetCompliance(ComplianceSettings{
+		Default: ProfileLegacy,
+		Tags:    map[string]string{"gov": ProfileCNSA20, "regulated": ProfileFIPS1403, "lab": ProfileLegacy},
+	}); err != nil {
+		t.Fatalf("SetCompliance: %v", err)
+	}
+
+	pol := &Policy{
+		Name:       "p",
+		Enabled:    true,
+		Compliance: ProfileLegacy,
+		AppliesTo:  []string{"gov", "regulated", "lab"},
+		Tunnels:    []ipsec.TunnelConfig{suiteTunnel(ipsec.EncryptionAES128, ipsec.IntegritySHA256, ipsec.DHGroupModp2048, ipsec.IKEv2)},
+	}
+	if got := complianceFindings(engine.Check(pol)); len(got) != 0 {
+		t.Fatalf("policy fails its own legacy profile: %q", got)
+	}
+
+	tests := []struct {
+		name string
+		tags []string
+		want []string // "profile rule"
+	}{
+		{name: "untagged peer", tags: nil},
+		{name: "tag without a profile", tags: []string{"other", "lab"}},
+		{name: "FIPS tag", tags: []string{"regulated"}},
+		{
+			name: "CNSA tag overrides the policy's profile",
+			tags: []string{"gov"},
+			want: []string{"cnsa-2.0 encryption", "cnsa-2.0 integrity", "cnsa-2.0 dh_group"},
+		},
+		{
+			name: "every tag's profile",
+			tags: []string{"regulated", "gov", "lab"},
+			want: []string{"cnsa-2.0 encryption", "cnsa-2.0 integrity", "cnsa-2.0 dh_group"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := &PeerInfo{ID: "peer-1", Tags: tt.tags}
+			var got []string
+			for _, v := range engine.CheckPeerCompliance(pol, peer) {
+				got = append(got, v.Profile+" "+v.Rule)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got violations %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// A policy that does not apply to the peer is not checked against it
+	gov := &PeerInfo{ID: "peer-2", Tags: []string{"gov"}}
+	pol.AppliesTo = []string{"lab"}
+	if violations := engine.CheckPeerCompliance(pol, gov); len(violations) != 0 {
+		t.Errorf("untargeted peer: %v", violations)
+	}
+
+	if err := engine.SetCompliance(ComplianceSettings{Tags: map[string]string{"gov": "cnsa"}}); err == nil ||
+		!strings.Contains(err.Error(), "tag gov: unknown compliance profile: cnsa") {
+		t.Errorf("SetCompliance with an unknown tag profile: %v", err)
+	}
+	if err := engine.SetCompliance(ComplianceSettings{Default: "strict"}); err == nil {
+		t.Error("SetCompliance accepted an unknown default profile")
+	}
+}
@@ -0,0 +1,139 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy files hold one or more policies, either as multi-document YAML
+// (see configs/example-policies.yaml) or as JSON, a single object or an
+// array. Server-owned fields (version, created_at, updated_at, and the
+// standby_secret and rotation of tunnels whose PSK is rotated) are ignored on
+// import and left out on export, so that exporting, importing and exporting
+// again gives the same bytes.
+
+// Policy file formats
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// FormatForPath picks the file format from a file name; anything that is not
+// .json is read as YAML
+func FormatForPath(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// DecodePolicies reads every policy in a policy file. Unknown fields are
+// rejected, so that a misspelt field is not silently dropped.
+func DecodePolicies(r io.Reader, format string) ([]Policy, error) {
+	var policies []Policy
+
+	switch format {
+	case FormatYAML:
+		decoder := yaml.NewDecoder(r)
+		decoder.KnownFields(true)
+		for doc := 1; ; doc++ {
+			var policy *Policy
+			err := decoder.Decode(&policy)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("document %d: %w", doc, err)
+			}
+			// Empty documents, e.g. a trailing "---", hold no policy
+			if policy != nil {
+				policies = append(policies, *policy)
+			}
+		}
+
+	case FormatJSON:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = decoder.Decode(&policies)
+		} else {
+			var policy Policy
+			err = decoder.Decode(&policy)
+			policies = append(policies, policy)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown policy file format %q", format)
+	}
+
+	for i := range policies {
+		clearServerFields(&policies[i])
+	}
+	return policies, nil
+}
+
+// EncodePolicies writes policies as a policy file, ordered by name
+func EncodePolicies(w io.Writer, policies []Policy, format string) error {
+	sorted := make([]Policy, len(policies))
+	copy(sorted, policies)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	for i := range sorted {
+		clearServerFields(&sorted[i])
+	}
+
+	switch format {
+	case FormatYAML:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		for i := range sorted {
+			if err := encoder.Encode(&sorted[i]); err != nil {
+				return fmt.Errorf("policy %s: %w", sorted[i].Name, err)
+			}
+		}
+		return encoder.Close()
+
+	case FormatJSON:
+		data, err := json.MarshalIndent(sorted, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+
+	return fmt.Errorf("unknown policy file format %q", format)
+}
+
+func clearServerFields(policy *Policy) {
+	policy.Version = 0
+	policy.CreatedAt = time.Time{}
+	policy.UpdatedAt = time.Time{}
+
+	// The tunnels may be shared with the caller's copy
+	if policy.Tunnels != nil {
+		policy.Tunnels = append(make([]ipsec.TunnelConfig, 0, len(policy.Tunnels)), policy.Tunnels...)
+		KeepRotationState(policy, nil)
+	}
+}
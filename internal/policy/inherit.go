@@ -0,0 +1,312 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// A policy may extend another with Policy.Extends. It is then stored as an
+// overlay on its base, and its effective content is the base, itself
+// resolved, with the overlay merged field by field:
+//
+//   - A field set in the overlay replaces the base's; zero values (empty
+//     strings and lists, zero numbers and durations, false) inherit it. An
+//     overlay cannot reset a field to its zero value, except for a tunnel's
+//     autostart and a child SA's pfs, where an explicit false is kept.
+//   - id, name, version, timestamps, enabled and extends are never inherited.
+//   - Tunnels are matched by name. A tunnel named like a base tunnel is merged
+//     into it field by field, including its crypto, IKE and child SA settings,
+//     auth and DPD; other tunnels are added after the base's.
+//   - Traffic selectors are matched by position: the overlay's first selector
+//     is merged into the base's first, and so on; extra ones are added.
+//   - A non-empty proposal list replaces the base's list as a whole.
+//
+// Policies are resolved whenever they are validated or served; the stored
+// overlay is what the API returns and what revisions record.
+
+// InheritanceError is returned when a policy's chain of bases cannot be
+// resolved: a base does not exist or the chain loops back on itself
+type InheritanceError struct {
+	PolicyID string   `json:"policy_id"`
+	Chain    []string `json:"chain"` // The policy first, then its bases as far as they resolved
+	Message  string   `json:"message"`
+}
+
+func (e *InheritanceError) Error() string {
+	return fmt.Sprintf("policy %s: %s (%s)", e.PolicyID, e.Message, strings.Join(e.Chain, " -> "))
+}
+
+// Finding reports the error against the extends field
+func (e *InheritanceError) Finding() Finding {
+	return errorFinding("extends", "inheritance.invalid", "%s (%s)", e.Message, strings.Join(e.Chain, " -> "))
+}
+
+// inheritanceChain returns a policy and its bases, the policy first and the
+// root last, along with their IDs
+func inheritanceChain(pol *Policy, byID map[string]*Policy) ([]*Policy, []string, error) {
+	chain := []*Policy{pol}
+	ids := []string{pol.ID}
+	seen := map[string]bool{pol.ID: true}
+
+	for current := pol; current.Extends != ""; {
+		base, ok := byID[current.Extends]
+		if !ok {
+			return nil, append(ids, current.Extends), &InheritanceError{
+				PolicyID: pol.ID,
+				Chain:    append(ids, current.Extends),
+				Message:  fmt.Sprintf("base policy %s does not exist", current.Extends),
+			}
+		}
+		ids = append(ids, base.ID)
+		if seen[base.ID] {
+			return nil, ids, &InheritanceError{
+				PolicyID: pol.ID,
+				Chain:    ids,
+				Message:  "inheritance cycle",
+			}
+		}
+		seen[base.ID] = true
+		chain = append(chain, base)
+		current = base
+	}
+	return chain, ids, nil
+}
+
+// FlattenPolicy resolves a policy's inheritance chain, looking its bases up
+// among policies; a policy in the list with the same ID as pol is ignored in
+// favour of pol. The result holds the effective content, with Extends
+// cleared; the chain lists the policy and its bases, the root last.
+func FlattenPolicy(pol *Policy, policies []Policy) (*Policy, []string, error) {
+	byID := make(map[string]*Policy, len(policies)+1)
+	for i := range policies {
+		byID[policies[i].ID] = &policies[i]
+	}
+	byID[pol.ID] = pol
+
+	chain, ids, err := inheritanceChain(pol, byID)
+	if err != nil {
+		return nil, ids, err
+	}
+
+	flat := *chain[len(chain)-1]
+	for i := len(chain) - 2; i >= 0; i-- {
+		flat = overlayPolicy(flat, *chain[i])
+	}
+	flat.Extends = ""
+	return &flat, ids, nil
+}
+
+// ResolveInheritance flattens every policy in a list against the others.
+// Policies that extend nothing are returned unchanged.
+func ResolveInheritance(policies []Policy) ([]Policy, error) {
+	resolved := make([]Policy, len(policies))
+	for i := range policies {
+		if policies[i].Extends == "" {
+			resolved[i] = policies[i]
+			continue
+		}
+		flat, _, err := FlattenPolicy(&policies[i], policies)
+		if err != nil {
+			return nil, err
+		}
+		resolved[i] = *flat
+	}
+	return resolved, nil
+}
+
+// Descendants returns the IDs of the policies that extend a policy, directly
+// or through other policies, nearest first
+func Descendants(policies []Policy, id string) []string {
+	if id == "" {
+		return nil
+	}
+
+	var ids []string
+	seen := map[string]bool{id: true}
+
+	for queue := []string{id}; len(queue) > 0; queue = queue[1:] {
+		for _, pol := range policies {
+			if pol.Extends == queue[0] && !seen[pol.ID] {
+				seen[pol.ID] = true
+				ids = append(ids, pol.ID)
+				queue = append(queue, pol.ID)
+			}
+		}
+	}
+	return ids
+}
+
+// overlayPolicy merges an overlay policy into its resolved base
+func overlayPolicy(base, overlay Policy) Policy {
+	merged := base
+
+	// Never inherited
+	merged.ID = overlay.ID
+	merged.Name = overlay.Name
+	merged.Version = overlay.Version
+	merged.SchemaVersion = overlay.SchemaVersion
+	merged.CreatedAt = overlay.CreatedAt
+	merged.UpdatedAt = overlay.UpdatedAt
+	merged.Enabled = overlay.Enabled
+	merged.Extends = overlay.Extends
+
+	overlayString(&merged.Description, overlay.Description)
+	overlayString(&merged.Compliance, overlay.Compliance)
+	if len(overlay.AppliesTo) > 0 {
+		merged.AppliesTo = overlay.AppliesTo
+	}
+	if overlay.Priority != 0 {
+		merged.Priority = overlay.Priority
+	}
+	if overlay.NotBefore != nil {
+		merged.NotBefore = overlay.NotBefore
+	}
+	if overlay.NotAfter != nil {
+		merged.NotAfter = overlay.NotAfter
+	}
+	if len(overlay.MaintenanceWindows) > 0 {
+		merged.MaintenanceWindows = overlay.MaintenanceWindows
+	}
+
+	merged.Tunnels = append([]ipsec.TunnelConfig(nil), base.Tunnels...)
+	for _, tunnel := range overlay.Tunnels {
+		found := false
+		for i := range merged.Tunnels {
+			if merged.Tunnels[i].Name == tunnel.Name {
+				merged.Tunnels[i] = overlayTunnel(merged.Tunnels[i], tunnel)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Tunnels = append(merged.Tunnels, tunnel)
+		}
+	}
+
+	return merged
+}
+
+func overlayTunnel(base, overlay ipsec.TunnelConfig) ipsec.TunnelConfig {
+	merged := base
+
+	if overlay.Mode != "" {
+		merged.Mode = overlay.Mode
+	}
+	overlayString(&merged.LocalAddress, overlay.LocalAddress)
+	overlayString(&merged.RemoteAddress, overlay.RemoteAddress)
+	overlayString(&merged.LocalID, overlay.LocalID)
+	overlayString(&merged.RemoteID, overlay.RemoteID)
+	overlayString(&merged.Mark, overlay.Mark)
+	if overlay.AutoStart != nil {
+		merged.AutoStart = overlay.AutoStart
+	}
+
+	merged.Crypto = overlayCrypto(base.Crypto, overlay.Crypto)
+
+	if overlay.Auth.Type != "" {
+		merged.Auth.Type = overlay.Auth.Type
+	}
+	// A rotation belongs to the secret it rotates, and a secret given either
+	// way replaces one given the other
+	if overlay.Auth.Secret != "" {
+		merged.Auth.Secret = overlay.Auth.Secret
+		merged.Auth.StandbySecret = overlay.Auth.StandbySecret
+		merged.Auth.Rotation = overlay.Auth.Rotation
+		merged.Auth.SecretRef = ""
+	} else if overlay.Auth.SecretRef != "" {
+		merged.Auth.SecretRef = overlay.Auth.SecretRef
+		merged.Auth.Secret, merged.Auth.StandbySecret, merged.Auth.Rotation = "", "", ""
+	}
+	overlayString(&merged.Auth.RotateEvery, overlay.Auth.RotateEvery)
+	overlayString(&merged.Auth.CertPath, overlay.Auth.CertPath)
+	overlayString(&merged.Auth.KeyPath, overlay.Auth.KeyPath)
+	overlayString(&merged.Auth.CACertPath, overlay.Auth.CACertPath)
+	overlayString(&merged.Auth.Issuer, overlay.Auth.Issuer)
+
+	if overlay.DPD.Delay != 0 {
+		merged.DPD.Delay = overlay.DPD.Delay
+	}
+	overlayString(&merged.DPD.Action, overlay.DPD.Action)
+
+	merged.TrafficSelectors = append([]ipsec.TrafficSelector(nil), base.TrafficSelectors...)
+	for i, ts := range overlay.TrafficSelectors {
+		if i >= len(merged.TrafficSelectors) {
+			merged.TrafficSelectors = append(merged.TrafficSelectors, ts)
+			continue
+		}
+		merged.TrafficSelectors[i] = overlaySelector(merged.TrafficSelectors[i], ts)
+	}
+
+	return merged
+}
+
+func overlayCrypto(base, overlay ipsec.CryptoConfig) ipsec.CryptoConfig {
+	merged := base
+
+	if overlay.Encryption != "" {
+		merged.Encryption = overlay.Encryption
+	}
+	if overlay.Integrity != "" {
+		merged.Integrity = overlay.Integrity
+	}
+	if overlay.DHGroup != "" {
+		merged.DHGroup = overlay.DHGroup
+	}
+	if overlay.IKEVersion != "" {
+		merged.IKEVersion = overlay.IKEVersion
+	}
+	if overlay.Lifetime != 0 {
+		merged.Lifetime = overlay.Lifetime
+	}
+	merged.IKE = overlaySA(base.IKE, overlay.IKE)
+	merged.Child = overlaySA(base.Child, overlay.Child)
+
+	return merged
+}
+
+func overlaySA(base, overlay *ipsec.SAConfig) *ipsec.SAConfig {
+	if overlay == nil {
+		return base
+	}
+	if base == nil {
+		return overlay
+	}
+
+	merged := *base
+	if len(overlay.Proposals) > 0 {
+		merged.Proposals = overlay.Proposals
+	}
+	if overlay.Lifetime != 0 {
+		merged.Lifetime = overlay.Lifetime
+	}
+	if overlay.RekeyMargin != 0 {
+		merged.RekeyMargin = overlay.RekeyMargin
+	}
+	if overlay.PFS != nil {
+		merged.PFS = overlay.PFS
+	}
+	return &merged
+}
+
+func overlaySelector(base, overlay ipsec.TrafficSelector) ipsec.TrafficSelector {
+	merged := base
+
+	overlayString(&merged.LocalSubnet, overlay.LocalSubnet)
+	overlayString(&merged.RemoteSubnet, overlay.RemoteSubnet)
+	overlayString(&merged.Protocol, overlay.Protocol)
+	if overlay.LocalPort != 0 {
+		merged.LocalPort = overlay.LocalPort
+	}
+	if overlay.RemotePort != 0 {
+		merged.RemotePort = overlay.RemotePort
+	}
+	return merged
+}
+
+func overlayString(dst *string, value string) {
+	if value != "" {
+		*dst = value
+	}
+}
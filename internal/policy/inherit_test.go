@@ -0,0 +1,251 @@
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+func TestFlattenPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []Policy
+		chain    []string
+		message  string
+	}{
+		{
+			name:     "missing base",
+			policies: []Policy{{ID: "a", Extends: "b"}, {ID: "b", Extends: "none"}},
+			chain:    []string{"a", "b", "none"},
+			message:  "base policy none does not exist",
+		},
+		{
+			name:     "extends itself",
+			policies: []Policy{{ID: "a", Extends: "a"}},
+			chain:    []string{"a", "a"},
+			message:  "inheritance cycle",
+		},
+		{
+			name:     "cycle",
+			policies: []Policy{{ID: "a", Extends: "b"}, {ID: "b", Extends: "c"}, {ID: "c", Extends: "a"}},
+			chain:    []string{"a", "b", "c", "a"},
+			message:  "inheritance cycle",
+		},
+		{
+			name:     "cycle further up the chain",
+			policies: []Policy{{ID: "a", Extends: "b"}, {ID: "b", Extends: "c"}, {ID: "c", Extends: "b"}},
+			chain:    []string{"a", "b", "c", "b"},
+			message:  "inheritance cycle",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, chain, err := FlattenPolicy(&tt.policies[0], tt.policies)
+			var inheritance *InheritanceError
+			if !errors.As(err, &inheritance) {
+				t.Fatalf("FlattenPolicy error = %v, want an *InheritanceError", err)
+			}
+			if inheritance.PolicyID != "a" || inheritance.Message != tt.message || !reflect.DeepEqual(inheritance.Chain, tt.chain) {
+				t.Errorf("got %+v, want chain %v and %q", inheritance, tt.chain, tt.message)
+			}
+			if !reflect.DeepEqual(chain, tt.chain) {
+				t.Errorf("returned chain %v, want %v", chain, tt.chain)
+			}
+			if finding := inheritance.Finding(); finding.Path != "extends" || finding.Code != "inheritance.invalid" {
+				t.Errorf("finding %+v", finding)
+			}
+
+			if _, err := ResolveInheritance(tt.policies); !errors.As(err, &inheritance) {
+				t.Errorf("ResolveInheritance error = %v, want an *InheritanceError", err)
+			}
+		})
+	}
+}
+
+func TestFlattenPolicy(t *testing.T) {
+	on, off := true, false
+	root := Policy{
+		ID:          "root",
+		Name:        "root",
+		Description: "root",
+		Priority:    10,
+		Compliance:  ProfileFIPS1403,
+		AppliesTo:   []string{"all"},
+		Enabled:     true,
+		Tunnels: []ipsec.TunnelConfig{
+			{
+				Name:          "a",
+				Mode:          ipsec.ModeESPTunnel,
+				LocalAddress:  "192.0.2.1",
+				RemoteAddress: "198.51.100.1",
+				Crypto: ipsec.CryptoConfig{
+					Encryption: ipsec.EncryptionAES256GCM,
+					DHGroup:    ipsec.DHGroupECP256,
+					Lifetime:   time.Hour,
+					Child:      &ipsec.SAConfig{Lifetime: 30 * time.Minute, PFS: &on},
+				},
+				Auth:      ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: "root-secret"},
+				DPD:       ipsec.DPDConfig{Delay: 30 * time.Second, Action: "restart"},
+				AutoStart: &on,
+				TrafficSelectors: []ipsec.TrafficSelector{
+					{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24", Protocol: "tcp"},
+				},
+			},
+		},
+	}
+	middle := Policy{
+		ID:       "middle",
+		Name:     "middle",
+		Extends:  "root",
+		Priority: 20,
+		Tunnels: []ipsec.TunnelConfig{
+			{
+				Name:   "a",
+				Crypto: ipsec.CryptoConfig{DHGroup: ipsec.DHGroupECP384, Child: &ipsec.SAConfig{PFS: &off}},
+				Auth:   ipsec.AuthConfig{SecretRef: "store:middle"},
+				TrafficSelectors: []ipsec.TrafficSelector{
+					{RemoteSubnet: "10.3.0.0/24"},
+					{LocalSubnet: "10.1.1.0/24", RemoteSubnet: "10.4.0.0/24"},
+				},
+			},
+			{Name: "b", Mode: ipsec.ModeESPTransport},
+		},
+	}
+	leaf := Policy{
+		ID:          "leaf",
+		Name:        "leaf",
+		Extends:     "middle",
+		Description: "leaf",
+		Tunnels: []ipsec.TunnelConfig{
+			{Name: "a", LocalAddress: "192.0.2.9", AutoStart: &off, DPD: ipsec.DPDConfig{Action: "clear"}},
+			{Name: "c", Mode: ipsec.ModeESPTunnel},
+		},
+	}
+	policies := []Policy{leaf, middle, root}
+
+	flat, chain, err := FlattenPolicy(&leaf, policies)
+	if err != nil {
+		t.Fatalf("FlattenPolicy: %v", err)
+	}
+	if !reflect.DeepEqual(chain, []string{"leaf", "middle", "root"}) {
+		t.Errorf("chain %v, want leaf, middle, root", chain)
+	}
+
+	// Policy fields
+	if flat.ID != "leaf" || flat.Name != "leaf" || flat.Extends != "" || flat.Enabled {
+		t.Errorf("identity fields %q %q %q %v, want the leaf's with extends cleared", flat.ID, flat.Name, flat.Extends, flat.Enabled)
+	}
+	if flat.Description != "leaf" || flat.Priority != 20 || flat.Compliance != ProfileFIPS1403 || !reflect.DeepEqual(flat.AppliesTo, []string{"all"}) {
+		t.Errorf("fields %q %d %q %v, want leaf, 20, fips-140-3 and all", flat.Description, flat.Priority, flat.Compliance, flat.AppliesTo)
+	}
+
+	// Tunnels named like a base's are merged; new ones are appended in order
+	var names []string
+	for _, tunnel := range flat.Tunnels {
+		names = append(names, tunnel.Name)
+	}
+	if strings.Join(names, ",") != "a,b,c" {
+		t.Fatalf("tunnels %v, want a, b, c", names)
+	}
+
+	a := flat.Tunnels[0]
+	if a.Mode != ipsec.ModeESPTunnel || a.LocalAddress != "192.0.2.9" || a.RemoteAddress != "198.51.100.1" {
+		t.Errorf("tunnel a endpoints %s %s %s", a.Mode, a.LocalAddress, a.RemoteAddress)
+	}
+	if a.Crypto.Encryption != ipsec.EncryptionAES256GCM || a.Crypto.DHGroup != ipsec.DHGroupECP384 || a.Crypto.Lifetime != time.Hour {
+		t.Errorf("tunnel a crypto %+v", a.Crypto)
+	}
+	if a.Crypto.Child == nil || a.Crypto.Child.Lifetime != 30*time.Minute || a.Crypto.Child.PFSEnabled() {
+		t.Errorf("tunnel a child SA %+v, want a 30m lifetime with PFS off", a.Crypto.Child)
+	}
+	if a.Auth.Type != ipsec.AuthPSK || a.Auth.Secret != "" || a.Auth.SecretRef != "store:middle" {
+		t.Errorf("tunnel a auth %+v, want the middle's secret_ref replacing the root's secret", a.Auth)
+	}
+	if a.DPD.Delay != 30*time.Second || a.DPD.Action != "clear" {
+		t.Errorf("tunnel a DPD %+v", a.DPD)
+	}
+	if a.AutoStartEnabled() {
+		t.Error("tunnel a starts automatically, want the leaf to turn it off")
+	}
+	wantSelectors := []ipsec.TrafficSelector{
+		{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.3.0.0/24", Protocol: "tcp"},
+		{LocalSubnet: "10.1.1.0/24", RemoteSubnet: "10.4.0.0/24"},
+	}
+	if !reflect.DeepEqual(a.TrafficSelectors, wantSelectors) {
+		t.Errorf("tunnel a selectors %+v, want %+v", a.TrafficSelectors, wantSelectors)
+	}
+	if flat.Tunnels[1].Mode != ipsec.ModeESPTransport || flat.Tunnels[2].Mode != ipsec.ModeESPTunnel {
+		t.Errorf("added tunnels %+v", flat.Tunnels[1:])
+	}
+
+	// Flattening leaves the stored policies alone
+	if root.Tunnels[0].Crypto.Child.Lifetime != 30*time.Minute || !root.Tunnels[0].AutoStartEnabled() ||
+		len(root.Tunnels[0].TrafficSelectors) != 1 || policies[1].Tunnels[0].Crypto.Lifetime != 0 {
+		t.Error("FlattenPolicy changed a base")
+	}
+
+	// An overlay that leaves autostart out inherits it
+	middleFlat, _, err := FlattenPolicy(&middle, policies)
+	if err != nil {
+		t.Fatalf("FlattenPolicy: %v", err)
+	}
+	if !middleFlat.Tunnels[0].AutoStartEnabled() {
+		t.Error("middle's tunnel a does not start automatically, want it inherited from root")
+	}
+
+	// ResolveInheritance flattens each policy and keeps the others
+	resolved, err := ResolveInheritance(policies)
+	if err != nil {
+		t.Fatalf("ResolveInheritance: %v", err)
+	}
+	if !reflect.DeepEqual(resolved[0], *flat) || !reflect.DeepEqual(resolved[1], *middleFlat) || !reflect.DeepEqual(resolved[2], root) {
+		t.Error("ResolveInheritance differs from flattening each policy")
+	}
+
+	// A candidate replaces the stored policy with its ID
+	changed := middle
+	changed.Priority = 30
+	flat, _, err = FlattenPolicy(&leaf, WithPolicy(policies, changed))
+	if err != nil || flat.Priority != 30 {
+		t.Errorf("FlattenPolicy over a changed base: priority %d, %v", flat.Priority, err)
+	}
+}
+
+func TestDescendants(t *testing.T) {
+	policies := []Policy{
+		{ID: "root"},
+		{ID: "a", Extends: "root"},
+		{ID: "b", Extends: "root"},
+		{ID: "a1", Extends: "a"},
+		{ID: "a1x", Extends: "a1"},
+		{ID: "other"},
+		{ID: "loop1", Extends: "loop2"},
+		{ID: "loop2", Extends: "loop1"},
+	}
+
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"root", []string{"a", "b", "a1", "a1x"}},
+		{"a", []string{"a1", "a1x"}},
+		{"a1x", nil},
+		{"other", nil},
+		{"none", nil},
+		{"", nil},
+		{"loop1", []string{"loop2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if got := Descendants(policies, tt.id); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Descendants(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package policy
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// JSON Schemas for policy files and for the API's request and response
+// bodies are generated from the Go types by reflection, so they follow the
+// structs as fields are added. Fields are named by their json tags; no field
+// is marked required, because a policy that extends another may leave any
+// field to its base and the server fills in the rest. Time values are
+// RFC 3339 strings. Durations are integer nanoseconds, except in the
+// structs that encode their durations as Go duration strings ("1h", "30s"),
+// which also accept integers when decoding.
+
+// JSONSchema is a JSON Schema document or subschema
+type JSONSchema map[string]interface{}
+
+// schemaEnums lists the values of string types with a fixed set of values.
+// The empty string is allowed too: it means unset, or inherited from the
+// base policy.
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(ipsec.IPsecMode("")):           modeNames(platformCapabilities["linux"].Modes),
+	reflect.TypeOf(ipsec.AuthType("")):            {string(ipsec.AuthPSK), string(ipsec.AuthCertificate)},
+	reflect.TypeOf(ipsec.EncryptionAlgorithm("")): encryptionNames(allEncryption),
+	reflect.TypeOf(ipsec.IntegrityAlgorithm("")):  integrityNames(allIntegrity),
+	reflect.TypeOf(ipsec.DHGroup("")):             dhGroupNames(platformCapabilities["linux"].DHGroups),
+	reflect.TypeOf(ipsec.IKEVersion("")):          {string(ipsec.IKEv1), string(ipsec.IKEv2)},
+	reflect.TypeOf(ipsec.TunnelState("")): {
+		string(ipsec.StateDown), string(ipsec.StateConnecting), string(ipsec.StateEstablished),
+		string(ipsec.StateRekeying), string(ipsec.StateError),
+	},
+	reflect.TypeOf(PeerStatus("")):   {string(PeerStatusOnline), string(PeerStatusOffline), string(PeerStatusError)},
+	reflect.TypeOf(TopologyMode("")): {string(TopologyHubSpoke), string(TopologyMesh), string(TopologyPartial)},
+	reflect.TypeOf(Severity("")):     {string(SeverityError), string(SeverityWarning), string(SeverityInfo)},
+}
+
+// durationPattern matches the output of time.Duration.String and the input
+// time.ParseDuration accepts
+const durationPattern = `^-?(0|([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	durationType      = reflect.TypeOf(time.Duration(0))
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// SchemaGenerator builds JSON Schemas for Go types. Named struct types are
+// collected in Defs and referenced as RefPrefix followed by the type name.
+type SchemaGenerator struct {
+	RefPrefix string                // e.g. "#/$defs/" or "#/components/schemas/"
+	Strict    bool                  // Reject properties a struct does not have
+	Defs      map[string]JSONSchema // Named struct types, by definition name
+
+	names map[reflect.Type]string
+}
+
+// NewSchemaGenerator returns a generator whose references start with refPrefix
+func NewSchemaGenerator(refPrefix string, strict bool) *SchemaGenerator {
+	return &SchemaGenerator{
+		RefPrefix: refPrefix,
+		Strict:    strict,
+		Defs:      make(map[string]JSONSchema),
+		names:     make(map[reflect.Type]string),
+	}
+}
+
+// Schema returns the schema of a type, adding the named structs it uses to
+// Defs
+func (g *SchemaGenerator) Schema(t reflect.Type) JSONSchema {
+	return g.schema(t, false)
+}
+
+// schema returns the schema of a type; textDurations is set for the fields
+// of structs that write their durations as strings
+func (g *SchemaGenerator) schema(t reflect.Type, textDurations bool) JSONSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return JSONSchema{"type": "string", "format": "date-time"}
+	case durationType:
+		if textDurations {
+			return JSONSchema{"oneOf": []interface{}{
+				JSONSchema{"type": "string", "pattern": durationPattern},
+				JSONSchema{"type": "integer"},
+			}}
+		}
+		return JSONSchema{"type": "integer", "description": "nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if values, ok := schemaEnums[t]; ok {
+			enum := []interface{}{""}
+			for _, value := range values {
+				enum = append(enum, value)
+			}
+			return JSONSchema{"type": "string", "enum": enum}
+		}
+		return JSONSchema{"type": "string"}
+	case reflect.Bool:
+		return JSONSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return JSONSchema{"type": "integer"}
+	case reflect.Uint8, reflect.Uint16:
+		return JSONSchema{"type": "integer", "minimum": 0, "maximum": 1<<(8*t.Size()) - 1}
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return JSONSchema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return JSONSchema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// Nil slices are written as null
+		return JSONSchema{"type": []interface{}{"array", "null"}, "items": g.schema(t.Elem(), textDurations)}
+	case reflect.Map:
+		return JSONSchema{"type": []interface{}{"object", "null"}, "additionalProperties": g.schema(t.Elem(), textDurations)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return JSONSchema{"$ref": g.RefPrefix + g.define(t)}
+	}
+
+	// Interfaces and anything else hold arbitrary JSON
+	return JSONSchema{}
+}
+
+// define adds a named struct type to Defs and returns its definition name
+func (g *SchemaGenerator) define(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+
+	// Unexported server types are named like exported ones; a name taken by
+	// a type from another package is qualified with the package name
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	if _, taken := g.Defs[name]; taken {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+
+	g.names[t] = name
+	g.Defs[name] = nil // Placeholder, so recursive types terminate
+	g.Defs[name] = g.structSchema(t)
+	return name
+}
+
+func (g *SchemaGenerator) structSchema(t reflect.Type) JSONSchema {
+	textDurations := t.Implements(jsonMarshalerType)
+	properties := JSONSchema{}
+	g.addFields(properties, t, textDurations)
+
+	schema := JSONSchema{"type": "object", "properties": properties}
+	if g.Strict {
+		schema["additionalProperties"] = false
+	}
+	return schema
+}
+
+// addFields adds a struct's JSON properties, including those of embedded
+// structs, which encoding/json inlines
+func (g *SchemaGenerator) addFields(properties JSONSchema, t reflect.Type, textDurations bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				g.addFields(properties, embedded, textDurations)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type, textDurations)
+	}
+}
+
+// PolicyFileSchema returns the JSON Schema of a policy file: a policy or a
+// list of policies. Each document of a multi-document YAML file is checked
+// on its own. Unknown fields are rejected, as the importer rejects them.
+func PolicyFileSchema() JSONSchema {
+	g := NewSchemaGenerator("#/$defs/", true)
+	policy := g.Schema(reflect.TypeOf(Policy{}))
+
+	return JSONSchema{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "IPsec policy file",
+		"description": "One policy, or a list of policies, as imported by `ipsec-server policy import`. Server-owned fields (version, created_at, updated_at, and auth.standby_secret and auth.rotation of tunnels) are ignored on import.",
+		"oneOf": []interface{}{
+			policy,
+			JSONSchema{"type": "array", "items": policy},
+		},
+		"$defs": g.Defs,
+	}
+}
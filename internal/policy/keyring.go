@@ -0,0 +1,275 @@
+package policy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Secrets such as tunnel PSKs are stored with envelope encryption. Each
+// secret is encrypted with its own random data key under AES-256-GCM, and
+// the data key is encrypted ("wrapped") with a master key. The stored value
+// names the master key it was wrapped with:
+//
+//	enc:v1:<key id>:<wrapped data key>:<ciphertext>
+//
+// both parts base64url-encoded, each with its GCM nonce in front. A keyring
+// holds the current master key, which seals new secrets, and any older keys
+// still needed to open existing ones. Rotating re-wraps every data key with
+// the current master key, after which the older keys can be dropped.
+
+const sealedPrefix = "enc:v1:"
+
+// MasterKeySize is the size of a master key in bytes (AES-256)
+const MasterKeySize = 32
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var (
+	// ErrNoMasterKey is returned when an encrypted secret is read without a
+	// keyring
+	ErrNoMasterKey = errors.New("secret is encrypted but no master key is configured")
+
+	// ErrUnknownMasterKey is returned when an encrypted secret was sealed
+	// with a key the keyring does not hold
+	ErrUnknownMasterKey = errors.New("secret is encrypted with a master key that is not configured")
+)
+
+// masterKey is one key of a keyring
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Keyring holds the master keys secrets are sealed with
+type Keyring struct {
+	keys []masterKey // The current key first
+}
+
+// ParseKeyring reads master keys, one per line or separated by commas, each
+// written as "<id>:<base64 key>" or just the base64 key, in which case its ID
+// is derived from the key. The first key is the current one. Blank lines and
+// lines starting with # are ignored.
+func ParseKeyring(text string) (*Keyring, error) {
+	keyring := &Keyring{}
+	seen := make(map[string]bool)
+
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' })
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		id, encoded, found := strings.Cut(field, ":")
+		if !found {
+			id, encoded = "", field
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("master key %d: not valid base64", len(keyring.keys)+1)
+		}
+		if len(raw) != MasterKeySize {
+			return nil, fmt.Errorf("master key %d: must be %d bytes, got %d", len(keyring.keys)+1, MasterKeySize, len(raw))
+		}
+		if id == "" {
+			sum := sha256.Sum256(raw)
+			id = hex.EncodeToString(sum[:4])
+		}
+		if !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("master key %d: invalid key ID %q", len(keyring.keys)+1, id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("master key %d: duplicate key ID %q", len(keyring.keys)+1, id)
+		}
+		seen[id] = true
+
+		aead, err := newGCM(raw)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys = append(keyring.keys, masterKey{id: id, aead: aead})
+	}
+
+	if len(keyring.keys) == 0 {
+		return nil, errors.New("no master key found")
+	}
+	return keyring, nil
+}
+
+// GenerateMasterKey returns a new random master key in the form ParseKeyring
+// reads, with the given ID
+func GenerateMasterKey(id string) (string, error) {
+	if !keyIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid key ID %q", id)
+	}
+	raw := make([]byte, MasterKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// CurrentKeyID returns the ID of the key new secrets are sealed with
+func (k *Keyring) CurrentKeyID() string {
+	return k.keys[0].id
+}
+
+// HasKey reports whether the keyring holds a key with the given ID
+func (k *Keyring) HasKey(id string) bool {
+	for _, key := range k.keys {
+		if key.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSealed reports whether a stored value is an encrypted secret
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// SealedKeyID returns the ID of the master key a sealed value was wrapped
+// with, or "" if the value is not sealed
+func SealedKeyID(value string) string {
+	if !IsSealed(value) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, sealedPrefix), ":")
+	return id
+}
+
+// Seal encrypts a secret under a new data key wrapped with the current
+// master key. Empty secrets stay empty.
+func (k *Keyring) Seal(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, MasterKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	data, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := sealGCM(data, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+	return k.wrap(dataKey, ciphertext)
+}
+
+// Open decrypts a sealed secret; values that are not sealed are returned
+// as they are. A nil keyring opens nothing and fails on sealed values.
+func (k *Keyring) Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+
+	dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+	data, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openGCM(data, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap re-wraps the data key of a sealed secret with the current master
+// key, leaving the ciphertext alone. Plain values are sealed.
+func (k *Keyring) Rewrap(value string) (string, error) {
+	if !IsSealed(value) {
+		return k.Seal(value)
+	}
+
+	dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+	return k.wrap(dataKey, ciphertext)
+}
+
+func (k *Keyring) wrap(dataKey, ciphertext []byte) (string, error) {
+	current := k.keys[0]
+	wrapped, err := sealGCM(current.aead, dataKey, []byte(current.id))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + current.id + ":" +
+		base64.RawURLEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+func (k *Keyring) unwrap(value string) (dataKey, ciphertext []byte, err error) {
+	if k == nil {
+		return nil, nil, ErrNoMasterKey
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, sealedPrefix), ":")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("malformed encrypted secret")
+	}
+	id := parts[0]
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.New("malformed encrypted secret")
+	}
+	ciphertext, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, errors.New("malformed encrypted secret")
+	}
+
+	for _, key := range k.keys {
+		if key.id != id {
+			continue
+		}
+		dataKey, err = openGCM(key.aead, wrapped, []byte(id))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to unwrap data key with master key %s: %w", id, err)
+		}
+		return dataKey, ciphertext, nil
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrUnknownMasterKey, id)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealGCM encrypts with a random nonce, which it puts in front of the result
+func sealGCM(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func openGCM(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
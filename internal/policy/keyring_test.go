@@ -0,0 +1,236 @@
+package policy
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testKeyring returns a keyring of newly generated keys, the first current
+func testKeyring(t *testing.T, ids ...string) (*Keyring, []string) {
+	t.Helper()
+	var lines []string
+	for _, id := range ids {
+		key, err := GenerateMasterKey(id)
+		if err != nil {
+			t.Fatalf("GenerateMasterKey(%q): %v", id, err)
+		}
+		lines = append(lines, key)
+	}
+	keys, err := ParseKeyring(strings.Join(lines, "\n"))
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	return keys, lines
+}
+
+// tamper flips a bit in one base64 part of a sealed value: 1 for the
+// wrapped data key, 2 for the ciphertext
+func tamper(t *testing.T, sealed string, part int) string {
+	t.Helper()
+	parts := strings.Split(strings.TrimPrefix(sealed, sealedPrefix), ":")
+	raw, err := base64.RawURLEncoding.DecodeString(parts[part])
+	if err != nil {
+		t.Fatalf("sealed value %s: %v", sealed, err)
+	}
+	raw[len(raw)/2] ^= 0x01
+	parts[part] = base64.RawURLEncoding.EncodeToString(raw)
+	return sealedPrefix + strings.Join(parts, ":")
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	keys, _ := testKeyring(t, "k1")
+
+	sealed, err := keys.Seal("a secret")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !IsSealed(sealed) || SealedKeyID(sealed) != "k1" || strings.Contains(sealed, "a secret") {
+		t.Fatalf("Seal gave %q", sealed)
+	}
+	if again, _ := keys.Seal("a secret"); again == sealed {
+		t.Error("sealing twice gave the same value")
+	}
+
+	opened, err := keys.Open(sealed)
+	if err != nil || opened != "a secret" {
+		t.Errorf("Open = %q, %v, want the secret", opened, err)
+	}
+
+	// Plain values pass through and empty secrets stay empty
+	if opened, err := keys.Open("plain"); err != nil || opened != "plain" {
+		t.Errorf("Open of a plain value = %q, %v", opened, err)
+	}
+	if sealed, err := keys.Seal(""); err != nil || sealed != "" {
+		t.Errorf("Seal of an empty secret = %q, %v", sealed, err)
+	}
+
+	var none *Keyring
+	if _, err := none.Open(sealed); !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("Open without a keyring: %v, want %v", err, ErrNoMasterKey)
+	}
+}
+
+func TestKeyringOpenErrors(t *testing.T) {
+	keys, _ := testKeyring(t, "k1")
+	sealed, err := keys.Seal("a secret")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	other, _ := testKeyring(t, "k2")
+	impostor, _ := testKeyring(t, "k1")
+
+	tests := []struct {
+		name  string
+		keys  *Keyring
+		value string
+		is    error
+		err   string
+	}{
+		{name: "unknown key ID", keys: other, value: sealed, is: ErrUnknownMasterKey},
+		{name: "another key with the same ID", keys: impostor, value: sealed, err: "failed to unwrap data key with master key k1"},
+		{name: "tampered wrapped key", keys: keys, value: tamper(t, sealed, 1), err: "failed to unwrap data key"},
+		{name: "tampered ciphertext", keys: keys, value: tamper(t, sealed, 2), err: "failed to decrypt secret"},
+		{name: "key ID swapped", keys: keys, value: strings.Replace(sealed, ":k1:", ":k2:", 1), is: ErrUnknownMasterKey},
+		{name: "missing part", keys: keys, value: "enc:v1:k1:AAAA", err: "malformed encrypted secret"},
+		{name: "extra part", keys: keys, value: sealed + ":AAAA", err: "malformed encrypted secret"},
+		{name: "bad base64", keys: keys, value: "enc:v1:k1:!!!!:AAAA", err: "malformed encrypted secret"},
+		{name: "short wrapped key", keys: keys, value: "enc:v1:k1:AAAA:AAAA", err: "ciphertext too short"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened, err := tt.keys.Open(tt.value)
+			if err == nil {
+				t.Fatalf("Open = %q, want an error", opened)
+			}
+			if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Errorf("Open error = %v, want %v", err, tt.is)
+			}
+			if tt.err != "" && !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Open error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestKeyringRewrap(t *testing.T) {
+	old, oldLines := testKeyring(t, "old")
+	sealed, err := old.Seal("a secret")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	// The new key goes first, the old one stays to open existing secrets
+	newKey, err := GenerateMasterKey("new")
+	if err != nil {
+		t.Fatalf("GenerateMasterKey: %v", err)
+	}
+	rotated, err := ParseKeyring(newKey + "\n" + oldLines[0])
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	if rotated.CurrentKeyID() != "new" {
+		t.Fatalf("current key is %s, want new", rotated.CurrentKeyID())
+	}
+	if opened, err := rotated.Open(sealed); err != nil || opened != "a secret" {
+		t.Fatalf("Open with the old key second = %q, %v", opened, err)
+	}
+
+	rewrapped, err := rotated.Rewrap(sealed)
+	if err != nil {
+		t.Fatalf("Rewrap: %v", err)
+	}
+	if SealedKeyID(rewrapped) != "new" {
+		t.Errorf("rewrapped value is under key %s, want new", SealedKeyID(rewrapped))
+	}
+	// Only the data key is re-wrapped
+	if strings.Split(rewrapped, ":")[4] != strings.Split(sealed, ":")[4] {
+		t.Error("Rewrap changed the ciphertext")
+	}
+
+	current, err := ParseKeyring(newKey)
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	if opened, err := current.Open(rewrapped); err != nil || opened != "a secret" {
+		t.Errorf("Open without the old key = %q, %v", opened, err)
+	}
+	if _, err := current.Open(sealed); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("Open of the old value without the old key: %v, want %v", err, ErrUnknownMasterKey)
+	}
+
+	// Plain values are sealed
+	plain, err := current.Rewrap("plain")
+	if err != nil || SealedKeyID(plain) != "new" {
+		t.Errorf("Rewrap of a plain value = %q, %v", plain, err)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	k1, err := GenerateMasterKey("k1")
+	if err != nil {
+		t.Fatalf("GenerateMasterKey: %v", err)
+	}
+	k2, err := GenerateMasterKey("k2")
+	if err != nil {
+		t.Fatalf("GenerateMasterKey: %v", err)
+	}
+	_, bare, _ := strings.Cut(k2, ":")
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+
+	tests := []struct {
+		name    string
+		text    string
+		current string
+		ids     []string
+		err     string
+	}{
+		{name: "one key", text: k1, current: "k1", ids: []string{"k1"}},
+		{name: "lines, comments and blanks", text: "# keys\n\n" + k2 + "\n  " + k1 + "  \n", current: "k2", ids: []string{"k1", "k2"}},
+		{name: "commas", text: k1 + "," + k2, current: "k1", ids: []string{"k1", "k2"}},
+		{name: "bare key", text: bare},
+		{name: "empty", text: "", err: "no master key found"},
+		{name: "only comments", text: "# none\n", err: "no master key found"},
+		{name: "duplicate ID", text: k1 + "\n" + strings.Replace(k2, "k2:", "k1:", 1), err: `master key 2: duplicate key ID "k1"`},
+		{name: "same bare key twice", text: bare + "\n" + bare, err: "master key 2: duplicate key ID"},
+		{name: "short key", text: "k1:" + short, err: "master key 1: must be 32 bytes, got 16"},
+		{name: "bad base64", text: k1 + "\nk2:not base64", err: "master key 2: not valid base64"},
+		{name: "invalid ID", text: "k 1:" + bare, err: `master key 1: invalid key ID "k 1"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ParseKeyring(tt.text)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseKeyring error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseKeyring: %v", err)
+			}
+			if tt.current != "" && keys.CurrentKeyID() != tt.current {
+				t.Errorf("current key %s, want %s", keys.CurrentKeyID(), tt.current)
+			}
+			for _, id := range tt.ids {
+				if !keys.HasKey(id) {
+					t.Errorf("keyring does not hold %s", id)
+				}
+			}
+		})
+	}
+
+	// A bare key's ID is derived from the key, so it is stable
+	first, _ := ParseKeyring(bare)
+	second, _ := ParseKeyring(bare)
+	if first.CurrentKeyID() == "" || first.CurrentKeyID() != second.CurrentKeyID() {
+		t.Errorf("bare key IDs %q and %q", first.CurrentKeyID(), second.CurrentKeyID())
+	}
+
+	if _, err := GenerateMasterKey("bad id"); err == nil {
+		t.Error("GenerateMasterKey accepted an invalid ID")
+	}
+}
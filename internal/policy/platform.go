@@ -0,0 +1,230 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// PlatformCapabilities describes what the IPsec backend an agent uses on a
+// platform can configure. Settings outside these lists are not rejected by
+// the agent; its backend silently substitutes a default, so they must be
+// caught before the policy is pushed.
+type PlatformCapabilities struct {
+	Platform    string                      `json:"platform"`
+	Backend     string                      `json:"backend"`
+	Modes       []ipsec.IPsecMode           `json:"modes"`
+	Encryption  []ipsec.EncryptionAlgorithm `json:"encryption"`
+	Integrity   []ipsec.IntegrityAlgorithm  `json:"integrity"`
+	DHGroups    []ipsec.DHGroup             `json:"dh_groups"`
+	IKEVersions []ipsec.IKEVersion          `json:"ike_versions"`
+	Issuers     []string                    `json:"issuers"`         // Certificate issuers the agent can authenticate with
+	Rotation    bool                        `json:"rotation"`        // The backend accepts a standby PSK alongside the secret, as PSK rotations need
+	Notes       map[string]string           `json:"notes,omitempty"` // Why a setting is missing, keyed by setting
+}
+
+var allEncryption = []ipsec.EncryptionAlgorithm{
+	ipsec.EncryptionAES128, ipsec.EncryptionAES256,
+	ipsec.EncryptionAES128GCM, ipsec.EncryptionAES256GCM,
+	ipsec.Encryption3DES,
+}
+
+var allIntegrity = []ipsec.IntegrityAlgorithm{
+	ipsec.IntegritySHA1, ipsec.IntegritySHA256, ipsec.IntegritySHA384, ipsec.IntegritySHA512,
+}
+
+var platformCapabilities = map[string]*PlatformCapabilities{
+	"linux": {
+		Platform: "linux",
+		Backend:  "strongswan",
+		Modes: []ipsec.IPsecMode{
+			ipsec.ModeESPTunnel, ipsec.ModeESPTransport,
+			ipsec.ModeAHTunnel, ipsec.ModeAHTransport, ipsec.ModeESPAHTunnel,
+		},
+		Encryption: allEncryption,
+		Integrity:  allIntegrity,
+		DHGroups: []ipsec.DHGroup{
+			ipsec.DHGroupModp1024, ipsec.DHGroupModp1536,
+			ipsec.DHGroupModp2048, ipsec.DHGroupModp3072, ipsec.DHGroupModp4096, ipsec.DHGroupModp8192,
+			ipsec.DHGroupECP256, ipsec.DHGroupECP384, ipsec.DHGroupECP521,
+		},
+		IKEVersions: []ipsec.IKEVersion{ipsec.IKEv1, ipsec.IKEv2},
+		Issuers:     []string{ipsec.IssuerBuiltin},
+		Rotation:    true,
+	},
+	"windows": {
+		Platform: "windows",
+		Backend:  "windows-ipsec",
+		Modes: []ipsec.IPsecMode{
+			ipsec.ModeESPTunnel, ipsec.ModeESPTransport, ipsec.ModeAHTransport,
+		},
+		Encryption: []ipsec.EncryptionAlgorithm{
+			ipsec.EncryptionAES128, ipsec.EncryptionAES256, ipsec.Encryption3DES,
+		},
+		Integrity: allIntegrity,
+		DHGroups: []ipsec.DHGroup{
+			ipsec.DHGroupModp1024, ipsec.DHGroupModp1536,
+			ipsec.DHGroupModp2048, ipsec.DHGroupModp3072, ipsec.DHGroupModp4096,
+			ipsec.DHGroupECP256, ipsec.DHGroupECP384,
+		},
+		IKEVersions: []ipsec.IKEVersion{ipsec.IKEv1, ipsec.IKEv2},
+		Issuers:     []string{},
+		Notes: map[string]string{
+			"mode":       "Windows connection security rules only support ESP in tunnel mode",
+			"encryption": "GCM is not configured in main mode proposals and falls back to CBC",
+			"dh_group":   "main mode proposals only offer groups 2, 5, 14-16, ECP256 and ECP384",
+			"issuer":     "certificate rules authenticate with the machine certificate store, which the agent does not manage",
+			"rotation":   "a main mode rule authenticates with a single preshared key",
+		},
+	},
+	"darwin": {
+		Platform: "darwin",
+		Backend:  "racoon",
+		Modes: []ipsec.IPsecMode{
+			ipsec.ModeESPTunnel, ipsec.ModeESPTransport,
+		},
+		Encryption: []ipsec.EncryptionAlgorithm{
+			ipsec.EncryptionAES128, ipsec.EncryptionAES256, ipsec.Encryption3DES,
+		},
+		Integrity: allIntegrity,
+		DHGroups: []ipsec.DHGroup{
+			ipsec.DHGroupModp1024, ipsec.DHGroupModp1536,
+			ipsec.DHGroupModp2048, ipsec.DHGroupModp3072, ipsec.DHGroupModp4096,
+		},
+		IKEVersions: []ipsec.IKEVersion{ipsec.IKEv1},
+		Issuers:     []string{ipsec.IssuerBuiltin},
+		Notes: map[string]string{
+			"mode":        "racoon sainfo blocks only negotiate ESP",
+			"encryption":  "racoon has no AES-GCM support",
+			"dh_group":    "racoon supports MODP groups up to 4096 bits only",
+			"ike_version": "racoon only implements IKEv1",
+			"rotation":    "racoon takes a single pre_shared_key per remote",
+		},
+	},
+}
+
+// LookupPlatformCapabilities returns the capabilities of a peer platform
+func LookupPlatformCapabilities(platform string) (*PlatformCapabilities, bool) {
+	caps, ok := platformCapabilities[strings.ToLower(platform)]
+	return caps, ok
+}
+
+// Check returns a finding for every tunnel setting, in any IKE or child
+// proposal, the platform's backend cannot configure
+func (c *PlatformCapabilities) Check(index int, tunnel ipsec.TunnelConfig) []Finding {
+	var findings []Finding
+	unsupported := func(setting, field, value string) {
+		msg := fmt.Sprintf("%s %s is not supported by %s agents (%s)", setting, value, c.Platform, c.Backend)
+		if note, ok := c.Notes[setting]; ok {
+			msg += ": " + note
+		}
+		findings = append(findings, errorFinding(tunnelPath(index, field), "platform.unsupported_"+setting, "%s", msg))
+	}
+
+	if !containsString(modeNames(c.Modes), string(tunnel.Mode)) {
+		unsupported("mode", "mode", string(tunnel.Mode))
+	}
+	for _, proposal := range offeredProposals(tunnel.Crypto) {
+		if !containsString(encryptionNames(c.Encryption), string(proposal.Encryption)) {
+			unsupported("encryption", proposal.Path+".encryption", string(proposal.Encryption))
+		}
+		if !containsString(integrityNames(c.Integrity), string(proposal.Integrity)) {
+			unsupported("integrity", proposal.Path+".integrity", string(proposal.Integrity))
+		}
+		if proposal.UsesDH && !containsString(dhGroupNames(c.DHGroups), string(proposal.DHGroup)) {
+			unsupported("dh_group", proposal.Path+".dhgroup", string(proposal.DHGroup))
+		}
+	}
+	if !containsString(ikeVersionNames(c.IKEVersions), string(tunnel.Crypto.IKEVersion)) {
+		unsupported("ike_version", "crypto.ikeversion", string(tunnel.Crypto.IKEVersion))
+	}
+	if tunnel.Auth.Type == ipsec.AuthCertificate && tunnel.Auth.Issuer != "" && !containsString(c.Issuers, tunnel.Auth.Issuer) {
+		unsupported("issuer", "auth.issuer", tunnel.Auth.Issuer)
+	}
+	if tunnel.Auth.Type == ipsec.AuthPSK && tunnel.Auth.RotateEvery != "" && !c.Rotation {
+		unsupported("rotation", "auth.rotate_every", tunnel.Auth.RotateEvery)
+	}
+
+	return findings
+}
+
+// PeerCompatibility is the result of checking a policy against one peer
+type PeerCompatibility struct {
+	PeerID     string    `json:"peer_id"`
+	Hostname   string    `json:"hostname"`
+	Platform   string    `json:"platform"`
+	Version    string    `json:"version"`
+	Compatible bool      `json:"compatible"`
+	Findings   []Finding `json:"findings,omitempty"`
+}
+
+// CompatibilityReport lists, for every registered peer a policy applies to,
+// whether that peer's platform can configure all of its tunnels and whether
+// their addresses fit the peer
+type CompatibilityReport struct {
+	Peers        []PeerCompatibility `json:"peers"`
+	Incompatible int                 `json:"incompatible"`
+}
+
+// CheckCompatibility resolves the peers a policy applies to and checks each
+// tunnel against the capabilities of each peer's platform. Peers on a
+// platform without a known capability matrix get an info finding and are
+// treated as compatible. Tunnel addresses are checked against each peer
+// with templates resolved for it.
+func (e *PolicyEngine) CheckCompatibility(policy *Policy, peers []PeerInfo) *CompatibilityReport {
+	report := &CompatibilityReport{Peers: []PeerCompatibility{}}
+
+	for i := range peers {
+		peer := &peers[i]
+		if len(targetedPolicies([]Policy{*policy}, peer)) == 0 {
+			continue
+		}
+
+		result := PeerCompatibility{
+			PeerID:     peer.ID,
+			Hostname:   peer.Hostname,
+			Platform:   peer.Platform,
+			Version:    peer.Version,
+			Compatible: true,
+		}
+
+		caps, ok := LookupPlatformCapabilities(peer.Platform)
+		if !ok {
+			result.Findings = append(result.Findings, Finding{
+				Severity: SeverityInfo,
+				Code:     "platform.unknown",
+				Message:  fmt.Sprintf("no capability matrix for platform %q; tunnels were not checked", peer.Platform),
+			})
+		} else {
+			for j, tunnel := range policy.Tunnels {
+				result.Findings = append(result.Findings, caps.Check(j, tunnel)...)
+			}
+		}
+		result.Findings = append(result.Findings, checkPeerAddresses(policy, peer)...)
+
+		if len(Findings(result.Findings).Blocking(false)) > 0 {
+			result.Compatible = false
+			report.Incompatible++
+		}
+		report.Peers = append(report.Peers, result)
+	}
+
+	return report
+}
+
+func modeNames(modes []ipsec.IPsecMode) []string {
+	names := make([]string, len(modes))
+	for i, mode := range modes {
+		names[i] = string(mode)
+	}
+	return names
+}
+
+func ikeVersionNames(versions []ipsec.IKEVersion) []string {
+	names := make([]string, len(versions))
+	for i, version := range versions {
+		names[i] = string(version)
+	}
+	return names
+}
@@ -0,0 +1,202 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// findingCodes formats findings as "path code"
+func findingCodes(findings []Finding) []string {
+	var codes []string
+	for _, f := range findings {
+		codes = append(codes, f.Path+" "+f.Code)
+	}
+	return codes
+}
+
+func TestPlatformCompatibilityValidator(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     ipsec.IPsecMode
+		ike      ipsec.IKEVersion
+		enc      ipsec.EncryptionAlgorithm
+		findings []string
+		severity Severity
+	}{
+		{name: "ESP", mode: ipsec.ModeESPTunnel, ike: ipsec.IKEv2, enc: ipsec.EncryptionAES256GCM},
+		{name: "AH tunnel", mode: ipsec.ModeAHTunnel, ike: ipsec.IKEv2, enc: ipsec.EncryptionAES256,
+			findings: []string{"tunnels[0].mode platform.ah_limited"}, severity: SeverityWarning},
+		{name: "AH transport", mode: ipsec.ModeAHTransport, ike: ipsec.IKEv2, enc: ipsec.EncryptionAES256,
+			findings: []string{"tunnels[0].mode platform.ah_limited"}, severity: SeverityWarning},
+		{name: "ESP and AH", mode: ipsec.ModeESPAHTunnel, ike: ipsec.IKEv2, enc: ipsec.EncryptionAES256,
+			findings: []string{"tunnels[0].mode platform.esp_ah_limited"}, severity: SeverityWarning},
+		{name: "GCM over IKEv1", mode: ipsec.ModeESPTunnel, ike: ipsec.IKEv1, enc: ipsec.EncryptionAES128GCM,
+			findings: []string{"tunnels[0].crypto.ikeversion platform.gcm_requires_ikev2"}, severity: SeverityError},
+		{name: "CBC over IKEv1", mode: ipsec.ModeESPTunnel, ike: ipsec.IKEv1, enc: ipsec.EncryptionAES128},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := ipsec.TunnelConfig{Mode: tt.mode, Crypto: ipsec.CryptoConfig{Encryption: tt.enc, IKEVersion: tt.ike}}
+			findings := (&PlatformCompatibilityValidator{}).Validate(&Policy{Tunnels: []ipsec.TunnelConfig{tunnel}})
+			if got := findingCodes(findings); !reflect.DeepEqual(got, tt.findings) {
+				t.Fatalf("got findings %q, want %q", got, tt.findings)
+			}
+			for _, f := range findings {
+				if f.Severity != tt.severity {
+					t.Errorf("finding %s has severity %s, want %s", f.Code, f.Severity, tt.severity)
+				}
+			}
+		})
+	}
+}
+
+func TestPlatformCapabilitiesCheck(t *testing.T) {
+	base := func() ipsec.TunnelConfig {
+		return ipsec.TunnelConfig{
+			Name: "t",
+			Mode: ipsec.ModeESPTunnel,
+			Crypto: ipsec.CryptoConfig{
+				Encryption: ipsec.EncryptionAES256,
+				Integrity:  ipsec.IntegritySHA256,
+				DHGroup:    ipsec.DHGroupModp2048,
+				IKEVersion: ipsec.IKEv1,
+			},
+			Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: "platform-secret"},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		platform string
+		change   func(*ipsec.TunnelConfig)
+		findings []string
+	}{
+		{name: "common suite on linux", platform: "linux", change: func(*ipsec.TunnelConfig) {}},
+		{name: "common suite on windows", platform: "windows", change: func(*ipsec.TunnelConfig) {}},
+		{name: "common suite on macOS", platform: "darwin", change: func(*ipsec.TunnelConfig) {}},
+		{name: "platform names ignore case", platform: "Linux", change: func(*ipsec.TunnelConfig) {}},
+
+		{name: "AH on linux", platform: "linux", change: func(t *ipsec.TunnelConfig) { t.Mode = ipsec.ModeAHTunnel }},
+		{name: "ESP and AH on linux", platform: "linux", change: func(t *ipsec.TunnelConfig) { t.Mode = ipsec.ModeESPAHTunnel }},
+		{name: "AH transport on windows", platform: "windows", change: func(t *ipsec.TunnelConfig) { t.Mode = ipsec.ModeAHTransport }},
+		{name: "AH tunnel on windows", platform: "windows", change: func(t *ipsec.TunnelConfig) { t.Mode = ipsec.ModeAHTunnel },
+			findings: []string{"tunnels[1].mode platform.unsupported_mode"}},
+		{name: "ESP and AH on windows", platform: "windows", change: func(t *ipsec.TunnelConfig) { t.Mode = ipsec.ModeESPAHTunnel },
+			findings: []string{"tunnels[1].mode platform.unsupported_mode"}},
+		{name: "AH transport on macOS", platform: "darwin", change: func(t *ipsec.TunnelConfig) { t.Mode = ipsec.ModeAHTransport },
+			findings: []string{"tunnels[1].mode platform.unsupported_mode"}},
+
+		{name: "GCM on windows", platform: "windows", change: func(t *ipsec.TunnelConfig) { t.Crypto.Encryption = ipsec.EncryptionAES256GCM },
+			findings: []string{"tunnels[1].crypto.encryption platform.unsupported_encryption"}},
+		{name: "ECP521 on windows", platform: "windows", change: func(t *ipsec.TunnelConfig) { t.Crypto.DHGroup = ipsec.DHGroupECP521 },
+			findings: []string{"tunnels[1].crypto.dhgroup platform.unsupported_dh_group"}},
+		{name: "ECP256 on macOS", platform: "darwin", change: func(t *ipsec.TunnelConfig) { t.Crypto.DHGroup = ipsec.DHGroupECP256 },
+			findings: []string{"tunnels[1].crypto.dhgroup platform.unsupported_dh_group"}},
+		{name: "IKEv2 on macOS", platform: "darwin", change: func(t *ipsec.TunnelConfig) { t.Crypto.IKEVersion = ipsec.IKEv2 },
+			findings: []string{"tunnels[1].crypto.ikeversion platform.unsupported_ike_version"}},
+		{
+			name:     "child proposals",
+			platform: "darwin",
+			change: func(t *ipsec.TunnelConfig) {
+				t.Crypto.Child = &ipsec.SAConfig{Lifetime: time.Hour, Proposals: []ipsec.Proposal{
+					{Encryption: ipsec.EncryptionAES128, Integrity: ipsec.IntegritySHA256, DHGroup: ipsec.DHGroupModp2048},
+					{Encryption: ipsec.EncryptionAES128GCM, Integrity: ipsec.IntegritySHA256, DHGroup: ipsec.DHGroupECP384},
+				}}
+			},
+			findings: []string{
+				"tunnels[1].crypto.child.proposals[1].encryption platform.unsupported_encryption",
+				"tunnels[1].crypto.child.proposals[1].dhgroup platform.unsupported_dh_group",
+			},
+		},
+
+		{name: "builtin issuer on windows", platform: "windows", change: func(t *ipsec.TunnelConfig) {
+			t.Auth = ipsec.AuthConfig{Type: ipsec.AuthCertificate, Issuer: ipsec.IssuerBuiltin}
+		}, findings: []string{"tunnels[1].auth.issuer platform.unsupported_issuer"}},
+		{name: "builtin issuer on linux", platform: "linux", change: func(t *ipsec.TunnelConfig) {
+			t.Auth = ipsec.AuthConfig{Type: ipsec.AuthCertificate, Issuer: ipsec.IssuerBuiltin}
+		}},
+		{name: "rotation on macOS", platform: "darwin", change: func(t *ipsec.TunnelConfig) { t.Auth.RotateEvery = "720h" },
+			findings: []string{"tunnels[1].auth.rotate_every platform.unsupported_rotation"}},
+		{name: "rotation on linux", platform: "linux", change: func(t *ipsec.TunnelConfig) { t.Auth.RotateEvery = "720h" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps, ok := LookupPlatformCapabilities(tt.platform)
+			if !ok {
+				t.Fatalf("no capabilities for %s", tt.platform)
+			}
+			tunnel := base()
+			tt.change(&tunnel)
+			if got := findingCodes(caps.Check(1, tunnel)); !reflect.DeepEqual(got, tt.findings) {
+				t.Errorf("got findings %q, want %q", got, tt.findings)
+			}
+		})
+	}
+
+	if _, ok := LookupPlatformCapabilities("plan9"); ok {
+		t.Error("found capabilities for an unknown platform")
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	pol := &Policy{
+		Name:      "p",
+		Enabled:   true,
+		AppliesTo: []string{"site"},
+		Tunnels: []ipsec.TunnelConfig{
+			{
+				Name:          "t",
+				Mode:          ipsec.ModeESPTunnel,
+				LocalAddress:  "192.0.2.1",
+				RemoteAddress: "198.51.100.1",
+				Crypto: ipsec.CryptoConfig{
+					Encryption: ipsec.EncryptionAES256GCM,
+					Integrity:  ipsec.IntegritySHA256,
+					DHGroup:    ipsec.DHGroupECP256,
+					IKEVersion: ipsec.IKEv2,
+				},
+				Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: "platform-secret"},
+			},
+		},
+	}
+	peers := []PeerInfo{
+		{ID: "lin", Platform: "linux", Tags: []string{"site"}, Addresses: []string{"192.0.2.1"}},
+		{ID: "win", Platform: "windows", Tags: []string{"site"}, Addresses: []string{"192.0.2.1"}},
+		{ID: "mac", Platform: "darwin", Tags: []string{"site"}, Addresses: []string{"192.0.2.1"}},
+		{ID: "bsd", Platform: "freebsd", Tags: []string{"site"}, Addresses: []string{"192.0.2.1"}},
+		{ID: "elsewhere", Platform: "linux", Addresses: []string{"192.0.2.1"}},
+		{ID: "moved", Platform: "linux", Tags: []string{"site"}, Addresses: []string{"192.0.2.99"}},
+	}
+
+	report := NewPolicyEngine().CheckCompatibility(pol, peers)
+
+	want := map[string][]string{
+		"lin": nil,
+		"win": {"tunnels[0].crypto.encryption platform.unsupported_encryption"},
+		"mac": {
+			"tunnels[0].crypto.encryption platform.unsupported_encryption",
+			"tunnels[0].crypto.dhgroup platform.unsupported_dh_group",
+			"tunnels[0].crypto.ikeversion platform.unsupported_ike_version",
+		},
+		"bsd":   {" platform.unknown"},
+		"moved": {"tunnels[0].local_address address.not_on_peer"},
+	}
+	got := make(map[string][]string)
+	for _, peer := range report.Peers {
+		got[peer.PeerID] = findingCodes(peer.Findings)
+		if wantCompatible := len(Findings(peer.Findings).Blocking(false)) == 0; peer.Compatible != wantCompatible {
+			t.Errorf("%s compatible = %v, want %v", peer.PeerID, peer.Compatible, wantCompatible)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got findings %q, want %q", got, want)
+	}
+	if report.Incompatible != 3 {
+		t.Errorf("%d incompatible peers, want 3", report.Incompatible)
+	}
+}
@@ -0,0 +1,185 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// TunnelChangeOp describes what an agent will do with a tunnel
+type TunnelChangeOp string
+
+const (
+	TunnelCreate TunnelChangeOp = "create"
+	TunnelUpdate TunnelChangeOp = "update"
+	TunnelDelete TunnelChangeOp = "delete"
+)
+
+// TunnelChange is a single tunnel that a peer would create, update or delete
+type TunnelChange struct {
+	Tunnel   string         `json:"tunnel"`
+	Op       TunnelChangeOp `json:"op"`
+	PolicyID string         `json:"policy_id,omitempty"` // Policy supplying the tunnel (before it, for deletes)
+	Fields   []FieldChange  `json:"fields,omitempty"`    // Only set for updates
+}
+
+// PeerPreview lists the tunnel changes a single peer would apply
+type PeerPreview struct {
+	PeerID    string           `json:"peer_id"`
+	Hostname  string           `json:"hostname"`
+	Changes   []TunnelChange   `json:"changes"`
+	Conflicts []TunnelConflict `json:"conflicts,omitempty"` // Conflicts after the change
+	Errors    TemplateErrors   `json:"errors,omitempty"`    // Templates that would not resolve after the change
+}
+
+// PolicyPreview is the fleet-wide effect of a policy change
+type PolicyPreview struct {
+	Peers     []PeerPreview `json:"peers"`     // Peers whose tunnels change
+	Unchanged int           `json:"unchanged"` // Number of peers with no changes
+}
+
+// WithPolicy returns a copy of policies in which candidate replaces the policy
+// with the same ID, or is added if there is none
+func WithPolicy(policies []Policy, candidate Policy) []Policy {
+	out := make([]Policy, 0, len(policies)+1)
+	replaced := false
+	for _, policy := range policies {
+		if candidate.ID != "" && policy.ID == candidate.ID {
+			out = append(out, candidate)
+			replaced = true
+			continue
+		}
+		out = append(out, policy)
+	}
+	if !replaced {
+		out = append(out, candidate)
+	}
+	return out
+}
+
+// WithoutPolicy returns a copy of policies with the given policy ID removed
+func WithoutPolicy(policies []Policy, id string) []Policy {
+	out := make([]Policy, 0, len(policies))
+	for _, policy := range policies {
+		if policy.ID != id {
+			out = append(out, policy)
+		}
+	}
+	return out
+}
+
+// Preview computes, for every peer, how its merged tunnel set changes when the
+// current policies are replaced by the candidate set. It uses the same
+// resolve and merge steps as policy distribution, so the result matches what
+// agents would apply on their next sync. A peer whose templates would stop
+// resolving is reported with its errors, since it would keep its old tunnels.
+func (e *PolicyEngine) Preview(current, candidate []Policy, peers []PeerInfo) (*PolicyPreview, error) {
+	preview := &PolicyPreview{Peers: []PeerPreview{}}
+
+	for i := range peers {
+		peer := &peers[i]
+
+		// Templates that already fail today are not the candidate's doing
+		currentPolicies, _ := e.PoliciesForPeer(current, peer)
+		candidatePolicies, err := e.PoliciesForPeer(candidate, peer)
+		var templateErrs TemplateErrors
+		if err != nil && !errors.As(err, &templateErrs) {
+			return nil, fmt.Errorf("peer %s: %w", peer.ID, err)
+		}
+
+		before := e.MergeTunnels(currentPolicies)
+		after := e.MergeTunnels(candidatePolicies)
+		if len(templateErrs) > 0 {
+			after = before
+		}
+
+		changes, err := diffMerged(before, after)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", peer.ID, err)
+		}
+
+		if len(changes) == 0 && len(templateErrs) == 0 {
+			preview.Unchanged++
+			continue
+		}
+
+		preview.Peers = append(preview.Peers, PeerPreview{
+			PeerID:    peer.ID,
+			Hostname:  peer.Hostname,
+			Changes:   changes,
+			Conflicts: after.Conflicts,
+			Errors:    templateErrs,
+		})
+	}
+
+	return preview, nil
+}
+
+// diffMerged compares two merged tunnel sets, returning changes sorted by tunnel name
+func diffMerged(before, after *MergeResult) ([]TunnelChange, error) {
+	old := make(map[string]ipsec.TunnelConfig, len(before.Tunnels))
+	for _, tunnel := range before.Tunnels {
+		old[tunnel.Name] = tunnel
+	}
+
+	changes := []TunnelChange{}
+
+	for _, tunnel := range after.Tunnels {
+		prev, exists := old[tunnel.Name]
+		if !exists {
+			changes = append(changes, TunnelChange{
+				Tunnel:   tunnel.Name,
+				Op:       TunnelCreate,
+				PolicyID: after.Sources[tunnel.Name],
+			})
+			continue
+		}
+
+		fields, err := diffTunnels(prev, tunnel)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) > 0 || before.Sources[tunnel.Name] != after.Sources[tunnel.Name] {
+			changes = append(changes, TunnelChange{
+				Tunnel:   tunnel.Name,
+				Op:       TunnelUpdate,
+				PolicyID: after.Sources[tunnel.Name],
+				Fields:   fields,
+			})
+		}
+	}
+
+	for _, tunnel := range before.Tunnels {
+		if _, exists := after.Sources[tunnel.Name]; !exists {
+			changes = append(changes, TunnelChange{
+				Tunnel:   tunnel.Name,
+				Op:       TunnelDelete,
+				PolicyID: before.Sources[tunnel.Name],
+			})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Tunnel < changes[j].Tunnel
+	})
+
+	return changes, nil
+}
+
+// diffTunnels compares two tunnel configurations field by field
+func diffTunnels(from, to ipsec.TunnelConfig) ([]FieldChange, error) {
+	a, err := toGeneric(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toGeneric(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []FieldChange
+	diffValues("", a, b, &changes)
+	return changes, nil
+}
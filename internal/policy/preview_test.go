@@ -0,0 +1,166 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// previewTunnel returns a tunnel to a hub whose local address is the peer's
+func previewTunnel(name, remote string) ipsec.TunnelConfig {
+	tunnel := pskTunnel(name, "preview-secret")
+	tunnel.Mode = ipsec.ModeESPTunnel
+	tunnel.LocalAddress = "{{ .Peer.IPAddress }}"
+	tunnel.RemoteAddress = remote
+	tunnel.TrafficSelectors = []ipsec.TrafficSelector{
+		{LocalSubnet: "{{ .Peer.Metadata.lan }}", RemoteSubnet: "10.0.0.0/16"},
+	}
+	return tunnel
+}
+
+// previewChanges formats each peer's changes as "peer op tunnel policy",
+// followed by "peer  field" for every changed field of an update
+func previewChanges(preview *PolicyPreview) []string {
+	var list []string
+	for _, peer := range preview.Peers {
+		for _, change := range peer.Changes {
+			list = append(list, peer.PeerID+" "+string(change.Op)+" "+change.Tunnel+" "+change.PolicyID)
+			for _, field := range change.Fields {
+				list = append(list, peer.PeerID+"  "+field.Path)
+			}
+		}
+	}
+	return list
+}
+
+func TestPreview(t *testing.T) {
+	peers := []PeerInfo{
+		{ID: "lin", Platform: "linux", IPAddress: "192.0.2.1", Tags: []string{"branch"}, Metadata: map[string]string{"lan": "10.1.0.0/24"}},
+		{ID: "win", Platform: "windows", IPAddress: "192.0.2.2", Tags: []string{"branch"}, Metadata: map[string]string{"lan": "10.2.0.0/24"}},
+		{ID: "mac", Platform: "darwin", IPAddress: "192.0.2.3", Tags: []string{"lab"}, Metadata: map[string]string{"lan": "10.3.0.0/24"}},
+	}
+	stored := []Policy{
+		{ID: "branches", Name: "branches", Enabled: true, AppliesTo: []string{"branch"}, Priority: 10,
+			Tunnels: []ipsec.TunnelConfig{previewTunnel("to-hq", "198.51.100.1"), previewTunnel("to-dr", "198.51.100.2")}},
+		{ID: "lab", Name: "lab", Enabled: true, AppliesTo: []string{"lab"},
+			Tunnels: []ipsec.TunnelConfig{previewTunnel("to-hq", "198.51.100.1")}},
+	}
+	engine := NewPolicyEngine()
+
+	tests := []struct {
+		name      string
+		candidate []Policy
+		changes   []string
+		unchanged int
+	}{
+		{
+			name:      "no change",
+			candidate: stored,
+			unchanged: 3,
+		},
+		{
+			name: "proposed policy changes a tunnel and adds one",
+			candidate: WithPolicy(stored, Policy{
+				ID: "branches", Name: "branches", Enabled: true, AppliesTo: []string{"branch"}, Priority: 10,
+				Tunnels: []ipsec.TunnelConfig{
+					previewTunnel("to-hq", "198.51.100.9"),
+					previewTunnel("to-dr", "198.51.100.2"),
+					previewTunnel("to-cloud", "203.0.113.1"),
+				},
+			}),
+			changes: []string{
+				"lin create to-cloud branches",
+				"lin update to-hq branches", "lin  remote_address",
+				"win create to-cloud branches",
+				"win update to-hq branches", "win  remote_address",
+			},
+			unchanged: 1,
+		},
+		{
+			name: "proposed policy takes over a tunnel",
+			candidate: WithPolicy(stored, Policy{
+				ID: "all", Name: "all", Enabled: true, AppliesTo: []string{"*"}, Priority: 20,
+				Tunnels: []ipsec.TunnelConfig{previewTunnel("to-hq", "198.51.100.1")},
+			}),
+			changes: []string{
+				"lin update to-hq all",
+				"win update to-hq all",
+				"mac update to-hq all",
+			},
+		},
+		{
+			name:      "deleted policy",
+			candidate: WithoutPolicy(stored, "branches"),
+			changes: []string{
+				"lin delete to-dr branches", "lin delete to-hq branches",
+				"win delete to-dr branches", "win delete to-hq branches",
+			},
+			unchanged: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preview, err := engine.Preview(stored, tt.candidate, peers)
+			if err != nil {
+				t.Fatalf("Preview: %v", err)
+			}
+			if got := previewChanges(preview); !reflect.DeepEqual(got, tt.changes) {
+				t.Errorf("got changes %q, want %q", got, tt.changes)
+			}
+			if preview.Unchanged != tt.unchanged {
+				t.Errorf("%d peers unchanged, want %d", preview.Unchanged, tt.unchanged)
+			}
+		})
+	}
+}
+
+func TestPreviewResolvesPerPeer(t *testing.T) {
+	peers := []PeerInfo{
+		{ID: "lin", Platform: "linux", IPAddress: "192.0.2.1", Metadata: map[string]string{"lan": "10.1.0.0/24"}},
+		{ID: "win", Platform: "windows", IPAddress: "192.0.2.2"},
+	}
+	candidate := []Policy{
+		{ID: "p", Name: "p", Enabled: true, Tunnels: []ipsec.TunnelConfig{previewTunnel("to-hq", "198.51.100.1")}},
+	}
+
+	preview, err := NewPolicyEngine().Preview(nil, candidate, peers)
+	if err != nil {
+		t.Fatalf("Preview: %v", err)
+	}
+	if len(preview.Peers) != 2 {
+		t.Fatalf("%d peers in the preview, want 2", len(preview.Peers))
+	}
+
+	// The peer with its metadata gets the tunnel
+	lin := preview.Peers[0]
+	if lin.PeerID != "lin" || len(lin.Changes) != 1 || lin.Changes[0].Op != TunnelCreate || len(lin.Errors) != 0 {
+		t.Errorf("linux peer preview %+v", lin)
+	}
+
+	// The one without would keep its old tunnels, so it only reports why
+	win := preview.Peers[1]
+	if win.PeerID != "win" || len(win.Changes) != 0 {
+		t.Errorf("windows peer preview %+v", win)
+	}
+	if len(win.Errors) != 1 || win.Errors[0].PolicyID != "p" || win.Errors[0].Field != "traffic_selectors[0].local_subnet" {
+		t.Errorf("windows peer errors %+v", win.Errors)
+	}
+
+	// A templated change shows as resolved for each peer
+	changed := candidate[0]
+	changed.Tunnels = []ipsec.TunnelConfig{previewTunnel("to-hq", "198.51.100.1")}
+	changed.Tunnels[0].LocalID = "{{ .Peer.Platform }}"
+	preview, err = NewPolicyEngine().Preview(candidate, []Policy{changed}, peers)
+	if err != nil {
+		t.Fatalf("Preview: %v", err)
+	}
+	want := []string{"lin update to-hq p", "lin  local_id"}
+	if got := previewChanges(preview); !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %q, want %q", got, want)
+	}
+	if field := preview.Peers[0].Changes[0].Fields[0]; field.New != "linux" {
+		t.Errorf("local_id changed to %v, want linux", field.New)
+	}
+}
@@ -0,0 +1,40 @@
+package policy
+
+import "github.com/swavlamban/ipsec-manager/internal/ipsec"
+
+// RedactedSecret replaces secrets in API responses. A policy or topology
+// sent back with it in place of a secret keeps the secret already stored,
+// so a redacted document can be edited and saved as it is.
+const RedactedSecret = "********"
+
+// RestoreSecrets replaces redacted secrets in pol's tunnels with those of the
+// stored tunnels of the same name. Redacted secrets with no stored tunnel to
+// take them from are left for validation to reject.
+func RestoreSecrets(pol, stored *Policy) {
+	if stored == nil {
+		return
+	}
+	for i := range pol.Tunnels {
+		restoreSecret(&pol.Tunnels[i].Auth, stored.Tunnels, pol.Tunnels[i].Name)
+	}
+}
+
+func restoreSecret(auth *ipsec.AuthConfig, stored []ipsec.TunnelConfig, name string) {
+	if auth.Secret != RedactedSecret {
+		return
+	}
+	for _, tunnel := range stored {
+		if tunnel.Name == name {
+			auth.Secret = tunnel.Auth.Secret
+			return
+		}
+	}
+}
+
+// RestoreTopologySecret replaces a redacted secret in a topology with the
+// stored topology's
+func RestoreTopologySecret(topology, stored *Topology) {
+	if stored != nil && topology.Auth.Secret == RedactedSecret {
+		topology.Auth.Secret = stored.Auth.Secret
+	}
+}
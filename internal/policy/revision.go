@@ -0,0 +1,201 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// PolicyRevision is an immutable snapshot of a policy taken on every save
+type PolicyRevision struct {
+	PolicyID  string    `json:"policy_id" yaml:"policy_id"`
+	Revision  int       `json:"revision" yaml:"revision"`
+	CreatedAt time.Time `json:"created_at" yaml:"created_at"`
+	Policy    Policy    `json:"policy" yaml:"policy"`
+}
+
+// ChangeOp describes how a field differs between two revisions
+type ChangeOp string
+
+const (
+	ChangeAdded   ChangeOp = "added"
+	ChangeRemoved ChangeOp = "removed"
+	ChangeChanged ChangeOp = "changed"
+)
+
+// FieldChange is a single difference between two policies
+type FieldChange struct {
+	Path string      `json:"path"` // e.g. tunnels[hq-to-branch].crypto.dhgroup
+	Op   ChangeOp    `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// PolicyDiff is the structured difference between two revisions of a policy
+type PolicyDiff struct {
+	PolicyID string        `json:"policy_id"`
+	From     int           `json:"from"`
+	To       int           `json:"to"`
+	Changes  []FieldChange `json:"changes"`
+}
+
+// diffIgnoredFields are bookkeeping fields that change on every save
+var diffIgnoredFields = map[string]bool{
+	"id":             true,
+	"version":        true,
+	"schema_version": true,
+	"created_at":     true,
+	"updated_at":     true,
+}
+
+// DiffPolicies compares two policies field by field. Tunnels are matched by
+// name rather than position, so reordering tunnels is not reported as a change.
+func DiffPolicies(from, to *Policy) ([]FieldChange, error) {
+	a, err := toGeneric(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toGeneric(to)
+	if err != nil {
+		return nil, err
+	}
+
+	for field := range diffIgnoredFields {
+		delete(a, field)
+		delete(b, field)
+	}
+
+	changes := []FieldChange{}
+	diffValues("", a, b, &changes)
+	return changes, nil
+}
+
+// toGeneric converts a value to its JSON representation as plain maps/slices
+func toGeneric(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %T: %w", v, err)
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %T: %w", v, err)
+	}
+	return out, nil
+}
+
+func diffValues(path string, a, b interface{}, changes *[]FieldChange) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			diffMaps(path, av, bv, changes)
+			return
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			if ak, ok := keyByName(av); ok {
+				if bk, ok := keyByName(bv); ok {
+					diffNamed(path, ak, bk, changes)
+					return
+				}
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, FieldChange{Path: path, Op: ChangeChanged, Old: a, New: b})
+	}
+}
+
+func diffMaps(path string, a, b map[string]interface{}, changes *[]FieldChange) {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+
+	for _, k := range sortedKeys(keys) {
+		av, aok := a[k]
+		bv, bok := b[k]
+		child := joinPath(path, k)
+
+		switch {
+		case !aok:
+			*changes = append(*changes, FieldChange{Path: child, Op: ChangeAdded, New: bv})
+		case !bok:
+			*changes = append(*changes, FieldChange{Path: child, Op: ChangeRemoved, Old: av})
+		default:
+			diffValues(child, av, bv, changes)
+		}
+	}
+}
+
+func diffNamed(path string, a, b map[string]interface{}, changes *[]FieldChange) {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+
+	for _, k := range sortedKeys(keys) {
+		av, aok := a[k]
+		bv, bok := b[k]
+		child := fmt.Sprintf("%s[%s]", path, k)
+
+		switch {
+		case !aok:
+			*changes = append(*changes, FieldChange{Path: child, Op: ChangeAdded, New: bv})
+		case !bok:
+			*changes = append(*changes, FieldChange{Path: child, Op: ChangeRemoved, Old: av})
+		default:
+			diffValues(child, av, bv, changes)
+		}
+	}
+}
+
+// keyByName indexes a list of objects by their "name" field. It fails if any
+// element is not an object or names are missing or duplicated.
+func keyByName(items []interface{}) (map[string]interface{}, bool) {
+	if len(items) == 0 {
+		return nil, false
+	}
+
+	out := make(map[string]interface{}, len(items))
+	for _, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := obj["name"].(string)
+		if !ok || name == "" {
+			return nil, false
+		}
+		if _, dup := out[name]; dup {
+			return nil, false
+		}
+		out[name] = obj
+	}
+	return out, true
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(keys map[string]bool) []string {
+	out := make([]string, 0, len(keys))
+	for k := range keys {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
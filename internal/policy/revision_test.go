@@ -0,0 +1,148 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+func TestDiffPolicies(t *testing.T) {
+	base := func() *Policy {
+		return &Policy{
+			ID:          "p",
+			Name:        "p",
+			Description: "old",
+			Version:     1,
+			AppliesTo:   []string{"branch"},
+			Tunnels:     []ipsec.TunnelConfig{pskTunnel("a", "secret"), pskTunnel("b", "secret")},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		change  func(*Policy)
+		changes []string // "op path"
+	}{
+		{"no change", func(p *Policy) {}, nil},
+		{"bookkeeping only", func(p *Policy) { p.Version = 7; p.SchemaVersion = 3 }, nil},
+		{"field", func(p *Policy) { p.Description = "new" }, []string{"changed description"}},
+		{"tunnel field", func(p *Policy) { p.Tunnels[1].Crypto.DHGroup = ipsec.DHGroupECP256 }, []string{"changed tunnels[b].crypto.dhgroup"}},
+		{"field removed", func(p *Policy) { p.Description = "" }, []string{"removed description"}},
+		{"tunnels reordered", func(p *Policy) { p.Tunnels[0], p.Tunnels[1] = p.Tunnels[1], p.Tunnels[0] }, nil},
+		{"tunnel added", func(p *Policy) { p.Tunnels = append(p.Tunnels, pskTunnel("c", "secret")) }, []string{"added tunnels[c]"}},
+		{"tunnel removed", func(p *Policy) { p.Tunnels = p.Tunnels[:1] }, []string{"removed tunnels[b]"}},
+		{"list", func(p *Policy) { p.AppliesTo = []string{"branch", "lab"} }, []string{"changed applies_to"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			to := base()
+			tt.change(to)
+			changes, err := DiffPolicies(base(), to)
+			if err != nil {
+				t.Fatalf("DiffPolicies: %v", err)
+			}
+			var got []string
+			for _, c := range changes {
+				got = append(got, string(c.Op)+" "+c.Path)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.changes, "\n") {
+				t.Errorf("got changes %q, want %q", got, tt.changes)
+			}
+		})
+	}
+}
+
+func TestPolicyRevisions(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+
+	pol := &Policy{ID: "p", Name: "p", Tunnels: []ipsec.TunnelConfig{pskTunnel("a", "first")}}
+	for _, secret := range []string{"first", "second", "third"} {
+		pol.Tunnels[0].Auth.Secret = secret
+		if err := storage.SavePolicy(ctx, pol); err != nil {
+			t.Fatalf("SavePolicy: %v", err)
+		}
+	}
+
+	revisions, err := storage.ListPolicyRevisions(ctx, "p")
+	if err != nil {
+		t.Fatalf("ListPolicyRevisions: %v", err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("got %d revisions, want 3", len(revisions))
+	}
+	for i, rev := range revisions {
+		if rev.Revision != i+1 || rev.Policy.Version != i+1 {
+			t.Errorf("revision %d holds version %d, want %d", rev.Revision, rev.Policy.Version, i+1)
+		}
+	}
+	if secret := revisions[1].Policy.Tunnels[0].Auth.Secret; secret != "second" {
+		t.Errorf("revision 2 has secret %q, want second", secret)
+	}
+
+	// Revisions outlive the policy
+	if err := storage.DeletePolicy(ctx, "p", 3); err != nil {
+		t.Fatalf("DeletePolicy: %v", err)
+	}
+	rev, err := storage.GetPolicyRevision(ctx, "p", 1)
+	if err != nil {
+		t.Fatalf("GetPolicyRevision after delete: %v", err)
+	}
+	if rev.Policy.Tunnels[0].Auth.Secret != "first" {
+		t.Errorf("revision 1 has secret %q, want first", rev.Policy.Tunnels[0].Auth.Secret)
+	}
+	if _, err := storage.GetPolicyRevision(ctx, "p", 4); err == nil {
+		t.Error("GetPolicyRevision of a missing revision succeeded")
+	}
+	if _, err := storage.ListPolicyRevisions(ctx, "none"); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("ListPolicyRevisions of an unknown policy: %v, want %v", err, ErrPolicyNotFound)
+	}
+}
+
+func TestDuplicatePolicyName(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+
+	if err := storage.SavePolicy(ctx, &Policy{ID: "a", Name: "shared"}); err != nil {
+		t.Fatalf("SavePolicy: %v", err)
+	}
+	b := &Policy{ID: "b", Name: "shared"}
+	if err := storage.SavePolicy(ctx, b); !errors.Is(err, ErrDuplicateName) {
+		t.Fatalf("SavePolicy with a taken name: %v, want %v", err, ErrDuplicateName)
+	}
+
+	b.Name = "other"
+	if err := storage.SavePolicy(ctx, b); err != nil {
+		t.Fatalf("SavePolicy: %v", err)
+	}
+	b.Name = "shared"
+	if err := storage.SavePolicy(ctx, b); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("renaming to a taken name: %v, want %v", err, ErrDuplicateName)
+	}
+
+	// A policy keeps its own name across saves
+	a := &Policy{ID: "a", Name: "shared", Version: 1, Description: "again"}
+	if err := storage.SavePolicy(ctx, a); err != nil {
+		t.Errorf("saving a policy under its own name: %v", err)
+	}
+
+	// The database refuses duplicates from writers that skip the check
+	_, err := storage.db.Exec(`INSERT INTO policies (id, name, version, created_at, updated_at, tunnels)
+		VALUES ('c', 'shared', 1, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, '[]')`)
+	if !isUniqueViolation(err, "policies.name") {
+		t.Errorf("inserting a taken name directly: %v, want a unique constraint violation", err)
+	}
+	if isUniqueViolation(errors.New("UNIQUE constraint failed: policies.id"), "policies.name") {
+		t.Error("a duplicate ID was reported as a duplicate name")
+	}
+
+	var index string
+	err = storage.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'index' AND name = 'idx_policies_name'").Scan(&index)
+	if err != nil || !strings.Contains(index, "UNIQUE INDEX") {
+		t.Errorf("name index %q, %v", index, err)
+	}
+}
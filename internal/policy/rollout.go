@@ -0,0 +1,399 @@
+package policy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// A rollout stages a policy update across the peers it targets. The updated
+// policy is saved as usual, but until a peer's wave is deployed that peer
+// keeps receiving the baseline, the policy as it was before the update. The
+// first wave is the canary; each later wave starts after a pause once the
+// agents of the previous wave report that they applied the new version and
+// its tunnels are healthy. A wave that reports a failed tunnel, or does not
+// become healthy in time, rolls the policy back to the baseline.
+
+// RolloutState is the overall state of a rollout
+type RolloutState string
+
+const (
+	RolloutRunning    RolloutState = "running"
+	RolloutPaused     RolloutState = "paused"      // Deployed waves keep the new version; no further waves start
+	RolloutCompleted  RolloutState = "completed"   // Every peer receives the new version
+	RolloutRolledBack RolloutState = "rolled_back" // The baseline was restored for every peer
+)
+
+// WaveState is the state of a single rollout wave
+type WaveState string
+
+const (
+	WavePending   WaveState = "pending"   // Peers still receive the baseline
+	WaveDeploying WaveState = "deploying" // Peers receive the new version; waiting for health reports
+	WaveHealthy   WaveState = "healthy"
+	WaveFailed    WaveState = "failed"
+)
+
+// RolloutEvent is what happened to a rollout when it was advanced
+type RolloutEvent string
+
+const (
+	RolloutNoChange     RolloutEvent = ""
+	RolloutWaveStarted  RolloutEvent = "wave_started"
+	RolloutWavePromoted RolloutEvent = "wave_promoted"
+	RolloutFinished     RolloutEvent = "completed"
+	RolloutFailed       RolloutEvent = "failed"
+)
+
+// Defaults for RolloutStrategy
+const (
+	DefaultRolloutPause         = 5 * time.Minute
+	DefaultRolloutHealthTimeout = 10 * time.Minute
+)
+
+// RolloutStrategy decides how the targeted peers are split into waves
+type RolloutStrategy struct {
+	Canary        int     `json:"canary,omitempty" yaml:"canary,omitempty"`                 // Peers in the first wave
+	CanaryPercent float64 `json:"canary_percent,omitempty" yaml:"canary_percent,omitempty"` // Or a percentage of the targeted peers; one peer if neither is set
+	WavePercent   float64 `json:"wave_percent,omitempty" yaml:"wave_percent,omitempty"`     // Size of each later wave; all remaining peers at once if zero
+	Pause         string  `json:"pause,omitempty" yaml:"pause,omitempty"`                   // Wait between waves, e.g. 10m
+	HealthTimeout string  `json:"health_timeout,omitempty" yaml:"health_timeout,omitempty"` // Time a wave has to report healthy
+}
+
+// Validate checks that the strategy's sizes and durations are usable
+func (s *RolloutStrategy) Validate() error {
+	if s.Canary < 0 {
+		return fmt.Errorf("canary must not be negative")
+	}
+	if s.CanaryPercent < 0 || s.CanaryPercent > 100 {
+		return fmt.Errorf("canary_percent must be between 0 and 100")
+	}
+	if s.Canary > 0 && s.CanaryPercent > 0 {
+		return fmt.Errorf("canary and canary_percent are mutually exclusive")
+	}
+	if s.WavePercent < 0 || s.WavePercent > 100 {
+		return fmt.Errorf("wave_percent must be between 0 and 100")
+	}
+	if _, _, err := s.durations(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *RolloutStrategy) durations() (pause, timeout time.Duration, err error) {
+	pause, timeout = DefaultRolloutPause, DefaultRolloutHealthTimeout
+	if s.Pause != "" {
+		if pause, err = time.ParseDuration(s.Pause); err != nil || pause < 0 {
+			return 0, 0, fmt.Errorf("invalid pause %q", s.Pause)
+		}
+	}
+	if s.HealthTimeout != "" {
+		if timeout, err = time.ParseDuration(s.HealthTimeout); err != nil || timeout <= 0 {
+			return 0, 0, fmt.Errorf("invalid health_timeout %q", s.HealthTimeout)
+		}
+	}
+	return pause, timeout, nil
+}
+
+// RolloutWave is a group of peers that receives the new version together
+type RolloutWave struct {
+	Peers       []string          `json:"peers"`
+	State       WaveState         `json:"state"`
+	StartedAt   *time.Time        `json:"started_at,omitempty"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty"`
+	Unhealthy   map[string]string `json:"unhealthy,omitempty"` // Peer ID -> reason, when the wave failed
+}
+
+// Rollout is a staged update of one policy
+type Rollout struct {
+	ID          string          `json:"id"`
+	PolicyID    string          `json:"policy_id"`
+	FromVersion int             `json:"from_version"` // Version of the baseline
+	ToVersion   int             `json:"to_version"`   // Version being rolled out
+	Baseline    Policy          `json:"baseline"`     // Served to peers whose wave has not been deployed
+	Strategy    RolloutStrategy `json:"strategy"`
+	State       RolloutState    `json:"state"`
+	Waves       []RolloutWave   `json:"waves"`
+	CurrentWave int             `json:"current_wave"`
+	Message     string          `json:"message,omitempty"` // Why the rollout stopped
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// NewRollout plans a rollout of target, which replaces baseline, across the
+// peers either version targets. Peers are ordered by ID so that the plan does
+// not depend on registration order. A rollout that targets no peers is
+// completed straight away.
+func NewRollout(baseline, target *Policy, peers []PeerInfo, strategy RolloutStrategy) (*Rollout, error) {
+	if err := strategy.Validate(); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for i := range peers {
+		peer := &peers[i]
+		if len(targetedPolicies([]Policy{*baseline, *target}, peer)) > 0 {
+			ids = append(ids, peer.ID)
+		}
+	}
+	sort.Strings(ids)
+
+	rollout := &Rollout{
+		PolicyID:    target.ID,
+		FromVersion: baseline.Version,
+		ToVersion:   target.Version,
+		Baseline:    *baseline,
+		Strategy:    strategy,
+		State:       RolloutRunning,
+		Waves:       planWaves(ids, strategy),
+	}
+	if len(rollout.Waves) == 0 {
+		rollout.State = RolloutCompleted
+		rollout.Message = "no peers targeted"
+	}
+	return rollout, nil
+}
+
+// planWaves splits peers into the canary wave and the waves after it
+func planWaves(peers []string, strategy RolloutStrategy) []RolloutWave {
+	size := func(percent float64) int {
+		n := int(math.Ceil(float64(len(peers)) * percent / 100))
+		if n < 1 {
+			n = 1
+		}
+		return n
+	}
+
+	canary := 1
+	switch {
+	case strategy.Canary > 0:
+		canary = strategy.Canary
+	case strategy.CanaryPercent > 0:
+		canary = size(strategy.CanaryPercent)
+	}
+
+	waveSize := len(peers)
+	if strategy.WavePercent > 0 {
+		waveSize = size(strategy.WavePercent)
+	}
+
+	var waves []RolloutWave
+	for start, n := 0, canary; start < len(peers); start, n = start+n, waveSize {
+		end := start + n
+		if end > len(peers) {
+			end = len(peers)
+		}
+		waves = append(waves, RolloutWave{Peers: peers[start:end], State: WavePending})
+	}
+	return waves
+}
+
+// Active reports whether the rollout still decides which version peers get
+func (r *Rollout) Active() bool {
+	return r.State == RolloutRunning || r.State == RolloutPaused
+}
+
+// Includes reports whether a peer receives the new version
+func (r *Rollout) Includes(peerID string) bool {
+	if r.State == RolloutCompleted {
+		return true
+	}
+	for i := 0; i <= r.CurrentWave && i < len(r.Waves); i++ {
+		if r.Waves[i].State == WavePending {
+			continue
+		}
+		if containsString(r.Waves[i].Peers, peerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyRollouts replaces each policy that has an active rollout with its
+// baseline, for a peer that has not been reached by the rollout yet
+func ApplyRollouts(policies []Policy, rollouts []Rollout, peerID string) []Policy {
+	out := make([]Policy, len(policies))
+	copy(out, policies)
+
+	for i := range rollouts {
+		rollout := &rollouts[i]
+		if !rollout.Active() || rollout.Includes(peerID) {
+			continue
+		}
+		for j := range out {
+			if out[j].ID == rollout.PolicyID {
+				out[j] = rollout.Baseline
+			}
+		}
+	}
+	return out
+}
+
+// Advance moves a running rollout forward using the agents' latest reports:
+// it starts the next wave once the pause is over, promotes a deploying wave
+// whose peers are all healthy, and fails it if a peer is unhealthy or the
+// health timeout passes. On RolloutFailed the caller restores the baseline
+// and calls RolledBack.
+func (r *Rollout) Advance(now time.Time, reports map[string]*PeerReport) RolloutEvent {
+	if r.State != RolloutRunning || r.CurrentWave >= len(r.Waves) {
+		return RolloutNoChange
+	}
+	pause, timeout, _ := r.Strategy.durations()
+	wave := &r.Waves[r.CurrentWave]
+
+	switch wave.State {
+	case WavePending:
+		if r.CurrentWave > 0 {
+			previous := r.Waves[r.CurrentWave-1]
+			if previous.CompletedAt != nil && now.Before(previous.CompletedAt.Add(pause)) {
+				return RolloutNoChange
+			}
+		}
+		r.startWave(now)
+		return RolloutWaveStarted
+
+	case WaveDeploying:
+		unhealthy := make(map[string]string)
+		waiting := make(map[string]string)
+		for _, peerID := range wave.Peers {
+			health, reason := reports[peerID].PolicyHealth(r.PolicyID, r.ToVersion, *wave.StartedAt)
+			switch health {
+			case PeerUnhealthy:
+				unhealthy[peerID] = reason
+			case PeerWaiting:
+				waiting[peerID] = reason
+			}
+		}
+
+		if len(unhealthy) == 0 && len(waiting) > 0 && now.Before(wave.StartedAt.Add(timeout)) {
+			return RolloutNoChange
+		}
+		if len(unhealthy) == 0 && len(waiting) == 0 {
+			return r.promoteWave(now)
+		}
+
+		// Peers still waiting at the timeout count as unhealthy
+		if len(unhealthy) == 0 {
+			for peerID, reason := range waiting {
+				unhealthy[peerID] = fmt.Sprintf("not healthy after %s: %s", timeout, reason)
+			}
+		}
+		wave.State = WaveFailed
+		wave.CompletedAt = &now
+		wave.Unhealthy = unhealthy
+		r.Message = fmt.Sprintf("wave %d failed: %d of %d peers unhealthy", r.CurrentWave+1, len(unhealthy), len(wave.Peers))
+		r.UpdatedAt = now
+		return RolloutFailed
+	}
+
+	return RolloutNoChange
+}
+
+// Promote deploys the current wave without waiting for the pause, or, if it
+// is already deploying, marks it healthy without waiting for health reports
+func (r *Rollout) Promote(now time.Time) (RolloutEvent, error) {
+	if !r.Active() {
+		return RolloutNoChange, fmt.Errorf("rollout is %s", r.State)
+	}
+
+	wave := &r.Waves[r.CurrentWave]
+	if wave.State == WavePending {
+		r.startWave(now)
+		return RolloutWaveStarted, nil
+	}
+
+	event := r.promoteWave(now)
+	// Promoting skips the pause before the next wave too
+	if event == RolloutWavePromoted {
+		r.startWave(now)
+	}
+	return event, nil
+}
+
+// RolledBack marks the rollout as rolled back after the baseline was restored
+func (r *Rollout) RolledBack(now time.Time, reason string) {
+	r.State = RolloutRolledBack
+	r.Message = reason
+	r.UpdatedAt = now
+}
+
+func (r *Rollout) startWave(now time.Time) {
+	wave := &r.Waves[r.CurrentWave]
+	wave.State = WaveDeploying
+	wave.StartedAt = &now
+	r.UpdatedAt = now
+}
+
+func (r *Rollout) promoteWave(now time.Time) RolloutEvent {
+	wave := &r.Waves[r.CurrentWave]
+	wave.State = WaveHealthy
+	wave.CompletedAt = &now
+	r.UpdatedAt = now
+
+	if r.CurrentWave == len(r.Waves)-1 {
+		r.State = RolloutCompleted
+		r.Message = ""
+		return RolloutFinished
+	}
+	r.CurrentWave++
+	return RolloutWavePromoted
+}
+
+// PeerReport is what an agent reports after applying its policies and on
+// every health check
+type PeerReport struct {
+	PeerID     string         `json:"peer_id"`
+	ReportedAt time.Time      `json:"reported_at"`
+	Policies   map[string]int `json:"policies"` // Applied policy ID -> version
+	Tunnels    []TunnelReport `json:"tunnels"`
+}
+
+// TunnelReport is the state of one tunnel on a peer
+type TunnelReport struct {
+	Name      string            `json:"name"`
+	PolicyID  string            `json:"policy_id"` // Policy that supplied the tunnel
+	State     ipsec.TunnelState `json:"state"`
+	AutoStart bool              `json:"auto_start"`
+	Error     string            `json:"error,omitempty"`    // Apply or status error
+	Rotation  string            `json:"rotation,omitempty"` // PSK rotation step the tunnel was configured for
+}
+
+// PeerHealth is how a peer is doing with a policy version
+type PeerHealth string
+
+const (
+	PeerHealthy   PeerHealth = "healthy"
+	PeerWaiting   PeerHealth = "waiting"
+	PeerUnhealthy PeerHealth = "unhealthy"
+)
+
+// PolicyHealth reports whether the peer applied the given version of a policy
+// since the given time and all of the tunnels it got from that policy are
+// healthy: established, or down but not meant to start automatically
+func (r *PeerReport) PolicyHealth(policyID string, version int, since time.Time) (PeerHealth, string) {
+	if r == nil || r.ReportedAt.Before(since) {
+		return PeerWaiting, "no report since the wave started"
+	}
+	if applied := r.Policies[policyID]; applied != version {
+		return PeerWaiting, fmt.Sprintf("version %d applied", applied)
+	}
+
+	for _, tunnel := range r.Tunnels {
+		if tunnel.PolicyID != policyID {
+			continue
+		}
+		switch {
+		case tunnel.State == ipsec.StateError:
+			return PeerUnhealthy, fmt.Sprintf("tunnel %s: %s", tunnel.Name, tunnel.Error)
+		case tunnel.State == ipsec.StateEstablished, tunnel.State == ipsec.StateRekeying:
+		case tunnel.State == ipsec.StateDown && !tunnel.AutoStart:
+		default:
+			return PeerWaiting, fmt.Sprintf("tunnel %s is %s", tunnel.Name, tunnel.State)
+		}
+	}
+
+	return PeerHealthy, ""
+}
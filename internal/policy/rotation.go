@@ -0,0 +1,327 @@
+package policy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// A PSK rotation replaces the secret of a tunnel, and of every other stored
+// tunnel with the same secret, which are taken to be its other ends, without
+// a moment in which the two ends disagree. It goes through three steps, each
+// written to the tunnels' AuthConfig:
+//
+//	staging    the new PSK is added as the standby secret; ends accept both
+//	switching  the new PSK becomes the secret and the old one the standby
+//	finishing  the old PSK is dropped
+//
+// Every step also sets Rotation to "<rotation ID>/<state>". Agents report the
+// step each tunnel was configured for, and the next step starts once every
+// peer receiving one of the tunnels has reported the current one; the
+// rotation completes when they all report finishing, whose marker stays on
+// the tunnels until their next rotation. A rotation can be cancelled while
+// it is staging, before any end uses the new PSK.
+
+// RotationState is the state of a PSK rotation
+type RotationState string
+
+const (
+	RotationStaging   RotationState = "staging"
+	RotationSwitching RotationState = "switching"
+	RotationFinishing RotationState = "finishing"
+	RotationCompleted RotationState = "completed" // Every peer dropped the old PSK
+	RotationCancelled RotationState = "cancelled" // The new PSK was dropped while staging
+)
+
+// What started a rotation
+const (
+	RotationScheduled = "schedule" // The tunnel's rotate_every came due
+	RotationManual    = "manual"
+)
+
+// MinRotationInterval is the shortest rotate_every a tunnel may have
+const MinRotationInterval = time.Hour
+
+// ErrTunnelNotFound is returned when a policy has no tunnel of a name
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
+// RotationTunnel is a stored tunnel taking part in a rotation
+type RotationTunnel struct {
+	PolicyID string `json:"policy_id"`
+	Tunnel   string `json:"tunnel"`
+}
+
+// PSKRotation is a rotation of the PSK shared by a group of tunnels
+type PSKRotation struct {
+	ID            string           `json:"id"`
+	Tunnels       []RotationTunnel `json:"tunnels"` // The tunnel the rotation was started for first
+	Trigger       string           `json:"trigger"` // schedule or manual
+	State         RotationState    `json:"state"`
+	Peers         []string         `json:"peers,omitempty"`     // Peers receiving the tunnels when last checked
+	Confirmed     []string         `json:"confirmed,omitempty"` // Those that had reported the step checked for
+	StepStartedAt time.Time        `json:"step_started_at"`
+	Message       string           `json:"message,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+}
+
+// ParseRotationInterval reads a rotate_every value: a Go duration such as
+// 720h, or a number of days such as 30d
+func ParseRotationInterval(value string) (time.Duration, error) {
+	var interval time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rotate_every %q", value)
+		}
+		interval = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid rotate_every %q", value)
+		}
+	}
+	if interval < MinRotationInterval {
+		return 0, fmt.Errorf("rotate_every must be at least %s", MinRotationInterval)
+	}
+	return interval, nil
+}
+
+// GeneratePSK returns a new random PSK of 256 bits, base64url-encoded
+func GeneratePSK() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// NewPSKRotation plans a rotation of a tunnel's PSK across the stored
+// policies. The tunnel must set its own PSK: a secret inherited from a base
+// policy is rotated in the base.
+func NewPSKRotation(policies []Policy, policyID, tunnelName, trigger string) (*PSKRotation, error) {
+	if IsTopologyPolicy(policyID) {
+		return nil, fmt.Errorf("tunnels generated from a topology are rotated by updating the topology's secret")
+	}
+
+	var tunnel *ipsec.TunnelConfig
+	found := false
+	for i := range policies {
+		if policies[i].ID != policyID {
+			continue
+		}
+		found = true
+		for j := range policies[i].Tunnels {
+			if policies[i].Tunnels[j].Name == tunnelName {
+				tunnel = &policies[i].Tunnels[j]
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrPolicyNotFound, policyID)
+	}
+	if tunnel == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, tunnelName)
+	}
+	if tunnel.Auth.Type != ipsec.AuthPSK {
+		return nil, fmt.Errorf("tunnel %s does not use PSK authentication", tunnelName)
+	}
+	if tunnel.Auth.SecretRef != "" {
+		return nil, fmt.Errorf("tunnel %s reads its PSK from %s; rotate the referenced secret instead", tunnelName, tunnel.Auth.SecretRef)
+	}
+	if tunnel.Auth.Secret == "" {
+		return nil, fmt.Errorf("tunnel %s inherits its PSK; rotate it in the base policy", tunnelName)
+	}
+
+	rotation := &PSKRotation{
+		ID:      uuid.New().String(),
+		Tunnels: []RotationTunnel{{PolicyID: policyID, Tunnel: tunnelName}},
+		Trigger: trigger,
+		State:   RotationStaging,
+	}
+	for _, pol := range policies {
+		if IsTopologyPolicy(pol.ID) {
+			continue
+		}
+		for _, other := range pol.Tunnels {
+			if pol.ID == policyID && other.Name == tunnelName {
+				continue
+			}
+			if other.Auth.Type == ipsec.AuthPSK && other.Auth.Secret == tunnel.Auth.Secret {
+				rotation.Tunnels = append(rotation.Tunnels, RotationTunnel{PolicyID: pol.ID, Tunnel: other.Name})
+			}
+		}
+	}
+	return rotation, nil
+}
+
+// Active reports whether the rotation still has steps to take
+func (r *PSKRotation) Active() bool {
+	return r.State == RotationStaging || r.State == RotationSwitching || r.State == RotationFinishing
+}
+
+// Marker is the Rotation value of the tunnels at the current step
+func (r *PSKRotation) Marker() string {
+	return r.ID + "/" + string(r.State)
+}
+
+// Includes reports whether a stored tunnel takes part in the rotation
+func (r *PSKRotation) Includes(policyID, tunnel string) bool {
+	for _, t := range r.Tunnels {
+		if t.PolicyID == policyID && (tunnel == "" || t.Tunnel == tunnel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply writes the current step to the rotation's tunnels in policies and
+// returns the policies it changed. newSecret is only used when staging.
+// Tunnels already at the step, and after staging those that no longer carry
+// the rotation, are left alone.
+func (r *PSKRotation) Apply(policies []Policy, newSecret string) []*Policy {
+	var changed []*Policy
+	for i := range policies {
+		pol := &policies[i]
+		touched := false
+		for j := range pol.Tunnels {
+			auth := &pol.Tunnels[j].Auth
+			if !r.Includes(pol.ID, pol.Tunnels[j].Name) {
+				continue
+			}
+			if auth.Rotation == r.Marker() {
+				continue // Already applied
+			}
+			if r.State != RotationStaging && !strings.HasPrefix(auth.Rotation, r.ID+"/") {
+				continue
+			}
+
+			switch r.State {
+			case RotationStaging:
+				auth.StandbySecret = newSecret
+			case RotationSwitching:
+				auth.Secret, auth.StandbySecret = auth.StandbySecret, auth.Secret
+			case RotationFinishing, RotationCancelled:
+				auth.StandbySecret = ""
+			}
+			auth.Rotation = r.Marker()
+			touched = true
+		}
+		if touched {
+			changed = append(changed, pol)
+		}
+	}
+	return changed
+}
+
+// Confirm records which peers have configured the current step of every
+// rotation tunnel they receive. tunnels maps each peer receiving the
+// rotation to the names of those tunnels. It reports whether all of them
+// have.
+func (r *PSKRotation) Confirm(tunnels map[string][]string, reports map[string]*PeerReport) bool {
+	r.Peers, r.Confirmed = []string{}, []string{}
+	for peerID, names := range tunnels {
+		r.Peers = append(r.Peers, peerID)
+		if reports[peerID].configured(names, r.Marker()) {
+			r.Confirmed = append(r.Confirmed, peerID)
+		}
+	}
+	sort.Strings(r.Peers)
+	sort.Strings(r.Confirmed)
+	return len(r.Confirmed) == len(r.Peers)
+}
+
+// configured reports whether the peer reported every named tunnel as
+// configured with the given rotation step
+func (r *PeerReport) configured(names []string, marker string) bool {
+	if r == nil {
+		return false
+	}
+	for _, name := range names {
+		ok := false
+		for _, tunnel := range r.Tunnels {
+			if tunnel.Name == name && tunnel.Rotation == marker {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Next moves the rotation to its next step after every peer confirmed the
+// current one
+func (r *PSKRotation) Next(now time.Time) {
+	switch r.State {
+	case RotationStaging:
+		r.State = RotationSwitching
+	case RotationSwitching:
+		r.State = RotationFinishing
+	case RotationFinishing:
+		r.State = RotationCompleted
+	}
+	r.StepStartedAt = now
+	r.UpdatedAt = now
+}
+
+// Cancel drops the new PSK of a rotation that is still staging
+func (r *PSKRotation) Cancel(now time.Time, reason string) error {
+	if r.State != RotationStaging {
+		return fmt.Errorf("rotation is %s; only a staging rotation can be cancelled", r.State)
+	}
+	r.State = RotationCancelled
+	r.Message = reason
+	r.StepStartedAt = now
+	r.UpdatedAt = now
+	return nil
+}
+
+// KeepRotationState replaces the rotation fields of pol's tunnels, which the
+// server owns, with those of the stored tunnels of the same name, or clears
+// them for tunnels that are not stored
+func KeepRotationState(pol, stored *Policy) {
+	for i := range pol.Tunnels {
+		auth := &pol.Tunnels[i].Auth
+		auth.StandbySecret, auth.Rotation = "", ""
+		if stored == nil {
+			continue
+		}
+		for _, tunnel := range stored.Tunnels {
+			if tunnel.Name == pol.Tunnels[i].Name {
+				auth.StandbySecret, auth.Rotation = tunnel.Auth.StandbySecret, tunnel.Auth.Rotation
+				break
+			}
+		}
+	}
+}
+
+// KeepRotatedSecrets replaces the PSK of each tunnel in an older revision of
+// a policy with the current one if the tunnel has been rotated since, as its
+// other ends have the new PSK too
+func KeepRotatedSecrets(revision, current *Policy) {
+	if current == nil {
+		return
+	}
+	for i := range revision.Tunnels {
+		auth := &revision.Tunnels[i].Auth
+		for _, tunnel := range current.Tunnels {
+			if tunnel.Name == revision.Tunnels[i].Name {
+				if tunnel.Auth.Rotation != "" && tunnel.Auth.Rotation != auth.Rotation && auth.Type == ipsec.AuthPSK {
+					auth.Secret = tunnel.Auth.Secret
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package policy
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+func pskTunnel(name, secret string) ipsec.TunnelConfig {
+	return ipsec.TunnelConfig{Name: name, Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: secret}}
+}
+
+func rotationTestPolicies() []Policy {
+	return []Policy{
+		{ID: "hq", Tunnels: []ipsec.TunnelConfig{
+			pskTunnel("to-branch", "old"),
+			pskTunnel("to-lab", "other"),
+			{Name: "cert", Auth: ipsec.AuthConfig{Type: ipsec.AuthCertificate}},
+			{Name: "ref", Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK, SecretRef: "store:lab"}},
+			{Name: "inherited", Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK}},
+		}},
+		{ID: "branch", Tunnels: []ipsec.TunnelConfig{pskTunnel("to-hq", "old")}},
+		{ID: topologyPolicyPrefix + "mesh", Tunnels: []ipsec.TunnelConfig{pskTunnel("mesh-a", "old")}},
+	}
+}
+
+func TestParseRotationInterval(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   string
+	}{
+		{"720h", 720 * time.Hour, ""},
+		{"30d", 30 * 24 * time.Hour, ""},
+		{"1h", time.Hour, ""},
+		{"90m", 90 * time.Minute, ""},
+		{"59m", 0, "at least 1h0m0s"},
+		{"0d", 0, "at least 1h0m0s"},
+		{"d", 0, "invalid rotate_every"},
+		{"1.5d", 0, "invalid rotate_every"},
+		{"monthly", 0, "invalid rotate_every"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseRotationInterval(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseRotationInterval(%q) error = %v, want %q", tt.value, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ParseRotationInterval(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPSKRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		policyID string
+		tunnel   string
+		tunnels  []RotationTunnel
+		err      string
+		is       error
+	}{
+		{
+			name: "other ends share the PSK", policyID: "hq", tunnel: "to-branch",
+			tunnels: []RotationTunnel{{"hq", "to-branch"}, {"branch", "to-hq"}},
+		},
+		{
+			name: "no other end", policyID: "hq", tunnel: "to-lab",
+			tunnels: []RotationTunnel{{"hq", "to-lab"}},
+		},
+		{name: "unknown policy", policyID: "none", tunnel: "to-branch", is: ErrPolicyNotFound},
+		{name: "unknown tunnel", policyID: "hq", tunnel: "none", is: ErrTunnelNotFound},
+		{name: "certificate", policyID: "hq", tunnel: "cert", err: "does not use PSK authentication"},
+		{name: "secret reference", policyID: "hq", tunnel: "ref", err: "rotate the referenced secret instead"},
+		{name: "inherited", policyID: "hq", tunnel: "inherited", err: "rotate it in the base policy"},
+		{name: "topology", policyID: topologyPolicyPrefix + "mesh", tunnel: "mesh-a", err: "updating the topology's secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotation, err := NewPSKRotation(rotationTestPolicies(), tt.policyID, tt.tunnel, RotationManual)
+			switch {
+			case tt.is != nil:
+				if !errors.Is(err, tt.is) {
+					t.Fatalf("error = %v, want %v", err, tt.is)
+				}
+				return
+			case tt.err != "":
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("NewPSKRotation: %v", err)
+			}
+
+			if !slices.Equal(rotation.Tunnels, tt.tunnels) {
+				t.Errorf("tunnels = %v, want %v", rotation.Tunnels, tt.tunnels)
+			}
+			if rotation.State != RotationStaging || rotation.Trigger != RotationManual {
+				t.Errorf("rotation is %s/%s, want staging/manual", rotation.State, rotation.Trigger)
+			}
+		})
+	}
+}
+
+func TestPSKRotationSteps(t *testing.T) {
+	policies := rotationTestPolicies()
+	rotation, err := NewPSKRotation(policies, "hq", "to-branch", RotationScheduled)
+	if err != nil {
+		t.Fatalf("NewPSKRotation: %v", err)
+	}
+	peers := map[string][]string{"hub": {"to-branch"}, "spoke": {"to-hq"}}
+
+	report := func(peer, tunnel string, pols []Policy) *PeerReport {
+		r := &PeerReport{PeerID: peer}
+		for _, pol := range pols {
+			for _, tun := range pol.Tunnels {
+				if tun.Name == tunnel {
+					r.Tunnels = append(r.Tunnels, TunnelReport{Name: tunnel, Rotation: tun.Auth.Rotation})
+				}
+			}
+		}
+		return r
+	}
+
+	steps := []struct {
+		state   RotationState
+		secret  string
+		standby string
+	}{
+		{RotationStaging, "old", "new"},
+		{RotationSwitching, "new", "old"},
+		{RotationFinishing, "new", ""},
+	}
+
+	now := time.Now()
+	for _, step := range steps {
+		if rotation.State != step.state {
+			t.Fatalf("rotation is %s, want %s", rotation.State, step.state)
+		}
+
+		reports := map[string]*PeerReport{"hub": report("hub", "to-branch", policies)}
+		if rotation.Confirm(peers, reports) {
+			t.Fatalf("%s: confirmed before the step was applied", step.state)
+		}
+
+		changed := rotation.Apply(policies, "new")
+		if len(changed) != 2 {
+			t.Fatalf("%s: Apply changed %d policies, want 2", step.state, len(changed))
+		}
+		if again := rotation.Apply(policies, "newer"); len(again) != 0 {
+			t.Fatalf("%s: applying the step twice changed %d policies", step.state, len(again))
+		}
+		for _, pol := range policies[:2] {
+			auth := pol.Tunnels[0].Auth
+			if auth.Secret != step.secret || auth.StandbySecret != step.standby || auth.Rotation != rotation.Marker() {
+				t.Errorf("%s: %s has secret %q, standby %q, rotation %q", step.state, pol.ID, auth.Secret, auth.StandbySecret, auth.Rotation)
+			}
+		}
+		if auth := policies[0].Tunnels[1].Auth; auth.Secret != "other" || auth.Rotation != "" {
+			t.Errorf("%s: tunnel outside the rotation changed: %+v", step.state, auth)
+		}
+
+		// One end confirmed, then both
+		reports["hub"] = report("hub", "to-branch", policies)
+		if rotation.Confirm(peers, reports) {
+			t.Fatalf("%s: confirmed with a peer missing", step.state)
+		}
+		if !slices.Equal(rotation.Peers, []string{"hub", "spoke"}) || !slices.Equal(rotation.Confirmed, []string{"hub"}) {
+			t.Errorf("%s: peers %v, confirmed %v", step.state, rotation.Peers, rotation.Confirmed)
+		}
+		reports["spoke"] = report("spoke", "to-hq", policies)
+		if !rotation.Confirm(peers, reports) {
+			t.Fatalf("%s: not confirmed by both peers", step.state)
+		}
+
+		if step.state != RotationStaging {
+			if err := rotation.Cancel(now, "too late"); err == nil {
+				t.Errorf("%s: Cancel succeeded", step.state)
+			}
+		}
+
+		now = now.Add(time.Minute)
+		rotation.Next(now)
+		if !rotation.StepStartedAt.Equal(now) {
+			t.Errorf("%s: step started at %v, want %v", step.state, rotation.StepStartedAt, now)
+		}
+	}
+
+	if rotation.State != RotationCompleted || rotation.Active() {
+		t.Errorf("rotation is %s after finishing, want completed", rotation.State)
+	}
+}
+
+func TestPSKRotationCancel(t *testing.T) {
+	policies := rotationTestPolicies()
+	rotation, err := NewPSKRotation(policies, "hq", "to-branch", RotationManual)
+	if err != nil {
+		t.Fatalf("NewPSKRotation: %v", err)
+	}
+	rotation.Apply(policies, "new")
+
+	if err := rotation.Cancel(time.Now(), "changed my mind"); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if rotation.Active() || rotation.Message != "changed my mind" {
+		t.Errorf("cancelled rotation is %s with message %q", rotation.State, rotation.Message)
+	}
+
+	if changed := rotation.Apply(policies, ""); len(changed) != 2 {
+		t.Fatalf("Apply changed %d policies, want 2", len(changed))
+	}
+	for _, pol := range policies[:2] {
+		auth := pol.Tunnels[0].Auth
+		if auth.Secret != "old" || auth.StandbySecret != "" || auth.Rotation != rotation.ID+"/cancelled" {
+			t.Errorf("%s has secret %q, standby %q, rotation %q", pol.ID, auth.Secret, auth.StandbySecret, auth.Rotation)
+		}
+	}
+}
+
+func TestPlatformRotationCapability(t *testing.T) {
+	tunnel := pskTunnel("a", "secret")
+	tunnel.Auth.RotateEvery = "30d"
+
+	for _, tt := range []struct {
+		platform string
+		findings int
+	}{
+		{"linux", 0},
+		{"windows", 1},
+		{"darwin", 1},
+	} {
+		caps, ok := LookupPlatformCapabilities(tt.platform)
+		if !ok {
+			t.Fatalf("no capabilities for %s", tt.platform)
+		}
+
+		var rotation []Finding
+		for _, f := range caps.Check(0, tunnel) {
+			if f.Code == "platform.unsupported_rotation" {
+				rotation = append(rotation, f)
+			}
+		}
+		if len(rotation) != tt.findings {
+			t.Errorf("%s: got %d rotation findings, want %d", tt.platform, len(rotation), tt.findings)
+		}
+		if len(rotation) > 0 && rotation[0].Path != "tunnels[0].auth.rotate_every" {
+			t.Errorf("%s: finding at %s", tt.platform, rotation[0].Path)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Custom validation rules let operators enforce organisation policy without
+// code changes. A rule is a list of conditions over policy field paths:
+//
+//	name: dmz-cert-auth
+//	severity: error
+//	when: ["applies_to contains dmz"]
+//	require: ["tunnels[*].auth.type == certificate"]
+//	message: tunnels for dmz peers must use certificate auth
+//
+// Paths use the policy's JSON field names, e.g. "tunnels[0].crypto.dhgroup".
+// A "[*]" index makes the rule apply to each list element in turn; every "[*]"
+// in a rule must refer to the same list, so "when" and "require" see the same
+// tunnel. The rule fails where all "when" conditions hold but a "require"
+// condition does not.
+//
+// Conditions have the form "<path> <op> <value>" with these operators:
+//
+//	==  !=  <  <=  >  >=      compare; numbers and durations ("8h") by value
+//	in (a,b)  notin (a,b)     set membership
+//	contains                  list element or substring
+//	matches                   regular expression
+//	exists  missing           presence of the field; no value
+//
+// Durations compare against the stored lifetime and delay fields, so
+// "tunnels[*].crypto.lifetime <= 8h" works as expected.
+
+// Rule is a declarative validation rule
+type Rule struct {
+	Name        string   `json:"name" yaml:"name" mapstructure:"name"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty" mapstructure:"description"`
+	Severity    Severity `json:"severity" yaml:"severity" mapstructure:"severity"`
+	When        []string `json:"when,omitempty" yaml:"when,omitempty" mapstructure:"when"` // Where the rule applies; everywhere if empty
+	Require     []string `json:"require" yaml:"require" mapstructure:"require"`            // What must then hold
+	Message     string   `json:"message" yaml:"message" mapstructure:"message"`
+}
+
+// ruleSet holds the compiled rules; it is shared with RuleValidator and
+// replaced as a whole on reload
+type ruleSet struct {
+	mu    sync.RWMutex
+	rules []compiledRule
+}
+
+func (s *ruleSet) get() []compiledRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rules
+}
+
+// SetRules compiles and installs a new set of custom rules, replacing the
+// current ones. On error the current rules are kept. It is safe to call while
+// policies are being validated.
+func (e *PolicyEngine) SetRules(rules []Rule) error {
+	compiled := make([]compiledRule, 0, len(rules))
+	seen := make(map[string]bool, len(rules))
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d: name is required", i)
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("rule %s: duplicate name", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		c, err := compileRule(rule)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		compiled = append(compiled, c)
+	}
+
+	e.rules.mu.Lock()
+	e.rules.rules = compiled
+	e.rules.mu.Unlock()
+	return nil
+}
+
+// Rules returns the installed custom rules
+func (e *PolicyEngine) Rules() []Rule {
+	compiled := e.rules.get()
+	rules := make([]Rule, len(compiled))
+	for i, c := range compiled {
+		rules[i] = c.Rule
+	}
+	return rules
+}
+
+// RuleValidator reports every custom rule a policy fails, with the rule's
+// severity and the code "rule.<name>"
+type RuleValidator struct {
+	rules *ruleSet
+}
+
+func (v *RuleValidator) Validate(policy *Policy) []Finding {
+	if v.rules == nil {
+		return nil
+	}
+
+	rules := v.rules.get()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	doc, err := toGeneric(policy)
+	if err != nil {
+		return []Finding{errorFinding("", "rule.internal", "%v", err)}
+	}
+
+	var findings []Finding
+	for _, rule := range rules {
+		findings = append(findings, rule.evaluate(doc)...)
+	}
+	return findings
+}
+
+// Compilation
+
+type compiledRule struct {
+	Rule
+	when     []ruleCondition
+	require  []ruleCondition
+	wildcard []pathSegment // List that "[*]" ranges over, if any
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	c := compiledRule{Rule: rule}
+
+	switch c.Severity {
+	case "":
+		c.Severity = SeverityError
+	case SeverityError, SeverityWarning, SeverityInfo:
+	default:
+		return c, fmt.Errorf("unknown severity %q", rule.Severity)
+	}
+	if len(rule.Require) == 0 {
+		return c, fmt.Errorf("at least one require condition is needed")
+	}
+	if c.Message == "" {
+		c.Message = fmt.Sprintf("policy does not satisfy rule %s", rule.Name)
+	}
+
+	var wildcard string
+	compile := func(exprs []string) ([]ruleCondition, error) {
+		conds := make([]ruleCondition, 0, len(exprs))
+		for _, expr := range exprs {
+			cond, err := parseRuleCondition(expr)
+			if err != nil {
+				return nil, fmt.Errorf("condition %q: %w", expr, err)
+			}
+			if prefix, ok := wildcardPrefix(cond.path); ok {
+				if wildcard != "" && formatPath(prefix, -1) != wildcard {
+					return nil, fmt.Errorf("condition %q: [*] must refer to %s like the other conditions", expr, wildcard)
+				}
+				wildcard = formatPath(prefix, -1)
+				c.wildcard = prefix
+			}
+			conds = append(conds, cond)
+		}
+		return conds, nil
+	}
+
+	var err error
+	if c.when, err = compile(rule.When); err != nil {
+		return c, err
+	}
+	if c.require, err = compile(rule.Require); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// evaluate runs the rule once, or once per element of its wildcard list
+func (r *compiledRule) evaluate(doc map[string]interface{}) []Finding {
+	if r.wildcard == nil {
+		if finding, failed := r.evaluateAt(doc, -1); failed {
+			return []Finding{finding}
+		}
+		return nil
+	}
+
+	list, _ := resolvePath(doc, r.wildcard, -1)
+	items, _ := list.([]interface{})
+
+	var findings []Finding
+	for i := range items {
+		if finding, failed := r.evaluateAt(doc, i); failed {
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// evaluateAt reports the first failing require condition, with "[*]" bound
+// to index
+func (r *compiledRule) evaluateAt(doc map[string]interface{}, index int) (Finding, bool) {
+	for _, cond := range r.when {
+		if !cond.holds(doc, index) {
+			return Finding{}, false
+		}
+	}
+	for _, cond := range r.require {
+		if !cond.holds(doc, index) {
+			return Finding{
+				Severity: r.Severity,
+				Path:     formatPath(cond.path, index),
+				Code:     "rule." + r.Name,
+				Message:  r.Message,
+			}, true
+		}
+	}
+	return Finding{}, false
+}
+
+// Field paths
+
+type pathSegment struct {
+	name  string
+	index int // -1: none, -2: wildcard
+}
+
+const (
+	noIndex       = -1
+	wildcardIndex = -2
+)
+
+func parsePath(path string) ([]pathSegment, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty field path")
+	}
+
+	var segments []pathSegment
+	wildcards := 0
+	for _, part := range strings.Split(path, ".") {
+		seg := pathSegment{name: part, index: noIndex}
+		if open := strings.Index(part, "["); open >= 0 {
+			if !strings.HasSuffix(part, "]") {
+				return nil, fmt.Errorf("invalid path segment %q", part)
+			}
+			seg.name = part[:open]
+			idx := part[open+1 : len(part)-1]
+			if idx == "*" {
+				seg.index = wildcardIndex
+				wildcards++
+			} else {
+				n, err := strconv.Atoi(idx)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid index in %q", part)
+				}
+				seg.index = n
+			}
+		}
+		if seg.name == "" {
+			return nil, fmt.Errorf("invalid path segment %q", part)
+		}
+		segments = append(segments, seg)
+	}
+
+	if wildcards > 1 {
+		return nil, fmt.Errorf("only one [*] is allowed per path")
+	}
+	return segments, nil
+}
+
+// wildcardPrefix returns the path up to and including the "[*]" segment,
+// without the index
+func wildcardPrefix(path []pathSegment) ([]pathSegment, bool) {
+	for i, seg := range path {
+		if seg.index == wildcardIndex {
+			prefix := make([]pathSegment, i+1)
+			copy(prefix, path[:i+1])
+			prefix[i].index = noIndex
+			return prefix, true
+		}
+	}
+	return nil, false
+}
+
+// resolvePath looks up a path in a JSON document, substituting index for "[*]"
+func resolvePath(doc map[string]interface{}, path []pathSegment, index int) (interface{}, bool) {
+	var current interface{} = doc
+	for _, seg := range path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[seg.name]
+		if !ok {
+			return nil, false
+		}
+
+		i := seg.index
+		if i == wildcardIndex {
+			i = index
+		}
+		if i == noIndex {
+			continue
+		}
+		list, ok := current.([]interface{})
+		if !ok || i < 0 || i >= len(list) {
+			return nil, false
+		}
+		current = list[i]
+	}
+	return current, current != nil
+}
+
+// formatPath renders a path, substituting index for "[*]" when it is set
+func formatPath(path []pathSegment, index int) string {
+	parts := make([]string, len(path))
+	for i, seg := range path {
+		switch {
+		case seg.index == wildcardIndex && index >= 0:
+			parts[i] = fmt.Sprintf("%s[%d]", seg.name, index)
+		case seg.index == wildcardIndex:
+			parts[i] = seg.name + "[*]"
+		case seg.index >= 0:
+			parts[i] = fmt.Sprintf("%s[%d]", seg.name, seg.index)
+		default:
+			parts[i] = seg.name
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// Conditions
+
+type ruleCondition struct {
+	path   []pathSegment
+	op     string
+	values []string
+	re     *regexp.Regexp
+}
+
+// ruleOperators are tried in order, so longer symbols come first
+var ruleOperators = []string{"==", "!=", "<=", ">=", "<", ">", "notin", "in", "contains", "matches", "exists", "missing"}
+
+func parseRuleCondition(expr string) (ruleCondition, error) {
+	expr = strings.TrimSpace(expr)
+
+	end := strings.IndexFunc(expr, func(r rune) bool {
+		return r == ' ' || r == '\t' || strings.ContainsRune("=!<>", r)
+	})
+	if end <= 0 {
+		return ruleCondition{}, fmt.Errorf("expected <path> <operator> <value>")
+	}
+
+	path, err := parsePath(expr[:end])
+	if err != nil {
+		return ruleCondition{}, err
+	}
+	rest := strings.TrimSpace(expr[end:])
+
+	cond := ruleCondition{path: path}
+	for _, op := range ruleOperators {
+		if !strings.HasPrefix(rest, op) {
+			continue
+		}
+		value := rest[len(op):]
+		// Word operators must be followed by a space or the end
+		if isWordOperator(op) && value != "" && value[0] != ' ' && value[0] != '\t' && value[0] != '(' {
+			continue
+		}
+		cond.op = op
+		rest = strings.TrimSpace(value)
+		break
+	}
+	if cond.op == "" {
+		return ruleCondition{}, fmt.Errorf("unknown operator in %q", rest)
+	}
+
+	switch cond.op {
+	case "exists", "missing":
+		if rest != "" {
+			return ruleCondition{}, fmt.Errorf("%s takes no value", cond.op)
+		}
+	case "in", "notin":
+		if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+			return ruleCondition{}, fmt.Errorf("%s needs a list such as (a, b)", cond.op)
+		}
+		for _, v := range strings.Split(rest[1:len(rest)-1], ",") {
+			cond.values = append(cond.values, unquoteRuleValue(v))
+		}
+	default:
+		if rest == "" {
+			return ruleCondition{}, fmt.Errorf("%s needs a value", cond.op)
+		}
+		cond.values = []string{unquoteRuleValue(rest)}
+	}
+
+	if cond.op == "matches" {
+		if cond.re, err = regexp.Compile(cond.values[0]); err != nil {
+			return ruleCondition{}, err
+		}
+	}
+
+	return cond, nil
+}
+
+func isWordOperator(op string) bool {
+	return op[0] >= 'a' && op[0] <= 'z'
+}
+
+func unquoteRuleValue(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+func (c ruleCondition) holds(doc map[string]interface{}, index int) bool {
+	actual, found := resolvePath(doc, c.path, index)
+
+	switch c.op {
+	case "exists":
+		return found
+	case "missing":
+		return !found
+	case "!=":
+		return !found || !ruleValueEquals(actual, c.values[0])
+	case "notin":
+		return !found || !ruleValueIn(actual, c.values)
+	}
+
+	if !found {
+		return false
+	}
+
+	switch c.op {
+	case "==":
+		return ruleValueEquals(actual, c.values[0])
+	case "in":
+		return ruleValueIn(actual, c.values)
+	case "contains":
+		if list, ok := actual.([]interface{}); ok {
+			return ruleValueIn(list, c.values)
+		}
+		return strings.Contains(ruleScalar(actual), c.values[0])
+	case "matches":
+		return c.re.MatchString(ruleScalar(actual))
+	}
+
+	cmp, ok := compareRuleValue(actual, c.values[0])
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// ruleValueIn reports whether a value, or any element of a list value, is
+// one of the wanted values
+func ruleValueIn(actual interface{}, want []string) bool {
+	items, ok := actual.([]interface{})
+	if !ok {
+		items = []interface{}{actual}
+	}
+	for _, item := range items {
+		for _, w := range want {
+			if ruleValueEquals(item, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ruleValueEquals(actual interface{}, want string) bool {
+	if cmp, ok := compareRuleValue(actual, want); ok {
+		return cmp == 0
+	}
+	return ruleScalar(actual) == want
+}
+
+// compareRuleValue orders a JSON value against a condition value when both
+// are numbers or both are durations
+func compareRuleValue(actual interface{}, want string) (int, bool) {
+	var a float64
+	switch v := actual.(type) {
+	case float64:
+		a = v
+		if w, err := strconv.ParseFloat(want, 64); err == nil {
+			return compareFloats(a, w), true
+		}
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, false
+		}
+		a = float64(d)
+	default:
+		return 0, false
+	}
+
+	// Durations are encoded as strings; older documents may hold nanoseconds
+	w, err := time.ParseDuration(want)
+	if err != nil {
+		return 0, false
+	}
+	return compareFloats(a, float64(w)), true
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func ruleScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+func rulesTestPolicy() *Policy {
+	return &Policy{
+		Name:      "branches",
+		AppliesTo: []string{"dmz", "branch"},
+		Priority:  10,
+		Tunnels: []ipsec.TunnelConfig{
+			{
+				Name:   "a",
+				Crypto: ipsec.CryptoConfig{DHGroup: ipsec.DHGroup("ecp256"), Lifetime: 4 * time.Hour},
+				Auth:   ipsec.AuthConfig{Type: ipsec.AuthType("certificate")},
+			},
+			{
+				Name:   "b",
+				Crypto: ipsec.CryptoConfig{DHGroup: ipsec.DHGroup("modp1024"), Lifetime: 24 * time.Hour},
+				Auth:   ipsec.AuthConfig{Type: ipsec.AuthType("psk")},
+			},
+		},
+	}
+}
+
+func TestRuleValidator(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		paths []string // Paths of the findings, in order
+	}{
+		{
+			name:  "equality per tunnel",
+			rule:  Rule{Require: []string{"tunnels[*].auth.type == certificate"}},
+			paths: []string{"tunnels[1].auth.type"},
+		},
+		{
+			name:  "when limits the rule",
+			rule:  Rule{When: []string{"applies_to contains lab"}, Require: []string{"tunnels[*].auth.type == certificate"}},
+			paths: nil,
+		},
+		{
+			name:  "when binds the same tunnel",
+			rule:  Rule{When: []string{"tunnels[*].auth.type == psk"}, Require: []string{"tunnels[*].crypto.dhgroup in (ecp256,ecp384)"}},
+			paths: []string{"tunnels[1].crypto.dhgroup"},
+		},
+		{
+			name:  "durations compare by value",
+			rule:  Rule{Require: []string{"tunnels[*].crypto.lifetime <= 8h"}},
+			paths: []string{"tunnels[1].crypto.lifetime"},
+		},
+		{
+			name:  "numbers compare by value",
+			rule:  Rule{Require: []string{"priority > 9"}},
+			paths: nil,
+		},
+		{
+			name:  "numbers fail",
+			rule:  Rule{Require: []string{"priority >= 100"}},
+			paths: []string{"priority"},
+		},
+		{
+			name:  "notin",
+			rule:  Rule{Require: []string{"tunnels[*].crypto.dhgroup notin (modp1024, modp1536)"}},
+			paths: []string{"tunnels[1].crypto.dhgroup"},
+		},
+		{
+			name:  "matches",
+			rule:  Rule{Require: []string{"name matches ^branch"}},
+			paths: nil,
+		},
+		{
+			name:  "exists on a missing field",
+			rule:  Rule{Require: []string{"description exists"}},
+			paths: []string{"description"},
+		},
+		{
+			name:  "missing",
+			rule:  Rule{Require: []string{"tunnels[*].auth.secret missing"}},
+			paths: nil,
+		},
+		{
+			name:  "fixed index",
+			rule:  Rule{Require: []string{"tunnels[0].name == b"}},
+			paths: []string{"tunnels[0].name"},
+		},
+		{
+			name:  "first failing require is reported",
+			rule:  Rule{Require: []string{"name == branches", "priority == 1", "description exists"}},
+			paths: []string{"priority"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Name = "test"
+			tt.rule.Severity = SeverityWarning
+
+			e := NewPolicyEngine()
+			if err := e.SetRules([]Rule{tt.rule}); err != nil {
+				t.Fatalf("SetRules: %v", err)
+			}
+
+			findings := (&RuleValidator{rules: e.rules}).Validate(rulesTestPolicy())
+			var paths []string
+			for _, f := range findings {
+				if f.Code != "rule.test" || f.Severity != SeverityWarning {
+					t.Errorf("got finding %s %s, want rule.test warning", f.Code, f.Severity)
+				}
+				paths = append(paths, f.Path)
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.paths, ",") {
+				t.Errorf("got findings at %v, want %v", paths, tt.paths)
+			}
+		})
+	}
+}
+
+func TestSetRulesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		err   string
+	}{
+		{"no name", []Rule{{Require: []string{"name exists"}}}, "rule 0: name is required"},
+		{"duplicate", []Rule{{Name: "a", Require: []string{"name exists"}}, {Name: "a", Require: []string{"name exists"}}}, "rule a: duplicate name"},
+		{"no require", []Rule{{Name: "a"}}, "at least one require condition"},
+		{"severity", []Rule{{Name: "a", Severity: "fatal", Require: []string{"name exists"}}}, `unknown severity "fatal"`},
+		{"operator", []Rule{{Name: "a", Require: []string{"name"}}}, `condition "name"`},
+		{"wildcards", []Rule{{Name: "a", When: []string{"tunnels[*].name exists"}, Require: []string{"applies_to[*] == x"}}}, "[*] must refer to tunnels"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewPolicyEngine()
+			if err := e.SetRules([]Rule{{Name: "kept", Require: []string{"name exists"}}}); err != nil {
+				t.Fatalf("SetRules: %v", err)
+			}
+
+			err := e.SetRules(tt.rules)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("SetRules error = %v, want %q", err, tt.err)
+			}
+			if rules := e.Rules(); len(rules) != 1 || rules[0].Name != "kept" {
+				t.Errorf("rules after a failed SetRules = %v, want the previous ones", rules)
+			}
+		})
+	}
+}
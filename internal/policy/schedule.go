@@ -0,0 +1,212 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A policy can be scheduled with NotBefore and NotAfter. When it also has
+// maintenance windows, those transitions are deferred to the next window
+// opening, so that tunnel changes only land inside approved windows: a policy
+// with NotBefore on a Wednesday and a Saturday 02:00-04:00 window activates on
+// Saturday at 02:00. Windows have no effect on a policy without NotBefore or
+// NotAfter.
+
+// MaintenanceWindow is a recurring period in which scheduled changes may take effect
+type MaintenanceWindow struct {
+	Days     []string `json:"days,omitempty" yaml:"days,omitempty"`         // mon..sun; every day if empty
+	Start    string   `json:"start" yaml:"start"`                           // HH:MM
+	End      string   `json:"end" yaml:"end"`                               // HH:MM; at or before Start means the window spans midnight
+	Timezone string   `json:"timezone,omitempty" yaml:"timezone,omitempty"` // IANA name, e.g. Europe/Berlin; UTC if empty
+}
+
+// ScheduleState is where a policy is in its schedule
+type ScheduleState string
+
+const (
+	SchedulePending  ScheduleState = "pending"  // Before its activation time
+	ScheduleActive   ScheduleState = "active"   // Distributed to peers
+	ScheduleExpired  ScheduleState = "expired"  // After its expiry time
+	ScheduleDisabled ScheduleState = "disabled" // Enabled is false
+)
+
+// PolicySchedule is the state of a policy's schedule at a point in time
+type PolicySchedule struct {
+	State       ScheduleState `json:"state"`
+	ActivatesAt *time.Time    `json:"activates_at,omitempty"` // NotBefore, deferred to a maintenance window
+	ExpiresAt   *time.Time    `json:"expires_at,omitempty"`   // NotAfter, deferred to a maintenance window
+}
+
+// ScheduleAt returns the schedule state of a policy at the given time
+func ScheduleAt(policy *Policy, at time.Time) PolicySchedule {
+	var schedule PolicySchedule
+
+	if policy.NotBefore != nil {
+		start := effectiveTime(policy, *policy.NotBefore)
+		schedule.ActivatesAt = &start
+	}
+	if policy.NotAfter != nil {
+		end := effectiveTime(policy, *policy.NotAfter)
+		schedule.ExpiresAt = &end
+	}
+
+	switch {
+	case !policy.Enabled:
+		schedule.State = ScheduleDisabled
+	case schedule.ExpiresAt != nil && !at.Before(*schedule.ExpiresAt):
+		schedule.State = ScheduleExpired
+	case schedule.ActivatesAt != nil && at.Before(*schedule.ActivatesAt):
+		schedule.State = SchedulePending
+	default:
+		schedule.State = ScheduleActive
+	}
+
+	return schedule
+}
+
+// IsActiveAt reports whether a policy is enabled and within its schedule
+func IsActiveAt(policy *Policy, at time.Time) bool {
+	return ScheduleAt(policy, at).State == ScheduleActive
+}
+
+// effectiveTime defers t to the policy's next maintenance window, if it has
+// any. Windows that do not parse are ignored; ScheduleValidator reports them.
+func effectiveTime(policy *Policy, t time.Time) time.Time {
+	if len(policy.MaintenanceWindows) == 0 {
+		return t
+	}
+
+	var earliest time.Time
+	for _, window := range policy.MaintenanceWindows {
+		next, err := window.Next(t)
+		if err != nil {
+			continue
+		}
+		if earliest.IsZero() || next.Before(earliest) {
+			earliest = next
+		}
+	}
+
+	if earliest.IsZero() {
+		return t
+	}
+	return earliest
+}
+
+// Next returns t if it falls inside the window, or else the next time the
+// window opens after t
+func (w MaintenanceWindow) Next(t time.Time) (time.Time, error) {
+	loc, days, start, end, err := w.parse()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	local := t.In(loc)
+	// Start a day early for windows that span midnight into t's day
+	for offset := -1; offset <= 7; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, loc)
+		if len(days) > 0 && !days[day.Weekday()] {
+			continue
+		}
+
+		open := clockOn(day, 0, start)
+		close := clockOn(day, 0, end)
+		if end <= start {
+			close = clockOn(day, 1, end)
+		}
+
+		if !t.Before(open) && t.Before(close) {
+			return t, nil
+		}
+		if open.After(t) {
+			return open, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("window never opens")
+}
+
+func (w MaintenanceWindow) parse() (*time.Location, map[time.Weekday]bool, time.Duration, time.Duration, error) {
+	loc := time.UTC
+	if w.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return nil, nil, 0, 0, fmt.Errorf("invalid timezone %q", w.Timezone)
+		}
+	}
+
+	days := make(map[time.Weekday]bool, len(w.Days))
+	for _, name := range w.Days {
+		day, ok := parseWeekday(name)
+		if !ok {
+			return nil, nil, 0, 0, fmt.Errorf("invalid day %q", name)
+		}
+		days[day] = true
+	}
+
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("invalid start: %w", err)
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("invalid end: %w", err)
+	}
+
+	return loc, days, start, end, nil
+}
+
+// clockOn returns the wall clock time clock on the day offset days after
+// day, in day's location. Adding clock to midnight instead would be an hour
+// off on days a DST transition falls before it.
+func clockOn(day time.Time, offset int, clock time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day()+offset,
+		int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// parseClock parses HH:MM into the offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// ScheduleValidator validates NotBefore, NotAfter and maintenance windows
+type ScheduleValidator struct{}
+
+func (v *ScheduleValidator) Validate(policy *Policy) []Finding {
+	var findings []Finding
+
+	if policy.NotBefore != nil && policy.NotAfter != nil && !policy.NotAfter.After(*policy.NotBefore) {
+		findings = append(findings, errorFinding("not_after", "schedule.invalid",
+			"not_after must be later than not_before"))
+	}
+
+	for i, window := range policy.MaintenanceWindows {
+		if _, _, _, _, err := window.parse(); err != nil {
+			findings = append(findings, errorFinding(fmt.Sprintf("maintenance_windows[%d]", i), "schedule.invalid",
+				"invalid maintenance window: %v", err))
+		}
+	}
+
+	if len(policy.MaintenanceWindows) > 0 && policy.NotBefore == nil && policy.NotAfter == nil {
+		findings = append(findings, warningFinding("maintenance_windows", "schedule.windows_unused",
+			"maintenance windows only defer not_before and not_after, and neither is set"))
+	}
+
+	return findings
+}
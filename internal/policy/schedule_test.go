@@ -0,0 +1,157 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	utc := func(s string) time.Time {
+		at, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	local := func(s string) time.Time {
+		at, err := time.ParseInLocation("2006-01-02 15:04", s, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+
+	// 2026-06-01 is a Monday
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+		at     time.Time
+		want   time.Time
+	}{
+		{
+			name:   "before the window",
+			window: MaintenanceWindow{Start: "02:00", End: "04:00"},
+			at:     utc("2026-06-01 01:00"),
+			want:   utc("2026-06-01 02:00"),
+		},
+		{
+			name:   "inside the window",
+			window: MaintenanceWindow{Start: "02:00", End: "04:00"},
+			at:     utc("2026-06-01 03:00"),
+			want:   utc("2026-06-01 03:00"),
+		},
+		{
+			name:   "at the close",
+			window: MaintenanceWindow{Start: "02:00", End: "04:00"},
+			at:     utc("2026-06-01 04:00"),
+			want:   utc("2026-06-02 02:00"),
+		},
+		{
+			name:   "spanning midnight, before it",
+			window: MaintenanceWindow{Start: "22:00", End: "02:00"},
+			at:     utc("2026-06-01 23:00"),
+			want:   utc("2026-06-01 23:00"),
+		},
+		{
+			name:   "spanning midnight, started the day before",
+			window: MaintenanceWindow{Start: "22:00", End: "02:00"},
+			at:     utc("2026-06-01 01:00"),
+			want:   utc("2026-06-01 01:00"),
+		},
+		{
+			name:   "spanning midnight, closed",
+			window: MaintenanceWindow{Start: "22:00", End: "02:00"},
+			at:     utc("2026-06-01 12:00"),
+			want:   utc("2026-06-01 22:00"),
+		},
+		{
+			name:   "started on an allowed day",
+			window: MaintenanceWindow{Days: []string{"sun"}, Start: "22:00", End: "02:00"},
+			at:     utc("2026-06-01 01:30"),
+			want:   utc("2026-06-01 01:30"),
+		},
+		{
+			name:   "closed until next week",
+			window: MaintenanceWindow{Days: []string{"sun"}, Start: "22:00", End: "02:00"},
+			at:     utc("2026-06-01 02:00"),
+			want:   utc("2026-06-07 22:00"),
+		},
+		{
+			name:   "later in the week",
+			window: MaintenanceWindow{Days: []string{"Saturday"}, Start: "02:00", End: "04:00"},
+			at:     utc("2026-06-01 12:00"),
+			want:   utc("2026-06-06 02:00"),
+		},
+		{
+			name:   "next allowed day",
+			window: MaintenanceWindow{Days: []string{"friday", "MON"}, Start: "02:00", End: "04:00"},
+			at:     utc("2026-06-01 05:00"),
+			want:   utc("2026-06-05 02:00"),
+		},
+		{
+			name:   "in the window's time zone",
+			window: MaintenanceWindow{Start: "02:00", End: "04:00", Timezone: "Europe/Berlin"},
+			at:     utc("2026-06-01 03:00"),
+			want:   utc("2026-06-02 00:00"),
+		},
+		{
+			name:   "on the day clocks go forward",
+			window: MaintenanceWindow{Days: []string{"sun"}, Start: "04:00", End: "06:00", Timezone: "Europe/Berlin"},
+			at:     local("2026-03-28 12:00"),
+			want:   local("2026-03-29 04:00"),
+		},
+		{
+			name:   "on the day clocks go back",
+			window: MaintenanceWindow{Days: []string{"sun"}, Start: "04:00", End: "06:00", Timezone: "Europe/Berlin"},
+			at:     local("2026-10-24 12:00"),
+			want:   local("2026-10-25 04:00"),
+		},
+		{
+			name:   "spanning a DST change, still open",
+			window: MaintenanceWindow{Days: []string{"sat"}, Start: "23:00", End: "05:00", Timezone: "Europe/Berlin"},
+			at:     local("2026-03-29 04:30"),
+			want:   local("2026-03-29 04:30"),
+		},
+		{
+			name:   "spanning a DST change, closed",
+			window: MaintenanceWindow{Days: []string{"sat"}, Start: "23:00", End: "05:00", Timezone: "Europe/Berlin"},
+			at:     local("2026-03-29 05:00"),
+			want:   local("2026-04-04 23:00"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.window.Next(tt.at)
+			if err != nil {
+				t.Fatalf("Next(%s): %v", tt.at, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowNextErrors(t *testing.T) {
+	tests := []struct {
+		window MaintenanceWindow
+		err    string
+	}{
+		{MaintenanceWindow{Start: "02:00", End: "04:00", Timezone: "Mars/Olympus"}, `invalid timezone "Mars/Olympus"`},
+		{MaintenanceWindow{Days: []string{"mon", "someday"}, Start: "02:00", End: "04:00"}, `invalid day "someday"`},
+		{MaintenanceWindow{Start: "2am", End: "04:00"}, `invalid start: "2am" is not HH:MM`},
+		{MaintenanceWindow{Start: "02:00", End: "24:00"}, `invalid end: "24:00" is not HH:MM`},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.window.Next(time.Now()); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Next with %+v: %v, want %q", tt.window, err, tt.err)
+		}
+	}
+}
@@ -2,23 +2,39 @@ package policy
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/swavlamban/ipsec-manager/internal/ipsec"
 )
 
+// CurrentSchemaVersion is the policy format written by this release.
+//
+//	1  durations (crypto.lifetime, dpd.delay) as integer nanoseconds
+//	2  durations as Go duration strings, e.g. "1h0m0s"
+//
+// Storage migrates older rows when it opens the database; readers accept
+// both encodings either way.
+const CurrentSchemaVersion = 2
+
 // Policy represents a complete IPsec policy configuration
 type Policy struct {
 	ID          string                `json:"id" yaml:"id"`
 	Name        string                `json:"name" yaml:"name"`
 	Description string                `json:"description,omitempty" yaml:"description,omitempty"`
-	Version     int                   `json:"version" yaml:"version"`
-	CreatedAt   time.Time             `json:"created_at" yaml:"created_at"`
-	UpdatedAt   time.Time             `json:"updated_at" yaml:"updated_at"`
+	Version     int                   `json:"version,omitzero" yaml:"version,omitempty"` // Server-assigned
+	SchemaVersion int                 `json:"schema_version,omitempty" yaml:"schema_version,omitempty"` // Format the policy is written in; current if empty
+	CreatedAt   time.Time             `json:"created_at,omitzero" yaml:"created_at,omitempty"`
+	UpdatedAt   time.Time             `json:"updated_at,omitzero" yaml:"updated_at,omitempty"`
 	Enabled     bool                  `json:"enabled" yaml:"enabled"`
+	Extends     string                `json:"extends,omitempty" yaml:"extends,omitempty"` // ID of the base policy this one overlays
 	Tunnels     []ipsec.TunnelConfig  `json:"tunnels" yaml:"tunnels"`
-	AppliesTo   []string              `json:"applies_to,omitempty" yaml:"applies_to,omitempty"` // Peer IDs or tags
+	AppliesTo   []string              `json:"applies_to,omitempty" yaml:"applies_to,omitempty"` // Peer IDs or tags, or "expr:" selector expressions
 	Priority    int                   `json:"priority" yaml:"priority"` // Higher priority = applied first
+	Compliance  string                `json:"compliance,omitempty" yaml:"compliance,omitempty"` // Compliance profile; server default when empty
+	NotBefore   *time.Time            `json:"not_before,omitempty" yaml:"not_before,omitempty"` // Not distributed before this time
+	NotAfter    *time.Time            `json:"not_after,omitempty" yaml:"not_after,omitempty"`   // Not distributed from this time on
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows,omitempty" yaml:"maintenance_windows,omitempty"` // Defer NotBefore/NotAfter to these windows
 }
 
 // PeerInfo represents information about a registered peer/agent
@@ -27,6 +43,7 @@ type PeerInfo struct {
 	Hostname     string            `json:"hostname" yaml:"hostname"`
 	Platform     string            `json:"platform" yaml:"platform"` // linux, windows, darwin
 	IPAddress    string            `json:"ip_address" yaml:"ip_address"`
+	Addresses    []string          `json:"addresses,omitempty" yaml:"addresses,omitempty"` // Every unicast address on the host, IPv4 and IPv6
 	Version      string            `json:"version" yaml:"version"` // Agent version
 	Tags         []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
 	LastSeenAt   time.Time         `json:"last_seen_at" yaml:"last_seen_at"`
@@ -47,37 +64,93 @@ const (
 // PolicyEngine handles policy validation and application logic
 type PolicyEngine struct {
 	validators []PolicyValidator
+	compliance *ComplianceSettings
+	secrets    *SecretSettings
+	rules      *ruleSet
+	strict     bool
+	now        func() time.Time // Clock for policy schedules
 }
 
-// PolicyValidator is an interface for policy validation rules
+// PolicyValidator is an interface for policy validation rules. It returns
+// every problem it finds rather than stopping at the first.
 type PolicyValidator interface {
-	Validate(policy *Policy) error
+	Validate(policy *Policy) []Finding
 }
 
 // NewPolicyEngine creates a new policy engine with default validators
 func NewPolicyEngine() *PolicyEngine {
+	compliance := &ComplianceSettings{Default: ProfileLegacy}
+	secrets := &SecretSettings{AllowInline: true}
+	rules := &ruleSet{}
 	return &PolicyEngine{
 		validators: []PolicyValidator{
 			&BasicValidator{},
-			&SecurityValidator{},
+			&AddressValidator{},
+			&SelectorValidator{},
+			&TemplateValidator{},
+			&SelectorOverlapValidator{},
+			&ScheduleValidator{},
+			&SecurityValidator{compliance: compliance, secrets: secrets},
 			&PlatformCompatibilityValidator{},
+			&RuleValidator{rules: rules},
 		},
+		compliance: compliance,
+		secrets:    secrets,
+		rules:      rules,
+		now:        time.Now,
 	}
 }
 
-// Validate validates a policy using all registered validators
-func (e *PolicyEngine) Validate(policy *Policy) error {
+// SetStrict makes warnings block saves as well as errors. It is meant to be
+// called during startup.
+func (e *PolicyEngine) SetStrict(strict bool) {
+	e.strict = strict
+}
+
+// Strict reports whether warnings block saves
+func (e *PolicyEngine) Strict() bool {
+	return e.strict
+}
+
+// Check runs every registered validator and returns all of their findings
+func (e *PolicyEngine) Check(policy *Policy) Findings {
+	findings := Findings{}
 	for _, validator := range e.validators {
-		if err := validator.Validate(policy); err != nil {
-			return fmt.Errorf("policy validation failed: %w", err)
-		}
+		findings = append(findings, validator.Validate(policy)...)
+	}
+	return findings
+}
+
+// Validate validates a policy using all registered validators. If the policy
+// has blocking findings, the error is a *ValidationError listing them all.
+func (e *PolicyEngine) Validate(policy *Policy) error {
+	findings := e.Check(policy)
+	if len(findings.Blocking(e.strict)) > 0 {
+		return &ValidationError{Findings: findings, Strict: e.strict}
 	}
 	return nil
 }
 
-// FilterPoliciesForPeer returns policies that apply to a specific peer
+// FilterPoliciesForPeer returns policies that apply to a specific peer and
+// are within their schedule at the server's current time
 func (e *PolicyEngine) FilterPoliciesForPeer(policies []Policy, peer *PeerInfo) []Policy {
 	var applicable []Policy
+	now := e.now()
+	
+	for _, policy := range targetedPolicies(policies, peer) {
+		if IsActiveAt(&policy, now) {
+			applicable = append(applicable, policy)
+		}
+	}
+	
+	return applicable
+}
+
+// targetedPolicies returns the enabled policies whose selectors match a peer,
+// regardless of their schedule. Save-time checks use it so that a policy
+// scheduled for later is checked against the peers it will reach.
+func targetedPolicies(policies []Policy, peer *PeerInfo) []Policy {
+	var targeted []Policy
 	
 	for _, policy := range policies {
 		if !policy.Enabled {
@@ -86,240 +159,318 @@ func (e *PolicyEngine) FilterPoliciesForPeer(policies []Policy, peer *PeerInfo)
 		
 		// If no specific peers/tags specified, policy applies to all
 		if len(policy.AppliesTo) == 0 {
-			applicable = append(applicable, policy)
+			targeted = append(targeted, policy)
 			continue
 		}
 		
-		// Check if peer ID or any tag matches
+		// Each entry is a selector; the policy applies if any of them matches
 		for _, target := range policy.AppliesTo {
-			if target == peer.ID || target == "*" {
-				applicable = append(applicable, policy)
+			if MatchesSelector(target, peer) {
+				targeted = append(targeted, policy)
 				break
 			}
-			
-			// Check tags
-			for _, tag := range peer.Tags {
-				if target == tag {
-					applicable = append(applicable, policy)
-					break
-				}
-			}
 		}
 	}
 	
-	return applicable
+	return targeted
 }
 
-// MergeTunnels merges tunnel configurations from multiple policies
-// Higher priority policies override lower priority ones
-func (e *PolicyEngine) MergeTunnels(policies []Policy) []ipsec.TunnelConfig {
-	tunnelMap := make(map[string]ipsec.TunnelConfig)
-	
-	// Sort by priority (should be done by caller, but we'll handle it)
-	// For now, iterate in order assuming they're sorted
-	
+// MergeResult is the outcome of merging the tunnels of several policies
+type MergeResult struct {
+	Tunnels   []ipsec.TunnelConfig `json:"tunnels"`
+	Sources   map[string]string    `json:"sources"` // Tunnel name -> ID of the policy that supplied it
+	Conflicts []TunnelConflict     `json:"conflicts,omitempty"`
+}
+
+// TunnelConflict records a tunnel name defined by more than one policy
+type TunnelConflict struct {
+	Tunnel     string   `json:"tunnel"`
+	PolicyID   string   `json:"policy_id"`  // Winning policy
+	Overridden []string `json:"overridden"` // Losing policies, in precedence order
+}
+
+// SortPolicies orders policies by precedence: higher priority first, then
+// by name and finally by ID so that ties always resolve the same way
+func SortPolicies(policies []Policy) {
+	sort.SliceStable(policies, func(i, j int) bool {
+		if policies[i].Priority != policies[j].Priority {
+			return policies[i].Priority > policies[j].Priority
+		}
+		if policies[i].Name != policies[j].Name {
+			return policies[i].Name < policies[j].Name
+		}
+		return policies[i].ID < policies[j].ID
+	})
+}
+
+// MergeTunnels merges tunnel configurations from multiple policies.
+// Policies are ranked with SortPolicies and, when several define a tunnel
+// with the same name, the highest-ranked one wins. Disabled policies are
+// ignored. Tunnels are returned sorted by name.
+func (e *PolicyEngine) MergeTunnels(policies []Policy) *MergeResult {
+	ranked := make([]Policy, 0, len(policies))
 	for _, policy := range policies {
+		if policy.Enabled {
+			ranked = append(ranked, policy)
+		}
+	}
+	SortPolicies(ranked)
+
+	result := &MergeResult{
+		Sources: make(map[string]string),
+	}
+	tunnelMap := make(map[string]ipsec.TunnelConfig)
+	conflicts := make(map[string]*TunnelConflict)
+
+	for _, policy := range ranked {
 		for _, tunnel := range policy.Tunnels {
-			// If tunnel with same name exists, override if higher priority
-			tunnelMap[tunnel.Name] = tunnel
+			winner, exists := result.Sources[tunnel.Name]
+			if !exists {
+				tunnelMap[tunnel.Name] = tunnel
+				result.Sources[tunnel.Name] = policy.ID
+				continue
+			}
+
+			conflict, ok := conflicts[tunnel.Name]
+			if !ok {
+				conflict = &TunnelConflict{Tunnel: tunnel.Name, PolicyID: winner}
+				conflicts[tunnel.Name] = conflict
+			}
+			conflict.Overridden = append(conflict.Overridden, policy.ID)
 		}
 	}
-	
-	// Convert map to slice
-	var tunnels []ipsec.TunnelConfig
+
 	for _, tunnel := range tunnelMap {
-		tunnels = append(tunnels, tunnel)
+		result.Tunnels = append(result.Tunnels, tunnel)
 	}
-	
-	return tunnels
+	sort.Slice(result.Tunnels, func(i, j int) bool {
+		return result.Tunnels[i].Name < result.Tunnels[j].Name
+	})
+
+	for _, conflict := range conflicts {
+		result.Conflicts = append(result.Conflicts, *conflict)
+	}
+	sort.Slice(result.Conflicts, func(i, j int) bool {
+		return result.Conflicts[i].Tunnel < result.Conflicts[j].Tunnel
+	})
+
+	return result
 }
 
 // BasicValidator validates basic policy structure
 type BasicValidator struct{}
 
-func (v *BasicValidator) Validate(policy *Policy) error {
+func (v *BasicValidator) Validate(policy *Policy) []Finding {
+	var findings []Finding
+
 	if policy.Name == "" {
-		return fmt.Errorf("policy name is required")
+		findings = append(findings, errorFinding("name", "basic.required", "policy name is required"))
 	}
 	
+	if policy.SchemaVersion < 0 || policy.SchemaVersion > CurrentSchemaVersion {
+		findings = append(findings, errorFinding("schema_version", "basic.schema_version",
+			"unsupported schema version %d (this server supports up to %d)", policy.SchemaVersion, CurrentSchemaVersion))
+	}
+
 	if len(policy.Tunnels) == 0 {
-		return fmt.Errorf("policy must contain at least one tunnel configuration")
+		findings = append(findings, errorFinding("tunnels", "basic.required",
+			"policy must contain at least one tunnel configuration"))
 	}
 	
 	// Validate each tunnel
 	for i, tunnel := range policy.Tunnels {
-		if err := v.validateTunnel(tunnel); err != nil {
-			return fmt.Errorf("tunnel %d (%s): %w", i, tunnel.Name, err)
-		}
+		findings = append(findings, v.validateTunnel(i, tunnel)...)
 	}
 	
-	return nil
+	return findings
 }
 
-func (v *BasicValidator) validateTunnel(tunnel ipsec.TunnelConfig) error {
+func (v *BasicValidator) validateTunnel(index int, tunnel ipsec.TunnelConfig) []Finding {
+	var findings []Finding
+	required := func(field, what string) {
+		findings = append(findings, errorFinding(tunnelPath(index, field), "basic.required", "%s is required", what))
+	}
+
 	if tunnel.Name == "" {
-		return fmt.Errorf("tunnel name is required")
+		required("name", "tunnel name")
 	}
 	
 	if tunnel.LocalAddress == "" {
-		return fmt.Errorf("local address is required")
+		required("local_address", "local address")
 	}
 	
 	if tunnel.RemoteAddress == "" {
-		return fmt.Errorf("remote address is required")
+		required("remote_address", "remote address")
 	}
 	
 	if len(tunnel.TrafficSelectors) == 0 {
-		return fmt.Errorf("at least one traffic selector is required")
+		findings = append(findings, errorFinding(tunnelPath(index, "traffic_selectors"), "basic.required",
+			"at least one traffic selector is required"))
 	}
 	
 	// Validate traffic selectors
 	for i, ts := range tunnel.TrafficSelectors {
 		if ts.LocalSubnet == "" {
-			return fmt.Errorf("traffic selector %d: local subnet is required", i)
+			required(fmt.Sprintf("traffic_selectors[%d].local_subnet", i), "local subnet")
 		}
 		if ts.RemoteSubnet == "" {
-			return fmt.Errorf("traffic selector %d: remote subnet is required", i)
+			required(fmt.Sprintf("traffic_selectors[%d].remote_subnet", i), "remote subnet")
 		}
 	}
 	
-	return nil
+	return findings
+}
+
+// SecurityValidator validates authentication settings and checks crypto
+// algorithms and SA lifetimes against the policy's compliance profile
+type SecurityValidator struct {
+	compliance *ComplianceSettings
+	secrets    *SecretSettings
 }
 
-// SecurityValidator validates security-related configurations
-type SecurityValidator struct{}
+func (v *SecurityValidator) Validate(policy *Policy) []Finding {
+	var findings []Finding
+
+	settings := v.compliance
+	if settings == nil {
+		settings = &ComplianceSettings{Default: ProfileLegacy}
+	}
+	allowInline := v.secrets == nil || v.secrets.AllowInline
+	profile, err := settings.policyProfile(policy)
+	if err != nil {
+		findings = append(findings, errorFinding("compliance", "compliance.unknown_profile", "%v", err))
+	}
 
-func (v *SecurityValidator) Validate(policy *Policy) error {
 	for i, tunnel := range policy.Tunnels {
 		// Validate authentication
 		if tunnel.Auth.Type == ipsec.AuthPSK {
-			if tunnel.Auth.Secret == "" {
-				return fmt.Errorf("tunnel %d (%s): PSK secret is required", i, tunnel.Name)
+			if tunnel.Auth.SecretRef != "" {
+				findings = append(findings, checkSecretRef(i, tunnel.Auth)...)
+			} else if tunnel.Auth.Secret == "" {
+				findings = append(findings, errorFinding(tunnelPath(i, "auth.secret"), "security.required",
+					"PSK secret or secret_ref is required"))
+			} else if !allowInline {
+				findings = append(findings, errorFinding(tunnelPath(i, "auth.secret"), "security.inline_secret",
+					"PSKs must be given by secret_ref rather than written into the policy"))
+			} else if tunnel.Auth.Secret == RedactedSecret {
+				findings = append(findings, errorFinding(tunnelPath(i, "auth.secret"), "security.redacted_secret",
+					"PSK secret is the redaction placeholder and there is no stored secret to keep"))
+			} else if len(tunnel.Auth.Secret) < 8 {
+				findings = append(findings, errorFinding(tunnelPath(i, "auth.secret"), "security.psk_too_short",
+					"PSK secret must be at least 8 characters"))
 			}
-			if len(tunnel.Auth.Secret) < 8 {
-				return fmt.Errorf("tunnel %d (%s): PSK secret must be at least 8 characters", i, tunnel.Name)
+			if tunnel.Auth.RotateEvery != "" {
+				if _, err := ParseRotationInterval(tunnel.Auth.RotateEvery); err != nil {
+					findings = append(findings, errorFinding(tunnelPath(i, "auth.rotate_every"), "security.rotate_every",
+						"%v", err))
+				}
 			}
+		} else if tunnel.Auth.Type == ipsec.AuthCertificate && tunnel.Auth.Issuer != "" {
+			findings = append(findings, checkIssuer(i, tunnel.Auth)...)
 		} else if tunnel.Auth.Type == ipsec.AuthCertificate {
 			if tunnel.Auth.CertPath == "" {
-				return fmt.Errorf("tunnel %d (%s): certificate path is required", i, tunnel.Name)
+				findings = append(findings, errorFinding(tunnelPath(i, "auth.cert_path"), "security.required",
+					"certificate path is required"))
 			}
 			if tunnel.Auth.KeyPath == "" {
-				return fmt.Errorf("tunnel %d (%s): private key path is required", i, tunnel.Name)
+				findings = append(findings, errorFinding(tunnelPath(i, "auth.key_path"), "security.required",
+					"private key path is required"))
 			}
 		}
-		
-		// Validate crypto algorithms
-		if !v.isValidEncryption(tunnel.Crypto.Encryption) {
-			return fmt.Errorf("tunnel %d (%s): invalid encryption algorithm: %s", i, tunnel.Name, tunnel.Crypto.Encryption)
+		if tunnel.Auth.SecretRef != "" && tunnel.Auth.Type != ipsec.AuthPSK {
+			findings = append(findings, errorFinding(tunnelPath(i, "auth.secret_ref"), "security.secret_ref",
+				"secret_ref applies to PSK authentication only"))
 		}
-		
-		if !v.isValidIntegrity(tunnel.Crypto.Integrity) {
-			return fmt.Errorf("tunnel %d (%s): invalid integrity algorithm: %s", i, tunnel.Name, tunnel.Crypto.Integrity)
+		if tunnel.Auth.Issuer != "" && tunnel.Auth.Type != ipsec.AuthCertificate {
+			findings = append(findings, errorFinding(tunnelPath(i, "auth.issuer"), "security.issuer",
+				"issuer applies to certificate authentication only"))
 		}
-		
-		if !v.isValidDHGroup(tunnel.Crypto.DHGroup) {
-			return fmt.Errorf("tunnel %d (%s): invalid DH group: %s", i, tunnel.Name, tunnel.Crypto.DHGroup)
+		if tunnel.Auth.RotateEvery != "" && tunnel.Auth.Type != ipsec.AuthPSK {
+			findings = append(findings, errorFinding(tunnelPath(i, "auth.rotate_every"), "security.rotate_every",
+				"rotate_every applies to PSK authentication only"))
 		}
 		
-		// Validate lifetime
-		if tunnel.Crypto.Lifetime == 0 {
-			return fmt.Errorf("tunnel %d (%s): SA lifetime must be specified", i, tunnel.Name)
+		child := tunnel.Crypto.ChildSA()
+		if child.Lifetime == 0 {
+			findings = append(findings, errorFinding(tunnelPath(i, "crypto.lifetime"), "security.required",
+				"SA lifetime must be specified"))
 		}
-		if tunnel.Crypto.Lifetime < 5*time.Minute {
-			return fmt.Errorf("tunnel %d (%s): SA lifetime too short (minimum 5 minutes)", i, tunnel.Name)
+		if tunnel.Crypto.IKE != nil {
+			findings = append(findings, checkRekeyMargin(i, "crypto.ike", *tunnel.Crypto.IKE)...)
 		}
-		if tunnel.Crypto.Lifetime > 24*time.Hour {
-			return fmt.Errorf("tunnel %d (%s): SA lifetime too long (maximum 24 hours)", i, tunnel.Name)
+		if tunnel.Crypto.Child != nil {
+			findings = append(findings, checkRekeyMargin(i, "crypto.child", child)...)
 		}
-	}
-	
-	return nil
-}
 
-func (v *SecurityValidator) isValidEncryption(alg ipsec.EncryptionAlgorithm) bool {
-	validAlgs := []ipsec.EncryptionAlgorithm{
-		ipsec.EncryptionAES128,
-		ipsec.EncryptionAES256,
-		ipsec.EncryptionAES128GCM,
-		ipsec.EncryptionAES256GCM,
-		ipsec.Encryption3DES,
-	}
-	
-	for _, valid := range validAlgs {
-		if alg == valid {
-			return true
+		// Validate crypto algorithms and lifetime limits
+		if profile == nil {
+			continue
 		}
-	}
-	return false
-}
-
-func (v *SecurityValidator) isValidIntegrity(alg ipsec.IntegrityAlgorithm) bool {
-	validAlgs := []ipsec.IntegrityAlgorithm{
-		ipsec.IntegritySHA1,
-		ipsec.IntegritySHA256,
-		ipsec.IntegritySHA384,
-		ipsec.IntegritySHA512,
-	}
-	
-	for _, valid := range validAlgs {
-		if alg == valid {
-			return true
+		for _, violation := range profile.Check(i, tunnel) {
+			if violation.Rule == RuleLifetimeMin && child.Lifetime == 0 {
+				continue // Already reported as missing
+			}
+			findings = append(findings, violation.Finding())
 		}
 	}
-	return false
+	
+	return findings
 }
 
-func (v *SecurityValidator) isValidDHGroup(group ipsec.DHGroup) bool {
-	validGroups := []ipsec.DHGroup{
-		ipsec.DHGroupModp1024,
-		ipsec.DHGroupModp1536,
-		ipsec.DHGroupModp2048,
-		ipsec.DHGroupModp3072,
-		ipsec.DHGroupModp4096,
-		ipsec.DHGroupModp8192,
-		ipsec.DHGroupECP256,
-		ipsec.DHGroupECP384,
-		ipsec.DHGroupECP521,
-	}
-	
-	for _, valid := range validGroups {
-		if group == valid {
-			return true
-		}
+// checkRekeyMargin checks that an SA is rekeyed before its lifetime ends
+func checkRekeyMargin(index int, field string, sa ipsec.SAConfig) []Finding {
+	path := tunnelPath(index, field+".rekey_margin")
+	switch {
+	case sa.RekeyMargin < 0:
+		return []Finding{errorFinding(path, "security.rekey_margin", "rekey margin must not be negative")}
+	case sa.RekeyMargin > 0 && sa.Lifetime == 0:
+		return []Finding{errorFinding(path, "security.rekey_margin", "rekey margin requires a lifetime")}
+	case sa.RekeyMargin > 0 && sa.RekeyMargin >= sa.Lifetime:
+		return []Finding{errorFinding(path, "security.rekey_margin",
+			"rekey margin %s must be shorter than the lifetime %s", sa.RekeyMargin, sa.Lifetime)}
 	}
-	return false
+	return nil
 }
 
 // PlatformCompatibilityValidator validates platform-specific constraints
 type PlatformCompatibilityValidator struct{}
 
-func (v *PlatformCompatibilityValidator) Validate(policy *Policy) error {
+func (v *PlatformCompatibilityValidator) Validate(policy *Policy) []Finding {
+	var findings []Finding
+
 	// Check for platform-specific limitations
 	for i, tunnel := range policy.Tunnels {
 		// AH mode has limited support on some platforms
 		if tunnel.Mode == ipsec.ModeAHTunnel || tunnel.Mode == ipsec.ModeAHTransport {
-			// Warn but don't fail - let platform-specific managers handle it
+			findings = append(findings, warningFinding(tunnelPath(i, "mode"), "platform.ah_limited",
+				"%s authenticates traffic without encrypting it and cannot traverse NAT", tunnel.Mode))
 		}
 		
 		// Combined ESP+AH mode
 		if tunnel.Mode == ipsec.ModeESPAHTunnel {
-			// Some platforms may not support this
+			findings = append(findings, warningFinding(tunnelPath(i, "mode"), "platform.esp_ah_limited",
+				"%s is not supported by every IPsec backend and cannot traverse NAT", tunnel.Mode))
 		}
 		
 		// GCM modes require modern strongSwan/IPsec implementation
-		if tunnel.Crypto.Encryption == ipsec.EncryptionAES128GCM || 
-		   tunnel.Crypto.Encryption == ipsec.EncryptionAES256GCM {
-			if tunnel.Crypto.IKEVersion != ipsec.IKEv2 {
-				return fmt.Errorf("tunnel %d (%s): GCM modes require IKEv2", i, tunnel.Name)
+		if tunnel.Crypto.IKEVersion != ipsec.IKEv2 {
+			for _, proposal := range offeredProposals(tunnel.Crypto) {
+				if proposal.Encryption == ipsec.EncryptionAES128GCM ||
+					proposal.Encryption == ipsec.EncryptionAES256GCM {
+					findings = append(findings, errorFinding(tunnelPath(i, "crypto.ikeversion"), "platform.gcm_requires_ikev2",
+						"GCM modes require IKEv2 (used by %s)", proposal.Path))
+					break
+				}
 			}
 		}
 	}
 	
-	return nil
+	return findings
 }
 
 // DefaultPolicy returns a default policy template
 func DefaultPolicy() *Policy {
+	autoStart := true
 	return &Policy{
 		Name:      "default-policy",
 		Version:   1,
@@ -354,7 +505,7 @@ func DefaultPolicy() *Policy {
 					Delay:  30 * time.Second,
 					Action: "restart",
 				},
-				AutoStart: true,
+				AutoStart: &autoStart,
 			},
 		},
 	}
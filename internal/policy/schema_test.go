@@ -0,0 +1,86 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// mergePolicy returns an enabled policy whose tunnels only carry a name and
+// the policy's ID as their remote address, to tell which policy supplied them
+func mergePolicy(id, name string, priority int, tunnels ...string) Policy {
+	pol := Policy{ID: id, Name: name, Priority: priority, Enabled: true}
+	for _, tunnel := range tunnels {
+		pol.Tunnels = append(pol.Tunnels, ipsec.TunnelConfig{Name: tunnel, RemoteAddress: id})
+	}
+	return pol
+}
+
+func TestSortPolicies(t *testing.T) {
+	policies := []Policy{
+		mergePolicy("p1", "b", 10),
+		mergePolicy("p2", "a", 10),
+		mergePolicy("p3", "z", 50),
+		mergePolicy("p5", "a", 10),
+		mergePolicy("p4", "a", 10),
+		mergePolicy("p6", "a", -1),
+		mergePolicy("p7", "a", 0),
+	}
+	SortPolicies(policies)
+
+	var ids []string
+	for _, pol := range policies {
+		ids = append(ids, pol.ID)
+	}
+	if want := "p3,p2,p4,p5,p1,p7,p6"; strings.Join(ids, ",") != want {
+		t.Errorf("order %v, want %s", ids, want)
+	}
+}
+
+func TestMergeTunnels(t *testing.T) {
+	disabled := mergePolicy("off", "off", 100, "shared", "disabled-only")
+	disabled.Enabled = false
+
+	policies := []Policy{
+		mergePolicy("low", "low", 1, "shared", "low-only"),
+		disabled,
+		mergePolicy("high", "high", 10, "shared"),
+		mergePolicy("tie-b", "b", 5, "tie", "shared"),
+		mergePolicy("tie-a", "a", 5, "tie"),
+	}
+	result := NewPolicyEngine().MergeTunnels(policies)
+
+	var tunnels []string
+	for _, tunnel := range result.Tunnels {
+		tunnels = append(tunnels, tunnel.Name+" "+tunnel.RemoteAddress)
+	}
+	wantTunnels := []string{"low-only low", "shared high", "tie tie-a"}
+	if !reflect.DeepEqual(tunnels, wantTunnels) {
+		t.Errorf("tunnels %q, want %q", tunnels, wantTunnels)
+	}
+
+	wantSources := map[string]string{"low-only": "low", "shared": "high", "tie": "tie-a"}
+	if !reflect.DeepEqual(result.Sources, wantSources) {
+		t.Errorf("sources %v, want %v", result.Sources, wantSources)
+	}
+
+	// Disabled policies neither supply nor lose tunnels
+	wantConflicts := []TunnelConflict{
+		{Tunnel: "shared", PolicyID: "high", Overridden: []string{"tie-b", "low"}},
+		{Tunnel: "tie", PolicyID: "tie-a", Overridden: []string{"tie-b"}},
+	}
+	if !reflect.DeepEqual(result.Conflicts, wantConflicts) {
+		t.Errorf("conflicts %+v, want %+v", result.Conflicts, wantConflicts)
+	}
+
+	// Merging does not reorder the caller's policies
+	if policies[0].ID != "low" || policies[4].ID != "tie-a" {
+		t.Error("MergeTunnels reordered its input")
+	}
+
+	if empty := NewPolicyEngine().MergeTunnels(nil); len(empty.Tunnels) != 0 || len(empty.Conflicts) != 0 || empty.Sources == nil {
+		t.Errorf("merging no policies gave %+v", empty)
+	}
+}
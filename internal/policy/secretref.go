@@ -0,0 +1,198 @@
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// A tunnel can name its PSK with secret_ref instead of carrying it in
+// auth.secret, so that the secret is never part of the policy:
+//
+//	store:NAME           an entry of the server's secret store
+//	file:/path           a file on the server
+//	env:IPSEC_PSK_NAME   an environment variable of the server
+//	agent:file:/path     a file on the peer, read by the agent
+//	agent:env:IPSEC_PSK_NAME
+//	                     an environment variable of the agent
+//
+// The server resolves its references when an agent fetches its policies,
+// and agents resolve theirs before configuring the tunnel, so local-only
+// secrets never reach the server. Files must sit under the resolving side's
+// secret directory and variables must start with SecretEnvPrefix, so that a
+// reference cannot read arbitrary files or the server's own credentials.
+
+// Kinds of secret reference
+const (
+	SecretRefStore = "store"
+	SecretRefFile  = "file"
+	SecretRefEnv   = "env"
+)
+
+// SecretEnvPrefix starts every environment variable a reference may read
+const SecretEnvPrefix = "IPSEC_PSK_"
+
+// DefaultSecretDir is the directory file references are read from unless
+// configured otherwise
+const DefaultSecretDir = "/etc/ipsec/secrets"
+
+var (
+	secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,127}$`)
+	secretEnvPattern  = regexp.MustCompile(`^` + SecretEnvPrefix + `[A-Za-z0-9_]+$`)
+)
+
+// SecretRef is a parsed secret_ref
+type SecretRef struct {
+	Agent bool   // Resolved by the agent rather than the server
+	Kind  string // store, file or env
+	Name  string // Store entry name, absolute file path or variable name
+}
+
+// ParseSecretRef reads a secret_ref value
+func ParseSecretRef(ref string) (SecretRef, error) {
+	var parsed SecretRef
+	rest := ref
+	if after, ok := strings.CutPrefix(rest, "agent:"); ok {
+		parsed.Agent = true
+		rest = after
+	}
+
+	kind, name, ok := strings.Cut(rest, ":")
+	if !ok || name == "" {
+		return parsed, fmt.Errorf("invalid secret_ref %q: expected store:NAME, file:PATH or env:NAME, optionally prefixed with agent:", ref)
+	}
+	parsed.Kind, parsed.Name = kind, name
+
+	switch kind {
+	case SecretRefStore:
+		if parsed.Agent {
+			return parsed, fmt.Errorf("invalid secret_ref %q: store entries are resolved by the server", ref)
+		}
+		if !ValidSecretName(name) {
+			return parsed, fmt.Errorf("invalid secret_ref %q: invalid secret name", ref)
+		}
+	case SecretRefFile:
+		if !filepath.IsAbs(name) || filepath.Clean(name) != name {
+			return parsed, fmt.Errorf("invalid secret_ref %q: file path must be absolute and clean", ref)
+		}
+	case SecretRefEnv:
+		if !secretEnvPattern.MatchString(name) {
+			return parsed, fmt.Errorf("invalid secret_ref %q: variable name must start with %s", ref, SecretEnvPrefix)
+		}
+	default:
+		return parsed, fmt.Errorf("invalid secret_ref %q: unknown kind %q", ref, kind)
+	}
+	return parsed, nil
+}
+
+// ValidSecretName reports whether name can name a secret store entry
+func ValidSecretName(name string) bool {
+	return secretNamePattern.MatchString(name)
+}
+
+// String returns the reference as written in a policy
+func (r SecretRef) String() string {
+	ref := r.Kind + ":" + r.Name
+	if r.Agent {
+		ref = "agent:" + ref
+	}
+	return ref
+}
+
+// ReadLocal resolves a file or environment reference on this host. File
+// references must name a file under dir. Trailing line breaks are dropped
+// and an empty secret is an error.
+func (r SecretRef) ReadLocal(dir string) (string, error) {
+	var secret string
+	switch r.Kind {
+	case SecretRefFile:
+		// Compare real paths, so a symlink cannot lead out of the directory
+		path, err := filepath.EvalSymlinks(r.Name)
+		if err != nil {
+			return "", err
+		}
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("%s is outside the secret directory %s", r.Name, dir)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimRight(string(data), "\r\n")
+	case SecretRefEnv:
+		var ok bool
+		if secret, ok = os.LookupEnv(r.Name); !ok {
+			return "", fmt.Errorf("environment variable %s is not set", r.Name)
+		}
+	default:
+		return "", fmt.Errorf("%s references cannot be read locally", r.Kind)
+	}
+
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", r)
+	}
+	return secret, nil
+}
+
+// StoredSecret is an entry of the server's secret store, which tunnels refer
+// to with "store:NAME"
+type StoredSecret struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Secret      string    `json:"secret,omitempty"` // Left out of listings
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Validate checks an entry before it is saved
+func (s *StoredSecret) Validate() error {
+	if !ValidSecretName(s.Name) {
+		return fmt.Errorf("invalid secret name %q: use letters, digits, '.', '_' and '-', up to 128 characters", s.Name)
+	}
+	if s.Secret == RedactedSecret {
+		return fmt.Errorf("secret is the redaction placeholder")
+	}
+	if len(s.Secret) < 8 {
+		return fmt.Errorf("secret must be at least 8 characters")
+	}
+	return nil
+}
+
+// SecretSettings controls where tunnel PSKs may come from
+type SecretSettings struct {
+	AllowInline bool // PSKs may be written into policies; otherwise every PSK needs a secret_ref
+}
+
+// SetSecretSettings replaces the engine's secret settings. It is meant to be
+// called during startup.
+func (e *PolicyEngine) SetSecretSettings(settings SecretSettings) {
+	*e.secrets = settings
+}
+
+// checkSecretRef validates the secret_ref of a PSK tunnel
+func checkSecretRef(index int, auth ipsec.AuthConfig) []Finding {
+	path := tunnelPath(index, "auth.secret_ref")
+	var findings []Finding
+	if _, err := ParseSecretRef(auth.SecretRef); err != nil {
+		findings = append(findings, errorFinding(path, "security.secret_ref", "%v", err))
+	}
+	if auth.Secret != "" {
+		findings = append(findings, errorFinding(path, "security.secret_ref",
+			"secret and secret_ref are mutually exclusive"))
+	}
+	if auth.RotateEvery != "" {
+		findings = append(findings, errorFinding(tunnelPath(index, "auth.rotate_every"), "security.rotate_every",
+			"a PSK given by secret_ref is rotated where it is stored, not with rotate_every"))
+	}
+	return findings
+}
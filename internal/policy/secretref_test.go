@@ -0,0 +1,136 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSecretRef(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want SecretRef
+		err  string
+	}{
+		{ref: "store:branch-psk", want: SecretRef{Kind: SecretRefStore, Name: "branch-psk"}},
+		{ref: "file:/etc/ipsec/secrets/branch", want: SecretRef{Kind: SecretRefFile, Name: "/etc/ipsec/secrets/branch"}},
+		{ref: "env:IPSEC_PSK_BRANCH", want: SecretRef{Kind: SecretRefEnv, Name: "IPSEC_PSK_BRANCH"}},
+		{ref: "agent:file:/etc/ipsec/secrets/branch", want: SecretRef{Agent: true, Kind: SecretRefFile, Name: "/etc/ipsec/secrets/branch"}},
+		{ref: "agent:env:IPSEC_PSK_BRANCH", want: SecretRef{Agent: true, Kind: SecretRefEnv, Name: "IPSEC_PSK_BRANCH"}},
+
+		{ref: "", err: "expected store:NAME"},
+		{ref: "branch-psk", err: "expected store:NAME"},
+		{ref: "store:", err: "expected store:NAME"},
+		{ref: "agent:", err: "expected store:NAME"},
+		{ref: "vault:branch", err: `unknown kind "vault"`},
+		{ref: "agent:store:branch-psk", err: "store entries are resolved by the server"},
+		{ref: "store:../branch", err: "invalid secret name"},
+		{ref: "store:branch psk", err: "invalid secret name"},
+		{ref: "file:secrets/branch", err: "must be absolute and clean"},
+		{ref: "file:/etc/ipsec/secrets/../shadow", err: "must be absolute and clean"},
+		{ref: "file:/etc/ipsec/secrets//branch", err: "must be absolute and clean"},
+		{ref: "agent:file:../branch", err: "must be absolute and clean"},
+		{ref: "env:HOME", err: "must start with IPSEC_PSK_"},
+		{ref: "env:IPSEC_PSK_", err: "must start with IPSEC_PSK_"},
+		{ref: "agent:env:IPSEC_PSK_A-B", err: "must start with IPSEC_PSK_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := ParseSecretRef(tt.ref)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseSecretRef(%q) error = %v, want %q", tt.ref, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSecretRef(%q): %v", tt.ref, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSecretRef(%q) = %+v, want %+v", tt.ref, got, tt.want)
+			}
+			if got.String() != tt.ref {
+				t.Errorf("String() = %q, want %q", got.String(), tt.ref)
+			}
+		})
+	}
+}
+
+func TestSecretRefReadLocal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "secrets")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(dir, "branch"):  "branch-secret\r\n",
+		filepath.Join(dir, "empty"):   "\n",
+		filepath.Join(root, "shadow"): "outside-secret",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(dir, "escape"): filepath.Join(root, "shadow"),
+		filepath.Join(dir, "alias"):  filepath.Join(dir, "branch"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+	t.Setenv("IPSEC_PSK_BRANCH", "env-secret")
+	t.Setenv("IPSEC_PSK_EMPTY", "")
+
+	tests := []struct {
+		name string
+		ref  SecretRef
+		want string
+		err  string
+	}{
+		{name: "file", ref: SecretRef{Kind: SecretRefFile, Name: filepath.Join(dir, "branch")}, want: "branch-secret"},
+		{name: "symlink inside the directory", ref: SecretRef{Kind: SecretRefFile, Name: filepath.Join(dir, "alias")}, want: "branch-secret"},
+		{name: "agent file", ref: SecretRef{Agent: true, Kind: SecretRefFile, Name: filepath.Join(dir, "branch")}, want: "branch-secret"},
+		{name: "env", ref: SecretRef{Kind: SecretRefEnv, Name: "IPSEC_PSK_BRANCH"}, want: "env-secret"},
+		{name: "agent env", ref: SecretRef{Agent: true, Kind: SecretRefEnv, Name: "IPSEC_PSK_BRANCH"}, want: "env-secret"},
+
+		{name: "traversal", ref: SecretRef{Kind: SecretRefFile, Name: dir + "/../shadow"}, err: "outside the secret directory"},
+		{name: "absolute path outside", ref: SecretRef{Kind: SecretRefFile, Name: filepath.Join(root, "shadow")}, err: "outside the secret directory"},
+		{name: "symlink leading outside", ref: SecretRef{Kind: SecretRefFile, Name: filepath.Join(dir, "escape")}, err: "outside the secret directory"},
+		{name: "the directory itself", ref: SecretRef{Kind: SecretRefFile, Name: dir}, err: "is a directory"},
+		{name: "missing file", ref: SecretRef{Kind: SecretRefFile, Name: filepath.Join(dir, "missing")}, err: "no such file"},
+		{name: "empty file", ref: SecretRef{Kind: SecretRefFile, Name: filepath.Join(dir, "empty")}, err: "is empty"},
+		{name: "unset variable", ref: SecretRef{Kind: SecretRefEnv, Name: "IPSEC_PSK_UNSET"}, err: "IPSEC_PSK_UNSET is not set"},
+		{name: "empty variable", ref: SecretRef{Kind: SecretRefEnv, Name: "IPSEC_PSK_EMPTY"}, err: "env:IPSEC_PSK_EMPTY is empty"},
+		{name: "store entry", ref: SecretRef{Kind: SecretRefStore, Name: "branch"}, err: "store references cannot be read locally"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.ref.ReadLocal(dir)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ReadLocal(%s) = %q, %v, want error %q", tt.ref, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ReadLocal(%s) = %q, %v, want %q", tt.ref, got, err, tt.want)
+			}
+		})
+	}
+
+	// The directory may itself be reached through a symlink
+	linkedDir := filepath.Join(root, "linked")
+	if err := os.Symlink(dir, linkedDir); err != nil {
+		t.Fatal(err)
+	}
+	ref := SecretRef{Kind: SecretRefFile, Name: filepath.Join(dir, "branch")}
+	if got, err := ref.ReadLocal(linkedDir); err != nil || got != "branch-secret" {
+		t.Errorf("ReadLocal through a linked directory = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,480 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Selector decides whether a policy applies to a peer.
+//
+// Each Policy.AppliesTo entry is a peer ID or tag, matched literally, or "*"
+// for every peer. Entries starting with "expr:" are selector expressions
+// instead, so existing tags are never read as expressions whatever
+// characters they contain. Expressions are built from:
+//
+//	key=value, key==value, key!=value   compare a peer field
+//	key in (a,b), key notin (a,b)      set membership
+//	a,b   a && b   a and b              AND
+//	a || b   a or b                     OR
+//	!a   not a                          NOT
+//	( ... )                             grouping
+//
+// A bare word in an expression matches a peer ID or tag. Keys are resolved
+// against the peer's id, hostname, platform, version, ip_address, status and
+// tag (any tag) fields first and then against PeerInfo.Metadata;
+// "metadata.<key>" always selects metadata. Values may be double-quoted to
+// include spaces or operator characters.
+//
+// Example: expr:platform=linux,site!=lab || env in (prod,staging)
+type Selector interface {
+	Matches(peer *PeerInfo) bool
+}
+
+// SelectorExprPrefix marks an AppliesTo entry as a selector expression
+const SelectorExprPrefix = "expr:"
+
+// ParseSelector parses a single AppliesTo entry
+func ParseSelector(entry string) (Selector, error) {
+	expr, ok := strings.CutPrefix(entry, SelectorExprPrefix)
+	if !ok {
+		if entry == "*" {
+			return anySelector{}, nil
+		}
+		return bareSelector{name: entry}, nil
+	}
+
+	tokens, err := lexSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+
+	p := &selectorParser{tokens: tokens}
+	sel, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.tokens[p.pos].text, p.tokens[p.pos].offset)
+	}
+	return sel, nil
+}
+
+// MatchesSelector reports whether a peer matches an AppliesTo entry. An
+// expression that does not parse matches no peer; validation rejects them
+// on save.
+func MatchesSelector(entry string, peer *PeerInfo) bool {
+	sel, err := ParseSelector(entry)
+	if err != nil {
+		return false
+	}
+	return sel.Matches(peer)
+}
+
+// SelectorValidator validates Policy.AppliesTo selector expressions
+type SelectorValidator struct{}
+
+func (v *SelectorValidator) Validate(policy *Policy) []Finding {
+	var findings []Finding
+	for i, expr := range policy.AppliesTo {
+		if _, err := ParseSelector(expr); err != nil {
+			findings = append(findings, errorFinding(fmt.Sprintf("applies_to[%d]", i), "selector.invalid",
+				"invalid selector %q: %v", expr, err))
+		}
+	}
+	return findings
+}
+
+// Selector nodes
+
+type anySelector struct{}
+
+func (anySelector) Matches(peer *PeerInfo) bool { return true }
+
+type bareSelector struct {
+	name string
+}
+
+func (s bareSelector) Matches(peer *PeerInfo) bool {
+	if s.name == peer.ID {
+		return true
+	}
+	for _, tag := range peer.Tags {
+		if tag == s.name {
+			return true
+		}
+	}
+	return false
+}
+
+type notSelector struct {
+	inner Selector
+}
+
+func (s notSelector) Matches(peer *PeerInfo) bool { return !s.inner.Matches(peer) }
+
+type andSelector []Selector
+
+func (s andSelector) Matches(peer *PeerInfo) bool {
+	for _, sel := range s {
+		if !sel.Matches(peer) {
+			return false
+		}
+	}
+	return true
+}
+
+type orSelector []Selector
+
+func (s orSelector) Matches(peer *PeerInfo) bool {
+	for _, sel := range s {
+		if sel.Matches(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+type matchSelector struct {
+	key    string
+	values []string
+	negate bool // != and notin
+}
+
+func (s matchSelector) Matches(peer *PeerInfo) bool {
+	found := false
+	for _, actual := range peerValues(peer, s.key) {
+		for _, want := range s.values {
+			if actual == want {
+				found = true
+			}
+		}
+	}
+	return found != s.negate
+}
+
+// peerValues returns the values of a selector key for a peer. Only "tag" can
+// have more than one value; a missing key has none.
+func peerValues(peer *PeerInfo, key string) []string {
+	if strings.HasPrefix(key, "metadata.") {
+		key = strings.TrimPrefix(key, "metadata.")
+		if v, ok := peer.Metadata[key]; ok {
+			return []string{v}
+		}
+		return nil
+	}
+
+	switch key {
+	case "id":
+		return []string{peer.ID}
+	case "hostname":
+		return []string{peer.Hostname}
+	case "platform":
+		return []string{peer.Platform}
+	case "version":
+		return []string{peer.Version}
+	case "ip_address":
+		return []string{peer.IPAddress}
+	case "status":
+		return []string{string(peer.Status)}
+	case "tag":
+		return peer.Tags
+	}
+
+	if v, ok := peer.Metadata[key]; ok {
+		return []string{v}
+	}
+	return nil
+}
+
+// Lexer
+
+type selectorTokenKind int
+
+const (
+	tokWord selectorTokenKind = iota
+	tokEq
+	tokNeq
+	tokComma
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type selectorToken struct {
+	kind   selectorTokenKind
+	text   string
+	offset int
+	quoted bool
+}
+
+func lexSelector(expr string) ([]selectorToken, error) {
+	var tokens []selectorToken
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, selectorToken{kind: tokLParen, text: "(", offset: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, selectorToken{kind: tokRParen, text: ")", offset: i})
+			i++
+		case r == ',':
+			tokens = append(tokens, selectorToken{kind: tokComma, text: ",", offset: i})
+			i++
+		case r == '=':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, selectorToken{kind: tokEq, text: "==", offset: i})
+				i += 2
+			} else {
+				tokens = append(tokens, selectorToken{kind: tokEq, text: "=", offset: i})
+				i++
+			}
+		case r == '!':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, selectorToken{kind: tokNeq, text: "!=", offset: i})
+				i += 2
+			} else {
+				tokens = append(tokens, selectorToken{kind: tokNot, text: "!", offset: i})
+				i++
+			}
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, fmt.Errorf("unexpected %q at position %d", r, i)
+			}
+			kind := tokAnd
+			if r == '|' {
+				kind = tokOr
+			}
+			tokens = append(tokens, selectorToken{kind: kind, text: string([]rune{r, r}), offset: i})
+			i += 2
+		case r == '"':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(runes) && runes[i] != '"' {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated quote at position %d", start)
+			}
+			i++
+			tokens = append(tokens, selectorToken{kind: tokWord, text: sb.String(), offset: start, quoted: true})
+		case isSelectorWordRune(r):
+			start := i
+			for i < len(runes) && isSelectorWordRune(runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+			kind := tokWord
+			switch word {
+			case "and":
+				kind = tokAnd
+			case "or":
+				kind = tokOr
+			case "not":
+				kind = tokNot
+			}
+			tokens = append(tokens, selectorToken{kind: kind, text: word, offset: start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", r, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isSelectorWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.:/@*", r)
+}
+
+// Parser
+
+type selectorParser struct {
+	tokens []selectorToken
+	pos    int
+}
+
+func (p *selectorParser) peek() *selectorToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *selectorParser) accept(kind selectorTokenKind) bool {
+	if t := p.peek(); t != nil && t.kind == kind {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// acceptKeyword matches an unquoted word such as "in" or "notin"
+func (p *selectorParser) acceptKeyword(word string) bool {
+	if t := p.peek(); t != nil && t.kind == tokWord && !t.quoted && t.text == word {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) parseOr() (Selector, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	terms := orSelector{first}
+	for p.accept(tokOr) {
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, next)
+	}
+
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return terms, nil
+}
+
+func (p *selectorParser) parseAnd() (Selector, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	terms := andSelector{first}
+	for p.accept(tokAnd) || p.accept(tokComma) {
+		next, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, next)
+	}
+
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return terms, nil
+}
+
+func (p *selectorParser) parseUnary() (Selector, error) {
+	if p.accept(tokNot) {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notSelector{inner: inner}, nil
+	}
+
+	if p.accept(tokLParen) {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(tokRParen) {
+			return nil, p.errorf("expected )")
+		}
+		return inner, nil
+	}
+
+	return p.parseTerm()
+}
+
+func (p *selectorParser) parseTerm() (Selector, error) {
+	t := p.peek()
+	if t == nil || t.kind != tokWord {
+		return nil, p.errorf("expected peer ID, tag or key")
+	}
+	p.pos++
+	key := t.text
+
+	switch {
+	case p.accept(tokEq):
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return matchSelector{key: key, values: []string{value}}, nil
+
+	case p.accept(tokNeq):
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return matchSelector{key: key, values: []string{value}, negate: true}, nil
+
+	case p.acceptKeyword("in"):
+		values, err := p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		return matchSelector{key: key, values: values}, nil
+
+	case p.acceptKeyword("notin"):
+		values, err := p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		return matchSelector{key: key, values: values, negate: true}, nil
+	}
+
+	if key == "*" && !t.quoted {
+		return anySelector{}, nil
+	}
+	return bareSelector{name: key}, nil
+}
+
+func (p *selectorParser) parseValue() (string, error) {
+	t := p.peek()
+	if t == nil || t.kind != tokWord {
+		return "", p.errorf("expected value")
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *selectorParser) parseSet() ([]string, error) {
+	if !p.accept(tokLParen) {
+		return nil, p.errorf("expected ( after in")
+	}
+
+	var values []string
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		if p.accept(tokRParen) {
+			return values, nil
+		}
+		if !p.accept(tokComma) {
+			return nil, p.errorf("expected , or )")
+		}
+	}
+}
+
+func (p *selectorParser) errorf(msg string) error {
+	if t := p.peek(); t != nil {
+		return fmt.Errorf("%s at position %d, got %q", msg, t.offset, t.text)
+	}
+	return fmt.Errorf("%s at end of selector", msg)
+}
@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchesSelector(t *testing.T) {
+	peer := &PeerInfo{
+		ID:       "peer-1",
+		Hostname: "gw1.example.com",
+		Platform: "linux",
+		Status:   PeerStatusOnline,
+		Tags:     []string{"branch", "site=a", "no entry", "and"},
+		Metadata: map[string]string{"site": "berlin", "env": "prod", "platform": "ignored"},
+	}
+
+	tests := []struct {
+		entry string
+		want  bool
+	}{
+		// Plain entries are literal IDs and tags
+		{"*", true},
+		{"peer-1", true},
+		{"branch", true},
+		{"peer-2", false},
+		{"site=a", true},
+		{"site=berlin", false},
+		{"no entry", true},
+		{"and", true},
+		{"!branch", false},
+		{"(branch)", false},
+		{"", false},
+
+		// Expressions
+		{"expr:*", true},
+		{"expr:branch", true},
+		{"expr:platform=linux", true},
+		{"expr:platform==linux", true},
+		{"expr:platform!=linux", false},
+		{"expr:site=berlin", true},
+		{"expr:metadata.platform=ignored", true},
+		{"expr:platform=ignored", false},
+		{"expr:tag=branch", true},
+		{"expr:tag!=branch", false},
+		{"expr:tag=\"no entry\"", true},
+		{"expr:env in (prod,staging)", true},
+		{"expr:env notin (prod,staging)", false},
+		{"expr:missing in (a,b)", false},
+		{"expr:missing notin (a,b)", true},
+		{"expr:platform=linux,site!=berlin", false},
+		{"expr:platform=linux && site=berlin", true},
+		{"expr:platform=windows || env=prod", true},
+		{"expr:platform=windows or env=staging", false},
+		{"expr:!branch", false},
+		{"expr:not peer-2", true},
+		{"expr:!(platform=windows || env=staging)", true},
+		{"expr:status=online and hostname=gw1.example.com", true},
+		{"expr:\"*\"", false},
+
+		// Invalid expressions match nothing
+		{"expr:", false},
+		{"expr:platform=", false},
+		{"expr:(branch", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			if got := MatchesSelector(tt.entry, peer); got != tt.want {
+				t.Errorf("MatchesSelector(%q) = %v, want %v", tt.entry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []struct {
+		entry string
+		err   string // substring of the error; empty if the entry parses
+	}{
+		{"tag with (parens) and = signs", ""},
+		{"a && b", ""},
+		{"expr:a && b", ""},
+		{"expr:", "empty selector"},
+		{"expr:   ", "empty selector"},
+		{"expr:a &", `unexpected '&'`},
+		{"expr:a | b", `unexpected '|'`},
+		{"expr:(a", "expected ) at end of selector"},
+		{"expr:a)", `unexpected ")" at position 1`},
+		{"expr:a =", "expected value at end of selector"},
+		{"expr:a in b", "expected ( after in"},
+		{"expr:a in (b c)", "expected , or )"},
+		{"expr:\"a", "unterminated quote at position 0"},
+		{"expr:a,,b", "expected peer ID, tag or key"},
+		{"expr:a $ b", `unexpected '$'`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			_, err := ParseSelector(tt.entry)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("ParseSelector(%q) failed: %v", tt.entry, err)
+			case tt.err != "" && err == nil:
+				t.Errorf("ParseSelector(%q) succeeded, want error %q", tt.entry, tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("ParseSelector(%q) error = %q, want %q", tt.entry, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSelectorValidator(t *testing.T) {
+	pol := &Policy{AppliesTo: []string{"branch", "expr:platform=linux", "expr:(", "site=a b"}}
+
+	findings := (&SelectorValidator{}).Validate(pol)
+	if len(findings) != 1 {
+		t.Fatalf("got %d findings, want 1: %v", len(findings), findings)
+	}
+	if findings[0].Path != "applies_to[2]" || findings[0].Code != "selector.invalid" {
+		t.Errorf("got finding %s %s, want applies_to[2] selector.invalid", findings[0].Path, findings[0].Code)
+	}
+}
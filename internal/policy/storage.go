@@ -4,26 +4,34 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
 	_ "modernc.org/sqlite" // SQLite driver
 )
 
 // Storage handles persistent storage of policies and peer information
 type Storage struct {
-	db *sql.DB
+	db   *sql.DB
+	keys *Keyring // Seals tunnel secrets; secrets are stored in plaintext when nil
 }
 
-// NewStorage creates a new storage instance
-func NewStorage(dbPath string) (*Storage, error) {
-	db, err := sql.Open("sqlite", dbPath)
+// NewStorage creates a new storage instance. With a keyring, tunnel secrets
+// are encrypted at rest, and any stored in plaintext are encrypted when the
+// database is opened.
+func NewStorage(dbPath string, keys *Keyring) (*Storage, error) {
+	// secure_delete zeroes the space freed when a row is overwritten, so that
+	// replaced secrets do not linger in the file or its backups
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=secure_delete(1)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	storage := &Storage{db: db}
+	storage := &Storage{db: db, keys: keys}
 	if err := storage.initialize(); err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
@@ -45,9 +53,22 @@ func (s *Storage) initialize() error {
 		priority INTEGER NOT NULL DEFAULT 0,
 		applies_to TEXT, -- JSON array
 		tunnels TEXT NOT NULL, -- JSON array
+		compliance TEXT NOT NULL DEFAULT '',
+		not_before TIMESTAMP,
+		not_after TIMESTAMP,
+		maintenance_windows TEXT NOT NULL DEFAULT '', -- JSON array
+		schema_version INTEGER NOT NULL DEFAULT 1,
 		UNIQUE(name)
 	);
 
+	CREATE TABLE IF NOT EXISTS policy_revisions (
+		policy_id TEXT NOT NULL,
+		revision INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		policy TEXT NOT NULL, -- JSON object, full policy as saved
+		PRIMARY KEY (policy_id, revision)
+	);
+
 	CREATE TABLE IF NOT EXISTS peers (
 		id TEXT PRIMARY KEY,
 		hostname TEXT NOT NULL,
@@ -58,7 +79,75 @@ func (s *Storage) initialize() error {
 		last_seen_at TIMESTAMP NOT NULL,
 		registered_at TIMESTAMP NOT NULL,
 		metadata TEXT, -- JSON object
-		status TEXT NOT NULL
+		status TEXT NOT NULL,
+		addresses TEXT NOT NULL DEFAULT '' -- JSON array
+	);
+
+	CREATE TABLE IF NOT EXISTS policy_schedule (
+		policy_id TEXT PRIMARY KEY,
+		state TEXT NOT NULL, -- Last schedule state seen by the scheduler
+		changed_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS rollouts (
+		id TEXT PRIMARY KEY,
+		policy_id TEXT NOT NULL,
+		state TEXT NOT NULL,
+		from_version INTEGER NOT NULL,
+		to_version INTEGER NOT NULL,
+		baseline TEXT NOT NULL, -- JSON object, policy before the update
+		strategy TEXT NOT NULL, -- JSON object
+		waves TEXT NOT NULL, -- JSON array
+		current_wave INTEGER NOT NULL DEFAULT 0,
+		message TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS peer_reports (
+		peer_id TEXT PRIMARY KEY,
+		reported_at TIMESTAMP NOT NULL,
+		report TEXT NOT NULL -- JSON object, latest report only
+	);
+
+	CREATE TABLE IF NOT EXISTS psk_rotations (
+		id TEXT PRIMARY KEY,
+		state TEXT NOT NULL,
+		rotation TEXT NOT NULL, -- JSON object, the whole rotation; never holds a secret
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS topologies (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT 1,
+		topology TEXT NOT NULL, -- JSON object, the whole topology
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS secrets (
+		name TEXT PRIMARY KEY,
+		version INTEGER NOT NULL,
+		secret TEXT NOT NULL, -- JSON object, the whole entry
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS certificate_authority (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		authority TEXT NOT NULL, -- JSON object, the CA certificate and key
+		created_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS certificates (
+		serial TEXT PRIMARY KEY,
+		peer_id TEXT NOT NULL,
+		not_after TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		certificate TEXT NOT NULL -- JSON object, the whole issued certificate
 	);
 
 	CREATE TABLE IF NOT EXISTS audit_log (
@@ -72,9 +161,12 @@ func (s *Storage) initialize() error {
 		ip_address TEXT
 	);
 
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_policies_name ON policies(name);
 	CREATE INDEX IF NOT EXISTS idx_policies_enabled ON policies(enabled);
 	CREATE INDEX IF NOT EXISTS idx_policies_priority ON policies(priority DESC);
 	CREATE INDEX IF NOT EXISTS idx_peers_last_seen ON peers(last_seen_at DESC);
+	CREATE INDEX IF NOT EXISTS idx_rollouts_policy ON rollouts(policy_id, state);
+	CREATE INDEX IF NOT EXISTS idx_certificates_peer ON certificates(peer_id);
 	CREATE INDEX IF NOT EXISTS idx_audit_log_timestamp ON audit_log(timestamp DESC);
 	`
 
@@ -82,6 +174,139 @@ func (s *Storage) initialize() error {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
 
+	// Versions are server-assigned and start at 1; older rows may hold 0
+	if _, err := s.db.Exec("UPDATE policies SET version = 1 WHERE version < 1"); err != nil {
+		return fmt.Errorf("failed to migrate policy versions: %w", err)
+	}
+
+	// Columns added after the first release
+	if err := s.addColumn("policies", "compliance", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.addColumn("policies", "not_before", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := s.addColumn("policies", "not_after", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := s.addColumn("policies", "maintenance_windows", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.addColumn("policies", "schema_version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := s.addColumn("peers", "addresses", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.addColumn("policies", "extends", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	if err := s.migratePolicies(); err != nil {
+		return err
+	}
+
+	// Secrets written before a master key was configured
+	if s.keys != nil {
+		sealPlain := func(secret string) (string, error) {
+			if secret == "" || IsSealed(secret) {
+				return secret, nil
+			}
+			return s.keys.Seal(secret)
+		}
+		if _, err := s.resealSecrets(context.Background(), sealPlain); err != nil {
+			return fmt.Errorf("failed to encrypt stored secrets: %w", err)
+		}
+	}
+	return nil
+}
+
+// migratePolicies rewrites policies stored in an older schema version in the
+// current one. Only the encoding changes, so versions and revisions are left
+// alone.
+func (s *Storage) migratePolicies() error {
+	rows, err := s.db.Query("SELECT id, tunnels FROM policies WHERE schema_version < ?", CurrentSchemaVersion)
+	if err != nil {
+		return fmt.Errorf("failed to find policies to migrate: %w", err)
+	}
+
+	defer rows.Close()
+
+	migrated := make(map[string]string)
+	for rows.Next() {
+		var id, tunnelsJSON string
+		if err := rows.Scan(&id, &tunnelsJSON); err != nil {
+			return fmt.Errorf("failed to scan policy to migrate: %w", err)
+		}
+
+		// Version 1 -> 2: the tunnel codecs read nanoseconds and write strings
+		var tunnels []ipsec.TunnelConfig
+		if err := json.Unmarshal([]byte(tunnelsJSON), &tunnels); err != nil {
+			return fmt.Errorf("failed to migrate policy %s: %w", id, err)
+		}
+		data, err := json.Marshal(tunnels)
+		if err != nil {
+			return fmt.Errorf("failed to migrate policy %s: %w", id, err)
+		}
+		migrated[id] = string(data)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to find policies to migrate: %w", err)
+	}
+	rows.Close()
+
+	if len(migrated) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	for id, tunnelsJSON := range migrated {
+		_, err := tx.Exec("UPDATE policies SET tunnels = ?, schema_version = ? WHERE id = ?",
+			tunnelsJSON, CurrentSchemaVersion, id)
+		if err != nil {
+			return fmt.Errorf("failed to migrate policy %s: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration: %w", err)
+	}
+
+	return nil
+}
+
+// addColumn adds a column to an existing table unless it is already there
+func (s *Storage) addColumn(table, column, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to inspect %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect %s: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -90,8 +315,87 @@ func (s *Storage) Close() error {
 	return s.db.Close()
 }
 
-// SavePolicy saves or updates a policy
+var (
+	// ErrPolicyNotFound is returned when a policy ID does not exist
+	ErrPolicyNotFound = errors.New("policy not found")
+
+	// ErrVersionConflict is returned when a write is based on a stale policy version
+	ErrVersionConflict = errors.New("policy version conflict")
+
+	// ErrDuplicateName is returned when another policy already has the name
+	ErrDuplicateName = errors.New("policy name already in use")
+
+	// ErrRolloutNotFound is returned when a rollout ID does not exist
+	ErrRolloutNotFound = errors.New("rollout not found")
+
+	// ErrTopologyNotFound is returned when a topology ID does not exist
+	ErrTopologyNotFound = errors.New("topology not found")
+
+	// ErrRotationNotFound is returned when a rotation ID does not exist
+	ErrRotationNotFound = errors.New("rotation not found")
+
+	// ErrSecretNotFound is returned when the secret store has no entry of a name
+	ErrSecretNotFound = errors.New("secret not found")
+
+	// ErrCANotFound is returned when the built-in CA has not been generated yet
+	ErrCANotFound = errors.New("certificate authority not found")
+
+	// ErrCertificateNotFound is returned when no certificate has a serial
+	ErrCertificateNotFound = errors.New("certificate not found")
+)
+
+// SavePolicy saves or updates a policy. Policy.Version must hold the version
+// the caller last read (0 for a new policy); the write only succeeds if that
+// is still the stored version, otherwise ErrVersionConflict is returned. On
+// success Policy.Version is set to the new, server-assigned version.
 func (s *Storage) SavePolicy(ctx context.Context, policy *Policy) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.savePolicy(ctx, tx, policy); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit policy: %w", err)
+	}
+
+	return nil
+}
+
+// SavePolicies saves several policies like SavePolicy, in one transaction:
+// either all of them are saved or, on the first error, none is
+func (s *Storage) SavePolicies(ctx context.Context, policies []*Policy) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	versions := make([]int, len(policies))
+	for i, policy := range policies {
+		versions[i] = policy.Version
+		if err := s.savePolicy(ctx, tx, policy); err != nil {
+			// Leave the callers' versions as they were
+			for j := 0; j < i; j++ {
+				policies[j].Version = versions[j]
+			}
+			return fmt.Errorf("policy %s: %w", policy.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit policies: %w", err)
+	}
+
+	return nil
+}
+
+// savePolicy writes a policy and its revision within tx
+func (s *Storage) savePolicy(ctx context.Context, tx *sql.Tx, policy *Policy) error {
 	if policy.ID == "" {
 		policy.ID = uuid.New().String()
 	}
@@ -102,7 +406,11 @@ func (s *Storage) SavePolicy(ctx context.Context, policy *Policy) error {
 	policy.UpdatedAt = time.Now()
 
 	// Serialize tunnels and applies_to to JSON
-	tunnelsJSON, err := json.Marshal(policy.Tunnels)
+	tunnels, err := s.sealTunnels(policy.Tunnels)
+	if err != nil {
+		return err
+	}
+	tunnelsJSON, err := json.Marshal(tunnels)
 	if err != nil {
 		return fmt.Errorf("failed to marshal tunnels: %w", err)
 	}
@@ -112,51 +420,173 @@ func (s *Storage) SavePolicy(ctx context.Context, policy *Policy) error {
 		return fmt.Errorf("failed to marshal applies_to: %w", err)
 	}
 
-	query := `
-	INSERT INTO policies (id, name, description, version, created_at, updated_at, enabled, priority, applies_to, tunnels)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	ON CONFLICT(id) DO UPDATE SET
-		name = excluded.name,
-		description = excluded.description,
-		version = excluded.version,
-		updated_at = excluded.updated_at,
-		enabled = excluded.enabled,
-		priority = excluded.priority,
-		applies_to = excluded.applies_to,
-		tunnels = excluded.tunnels
-	`
+	windowsJSON, err := json.Marshal(policy.MaintenanceWindows)
+	if err != nil {
+		return fmt.Errorf("failed to marshal maintenance_windows: %w", err)
+	}
 
-	_, err = s.db.ExecContext(ctx, query,
-		policy.ID, policy.Name, policy.Description, policy.Version,
-		policy.CreatedAt, policy.UpdatedAt, policy.Enabled, policy.Priority,
-		string(appliesToJSON), string(tunnelsJSON),
-	)
+	if taken, err := s.policyNameTaken(ctx, tx, policy.Name, policy.ID); err != nil {
+		return err
+	} else if taken {
+		return fmt.Errorf("%w: %s", ErrDuplicateName, policy.Name)
+	}
+
+	var result sql.Result
+	if policy.Version == 0 {
+		// New policy: the insert is a no-op if the ID is already taken
+		query := `
+		INSERT INTO policies (id, name, description, version, created_at, updated_at, enabled, priority, applies_to, tunnels, compliance,
+			not_before, not_after, maintenance_windows, schema_version, extends)
+		VALUES (?, ?, ?, 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO NOTHING
+		`
+		result, err = tx.ExecContext(ctx, query,
+			policy.ID, policy.Name, policy.Description,
+			policy.CreatedAt, policy.UpdatedAt, policy.Enabled, policy.Priority,
+			string(appliesToJSON), string(tunnelsJSON), policy.Compliance,
+			policy.NotBefore, policy.NotAfter, string(windowsJSON), CurrentSchemaVersion, policy.Extends,
+		)
+	} else {
+		// Existing policy: compare-and-swap on the stored version
+		query := `
+		UPDATE policies SET
+			name = ?,
+			description = ?,
+			version = version + 1,
+			updated_at = ?,
+			enabled = ?,
+			priority = ?,
+			applies_to = ?,
+			tunnels = ?,
+			compliance = ?,
+			not_before = ?,
+			not_after = ?,
+			maintenance_windows = ?,
+			schema_version = ?,
+			extends = ?
+		WHERE id = ? AND version = ?
+		`
+		result, err = tx.ExecContext(ctx, query,
+			policy.Name, policy.Description, policy.UpdatedAt, policy.Enabled, policy.Priority,
+			string(appliesToJSON), string(tunnelsJSON), policy.Compliance,
+			policy.NotBefore, policy.NotAfter, string(windowsJSON), CurrentSchemaVersion, policy.Extends,
+			policy.ID, policy.Version,
+		)
+	}
 
+	if isUniqueViolation(err, "policies.name") {
+		// Another writer took the name after the check above
+		return fmt.Errorf("%w: %s", ErrDuplicateName, policy.Name)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to save policy: %w", err)
 	}
 
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rows == 0 {
+		if policy.Version != 0 {
+			if exists, err := s.policyExists(ctx, tx, policy.ID); err != nil {
+				return err
+			} else if !exists {
+				return fmt.Errorf("%w: %s", ErrPolicyNotFound, policy.ID)
+			}
+		}
+		return ErrVersionConflict
+	}
+
+	// Read back server-owned fields
+	err = tx.QueryRowContext(ctx,
+		"SELECT version, created_at, schema_version FROM policies WHERE id = ?", policy.ID,
+	).Scan(&policy.Version, &policy.CreatedAt, &policy.SchemaVersion)
+	if err != nil {
+		return fmt.Errorf("failed to read saved policy: %w", err)
+	}
+
+	// Every save is kept as an immutable revision
+	return s.insertRevision(ctx, tx, policy)
+}
+
+// policyExists reports whether a policy with the given ID is stored
+func (s *Storage) policyExists(ctx context.Context, tx *sql.Tx, id string) (bool, error) {
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM policies WHERE id = ?", id).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check policy: %w", err)
+	}
+	return count > 0, nil
+}
+
+// policyNameTaken reports whether a policy other than id has the name
+func (s *Storage) policyNameTaken(ctx context.Context, tx *sql.Tx, name, id string) (bool, error) {
+	var count int
+	err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM policies WHERE name = ? AND id != ?", name, id).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check policy name: %w", err)
+	}
+	return count > 0, nil
+}
+
+// isUniqueViolation reports whether err is SQLite refusing a write that
+// would duplicate a value of a unique column, given as table.column
+func isUniqueViolation(err error, column string) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: "+column)
+}
+
+// insertRevision appends the policy as the next revision in its history
+func (s *Storage) insertRevision(ctx context.Context, tx *sql.Tx, policy *Policy) error {
+	var revision int
+	err := tx.QueryRowContext(ctx,
+		"SELECT COALESCE(MAX(revision), 0) + 1 FROM policy_revisions WHERE policy_id = ?",
+		policy.ID,
+	).Scan(&revision)
+	if err != nil {
+		return fmt.Errorf("failed to get next revision: %w", err)
+	}
+
+	stored, err := s.sealPolicy(policy)
+	if err != nil {
+		return err
+	}
+	policyJSON, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal policy: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO policy_revisions (policy_id, revision, created_at, policy) VALUES (?, ?, ?, ?)",
+		policy.ID, revision, policy.UpdatedAt, string(policyJSON),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save policy revision: %w", err)
+	}
+
 	return nil
 }
 
 // GetPolicy retrieves a policy by ID
 func (s *Storage) GetPolicy(ctx context.Context, id string) (*Policy, error) {
 	query := `
-	SELECT id, name, description, version, created_at, updated_at, enabled, priority, applies_to, tunnels
+	SELECT id, name, description, version, created_at, updated_at, enabled, priority, applies_to, tunnels, compliance,
+		not_before, not_after, maintenance_windows, schema_version, extends
 	FROM policies WHERE id = ?
 	`
 
 	var policy Policy
-	var appliesToJSON, tunnelsJSON string
+	var appliesToJSON, tunnelsJSON, windowsJSON string
+	var notBefore, notAfter sql.NullTime
 
 	err := s.db.QueryRowContext(ctx, query, id).Scan(
 		&policy.ID, &policy.Name, &policy.Description, &policy.Version,
 		&policy.CreatedAt, &policy.UpdatedAt, &policy.Enabled, &policy.Priority,
-		&appliesToJSON, &tunnelsJSON,
+		&appliesToJSON, &tunnelsJSON, &policy.Compliance,
+		&notBefore, &notAfter, &windowsJSON, &policy.SchemaVersion, &policy.Extends,
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("policy not found: %s", id)
+		return nil, fmt.Errorf("%w: %s", ErrPolicyNotFound, id)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get policy: %w", err)
@@ -169,6 +599,13 @@ func (s *Storage) GetPolicy(ctx context.Context, id string) (*Policy, error) {
 	if err := json.Unmarshal([]byte(tunnelsJSON), &policy.Tunnels); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal tunnels: %w", err)
 	}
+	if err := s.openTunnels(policy.Tunnels); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", policy.ID, err)
+	}
+
+	if err := setSchedule(&policy, notBefore, notAfter, windowsJSON); err != nil {
+		return nil, err
+	}
 
 	return &policy, nil
 }
@@ -176,7 +613,8 @@ func (s *Storage) GetPolicy(ctx context.Context, id string) (*Policy, error) {
 // ListPolicies retrieves all policies
 func (s *Storage) ListPolicies(ctx context.Context, enabledOnly bool) ([]Policy, error) {
 	query := `
-	SELECT id, name, description, version, created_at, updated_at, enabled, priority, applies_to, tunnels
+	SELECT id, name, description, version, created_at, updated_at, enabled, priority, applies_to, tunnels, compliance,
+		not_before, not_after, maintenance_windows, schema_version, extends
 	FROM policies
 	`
 	
@@ -195,12 +633,14 @@ func (s *Storage) ListPolicies(ctx context.Context, enabledOnly bool) ([]Policy,
 	var policies []Policy
 	for rows.Next() {
 		var policy Policy
-		var appliesToJSON, tunnelsJSON string
+		var appliesToJSON, tunnelsJSON, windowsJSON string
+		var notBefore, notAfter sql.NullTime
 
 		err := rows.Scan(
 			&policy.ID, &policy.Name, &policy.Description, &policy.Version,
 			&policy.CreatedAt, &policy.UpdatedAt, &policy.Enabled, &policy.Priority,
-			&appliesToJSON, &tunnelsJSON,
+			&appliesToJSON, &tunnelsJSON, &policy.Compliance,
+			&notBefore, &notAfter, &windowsJSON, &policy.SchemaVersion, &policy.Extends,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan policy: %w", err)
@@ -213,6 +653,13 @@ func (s *Storage) ListPolicies(ctx context.Context, enabledOnly bool) ([]Policy,
 		if err := json.Unmarshal([]byte(tunnelsJSON), &policy.Tunnels); err != nil {
 			return nil, fmt.Errorf("failed to unmarshal tunnels: %w", err)
 		}
+		if err := s.openTunnels(policy.Tunnels); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", policy.ID, err)
+		}
+
+		if err := setSchedule(&policy, notBefore, notAfter, windowsJSON); err != nil {
+			return nil, err
+		}
 
 		policies = append(policies, policy)
 	}
@@ -220,9 +667,33 @@ func (s *Storage) ListPolicies(ctx context.Context, enabledOnly bool) ([]Policy,
 	return policies, nil
 }
 
-// DeletePolicy deletes a policy by ID
-func (s *Storage) DeletePolicy(ctx context.Context, id string) error {
-	result, err := s.db.ExecContext(ctx, "DELETE FROM policies WHERE id = ?", id)
+// setSchedule fills in the schedule columns of a scanned policy
+func setSchedule(policy *Policy, notBefore, notAfter sql.NullTime, windowsJSON string) error {
+	if notBefore.Valid {
+		policy.NotBefore = &notBefore.Time
+	}
+	if notAfter.Valid {
+		policy.NotAfter = &notAfter.Time
+	}
+	// Rows written before maintenance windows existed hold ''
+	if windowsJSON != "" {
+		if err := json.Unmarshal([]byte(windowsJSON), &policy.MaintenanceWindows); err != nil {
+			return fmt.Errorf("failed to unmarshal maintenance_windows: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeletePolicy deletes a policy by ID if it is still at the given version.
+// Revisions are kept so that a deleted policy can be inspected or restored.
+func (s *Storage) DeletePolicy(ctx context.Context, id string, version int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM policies WHERE id = ? AND version = ?", id, version)
 	if err != nil {
 		return fmt.Errorf("failed to delete policy: %w", err)
 	}
@@ -233,10 +704,87 @@ func (s *Storage) DeletePolicy(ctx context.Context, id string) error {
 	}
 
 	if rows == 0 {
-		return fmt.Errorf("policy not found: %s", id)
+		exists, err := s.policyExists(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrVersionConflict
+		}
+		return fmt.Errorf("%w: %s", ErrPolicyNotFound, id)
 	}
 
-	return nil
+	return tx.Commit()
+}
+
+// ListPolicyRevisions retrieves all revisions of a policy, oldest first
+func (s *Storage) ListPolicyRevisions(ctx context.Context, id string) ([]PolicyRevision, error) {
+	query := `
+	SELECT policy_id, revision, created_at, policy
+	FROM policy_revisions WHERE policy_id = ? ORDER BY revision ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policy revisions: %w", err)
+	}
+	defer rows.Close()
+
+	var revisions []PolicyRevision
+	for rows.Next() {
+		var rev PolicyRevision
+		var policyJSON string
+
+		if err := rows.Scan(&rev.PolicyID, &rev.Revision, &rev.CreatedAt, &policyJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan policy revision: %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(policyJSON), &rev.Policy); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal policy revision: %w", err)
+		}
+		if err := s.openTunnels(rev.Policy.Tunnels); err != nil {
+			return nil, fmt.Errorf("policy %s revision %d: %w", rev.PolicyID, rev.Revision, err)
+		}
+
+		revisions = append(revisions, rev)
+	}
+
+	if len(revisions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPolicyNotFound, id)
+	}
+
+	return revisions, nil
+}
+
+// GetPolicyRevision retrieves a single revision of a policy
+func (s *Storage) GetPolicyRevision(ctx context.Context, id string, revision int) (*PolicyRevision, error) {
+	query := `
+	SELECT policy_id, revision, created_at, policy
+	FROM policy_revisions WHERE policy_id = ? AND revision = ?
+	`
+
+	var rev PolicyRevision
+	var policyJSON string
+
+	err := s.db.QueryRowContext(ctx, query, id, revision).Scan(
+		&rev.PolicyID, &rev.Revision, &rev.CreatedAt, &policyJSON,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("policy revision not found: %s@%d", id, revision)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get policy revision: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(policyJSON), &rev.Policy); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal policy revision: %w", err)
+	}
+	if err := s.openTunnels(rev.Policy.Tunnels); err != nil {
+		return nil, fmt.Errorf("policy %s revision %d: %w", rev.PolicyID, rev.Revision, err)
+	}
+
+	return &rev, nil
 }
 
 // RegisterPeer registers or updates a peer
@@ -260,9 +808,14 @@ func (s *Storage) RegisterPeer(ctx context.Context, peer *PeerInfo) error {
 		return fmt.Errorf("failed to marshal metadata: %w", err)
 	}
 
+	addressesJSON, err := json.Marshal(peer.Addresses)
+	if err != nil {
+		return fmt.Errorf("failed to marshal addresses: %w", err)
+	}
+
 	query := `
-	INSERT INTO peers (id, hostname, platform, ip_address, version, tags, last_seen_at, registered_at, metadata, status)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO peers (id, hostname, platform, ip_address, version, tags, last_seen_at, registered_at, metadata, status, addresses)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(id) DO UPDATE SET
 		hostname = excluded.hostname,
 		platform = excluded.platform,
@@ -271,12 +824,14 @@ func (s *Storage) RegisterPeer(ctx context.Context, peer *PeerInfo) error {
 		tags = excluded.tags,
 		last_seen_at = excluded.last_seen_at,
 		metadata = excluded.metadata,
-		status = excluded.status
+		status = excluded.status,
+		addresses = excluded.addresses
 	`
 
 	_, err = s.db.ExecContext(ctx, query,
 		peer.ID, peer.Hostname, peer.Platform, peer.IPAddress, peer.Version,
 		string(tagsJSON), peer.LastSeenAt, peer.RegisteredAt, string(metadataJSON), peer.Status,
+		string(addressesJSON),
 	)
 
 	if err != nil {
@@ -289,16 +844,16 @@ func (s *Storage) RegisterPeer(ctx context.Context, peer *PeerInfo) error {
 // GetPeer retrieves a peer by ID
 func (s *Storage) GetPeer(ctx context.Context, id string) (*PeerInfo, error) {
 	query := `
-	SELECT id, hostname, platform, ip_address, version, tags, last_seen_at, registered_at, metadata, status
+	SELECT id, hostname, platform, ip_address, version, tags, last_seen_at, registered_at, metadata, status, addresses
 	FROM peers WHERE id = ?
 	`
 
 	var peer PeerInfo
-	var tagsJSON, metadataJSON string
+	var tagsJSON, metadataJSON, addressesJSON string
 
 	err := s.db.QueryRowContext(ctx, query, id).Scan(
 		&peer.ID, &peer.Hostname, &peer.Platform, &peer.IPAddress, &peer.Version,
-		&tagsJSON, &peer.LastSeenAt, &peer.RegisteredAt, &metadataJSON, &peer.Status,
+		&tagsJSON, &peer.LastSeenAt, &peer.RegisteredAt, &metadataJSON, &peer.Status, &addressesJSON,
 	)
 
 	if err == sql.ErrNoRows {
@@ -316,13 +871,20 @@ func (s *Storage) GetPeer(ctx context.Context, id string) (*PeerInfo, error) {
 		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
 	}
 
+	// Peers registered before addresses were reported hold ''
+	if addressesJSON != "" {
+		if err := json.Unmarshal([]byte(addressesJSON), &peer.Addresses); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal addresses: %w", err)
+		}
+	}
+
 	return &peer, nil
 }
 
 // ListPeers retrieves all peers
 func (s *Storage) ListPeers(ctx context.Context) ([]PeerInfo, error) {
 	query := `
-	SELECT id, hostname, platform, ip_address, version, tags, last_seen_at, registered_at, metadata, status
+	SELECT id, hostname, platform, ip_address, version, tags, last_seen_at, registered_at, metadata, status, addresses
 	FROM peers ORDER BY last_seen_at DESC
 	`
 
@@ -335,11 +897,11 @@ func (s *Storage) ListPeers(ctx context.Context) ([]PeerInfo, error) {
 	var peers []PeerInfo
 	for rows.Next() {
 		var peer PeerInfo
-		var tagsJSON, metadataJSON string
+		var tagsJSON, metadataJSON, addressesJSON string
 
 		err := rows.Scan(
 			&peer.ID, &peer.Hostname, &peer.Platform, &peer.IPAddress, &peer.Version,
-			&tagsJSON, &peer.LastSeenAt, &peer.RegisteredAt, &metadataJSON, &peer.Status,
+			&tagsJSON, &peer.LastSeenAt, &peer.RegisteredAt, &metadataJSON, &peer.Status, &addressesJSON,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan peer: %w", err)
@@ -353,6 +915,12 @@ func (s *Storage) ListPeers(ctx context.Context) ([]PeerInfo, error) {
 			return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
 		}
 
+		if addressesJSON != "" {
+			if err := json.Unmarshal([]byte(addressesJSON), &peer.Addresses); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal addresses: %w", err)
+			}
+		}
+
 		peers = append(peers, peer)
 	}
 
@@ -368,25 +936,1035 @@ func (s *Storage) UpdatePeerStatus(ctx context.Context, id string, status PeerSt
 	return err
 }
 
-// AuditLog logs an audit event
-func (s *Storage) AuditLog(ctx context.Context, action, resourceType, resourceID, userID, ipAddress string, details interface{}) error {
-	detailsJSON, err := json.Marshal(details)
+// ScheduleStates returns the schedule state last recorded for each policy
+func (s *Storage) ScheduleStates(ctx context.Context) (map[string]ScheduleState, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT policy_id, state FROM policy_schedule")
 	if err != nil {
-		return fmt.Errorf("failed to marshal details: %w", err)
+		return nil, fmt.Errorf("failed to list schedule states: %w", err)
 	}
+	defer rows.Close()
 
-	query := `
-	INSERT INTO audit_log (timestamp, action, resource_type, resource_id, user_id, details, ip_address)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
-	`
-
-	_, err = s.db.ExecContext(ctx, query,
-		time.Now(), action, resourceType, resourceID, userID, string(detailsJSON), ipAddress,
-	)
+	states := make(map[string]ScheduleState)
+	for rows.Next() {
+		var id, state string
+		if err := rows.Scan(&id, &state); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule state: %w", err)
+		}
+		states[id] = ScheduleState(state)
+	}
+	return states, rows.Err()
+}
 
+// SetScheduleState records the schedule state of a policy
+func (s *Storage) SetScheduleState(ctx context.Context, id string, state ScheduleState) error {
+	_, err := s.db.ExecContext(ctx, `
+	INSERT INTO policy_schedule (policy_id, state, changed_at) VALUES (?, ?, ?)
+	ON CONFLICT(policy_id) DO UPDATE SET state = excluded.state, changed_at = excluded.changed_at
+	`, id, string(state), time.Now())
 	if err != nil {
-		return fmt.Errorf("failed to log audit event: %w", err)
+		return fmt.Errorf("failed to save schedule state: %w", err)
 	}
+	return nil
+}
 
+// DeleteScheduleState forgets the schedule state of a policy
+func (s *Storage) DeleteScheduleState(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM policy_schedule WHERE policy_id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete schedule state: %w", err)
+	}
 	return nil
 }
+
+// SaveRollout creates or updates a rollout
+func (s *Storage) SaveRollout(ctx context.Context, rollout *Rollout) error {
+	if rollout.ID == "" {
+		rollout.ID = uuid.New().String()
+	}
+	if rollout.CreatedAt.IsZero() {
+		rollout.CreatedAt = time.Now()
+	}
+	rollout.UpdatedAt = time.Now()
+
+	baseline, err := s.sealPolicy(&rollout.Baseline)
+	if err != nil {
+		return err
+	}
+	baselineJSON, err := json.Marshal(baseline)
+	if err != nil {
+		return fmt.Errorf("failed to marshal baseline: %w", err)
+	}
+
+	strategyJSON, err := json.Marshal(rollout.Strategy)
+	if err != nil {
+		return fmt.Errorf("failed to marshal strategy: %w", err)
+	}
+
+	wavesJSON, err := json.Marshal(rollout.Waves)
+	if err != nil {
+		return fmt.Errorf("failed to marshal waves: %w", err)
+	}
+
+	query := `
+	INSERT INTO rollouts (id, policy_id, state, from_version, to_version, baseline, strategy, waves, current_wave, message, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		state = excluded.state,
+		waves = excluded.waves,
+		current_wave = excluded.current_wave,
+		message = excluded.message,
+		updated_at = excluded.updated_at
+	`
+
+	_, err = s.db.ExecContext(ctx, query,
+		rollout.ID, rollout.PolicyID, string(rollout.State), rollout.FromVersion, rollout.ToVersion,
+		string(baselineJSON), string(strategyJSON), string(wavesJSON),
+		rollout.CurrentWave, rollout.Message, rollout.CreatedAt, rollout.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save rollout: %w", err)
+	}
+
+	return nil
+}
+
+const rolloutColumns = `id, policy_id, state, from_version, to_version, baseline, strategy, waves, current_wave, message, created_at, updated_at`
+
+// GetRollout retrieves a rollout by ID
+func (s *Storage) GetRollout(ctx context.Context, id string) (*Rollout, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+rolloutColumns+" FROM rollouts WHERE id = ?", id)
+
+	rollout, err := s.scanRollout(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrRolloutNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rollout, nil
+}
+
+// ListRollouts retrieves rollouts, newest first, optionally only those of one
+// policy or only active ones
+func (s *Storage) ListRollouts(ctx context.Context, policyID string, activeOnly bool) ([]Rollout, error) {
+	query := "SELECT " + rolloutColumns + " FROM rollouts WHERE 1 = 1"
+	var args []interface{}
+
+	if policyID != "" {
+		query += " AND policy_id = ?"
+		args = append(args, policyID)
+	}
+	if activeOnly {
+		query += " AND state IN (?, ?)"
+		args = append(args, string(RolloutRunning), string(RolloutPaused))
+	}
+
+	query += " ORDER BY created_at DESC"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rollouts: %w", err)
+	}
+	defer rows.Close()
+
+	rollouts := []Rollout{}
+	for rows.Next() {
+		rollout, err := s.scanRollout(rows)
+		if err != nil {
+			return nil, err
+		}
+		rollouts = append(rollouts, *rollout)
+	}
+
+	return rollouts, rows.Err()
+}
+
+// scanRollout reads a rollout selected with rolloutColumns
+func (s *Storage) scanRollout(row interface{ Scan(...interface{}) error }) (*Rollout, error) {
+	var rollout Rollout
+	var state, baselineJSON, strategyJSON, wavesJSON string
+
+	err := row.Scan(
+		&rollout.ID, &rollout.PolicyID, &state, &rollout.FromVersion, &rollout.ToVersion,
+		&baselineJSON, &strategyJSON, &wavesJSON,
+		&rollout.CurrentWave, &rollout.Message, &rollout.CreatedAt, &rollout.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan rollout: %w", err)
+	}
+	rollout.State = RolloutState(state)
+
+	if err := json.Unmarshal([]byte(baselineJSON), &rollout.Baseline); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal baseline: %w", err)
+	}
+	if err := s.openTunnels(rollout.Baseline.Tunnels); err != nil {
+		return nil, fmt.Errorf("rollout %s baseline: %w", rollout.ID, err)
+	}
+
+	if err := json.Unmarshal([]byte(strategyJSON), &rollout.Strategy); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal strategy: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(wavesJSON), &rollout.Waves); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal waves: %w", err)
+	}
+
+	return &rollout, nil
+}
+
+// SavePeerReport stores the latest report of a peer, replacing the previous one
+func (s *Storage) SavePeerReport(ctx context.Context, report *PeerReport) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal peer report: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+	INSERT INTO peer_reports (peer_id, reported_at, report) VALUES (?, ?, ?)
+	ON CONFLICT(peer_id) DO UPDATE SET reported_at = excluded.reported_at, report = excluded.report
+	`, report.PeerID, report.ReportedAt, string(reportJSON))
+	if err != nil {
+		return fmt.Errorf("failed to save peer report: %w", err)
+	}
+
+	return nil
+}
+
+// ListPeerReports returns the latest report of every peer, keyed by peer ID
+func (s *Storage) ListPeerReports(ctx context.Context) (map[string]*PeerReport, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT report FROM peer_reports")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peer reports: %w", err)
+	}
+	defer rows.Close()
+
+	reports := make(map[string]*PeerReport)
+	for rows.Next() {
+		var reportJSON string
+		if err := rows.Scan(&reportJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan peer report: %w", err)
+		}
+
+		var report PeerReport
+		if err := json.Unmarshal([]byte(reportJSON), &report); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal peer report: %w", err)
+		}
+		reports[report.PeerID] = &report
+	}
+
+	return reports, rows.Err()
+}
+
+// SaveRotation creates or updates a PSK rotation
+func (s *Storage) SaveRotation(ctx context.Context, rotation *PSKRotation) error {
+	if rotation.ID == "" {
+		rotation.ID = uuid.New().String()
+	}
+	if rotation.CreatedAt.IsZero() {
+		rotation.CreatedAt = time.Now()
+	}
+	rotation.UpdatedAt = time.Now()
+
+	rotationJSON, err := json.Marshal(rotation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rotation: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+	INSERT INTO psk_rotations (id, state, rotation, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET state = excluded.state, rotation = excluded.rotation, updated_at = excluded.updated_at
+	`, rotation.ID, string(rotation.State), string(rotationJSON), rotation.CreatedAt, rotation.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save rotation: %w", err)
+	}
+
+	return nil
+}
+
+// GetRotation retrieves a PSK rotation by ID
+func (s *Storage) GetRotation(ctx context.Context, id string) (*PSKRotation, error) {
+	var rotationJSON string
+	err := s.db.QueryRowContext(ctx, "SELECT rotation FROM psk_rotations WHERE id = ?", id).Scan(&rotationJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrRotationNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rotation: %w", err)
+	}
+
+	var rotation PSKRotation
+	if err := json.Unmarshal([]byte(rotationJSON), &rotation); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rotation: %w", err)
+	}
+	return &rotation, nil
+}
+
+// ListRotations retrieves PSK rotations, newest first, optionally only those
+// including a tunnel of one policy or only active ones
+func (s *Storage) ListRotations(ctx context.Context, policyID string, activeOnly bool) ([]PSKRotation, error) {
+	query := "SELECT rotation FROM psk_rotations"
+	var args []interface{}
+	if activeOnly {
+		query += " WHERE state IN (?, ?, ?)"
+		args = append(args, string(RotationStaging), string(RotationSwitching), string(RotationFinishing))
+	}
+	query += " ORDER BY created_at DESC"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rotations: %w", err)
+	}
+	defer rows.Close()
+
+	rotations := []PSKRotation{}
+	for rows.Next() {
+		var rotationJSON string
+		if err := rows.Scan(&rotationJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan rotation: %w", err)
+		}
+		var rotation PSKRotation
+		if err := json.Unmarshal([]byte(rotationJSON), &rotation); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal rotation: %w", err)
+		}
+		if policyID != "" && !rotation.Includes(policyID, "") {
+			continue
+		}
+		rotations = append(rotations, rotation)
+	}
+
+	return rotations, rows.Err()
+}
+
+// SaveTopology saves or updates a topology. Like SavePolicy, it only
+// succeeds if Topology.Version still holds the stored version (0 for a new
+// topology), returns ErrVersionConflict otherwise, and sets Topology.Version
+// to the new version on success.
+func (s *Storage) SaveTopology(ctx context.Context, topology *Topology) error {
+	if topology.ID == "" {
+		topology.ID = uuid.New().String()
+	}
+	topology.UpdatedAt = time.Now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	expected := topology.Version
+	if expected == 0 {
+		topology.CreatedAt = topology.UpdatedAt
+	} else {
+		err := tx.QueryRowContext(ctx, "SELECT created_at FROM topologies WHERE id = ?", topology.ID).Scan(&topology.CreatedAt)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: %s", ErrTopologyNotFound, topology.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read topology: %w", err)
+		}
+	}
+
+	// The stored JSON carries the version it is saved as
+	stored := *topology
+	stored.Version = expected + 1
+	if s.keys != nil {
+		if stored.Auth.Secret, err = s.keys.Seal(topology.Auth.Secret); err != nil {
+			return fmt.Errorf("topology %s: %w", topology.ID, err)
+		}
+	}
+	topologyJSON, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal topology: %w", err)
+	}
+
+	var result sql.Result
+	if expected == 0 {
+		result, err = tx.ExecContext(ctx, `
+		INSERT INTO topologies (id, name, version, enabled, topology, created_at, updated_at)
+		VALUES (?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT(id) DO NOTHING
+		`, topology.ID, topology.Name, topology.Enabled, string(topologyJSON), topology.CreatedAt, topology.UpdatedAt)
+	} else {
+		result, err = tx.ExecContext(ctx, `
+		UPDATE topologies SET name = ?, version = version + 1, enabled = ?, topology = ?, updated_at = ?
+		WHERE id = ? AND version = ?
+		`, topology.Name, topology.Enabled, string(topologyJSON), topology.UpdatedAt, topology.ID, expected)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save topology: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return ErrVersionConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit topology: %w", err)
+	}
+	topology.Version = expected + 1
+	return nil
+}
+
+// topologyExists reports whether a topology with the given ID is stored
+func (s *Storage) topologyExists(ctx context.Context, tx *sql.Tx, id string) (bool, error) {
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM topologies WHERE id = ?", id).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check topology: %w", err)
+	}
+	return count > 0, nil
+}
+
+// GetTopology retrieves a topology by ID
+func (s *Storage) GetTopology(ctx context.Context, id string) (*Topology, error) {
+	var topologyJSON string
+	err := s.db.QueryRowContext(ctx, "SELECT topology FROM topologies WHERE id = ?", id).Scan(&topologyJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrTopologyNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topology: %w", err)
+	}
+
+	var topology Topology
+	if err := json.Unmarshal([]byte(topologyJSON), &topology); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal topology: %w", err)
+	}
+	if topology.Auth.Secret, err = s.keys.Open(topology.Auth.Secret); err != nil {
+		return nil, fmt.Errorf("topology %s: %w", topology.ID, err)
+	}
+	return &topology, nil
+}
+
+// ListTopologies retrieves topologies ordered by name, optionally only the
+// enabled ones
+func (s *Storage) ListTopologies(ctx context.Context, enabledOnly bool) ([]Topology, error) {
+	query := "SELECT topology FROM topologies"
+	if enabledOnly {
+		query += " WHERE enabled = 1"
+	}
+	query += " ORDER BY name, id"
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topologies: %w", err)
+	}
+	defer rows.Close()
+
+	topologies := []Topology{}
+	for rows.Next() {
+		var topologyJSON string
+		if err := rows.Scan(&topologyJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan topology: %w", err)
+		}
+		var topology Topology
+		if err := json.Unmarshal([]byte(topologyJSON), &topology); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal topology: %w", err)
+		}
+		if topology.Auth.Secret, err = s.keys.Open(topology.Auth.Secret); err != nil {
+			return nil, fmt.Errorf("topology %s: %w", topology.ID, err)
+		}
+		topologies = append(topologies, topology)
+	}
+
+	return topologies, rows.Err()
+}
+
+// DeleteTopology deletes a topology by ID if it is still at the given version
+func (s *Storage) DeleteTopology(ctx context.Context, id string, version int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM topologies WHERE id = ? AND version = ?", id, version)
+	if err != nil {
+		return fmt.Errorf("failed to delete topology: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rows == 0 {
+		exists, err := s.topologyExists(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrVersionConflict
+		}
+		return fmt.Errorf("%w: %s", ErrTopologyNotFound, id)
+	}
+
+	return tx.Commit()
+}
+
+// SaveSecret saves or updates a secret store entry. Like SavePolicy, it only
+// succeeds if StoredSecret.Version still holds the stored version (0 for a
+// new entry), returns ErrVersionConflict otherwise, and sets
+// StoredSecret.Version to the new version on success.
+func (s *Storage) SaveSecret(ctx context.Context, entry *StoredSecret) error {
+	entry.UpdatedAt = time.Now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	expected := entry.Version
+	if expected == 0 {
+		entry.CreatedAt = entry.UpdatedAt
+	} else {
+		err := tx.QueryRowContext(ctx, "SELECT created_at FROM secrets WHERE name = ?", entry.Name).Scan(&entry.CreatedAt)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: %s", ErrSecretNotFound, entry.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read secret: %w", err)
+		}
+	}
+
+	stored := *entry
+	stored.Version = expected + 1
+	if s.keys != nil {
+		if stored.Secret, err = s.keys.Seal(entry.Secret); err != nil {
+			return fmt.Errorf("secret %s: %w", entry.Name, err)
+		}
+	}
+	entryJSON, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal secret: %w", err)
+	}
+
+	var result sql.Result
+	if expected == 0 {
+		result, err = tx.ExecContext(ctx, `
+		INSERT INTO secrets (name, version, secret, created_at, updated_at)
+		VALUES (?, 1, ?, ?, ?)
+		ON CONFLICT(name) DO NOTHING
+		`, entry.Name, string(entryJSON), entry.CreatedAt, entry.UpdatedAt)
+	} else {
+		result, err = tx.ExecContext(ctx, `
+		UPDATE secrets SET version = version + 1, secret = ?, updated_at = ?
+		WHERE name = ? AND version = ?
+		`, string(entryJSON), entry.UpdatedAt, entry.Name, expected)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save secret: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return ErrVersionConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit secret: %w", err)
+	}
+	entry.Version = expected + 1
+	return nil
+}
+
+// GetSecret retrieves a secret store entry, with its secret, by name
+func (s *Storage) GetSecret(ctx context.Context, name string) (*StoredSecret, error) {
+	var entryJSON string
+	err := s.db.QueryRowContext(ctx, "SELECT secret FROM secrets WHERE name = ?", name).Scan(&entryJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	var entry StoredSecret
+	if err := json.Unmarshal([]byte(entryJSON), &entry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal secret: %w", err)
+	}
+	if entry.Secret, err = s.keys.Open(entry.Secret); err != nil {
+		return nil, fmt.Errorf("secret %s: %w", name, err)
+	}
+	return &entry, nil
+}
+
+// ListSecrets retrieves the secret store entries ordered by name, without
+// their secrets
+func (s *Storage) ListSecrets(ctx context.Context) ([]StoredSecret, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT secret FROM secrets ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []StoredSecret{}
+	for rows.Next() {
+		var entryJSON string
+		if err := rows.Scan(&entryJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan secret: %w", err)
+		}
+		var entry StoredSecret
+		if err := json.Unmarshal([]byte(entryJSON), &entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal secret: %w", err)
+		}
+		entry.Secret = ""
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// DeleteSecret deletes a secret store entry if it is still at the given
+// version
+func (s *Storage) DeleteSecret(ctx context.Context, name string, version int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM secrets WHERE name = ? AND version = ?", name, version)
+	if err != nil {
+		return fmt.Errorf("failed to delete secret: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rows == 0 {
+		var count int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM secrets WHERE name = ?", name).Scan(&count); err != nil {
+			return fmt.Errorf("failed to check secret: %w", err)
+		}
+		if count > 0 {
+			return ErrVersionConflict
+		}
+		return fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+
+	return tx.Commit()
+}
+
+// InitCA stores the built-in CA unless one is stored already, and returns
+// the stored one, so that servers sharing a database agree on their CA
+func (s *Storage) InitCA(ctx context.Context, pair *CAKeyPair) (*CAKeyPair, error) {
+	stored := *pair
+	if s.keys != nil {
+		var err error
+		if stored.Key, err = s.keys.Seal(pair.Key); err != nil {
+			return nil, fmt.Errorf("CA key: %w", err)
+		}
+	}
+	pairJSON, err := json.Marshal(stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal CA: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+	INSERT INTO certificate_authority (id, authority, created_at) VALUES (1, ?, ?)
+	ON CONFLICT(id) DO NOTHING
+	`, string(pairJSON), pair.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save CA: %w", err)
+	}
+
+	return s.GetCA(ctx)
+}
+
+// GetCA retrieves the built-in CA, with its key
+func (s *Storage) GetCA(ctx context.Context) (*CAKeyPair, error) {
+	var pairJSON string
+	err := s.db.QueryRowContext(ctx, "SELECT authority FROM certificate_authority WHERE id = 1").Scan(&pairJSON)
+	if err == sql.ErrNoRows {
+		return nil, ErrCANotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CA: %w", err)
+	}
+
+	var pair CAKeyPair
+	if err := json.Unmarshal([]byte(pairJSON), &pair); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal CA: %w", err)
+	}
+	if pair.Key, err = s.keys.Open(pair.Key); err != nil {
+		return nil, fmt.Errorf("CA key: %w", err)
+	}
+	return &pair, nil
+}
+
+// SaveCertificate records a certificate the CA issued. The chain is not
+// stored.
+func (s *Storage) SaveCertificate(ctx context.Context, cert *IssuedCertificate) error {
+	stored := *cert
+	stored.Chain = ""
+	certJSON, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certificate: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+	INSERT INTO certificates (serial, peer_id, not_after, revoked_at, certificate) VALUES (?, ?, ?, ?, ?)
+	`, cert.Serial, cert.PeerID, cert.NotAfter, cert.RevokedAt, string(certJSON))
+	if err != nil {
+		return fmt.Errorf("failed to save certificate: %w", err)
+	}
+
+	return nil
+}
+
+// GetCertificate retrieves an issued certificate by serial
+func (s *Storage) GetCertificate(ctx context.Context, serial string) (*IssuedCertificate, error) {
+	var certJSON string
+	err := s.db.QueryRowContext(ctx, "SELECT certificate FROM certificates WHERE serial = ?", serial).Scan(&certJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrCertificateNotFound, serial)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate: %w", err)
+	}
+
+	var cert IssuedCertificate
+	if err := json.Unmarshal([]byte(certJSON), &cert); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// ListCertificates retrieves issued certificates, latest expiry first,
+// optionally only those of one peer
+func (s *Storage) ListCertificates(ctx context.Context, peerID string) ([]IssuedCertificate, error) {
+	query := "SELECT certificate FROM certificates"
+	var args []interface{}
+	if peerID != "" {
+		query += " WHERE peer_id = ?"
+		args = append(args, peerID)
+	}
+	query += " ORDER BY not_after DESC"
+
+	return s.queryCertificates(ctx, query, args...)
+}
+
+// ListRevokedCertificates retrieves the revoked certificates that have not
+// expired by now, which are the ones a CRL lists
+func (s *Storage) ListRevokedCertificates(ctx context.Context, now time.Time) ([]IssuedCertificate, error) {
+	return s.queryCertificates(ctx, `
+	SELECT certificate FROM certificates
+	WHERE revoked_at IS NOT NULL AND not_after > ?
+	ORDER BY revoked_at
+	`, now)
+}
+
+func (s *Storage) queryCertificates(ctx context.Context, query string, args ...interface{}) ([]IssuedCertificate, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+	defer rows.Close()
+
+	certs := []IssuedCertificate{}
+	for rows.Next() {
+		var certJSON string
+		if err := rows.Scan(&certJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan certificate: %w", err)
+		}
+		var cert IssuedCertificate
+		if err := json.Unmarshal([]byte(certJSON), &cert); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, rows.Err()
+}
+
+// RevokeCertificate marks an issued certificate as revoked and returns it.
+// Revoking a revoked certificate keeps its first revocation.
+func (s *Storage) RevokeCertificate(ctx context.Context, serial, reason string, at time.Time) (*IssuedCertificate, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var certJSON string
+	err = tx.QueryRowContext(ctx, "SELECT certificate FROM certificates WHERE serial = ?", serial).Scan(&certJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrCertificateNotFound, serial)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate: %w", err)
+	}
+
+	var cert IssuedCertificate
+	if err := json.Unmarshal([]byte(certJSON), &cert); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal certificate: %w", err)
+	}
+	if cert.RevokedAt != nil {
+		return &cert, nil
+	}
+
+	cert.RevokedAt = &at
+	cert.RevocationReason = reason
+	updated, err := json.Marshal(cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal certificate: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE certificates SET revoked_at = ?, certificate = ? WHERE serial = ?",
+		at, string(updated), serial); err != nil {
+		return nil, fmt.Errorf("failed to revoke certificate: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// AuditLog logs an audit event
+func (s *Storage) AuditLog(ctx context.Context, action, resourceType, resourceID, userID, ipAddress string, details interface{}) error {
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to marshal details: %w", err)
+	}
+
+	query := `
+	INSERT INTO audit_log (timestamp, action, resource_type, resource_id, user_id, details, ip_address)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	_, err = s.db.ExecContext(ctx, query,
+		time.Now(), action, resourceType, resourceID, userID, string(detailsJSON), ipAddress,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to log audit event: %w", err)
+	}
+
+	return nil
+}
+
+// sealTunnels returns a copy of tunnels with their secrets sealed for storage
+func (s *Storage) sealTunnels(tunnels []ipsec.TunnelConfig) ([]ipsec.TunnelConfig, error) {
+	if s.keys == nil {
+		return tunnels, nil
+	}
+	return mapTunnelSecrets(tunnels, s.keys.Seal)
+}
+
+// sealPolicy returns a copy of a policy with its secrets sealed for storage
+func (s *Storage) sealPolicy(policy *Policy) (*Policy, error) {
+	tunnels, err := s.sealTunnels(policy.Tunnels)
+	if err != nil {
+		return nil, err
+	}
+	sealed := *policy
+	sealed.Tunnels = tunnels
+	return &sealed, nil
+}
+
+// openTunnels decrypts the secrets of stored tunnels in place
+func (s *Storage) openTunnels(tunnels []ipsec.TunnelConfig) error {
+	for i := range tunnels {
+		for _, secret := range []*string{&tunnels[i].Auth.Secret, &tunnels[i].Auth.StandbySecret} {
+			opened, err := s.keys.Open(*secret)
+			if err != nil {
+				return fmt.Errorf("tunnel %s: %w", tunnels[i].Name, err)
+			}
+			*secret = opened
+		}
+	}
+	return nil
+}
+
+// mapTunnelSecrets returns a copy of tunnels with fn applied to each secret,
+// the standby secret of a rotation included
+func mapTunnelSecrets(tunnels []ipsec.TunnelConfig, fn func(string) (string, error)) ([]ipsec.TunnelConfig, error) {
+	if tunnels == nil {
+		return nil, nil
+	}
+	mapped := make([]ipsec.TunnelConfig, len(tunnels))
+	for i, tunnel := range tunnels {
+		for _, secret := range []*string{&tunnel.Auth.Secret, &tunnel.Auth.StandbySecret} {
+			value, err := fn(*secret)
+			if err != nil {
+				return nil, fmt.Errorf("tunnel %s: %w", tunnel.Name, err)
+			}
+			*secret = value
+		}
+		mapped[i] = tunnel
+	}
+	return mapped, nil
+}
+
+// secretColumns lists the JSON columns that hold secrets, with how to apply
+// a function to the secrets in one stored value
+var secretColumns = []struct {
+	table, column string
+	mapSecrets    func(data string, fn func(string) (string, error)) (interface{}, error)
+}{
+	{"certificate_authority", "authority", func(data string, fn func(string) (string, error)) (interface{}, error) {
+		var pair CAKeyPair
+		if err := json.Unmarshal([]byte(data), &pair); err != nil {
+			return nil, err
+		}
+		key, err := fn(pair.Key)
+		pair.Key = key
+		return pair, err
+	}},
+	{"policies", "tunnels", func(data string, fn func(string) (string, error)) (interface{}, error) {
+		var tunnels []ipsec.TunnelConfig
+		if err := json.Unmarshal([]byte(data), &tunnels); err != nil {
+			return nil, err
+		}
+		return mapTunnelSecrets(tunnels, fn)
+	}},
+	{"policy_revisions", "policy", mapPolicySecrets},
+	{"rollouts", "baseline", mapPolicySecrets},
+	{"secrets", "secret", func(data string, fn func(string) (string, error)) (interface{}, error) {
+		var entry StoredSecret
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, err
+		}
+		secret, err := fn(entry.Secret)
+		entry.Secret = secret
+		return entry, err
+	}},
+	{"topologies", "topology", func(data string, fn func(string) (string, error)) (interface{}, error) {
+		var topology Topology
+		if err := json.Unmarshal([]byte(data), &topology); err != nil {
+			return nil, err
+		}
+		secret, err := fn(topology.Auth.Secret)
+		topology.Auth.Secret = secret
+		return topology, err
+	}},
+}
+
+func mapPolicySecrets(data string, fn func(string) (string, error)) (interface{}, error) {
+	var policy Policy
+	if err := json.Unmarshal([]byte(data), &policy); err != nil {
+		return nil, err
+	}
+	tunnels, err := mapTunnelSecrets(policy.Tunnels, fn)
+	policy.Tunnels = tunnels
+	return policy, err
+}
+
+// resealSecrets applies fn to every stored secret and rewrites the rows
+// where that changed a secret, in one transaction. It returns the number of
+// rows rewritten per table. If any were, the database is vacuumed afterwards,
+// so that no page still holds the old values.
+func (s *Storage) resealSecrets(ctx context.Context, fn func(string) (string, error)) (map[string]int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rewritten := make(map[string]int)
+	total := 0
+	for _, col := range secretColumns {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT rowid, %s FROM %s", col.column, col.table))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", col.table, err)
+		}
+
+		updates := make(map[int64]string)
+		for rows.Next() {
+			var rowID int64
+			var data string
+			if err := rows.Scan(&rowID, &data); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan %s: %w", col.table, err)
+			}
+
+			changed := false
+			track := func(secret string) (string, error) {
+				mapped, err := fn(secret)
+				if mapped != secret {
+					changed = true
+				}
+				return mapped, err
+			}
+			value, err := col.mapSecrets(data, track)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("%s row %d: %w", col.table, rowID, err)
+			}
+			if !changed {
+				continue
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("%s row %d: %w", col.table, rowID, err)
+			}
+			updates[rowID] = string(encoded)
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read %s: %w", col.table, err)
+		}
+		rows.Close()
+
+		for rowID, data := range updates {
+			query := fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", col.table, col.column)
+			if _, err := tx.ExecContext(ctx, query, data, rowID); err != nil {
+				return nil, fmt.Errorf("failed to update %s: %w", col.table, err)
+			}
+		}
+		rewritten[col.table] = len(updates)
+		total += len(updates)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	if total > 0 {
+		if _, err := s.db.ExecContext(ctx, "VACUUM"); err != nil {
+			return rewritten, fmt.Errorf("failed to vacuum database: %w", err)
+		}
+	}
+	return rewritten, nil
+}
+
+// MasterKeyID returns the ID of the master key new secrets are encrypted
+// with, or "" if secrets are stored in plaintext
+func (s *Storage) MasterKeyID() string {
+	if s.keys == nil {
+		return ""
+	}
+	return s.keys.CurrentKeyID()
+}
+
+// RotateKeys re-encrypts every stored secret that is not yet under the
+// keyring's current master key, and secrets stored in plaintext, and returns
+// the number of rows rewritten per table. Afterwards only the current key is
+// needed to read the database.
+func (s *Storage) RotateKeys(ctx context.Context) (map[string]int, error) {
+	if s.keys == nil {
+		return nil, errors.New("no master key is configured")
+	}
+
+	current := s.keys.CurrentKeyID()
+	return s.resealSecrets(ctx, func(secret string) (string, error) {
+		if secret == "" || SealedKeyID(secret) == current {
+			return secret, nil
+		}
+		return s.keys.Rewrap(secret)
+	})
+}
@@ -0,0 +1,280 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// newTestStorage opens a storage on a scratch database with a master key
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	keyText, err := GenerateMasterKey("test")
+	if err != nil {
+		t.Fatalf("GenerateMasterKey: %v", err)
+	}
+	keys, err := ParseKeyring(keyText)
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	storage, err := NewStorage(filepath.Join(t.TempDir(), "ipsec.db"), keys)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestSavePolicyVersions(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+
+	pol := &Policy{ID: "p", Name: "p", Tunnels: []ipsec.TunnelConfig{pskTunnel("a", "secret")}}
+	if err := storage.SavePolicy(ctx, pol); err != nil {
+		t.Fatalf("SavePolicy: %v", err)
+	}
+	if pol.Version != 1 {
+		t.Fatalf("new policy has version %d, want 1", pol.Version)
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		version int
+		is      error
+		want    int // Version after a successful save
+	}{
+		{name: "current version", id: "p", version: 1, want: 2},
+		{name: "stale version", id: "p", version: 1, is: ErrVersionConflict},
+		{name: "future version", id: "p", version: 5, is: ErrVersionConflict},
+		{name: "next version", id: "p", version: 2, want: 3},
+		{name: "create over an existing ID", id: "p", version: 0, is: ErrVersionConflict},
+		{name: "update a missing policy", id: "none", version: 1, is: ErrPolicyNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := &Policy{ID: tt.id, Name: tt.id, Version: tt.version, Description: tt.name}
+			err := storage.SavePolicy(ctx, update)
+			if tt.is != nil {
+				if !errors.Is(err, tt.is) {
+					t.Fatalf("SavePolicy error = %v, want %v", err, tt.is)
+				}
+				if update.Version != tt.version {
+					t.Errorf("failed save changed the version to %d", update.Version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SavePolicy: %v", err)
+			}
+			if update.Version != tt.want {
+				t.Errorf("saved version %d, want %d", update.Version, tt.want)
+			}
+
+			stored, err := storage.GetPolicy(ctx, tt.id)
+			if err != nil {
+				t.Fatalf("GetPolicy: %v", err)
+			}
+			if stored.Version != tt.want || stored.Description != tt.name {
+				t.Errorf("stored policy is at version %d with %q, want %d with %q", stored.Version, stored.Description, tt.want, tt.name)
+			}
+		})
+	}
+}
+
+func TestSavePoliciesAllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+
+	existing := &Policy{ID: "a", Name: "a"}
+	if err := storage.SavePolicy(ctx, existing); err != nil {
+		t.Fatalf("SavePolicy: %v", err)
+	}
+
+	batch := []*Policy{
+		{ID: "a", Name: "a", Version: 1, Description: "changed"},
+		{ID: "b", Name: "b"},
+		{ID: "c", Name: "c", Version: 3},
+	}
+	if err := storage.SavePolicies(ctx, batch); !errors.Is(err, ErrPolicyNotFound) {
+		t.Fatalf("SavePolicies error = %v, want %v", err, ErrPolicyNotFound)
+	}
+	for i, want := range []int{1, 0, 3} {
+		if batch[i].Version != want {
+			t.Errorf("policy %s has version %d after the failed batch, want %d", batch[i].ID, batch[i].Version, want)
+		}
+	}
+	if stored, err := storage.GetPolicy(ctx, "a"); err != nil || stored.Version != 1 || stored.Description != "" {
+		t.Errorf("policy a after the failed batch: %+v, %v", stored, err)
+	}
+	if _, err := storage.GetPolicy(ctx, "b"); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("policy b after the failed batch: %v, want not found", err)
+	}
+
+	batch[2] = &Policy{ID: "c", Name: "c"}
+	if err := storage.SavePolicies(ctx, batch); err != nil {
+		t.Fatalf("SavePolicies: %v", err)
+	}
+	for i, want := range []int{2, 1, 1} {
+		if batch[i].Version != want {
+			t.Errorf("policy %s has version %d, want %d", batch[i].ID, batch[i].Version, want)
+		}
+	}
+}
+
+func TestDeletePolicyVersion(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+
+	pol := &Policy{ID: "p", Name: "p"}
+	if err := storage.SavePolicy(ctx, pol); err != nil {
+		t.Fatalf("SavePolicy: %v", err)
+	}
+
+	if err := storage.DeletePolicy(ctx, "p", 2); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("DeletePolicy at a stale version: %v, want %v", err, ErrVersionConflict)
+	}
+	if err := storage.DeletePolicy(ctx, "p", 1); err != nil {
+		t.Fatalf("DeletePolicy: %v", err)
+	}
+	if err := storage.DeletePolicy(ctx, "p", 1); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("DeletePolicy twice: %v, want %v", err, ErrPolicyNotFound)
+	}
+}
+
+func TestSaveTopologyVersions(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+
+	topology := &Topology{ID: "mesh", Name: "mesh", Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: "secret"}}
+	if err := storage.SaveTopology(ctx, topology); err != nil || topology.Version != 1 {
+		t.Fatalf("SaveTopology: version %d, %v", topology.Version, err)
+	}
+
+	stale := *topology
+	topology.Name = "renamed"
+	if err := storage.SaveTopology(ctx, topology); err != nil || topology.Version != 2 {
+		t.Fatalf("SaveTopology: version %d, %v", topology.Version, err)
+	}
+	if err := storage.SaveTopology(ctx, &stale); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("SaveTopology at a stale version: %v, want %v", err, ErrVersionConflict)
+	}
+	if err := storage.SaveTopology(ctx, &Topology{ID: "none", Version: 1}); !errors.Is(err, ErrTopologyNotFound) {
+		t.Errorf("SaveTopology of a missing topology: %v, want %v", err, ErrTopologyNotFound)
+	}
+
+	stored, err := storage.GetTopology(ctx, "mesh")
+	if err != nil {
+		t.Fatalf("GetTopology: %v", err)
+	}
+	if stored.Version != 2 || stored.Name != "renamed" || stored.Auth.Secret != "secret" {
+		t.Errorf("stored topology: version %d, name %q, secret %q", stored.Version, stored.Name, stored.Auth.Secret)
+	}
+
+	if err := storage.DeleteTopology(ctx, "mesh", 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("DeleteTopology at a stale version: %v, want %v", err, ErrVersionConflict)
+	}
+	if err := storage.DeleteTopology(ctx, "mesh", 2); err != nil {
+		t.Fatalf("DeleteTopology: %v", err)
+	}
+	if err := storage.DeleteTopology(ctx, "mesh", 2); !errors.Is(err, ErrTopologyNotFound) {
+		t.Errorf("DeleteTopology twice: %v, want %v", err, ErrTopologyNotFound)
+	}
+}
+
+func TestSaveSecretVersions(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+
+	entry := &StoredSecret{Name: "lab", Secret: "first"}
+	if err := storage.SaveSecret(ctx, entry); err != nil || entry.Version != 1 {
+		t.Fatalf("SaveSecret: version %d, %v", entry.Version, err)
+	}
+	if err := storage.SaveSecret(ctx, &StoredSecret{Name: "lab", Secret: "again"}); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("SaveSecret of an existing name as new: %v, want %v", err, ErrVersionConflict)
+	}
+
+	entry.Secret = "second"
+	if err := storage.SaveSecret(ctx, entry); err != nil || entry.Version != 2 {
+		t.Fatalf("SaveSecret: version %d, %v", entry.Version, err)
+	}
+	if err := storage.SaveSecret(ctx, &StoredSecret{Name: "lab", Secret: "stale", Version: 1}); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("SaveSecret at a stale version: %v, want %v", err, ErrVersionConflict)
+	}
+	if err := storage.SaveSecret(ctx, &StoredSecret{Name: "none", Version: 1}); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("SaveSecret of a missing entry: %v, want %v", err, ErrSecretNotFound)
+	}
+
+	stored, err := storage.GetSecret(ctx, "lab")
+	if err != nil {
+		t.Fatalf("GetSecret: %v", err)
+	}
+	if stored.Version != 2 || stored.Secret != "second" {
+		t.Errorf("stored secret: version %d, secret %q", stored.Version, stored.Secret)
+	}
+
+	if err := storage.DeleteSecret(ctx, "lab", 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("DeleteSecret at a stale version: %v, want %v", err, ErrVersionConflict)
+	}
+	if err := storage.DeleteSecret(ctx, "lab", 2); err != nil {
+		t.Fatalf("DeleteSecret: %v", err)
+	}
+	if err := storage.DeleteSecret(ctx, "lab", 2); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("DeleteSecret twice: %v, want %v", err, ErrSecretNotFound)
+	}
+}
+
+func TestMigratePolicyDurations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "ipsec.db")
+	storage, err := NewStorage(path, nil)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	if err := storage.SavePolicy(ctx, &Policy{ID: "p", Name: "p"}); err != nil {
+		t.Fatalf("SavePolicy: %v", err)
+	}
+
+	// A policy as schema version 1 stored it, with nanosecond durations
+	legacy := `[{"name":"a","mode":"esp-tunnel","crypto":{"lifetime":3600000000000,"child":{"lifetime":1800000000000}},` +
+		`"auth":{"type":"certificate"},"traffic_selectors":null,"dpd":{"delay":30000000000,"action":"restart"},"autostart":false}]`
+	if _, err := storage.db.Exec("UPDATE policies SET tunnels = ?, schema_version = 1 WHERE id = 'p'", legacy); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = NewStorage(path, nil)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	defer storage.Close()
+
+	var tunnels string
+	var schemaVersion, version int
+	err = storage.db.QueryRow("SELECT tunnels, schema_version, version FROM policies WHERE id = 'p'").Scan(&tunnels, &schemaVersion, &version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schemaVersion != CurrentSchemaVersion || version != 1 {
+		t.Errorf("migrated policy is at schema version %d, version %d, want %d and 1", schemaVersion, version, CurrentSchemaVersion)
+	}
+	for _, want := range []string{`"lifetime":"1h0m0s"`, `"child":{"lifetime":"30m0s"}`, `"delay":"30s"`} {
+		if !strings.Contains(tunnels, want) {
+			t.Errorf("migrated tunnels %s do not contain %s", tunnels, want)
+		}
+	}
+
+	pol, err := storage.GetPolicy(ctx, "p")
+	if err != nil {
+		t.Fatalf("GetPolicy: %v", err)
+	}
+	if pol.Tunnels[0].Crypto.Lifetime != time.Hour || pol.Tunnels[0].DPD.Delay != 30*time.Second {
+		t.Errorf("migrated tunnel %+v", pol.Tunnels[0])
+	}
+}
@@ -0,0 +1,174 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// Tunnel fields may contain Go templates that are resolved per peer when an
+// agent fetches its policies, e.g. "{{ .Peer.IPAddress }}" or
+// "{{ .Peer.Metadata.lan_cidr }}". Only the endpoint, identity and traffic
+// selector subnet fields are templated.
+
+// TemplateData is the data available to tunnel field templates
+type TemplateData struct {
+	Peer *PeerInfo
+}
+
+// TemplateError describes a tunnel field that could not be resolved for a
+// peer: a template, or the secret_ref of the tunnel's PSK
+type TemplateError struct {
+	PolicyID string `json:"policy_id"`
+	Tunnel   string `json:"tunnel"`
+	Field    string `json:"field"`
+	Message  string `json:"message"`
+}
+
+func (e TemplateError) Error() string {
+	return fmt.Sprintf("policy %s, tunnel %s, %s: %s", e.PolicyID, e.Tunnel, e.Field, e.Message)
+}
+
+// TemplateErrors is the list of fields that could not be resolved for a peer
+type TemplateErrors []TemplateError
+
+func (e TemplateErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "unresolved tunnel fields: " + strings.Join(msgs, "; ")
+}
+
+// IsTemplate reports whether a field value contains a template action
+func IsTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// PoliciesForPeer returns the policies that apply to a peer with all tunnel
+// templates resolved for it. If any field cannot be resolved, the returned
+// error is a TemplateErrors listing every failure.
+func (e *PolicyEngine) PoliciesForPeer(policies []Policy, peer *PeerInfo) ([]Policy, error) {
+	return resolveForPeer(e.FilterPoliciesForPeer(policies, peer), peer)
+}
+
+// resolveForPeer resolves the tunnel templates of policies already known to
+// apply to a peer
+func resolveForPeer(applicable []Policy, peer *PeerInfo) ([]Policy, error) {
+	data := TemplateData{Peer: peer}
+
+	var errs TemplateErrors
+	resolved := make([]Policy, 0, len(applicable))
+	for _, policy := range applicable {
+		tunnels := make([]ipsec.TunnelConfig, len(policy.Tunnels))
+		for i, tunnel := range policy.Tunnels {
+			var tunnelErrs TemplateErrors
+			tunnels[i], tunnelErrs = resolveTunnel(tunnel, data)
+			for _, err := range tunnelErrs {
+				err.PolicyID = policy.ID
+				errs = append(errs, err)
+			}
+		}
+		policy.Tunnels = tunnels
+		resolved = append(resolved, policy)
+	}
+
+	if len(errs) > 0 {
+		return resolved, errs
+	}
+	return resolved, nil
+}
+
+// templateField is a tunnel field that may hold a template
+type templateField struct {
+	path  string
+	value *string
+}
+
+// templateFields returns the templated fields of a tunnel, keyed by JSON path
+func templateFields(tunnel *ipsec.TunnelConfig) []templateField {
+	fields := []templateField{
+		{"local_address", &tunnel.LocalAddress},
+		{"remote_address", &tunnel.RemoteAddress},
+		{"local_id", &tunnel.LocalID},
+		{"remote_id", &tunnel.RemoteID},
+	}
+	for i := range tunnel.TrafficSelectors {
+		ts := &tunnel.TrafficSelectors[i]
+		fields = append(fields,
+			templateField{fmt.Sprintf("traffic_selectors[%d].local_subnet", i), &ts.LocalSubnet},
+			templateField{fmt.Sprintf("traffic_selectors[%d].remote_subnet", i), &ts.RemoteSubnet},
+		)
+	}
+	return fields
+}
+
+// resolveTunnel renders every templated field of a tunnel for a peer. The
+// tunnel is copied, so the caller's traffic selectors are left untouched.
+func resolveTunnel(tunnel ipsec.TunnelConfig, data TemplateData) (ipsec.TunnelConfig, TemplateErrors) {
+	var errs TemplateErrors
+
+	selectors := make([]ipsec.TrafficSelector, len(tunnel.TrafficSelectors))
+	copy(selectors, tunnel.TrafficSelectors)
+	tunnel.TrafficSelectors = selectors
+
+	for _, field := range templateFields(&tunnel) {
+		if !IsTemplate(*field.value) {
+			continue
+		}
+
+		out, err := renderField(field.path, *field.value, data, "missingkey=error")
+		if err == nil && out == "" {
+			err = fmt.Errorf("template resolved to an empty value")
+		}
+		if err != nil {
+			errs = append(errs, TemplateError{Tunnel: tunnel.Name, Field: field.path, Message: err.Error()})
+			continue
+		}
+		*field.value = out
+	}
+
+	return tunnel, errs
+}
+
+func renderField(name, text string, data TemplateData, missingKey string) (string, error) {
+	tmpl, err := template.New(name).Option(missingKey).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// TemplateValidator checks tunnel field templates when a policy is saved. It
+// catches syntax errors and references to fields PeerInfo does not have;
+// metadata keys can only be checked per peer, when the policy is served.
+type TemplateValidator struct{}
+
+func (v *TemplateValidator) Validate(policy *Policy) []Finding {
+	var findings []Finding
+	sample := TemplateData{Peer: &PeerInfo{}}
+
+	for i := range policy.Tunnels {
+		tunnel := policy.Tunnels[i]
+		for _, field := range templateFields(&tunnel) {
+			if !IsTemplate(*field.value) {
+				continue
+			}
+			// Missing metadata keys render empty here instead of failing
+			if _, err := renderField(field.path, *field.value, sample, "missingkey=zero"); err != nil {
+				findings = append(findings, errorFinding(tunnelPath(i, field.path), "template.invalid",
+					"invalid template: %v", err))
+			}
+		}
+	}
+
+	return findings
+}
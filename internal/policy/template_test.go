@@ -0,0 +1,170 @@
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// templateTunnel returns a tunnel with every templated field set
+func templateTunnel(local, localID, subnet string) ipsec.TunnelConfig {
+	return ipsec.TunnelConfig{
+		Name:          "to-hq",
+		Mode:          ipsec.ModeESPTunnel,
+		LocalAddress:  local,
+		RemoteAddress: "198.51.100.1",
+		LocalID:       localID,
+		RemoteID:      "hq.example.com",
+		TrafficSelectors: []ipsec.TrafficSelector{
+			{LocalSubnet: subnet, RemoteSubnet: "10.0.0.0/16"},
+		},
+	}
+}
+
+func TestPoliciesForPeer(t *testing.T) {
+	peer := &PeerInfo{
+		ID:        "peer-1",
+		Hostname:  "branch-1.example.com",
+		IPAddress: "192.0.2.1",
+		Tags:      []string{"branch"},
+		Metadata:  map[string]string{"lan_cidr": "10.1.0.0/24"},
+	}
+	engine := NewPolicyEngine()
+
+	tests := []struct {
+		name   string
+		tunnel ipsec.TunnelConfig
+		want   ipsec.TunnelConfig
+		errors []string // "policy tunnel field"
+	}{
+		{
+			name:   "literal values",
+			tunnel: templateTunnel("192.0.2.1", "branch", "10.1.0.0/24"),
+			want:   templateTunnel("192.0.2.1", "branch", "10.1.0.0/24"),
+		},
+		{
+			name:   "peer fields",
+			tunnel: templateTunnel("{{ .Peer.IPAddress }}", "{{.Peer.Hostname}}", "{{ .Peer.Metadata.lan_cidr }}"),
+			want:   templateTunnel("192.0.2.1", "branch-1.example.com", "10.1.0.0/24"),
+		},
+		{
+			name:   "inside other text",
+			tunnel: templateTunnel("{{ .Peer.IPAddress }}", "@{{ .Peer.ID }}.vpn", "10.1.0.0/24"),
+			want:   templateTunnel("192.0.2.1", "@peer-1.vpn", "10.1.0.0/24"),
+		},
+		{
+			name:   "missing metadata key",
+			tunnel: templateTunnel("{{ .Peer.IPAddress }}", "branch", "{{ .Peer.Metadata.wan_cidr }}"),
+			errors: []string{"p to-hq traffic_selectors[0].local_subnet"},
+		},
+		{
+			name:   "empty value",
+			tunnel: templateTunnel("{{ .Peer.Platform }}", "{{ .Peer.Version }}", "10.1.0.0/24"),
+			errors: []string{"p to-hq local_address", "p to-hq local_id"},
+		},
+		{
+			name:   "unknown field",
+			tunnel: templateTunnel("{{ .Peer.Address }}", "branch", "10.1.0.0/24"),
+			errors: []string{"p to-hq local_address"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies := []Policy{
+				{ID: "p", Name: "p", Enabled: true, AppliesTo: []string{"branch"}, Tunnels: []ipsec.TunnelConfig{tt.tunnel}},
+				{ID: "other", Name: "other", Enabled: true, AppliesTo: []string{"lab"}, Tunnels: []ipsec.TunnelConfig{tt.tunnel}},
+			}
+			resolved, err := engine.PoliciesForPeer(policies, peer)
+
+			if tt.errors != nil {
+				var errs TemplateErrors
+				if !errors.As(err, &errs) {
+					t.Fatalf("PoliciesForPeer error = %v, want TemplateErrors", err)
+				}
+				var got []string
+				for _, e := range errs {
+					got = append(got, e.PolicyID+" "+e.Tunnel+" "+e.Field)
+				}
+				if !reflect.DeepEqual(got, tt.errors) {
+					t.Errorf("got errors %q, want %q", got, tt.errors)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("PoliciesForPeer: %v", err)
+			}
+			if len(resolved) != 1 || resolved[0].ID != "p" {
+				t.Fatalf("got %d policies, want p only", len(resolved))
+			}
+			if !reflect.DeepEqual(resolved[0].Tunnels[0], tt.want) {
+				t.Errorf("resolved %+v, want %+v", resolved[0].Tunnels[0], tt.want)
+			}
+			// The stored policy keeps its templates
+			if !reflect.DeepEqual(policies[0].Tunnels[0], tt.tunnel) {
+				t.Error("PoliciesForPeer changed the stored tunnel")
+			}
+		})
+	}
+}
+
+func TestTemplateValidator(t *testing.T) {
+	tests := []struct {
+		name     string
+		tunnel   ipsec.TunnelConfig
+		findings []string // "path code"
+	}{
+		{name: "literal values", tunnel: templateTunnel("192.0.2.1", "branch", "10.1.0.0/24")},
+		{
+			name:   "known fields",
+			tunnel: templateTunnel("{{ .Peer.IPAddress }}", "{{ .Peer.Hostname }}", "{{ .Peer.Metadata.lan_cidr }}"),
+		},
+		{
+			// Metadata keys are only known per peer
+			name:   "any metadata key",
+			tunnel: templateTunnel("{{ .Peer.IPAddress }}", "branch", "{{ index .Peer.Metadata \"lan cidr\" }}"),
+		},
+		{
+			name:     "unknown field",
+			tunnel:   templateTunnel("{{ .Peer.Address }}", "branch", "10.1.0.0/24"),
+			findings: []string{"tunnels[0].local_address template.invalid"},
+		},
+		{
+			name:     "unknown variable",
+			tunnel:   templateTunnel("192.0.2.1", "{{ .Site.Name }}", "10.1.0.0/24"),
+			findings: []string{"tunnels[0].local_id template.invalid"},
+		},
+		{
+			name:     "syntax error",
+			tunnel:   templateTunnel("192.0.2.1", "branch", "{{ .Peer.Metadata.lan_cidr }"),
+			findings: []string{"tunnels[0].traffic_selectors[0].local_subnet template.invalid"},
+		},
+		{
+			name:     "unknown function",
+			tunnel:   templateTunnel("{{ lookup .Peer.ID }}", "branch", "10.1.0.0/24"),
+			findings: []string{"tunnels[0].local_address template.invalid"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := (&TemplateValidator{}).Validate(&Policy{Tunnels: []ipsec.TunnelConfig{tt.tunnel}})
+			if got := findingCodes(findings); !reflect.DeepEqual(got, tt.findings) {
+				t.Errorf("got findings %q, want %q", got, tt.findings)
+			}
+			for _, f := range findings {
+				if f.Severity != SeverityError || !strings.HasPrefix(f.Message, "invalid template: ") {
+					t.Errorf("finding %+v", f)
+				}
+			}
+		})
+	}
+
+	if IsTemplate("10.1.0.0/24") || !IsTemplate("{{ .Peer.ID }}") {
+		t.Error("IsTemplate misreports")
+	}
+}
@@ -0,0 +1,489 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// A topology generates the tunnels between a group of peers instead of
+// listing them by hand. Peers take part by matching the topology's
+// selectors, and each peer's subnets come from one of its metadata keys.
+// Expanding a topology against the registered peers yields one generated
+// policy per participating peer holding that peer's side of each link; the
+// peer at the other end gets the mirror image. The server expands topologies
+// whenever an agent fetches its policies, so peers joining, leaving, or
+// changing their tags or subnets are picked up on the agents' next sync.
+
+// TopologyMode decides which participating peers are linked
+type TopologyMode string
+
+const (
+	TopologyHubSpoke TopologyMode = "hub-spoke" // Every spoke to every hub
+	TopologyMesh     TopologyMode = "mesh"      // Every member to every other member
+	TopologyPartial  TopologyMode = "partial"   // Only the pairs matched by Links
+)
+
+// DefaultSubnetKey is the metadata key holding a peer's subnets when a
+// topology does not name one
+const DefaultSubnetKey = "subnets"
+
+// topologyPolicyPrefix starts the ID of every policy generated from a topology
+const topologyPolicyPrefix = "topology:"
+
+// TopologyLink connects every peer matching From with every peer matching To
+type TopologyLink struct {
+	From string `json:"from" yaml:"from"` // Selector
+	To   string `json:"to" yaml:"to"`     // Selector
+}
+
+// Topology describes the tunnels between a group of peers
+type Topology struct {
+	ID          string             `json:"id" yaml:"id"`
+	Name        string             `json:"name" yaml:"name"`
+	Description string             `json:"description,omitempty" yaml:"description,omitempty"`
+	Version     int                `json:"version,omitzero" yaml:"version,omitempty"` // Server-assigned
+	CreatedAt   time.Time          `json:"created_at,omitzero" yaml:"created_at,omitempty"`
+	UpdatedAt   time.Time          `json:"updated_at,omitzero" yaml:"updated_at,omitempty"`
+	Enabled     bool               `json:"enabled" yaml:"enabled"`
+	Mode        TopologyMode       `json:"mode" yaml:"mode"`
+	Members     []string           `json:"members,omitempty" yaml:"members,omitempty"`       // Selectors; the spokes in hub-spoke mode, optional in partial mode
+	Hubs        []string           `json:"hubs,omitempty" yaml:"hubs,omitempty"`             // Selectors, hub-spoke mode only
+	Links       []TopologyLink     `json:"links,omitempty" yaml:"links,omitempty"`           // Partial mode only
+	SubnetKey   string             `json:"subnet_key,omitempty" yaml:"subnet_key,omitempty"` // Metadata key with a peer's comma-separated subnets; "subnets" when empty
+	IPsecMode   ipsec.IPsecMode    `json:"ipsec_mode,omitempty" yaml:"ipsec_mode,omitempty"` // esp-tunnel when empty
+	Crypto      ipsec.CryptoConfig `json:"crypto" yaml:"crypto"`
+	Auth        ipsec.AuthConfig   `json:"auth" yaml:"auth"`
+	DPD         ipsec.DPDConfig    `json:"dpd" yaml:"dpd"`
+	AutoStart   bool               `json:"autostart" yaml:"autostart"`
+	Priority    int                `json:"priority" yaml:"priority"`
+	Compliance  string             `json:"compliance,omitempty" yaml:"compliance,omitempty"` // Compliance profile; server default when empty
+}
+
+// PolicyID returns the ID of the policies generated from the topology
+func (t *Topology) PolicyID() string {
+	return topologyPolicyPrefix + t.ID
+}
+
+// IsTopologyPolicy reports whether a policy ID belongs to a generated policy
+func IsTopologyPolicy(id string) bool {
+	return strings.HasPrefix(id, topologyPolicyPrefix)
+}
+
+func (t *Topology) subnetKey() string {
+	if t.SubnetKey == "" {
+		return DefaultSubnetKey
+	}
+	return t.SubnetKey
+}
+
+func (t *Topology) ipsecMode() ipsec.IPsecMode {
+	if t.IPsecMode == "" {
+		return ipsec.ModeESPTunnel
+	}
+	return t.IPsecMode
+}
+
+// tunnel builds one generated tunnel from the topology's shared settings
+func (t *Topology) tunnel(name, local, remote string, selectors []ipsec.TrafficSelector) ipsec.TunnelConfig {
+	// Generated tunnels are not rotated; their PSK changes with the topology's
+	auth := t.Auth
+	auth.RotateEvery, auth.StandbySecret, auth.Rotation = "", "", ""
+	autoStart := t.AutoStart
+
+	return ipsec.TunnelConfig{
+		Name:             name,
+		Mode:             t.ipsecMode(),
+		LocalAddress:     local,
+		RemoteAddress:    remote,
+		Crypto:           t.Crypto,
+		Auth:             auth,
+		TrafficSelectors: selectors,
+		DPD:              t.DPD,
+		AutoStart:        &autoStart,
+	}
+}
+
+// TopologyProblem explains why a peer or a link was left out of an expansion
+type TopologyProblem struct {
+	PeerID       string `json:"peer_id"`
+	RemotePeerID string `json:"remote_peer_id,omitempty"` // Set for a link
+	Message      string `json:"message"`
+}
+
+// TopologyExpansion is a topology expanded against the registered peers
+type TopologyExpansion struct {
+	TopologyID string            `json:"topology_id"`
+	Version    int               `json:"version"`
+	Policies   map[string]Policy `json:"policies"` // Peer ID -> generated policy
+	Skipped    []TopologyProblem `json:"skipped,omitempty"`
+}
+
+// PolicyFor returns the policy generated for a peer, if the peer has any
+// links in the topology
+func (x *TopologyExpansion) PolicyFor(peerID string) (Policy, bool) {
+	pol, ok := x.Policies[peerID]
+	return pol, ok
+}
+
+// topologyNode is a participating peer with its parsed subnets
+type topologyNode struct {
+	peer    *PeerInfo
+	hub     bool
+	subnets []netip.Prefix
+}
+
+// ExpandTopology generates the tunnels of a topology for the given peers.
+// Peers are linked by the topology's mode; each link becomes a tunnel on
+// both peers, named after the topology and the peer at the other end, with a
+// traffic selector for every pair of same-family subnets. Peers without
+// usable subnets and links without a common address family are skipped and
+// reported. Disabled topologies expand to nothing.
+func ExpandTopology(t *Topology, peers []PeerInfo) *TopologyExpansion {
+	expansion := &TopologyExpansion{
+		TopologyID: t.ID,
+		Version:    t.Version,
+		Policies:   make(map[string]Policy),
+	}
+	if !t.Enabled {
+		return expansion
+	}
+
+	nodes := t.participants(peers, expansion)
+	tunnels := make(map[string][]ipsec.TunnelConfig)
+
+	for _, pair := range t.links(nodes) {
+		a, b := pair[0], pair[1]
+		problem := func(format string, args ...interface{}) {
+			expansion.Skipped = append(expansion.Skipped, TopologyProblem{
+				PeerID:       a.peer.ID,
+				RemotePeerID: b.peer.ID,
+				Message:      fmt.Sprintf(format, args...),
+			})
+		}
+
+		localAddr, remoteAddr, ok := linkEndpoints(a.peer, b.peer)
+		if !ok {
+			problem("peers have no addresses of a common family")
+			continue
+		}
+
+		var forward, reverse []ipsec.TrafficSelector
+		for _, local := range a.subnets {
+			for _, remote := range b.subnets {
+				if prefixFamily(local) != prefixFamily(remote) {
+					continue
+				}
+				forward = append(forward, ipsec.TrafficSelector{LocalSubnet: local.String(), RemoteSubnet: remote.String()})
+				reverse = append(reverse, ipsec.TrafficSelector{LocalSubnet: remote.String(), RemoteSubnet: local.String()})
+			}
+		}
+		if len(forward) == 0 {
+			problem("peers have no subnets of a common family")
+			continue
+		}
+
+		tunnels[a.peer.ID] = append(tunnels[a.peer.ID],
+			t.tunnel(topologyTunnelName(t, b.peer), localAddr.String(), remoteAddr.String(), forward))
+		tunnels[b.peer.ID] = append(tunnels[b.peer.ID],
+			t.tunnel(topologyTunnelName(t, a.peer), remoteAddr.String(), localAddr.String(), reverse))
+	}
+
+	for peerID, peerTunnels := range tunnels {
+		sort.Slice(peerTunnels, func(i, j int) bool {
+			return peerTunnels[i].Name < peerTunnels[j].Name
+		})
+		expansion.Policies[peerID] = Policy{
+			ID:            t.PolicyID(),
+			Name:          t.Name,
+			Description:   fmt.Sprintf("Generated from topology %s", t.Name),
+			Version:       t.Version,
+			SchemaVersion: CurrentSchemaVersion,
+			CreatedAt:     t.CreatedAt,
+			UpdatedAt:     t.UpdatedAt,
+			Enabled:       true,
+			Tunnels:       peerTunnels,
+			AppliesTo:     []string{SelectorExprPrefix + fmt.Sprintf("id=%q", peerID)},
+			Priority:      t.Priority,
+			Compliance:    t.Compliance,
+		}
+	}
+
+	return expansion
+}
+
+// participants returns the peers that take part in a topology, ordered by
+// ID, with their subnets parsed. Matching peers whose subnets are missing or
+// invalid are reported and left out.
+func (t *Topology) participants(peers []PeerInfo, expansion *TopologyExpansion) []*topologyNode {
+	var nodes []*topologyNode
+	key := t.subnetKey()
+
+	for i := range peers {
+		peer := &peers[i]
+
+		hub := false
+		member := matchesAny(t.Members, peer)
+		switch t.Mode {
+		case TopologyHubSpoke:
+			// A peer matching both is a hub
+			hub = matchesAny(t.Hubs, peer)
+		case TopologyPartial:
+			linked := false
+			for _, link := range t.Links {
+				if MatchesSelector(link.From, peer) || MatchesSelector(link.To, peer) {
+					linked = true
+					break
+				}
+			}
+			member = linked && (len(t.Members) == 0 || member)
+		}
+		if !hub && !member {
+			continue
+		}
+
+		subnets, err := metadataSubnets(peer, key)
+		if err != nil {
+			expansion.Skipped = append(expansion.Skipped, TopologyProblem{PeerID: peer.ID, Message: err.Error()})
+			continue
+		}
+		nodes = append(nodes, &topologyNode{peer: peer, hub: hub, subnets: subnets})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].peer.ID < nodes[j].peer.ID
+	})
+	return nodes
+}
+
+// links returns the pairs of participants to connect, each pair once
+func (t *Topology) links(nodes []*topologyNode) [][2]*topologyNode {
+	var pairs [][2]*topologyNode
+
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			var linked bool
+			switch t.Mode {
+			case TopologyMesh:
+				linked = true
+			case TopologyHubSpoke:
+				linked = a.hub != b.hub
+			case TopologyPartial:
+				for _, link := range t.Links {
+					if (MatchesSelector(link.From, a.peer) && MatchesSelector(link.To, b.peer)) ||
+						(MatchesSelector(link.From, b.peer) && MatchesSelector(link.To, a.peer)) {
+						linked = true
+						break
+					}
+				}
+			}
+			if linked {
+				pairs = append(pairs, [2]*topologyNode{a, b})
+			}
+		}
+	}
+	return pairs
+}
+
+func matchesAny(selectors []string, peer *PeerInfo) bool {
+	for _, expr := range selectors {
+		if MatchesSelector(expr, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataSubnets parses the comma-separated subnets a peer lists under a
+// metadata key
+func metadataSubnets(peer *PeerInfo, key string) ([]netip.Prefix, error) {
+	value := strings.TrimSpace(peer.Metadata[key])
+	if value == "" {
+		return nil, fmt.Errorf("peer has no subnets in metadata key %q", key)
+	}
+
+	var subnets []netip.Prefix
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		prefix, ok, err := parseSubnet(field)
+		if err != nil {
+			return nil, fmt.Errorf("metadata key %q: %v", key, err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("metadata key %q: templates are not allowed in subnets", key)
+		}
+		subnets = append(subnets, prefix)
+	}
+	return subnets, nil
+}
+
+// linkEndpoints picks the addresses two peers connect from: their primary
+// addresses when these share a family, otherwise the first pair of reported
+// addresses of a common family, IPv4 first
+func linkEndpoints(a, b *PeerInfo) (netip.Addr, netip.Addr, bool) {
+	primaryA, errA := netip.ParseAddr(a.IPAddress)
+	primaryB, errB := netip.ParseAddr(b.IPAddress)
+	if errA == nil && errB == nil && addressFamily(primaryA) == addressFamily(primaryB) {
+		return primaryA, primaryB, true
+	}
+
+	for _, family := range []string{"IPv4", "IPv6"} {
+		addrA, okA := peerAddress(a, family)
+		addrB, okB := peerAddress(b, family)
+		if okA && okB {
+			return addrA, addrB, true
+		}
+	}
+	return netip.Addr{}, netip.Addr{}, false
+}
+
+// peerAddress returns the first address of a family a peer reported
+func peerAddress(peer *PeerInfo, family string) (netip.Addr, bool) {
+	for _, s := range append([]string{peer.IPAddress}, peer.Addresses...) {
+		addr, err := netip.ParseAddr(s)
+		if err == nil && addressFamily(addr) == family {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// topologyTunnelName names the tunnel towards a remote peer after the
+// topology and the peer's ID, keeping only characters every backend accepts
+func topologyTunnelName(t *Topology, remote *PeerInfo) string {
+	sanitize := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+				return r
+			case r >= 'A' && r <= 'Z':
+				return r + ('a' - 'A')
+			}
+			return '-'
+		}, s)
+	}
+	return sanitize(t.Name) + "-" + sanitize(remote.ID)
+}
+
+// WithTopologies adds the policies generated for a peer by each topology to
+// the peer's policies
+func WithTopologies(policies []Policy, topologies []Topology, peers []PeerInfo, peerID string) []Policy {
+	result := append([]Policy(nil), policies...)
+	for i := range topologies {
+		if pol, ok := ExpandTopology(&topologies[i], peers).PolicyFor(peerID); ok {
+			result = append(result, pol)
+		}
+	}
+	return result
+}
+
+// Example topology tunnel endpoints and subnets, from the documentation
+// ranges, used to check a topology's shared tunnel settings
+const (
+	sampleLocalAddress  = "192.0.2.1"
+	sampleRemoteAddress = "192.0.2.2"
+	sampleLocalSubnet   = "198.51.100.0/24"
+	sampleRemoteSubnet  = "203.0.113.0/24"
+)
+
+// topologyTunnelFields are the tunnel fields a topology sets itself, mapped
+// to the topology field they come from
+var topologyTunnelFields = map[string]string{
+	"mode":      "ipsec_mode",
+	"crypto":    "crypto",
+	"auth":      "auth",
+	"dpd":       "dpd",
+	"autostart": "autostart",
+}
+
+// CheckTopology validates a topology: its mode and selectors, and its shared
+// tunnel settings, which are run through every policy validator on a sample
+// tunnel. Findings about the sample's own endpoints and subnets are dropped;
+// those are checked per peer when the topology is expanded.
+func (e *PolicyEngine) CheckTopology(t *Topology) Findings {
+	var findings Findings
+
+	if t.Name == "" {
+		findings = append(findings, errorFinding("name", "basic.required", "topology name is required"))
+	}
+
+	selectors := func(field string, exprs []string) {
+		for i, expr := range exprs {
+			if _, err := ParseSelector(expr); err != nil {
+				findings = append(findings, errorFinding(fmt.Sprintf("%s[%d]", field, i), "selector.invalid",
+					"invalid selector %q: %v", expr, err))
+			}
+		}
+	}
+	selectors("members", t.Members)
+	selectors("hubs", t.Hubs)
+	for i, link := range t.Links {
+		selectors(fmt.Sprintf("links[%d].from", i), []string{link.From})
+		selectors(fmt.Sprintf("links[%d].to", i), []string{link.To})
+	}
+
+	switch t.Mode {
+	case TopologyMesh:
+		if len(t.Members) == 0 {
+			findings = append(findings, errorFinding("members", "basic.required", "mesh topology needs member selectors"))
+		}
+	case TopologyHubSpoke:
+		if len(t.Hubs) == 0 {
+			findings = append(findings, errorFinding("hubs", "basic.required", "hub-spoke topology needs hub selectors"))
+		}
+		if len(t.Members) == 0 {
+			findings = append(findings, errorFinding("members", "basic.required", "hub-spoke topology needs member (spoke) selectors"))
+		}
+	case TopologyPartial:
+		if len(t.Links) == 0 {
+			findings = append(findings, errorFinding("links", "basic.required", "partial topology needs links"))
+		}
+	default:
+		findings = append(findings, errorFinding("mode", "topology.mode",
+			"unknown topology mode %q (expected %s, %s or %s)", t.Mode, TopologyHubSpoke, TopologyMesh, TopologyPartial))
+	}
+	if t.Mode != TopologyHubSpoke && len(t.Hubs) > 0 {
+		findings = append(findings, warningFinding("hubs", "topology.unused", "hubs are only used in hub-spoke mode"))
+	}
+	if t.Mode != TopologyPartial && len(t.Links) > 0 {
+		findings = append(findings, warningFinding("links", "topology.unused", "links are only used in partial mode"))
+	}
+
+	sample := Policy{
+		Name:       t.Name,
+		Enabled:    true,
+		Compliance: t.Compliance,
+		Tunnels: []ipsec.TunnelConfig{t.tunnel("sample", sampleLocalAddress, sampleRemoteAddress,
+			[]ipsec.TrafficSelector{{LocalSubnet: sampleLocalSubnet, RemoteSubnet: sampleRemoteSubnet}})},
+	}
+	prefix := tunnelPath(0, "")
+	for _, finding := range e.Check(&sample) {
+		if finding.Path == "" {
+			findings = append(findings, finding)
+			continue
+		}
+		field, ok := strings.CutPrefix(finding.Path, prefix+".")
+		if !ok {
+			continue
+		}
+		head, rest, _ := strings.Cut(field, ".")
+		mapped, ok := topologyTunnelFields[head]
+		if !ok {
+			continue
+		}
+		if rest != "" {
+			mapped += "." + rest
+		}
+		finding.Path = mapped
+		findings = append(findings, finding)
+	}
+
+	return findings
+}
@@ -0,0 +1,292 @@
+package policy
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// topologyPeer returns a peer with an address, tags and subnets
+func topologyPeer(id, address, subnets string, tags ...string) PeerInfo {
+	return PeerInfo{ID: id, Hostname: id, IPAddress: address, Tags: tags, Metadata: map[string]string{"subnets": subnets}}
+}
+
+// topologyPeers is a fleet of two hubs and three branches
+func topologyPeers() []PeerInfo {
+	return []PeerInfo{
+		topologyPeer("hub-1", "192.0.2.1", "10.0.0.0/24", "hub"),
+		topologyPeer("hub-2", "192.0.2.2", "10.0.1.0/24", "hub"),
+		topologyPeer("branch-a", "198.51.100.1", "10.1.0.0/24,10.1.1.0/24", "branch"),
+		topologyPeer("branch-b", "198.51.100.2", "10.2.0.0/24", "branch"),
+		topologyPeer("Branch C", "198.51.100.3", "10.3.0.0/24", "branch", "lab"),
+	}
+}
+
+// expansionLinks lists the tunnels of an expansion as "peer tunnel"
+func expansionLinks(x *TopologyExpansion) []string {
+	var links []string
+	for peerID, pol := range x.Policies {
+		for _, tunnel := range pol.Tunnels {
+			links = append(links, peerID+" "+tunnel.Name)
+		}
+	}
+	sort.Strings(links)
+	return links
+}
+
+func TestExpandTopology(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology Topology
+		links    []string
+	}{
+		{
+			name:     "hub-spoke",
+			topology: Topology{Name: "wan", Mode: TopologyHubSpoke, Hubs: []string{"hub"}, Members: []string{"branch-a", "branch-b"}},
+			links: []string{
+				"branch-a wan-hub-1", "branch-a wan-hub-2",
+				"branch-b wan-hub-1", "branch-b wan-hub-2",
+				"hub-1 wan-branch-a", "hub-1 wan-branch-b",
+				"hub-2 wan-branch-a", "hub-2 wan-branch-b",
+			},
+		},
+		{
+			name:     "full mesh",
+			topology: Topology{Name: "Mesh", Mode: TopologyMesh, Members: []string{"branch"}},
+			links: []string{
+				"Branch C mesh-branch-a", "Branch C mesh-branch-b",
+				"branch-a mesh-branch-b", "branch-a mesh-branch-c",
+				"branch-b mesh-branch-a", "branch-b mesh-branch-c",
+			},
+		},
+		{
+			name: "partial mesh",
+			topology: Topology{Name: "lab", Mode: TopologyPartial, Links: []TopologyLink{
+				{From: "lab", To: "hub-1"},
+				{From: "branch-a", To: "branch-b"},
+			}},
+			links: []string{
+				"Branch C lab-hub-1", "branch-a lab-branch-b",
+				"branch-b lab-branch-a", "hub-1 lab-branch-c",
+			},
+		},
+		{
+			name: "partial mesh limited to members",
+			topology: Topology{Name: "lab", Mode: TopologyPartial, Members: []string{"branch"}, Links: []TopologyLink{
+				{From: "lab", To: "hub-1"},
+				{From: "branch-a", To: "branch-b"},
+			}},
+			links: []string{"branch-a lab-branch-b", "branch-b lab-branch-a"},
+		},
+		{
+			name:     "unknown member",
+			topology: Topology{Name: "mesh", Mode: TopologyMesh, Members: []string{"branch-a", "branch-z"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.topology.ID = "t1"
+			tt.topology.Enabled = true
+			expansion := ExpandTopology(&tt.topology, topologyPeers())
+			if got := expansionLinks(expansion); strings.Join(got, "\n") != strings.Join(tt.links, "\n") {
+				t.Errorf("got tunnels:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.links, "\n"))
+			}
+			for peerID, pol := range expansion.Policies {
+				if pol.ID != "topology:t1" || !IsTopologyPolicy(pol.ID) || pol.Name != tt.topology.Name || !pol.Enabled {
+					t.Errorf("policy for %s is %s %q, enabled %v", peerID, pol.ID, pol.Name, pol.Enabled)
+				}
+				if len(pol.AppliesTo) != 1 || !MatchesSelector(pol.AppliesTo[0], &PeerInfo{ID: peerID}) ||
+					MatchesSelector(pol.AppliesTo[0], &PeerInfo{ID: "other"}) {
+					t.Errorf("policy for %s applies to %v", peerID, pol.AppliesTo)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandTopologyMirrors(t *testing.T) {
+	autoStart := true
+	topology := &Topology{
+		ID:        "t1",
+		Name:      "wan",
+		Version:   4,
+		Enabled:   true,
+		Mode:      TopologyHubSpoke,
+		Hubs:      []string{"hub-1"},
+		Members:   []string{"branch-a"},
+		Crypto:    ipsec.CryptoConfig{Encryption: ipsec.EncryptionAES256GCM, DHGroup: ipsec.DHGroupECP256},
+		Auth:      ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: "topology-secret", RotateEvery: "720h"},
+		AutoStart: autoStart,
+		Priority:  5,
+	}
+	expansion := ExpandTopology(topology, topologyPeers())
+	if len(expansion.Policies) != 2 || expansion.Version != 4 {
+		t.Fatalf("expansion has %d policies at version %d, want 2 at 4", len(expansion.Policies), expansion.Version)
+	}
+
+	hub, _ := expansion.PolicyFor("hub-1")
+	branch, _ := expansion.PolicyFor("branch-a")
+	if len(hub.Tunnels) != 1 || len(branch.Tunnels) != 1 {
+		t.Fatalf("hub has %d tunnels and branch %d, want one each", len(hub.Tunnels), len(branch.Tunnels))
+	}
+	atHub, atBranch := hub.Tunnels[0], branch.Tunnels[0]
+
+	if atHub.Name != "wan-branch-a" || atBranch.Name != "wan-hub-1" {
+		t.Errorf("tunnel names %s and %s", atHub.Name, atBranch.Name)
+	}
+	if atHub.LocalAddress != "192.0.2.1" || atHub.RemoteAddress != "198.51.100.1" ||
+		atBranch.LocalAddress != "198.51.100.1" || atBranch.RemoteAddress != "192.0.2.1" {
+		t.Errorf("endpoints %s->%s and %s->%s", atHub.LocalAddress, atHub.RemoteAddress, atBranch.LocalAddress, atBranch.RemoteAddress)
+	}
+
+	// One selector per pair of subnets, mirrored on the other end
+	wantHub := []ipsec.TrafficSelector{
+		{LocalSubnet: "10.0.0.0/24", RemoteSubnet: "10.1.0.0/24"},
+		{LocalSubnet: "10.0.0.0/24", RemoteSubnet: "10.1.1.0/24"},
+	}
+	wantBranch := []ipsec.TrafficSelector{
+		{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.0.0.0/24"},
+		{LocalSubnet: "10.1.1.0/24", RemoteSubnet: "10.0.0.0/24"},
+	}
+	if !reflect.DeepEqual(atHub.TrafficSelectors, wantHub) || !reflect.DeepEqual(atBranch.TrafficSelectors, wantBranch) {
+		t.Errorf("selectors %+v and %+v, want %+v and %+v", atHub.TrafficSelectors, atBranch.TrafficSelectors, wantHub, wantBranch)
+	}
+
+	// Shared settings are copied, without rotation
+	for _, tunnel := range []ipsec.TunnelConfig{atHub, atBranch} {
+		if tunnel.Mode != ipsec.ModeESPTunnel || tunnel.Crypto.DHGroup != ipsec.DHGroupECP256 || !tunnel.AutoStartEnabled() {
+			t.Errorf("tunnel %s settings %+v", tunnel.Name, tunnel)
+		}
+		if tunnel.Auth.Secret != "topology-secret" || tunnel.Auth.RotateEvery != "" {
+			t.Errorf("tunnel %s auth %+v", tunnel.Name, tunnel.Auth)
+		}
+	}
+	if hub.Priority != 5 || hub.Version != 4 {
+		t.Errorf("hub policy priority %d, version %d", hub.Priority, hub.Version)
+	}
+
+	// Tunnels do not share the autostart setting
+	*atHub.AutoStart = false
+	if !atBranch.AutoStartEnabled() {
+		t.Error("changing one generated tunnel changed another")
+	}
+
+	topology.Enabled = false
+	if disabled := ExpandTopology(topology, topologyPeers()); len(disabled.Policies) != 0 {
+		t.Errorf("disabled topology expanded to %d policies", len(disabled.Policies))
+	}
+}
+
+func TestExpandTopologySkipped(t *testing.T) {
+	peers := []PeerInfo{
+		topologyPeer("v4", "192.0.2.1", "10.1.0.0/24"),
+		topologyPeer("v6", "2001:db8::1", "2001:db8:a::/64"),
+		topologyPeer("dual", "2001:db8::2", "10.3.0.0/24,2001:db8:c::/64"),
+		topologyPeer("none", "192.0.2.4", ""),
+		topologyPeer("bad", "192.0.2.5", "10.5.0.0/33"),
+		topologyPeer("templated", "192.0.2.6", "{{ .Peer.IPAddress }}/32"),
+	}
+	peers[2].Addresses = []string{"192.0.2.3", "2001:db8::2"}
+	for i := range peers {
+		peers[i].Tags = []string{"all"}
+	}
+
+	topology := &Topology{ID: "t1", Name: "mesh", Enabled: true, Mode: TopologyMesh, Members: []string{"all"}}
+	expansion := ExpandTopology(topology, peers)
+
+	// The dual-stack peer reaches each single-stack peer over its family
+	want := []string{
+		"mesh-v4: 192.0.2.3 -> 192.0.2.1",
+		"mesh-v6: 2001:db8::2 -> 2001:db8::1",
+	}
+	var got []string
+	dual, _ := expansion.PolicyFor("dual")
+	for _, tunnel := range dual.Tunnels {
+		got = append(got, tunnel.Name+": "+tunnel.LocalAddress+" -> "+tunnel.RemoteAddress)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got tunnels %q, want %q", got, want)
+	}
+
+	var skipped []string
+	for _, problem := range expansion.Skipped {
+		skipped = append(skipped, problem.PeerID+" "+problem.RemotePeerID+": "+problem.Message)
+	}
+	wantSkipped := []string{
+		`none : peer has no subnets in metadata key "subnets"`,
+		`bad : metadata key "subnets": `,
+		`templated : metadata key "subnets": templates are not allowed in subnets`,
+		"v4 v6: peers have no addresses of a common family",
+	}
+	if len(skipped) != len(wantSkipped) {
+		t.Fatalf("skipped %q, want %q", skipped, wantSkipped)
+	}
+	for i := range skipped {
+		if !strings.HasPrefix(skipped[i], wantSkipped[i]) {
+			t.Errorf("skipped %q, want %q", skipped[i], wantSkipped[i])
+		}
+	}
+}
+
+func TestCheckTopology(t *testing.T) {
+	engine := NewPolicyEngine()
+	valid := func() *Topology {
+		return &Topology{
+			Name:    "mesh",
+			Mode:    TopologyMesh,
+			Members: []string{"branch"},
+			Crypto: ipsec.CryptoConfig{
+				Encryption: ipsec.EncryptionAES256GCM,
+				Integrity:  ipsec.IntegritySHA256,
+				DHGroup:    ipsec.DHGroupECP256,
+				IKEVersion: ipsec.IKEv2,
+				Lifetime:   time.Hour,
+			},
+			Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: "topology-secret"},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		change   func(*Topology)
+		findings []string // "path code"
+	}{
+		{name: "valid", change: func(*Topology) {}},
+		{name: "invalid member", change: func(t *Topology) { t.Members = []string{"branch", "expr:tag =="} }, findings: []string{"members[1] selector.invalid"}},
+		{name: "unknown mode", change: func(t *Topology) { t.Mode = "ring" }, findings: []string{"mode topology.mode"}},
+		{name: "mesh without members", change: func(t *Topology) { t.Members = nil }, findings: []string{"members basic.required"}},
+		{name: "hub-spoke without hubs", change: func(t *Topology) { t.Mode = TopologyHubSpoke }, findings: []string{"hubs basic.required"}},
+		{
+			name:     "partial without links",
+			change:   func(t *Topology) { t.Mode = TopologyPartial; t.Links = nil },
+			findings: []string{"links basic.required"},
+		},
+		{
+			name:     "invalid link",
+			change:   func(t *Topology) { t.Mode = TopologyPartial; t.Links = []TopologyLink{{From: "a", To: "expr:("}} },
+			findings: []string{"links[0].to[0] selector.invalid"},
+		},
+		{name: "hubs outside hub-spoke", change: func(t *Topology) { t.Hubs = []string{"hub"} }, findings: []string{"hubs topology.unused"}},
+		{name: "missing name", change: func(t *Topology) { t.Name = "" }, findings: []string{"name basic.required"}},
+		{name: "short PSK", change: func(t *Topology) { t.Auth.Secret = "short" }, findings: []string{"auth.secret security.psk_too_short"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology := valid()
+			tt.change(topology)
+			var got []string
+			for _, f := range engine.CheckTopology(topology) {
+				got = append(got, f.Path+" "+f.Code)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.findings, "\n") {
+				t.Errorf("got findings %q, want %q", got, tt.findings)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity ranks how serious a validation finding is
+type Severity string
+
+const (
+	SeverityError   Severity = "error"   // Blocks the save
+	SeverityWarning Severity = "warning" // Blocks the save only in strict mode
+	SeverityInfo    Severity = "info"    // Never blocks
+)
+
+// Finding is a single validation result
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Path     string   `json:"path,omitempty"` // Offending field, e.g. tunnels[2].crypto.dhgroup; empty for the whole policy
+	Code     string   `json:"code"`           // Machine-readable, e.g. compliance.dh_group
+	Message  string   `json:"message"`
+}
+
+func (f Finding) Error() string {
+	if f.Path == "" {
+		return f.Message
+	}
+	return fmt.Sprintf("%s: %s", f.Path, f.Message)
+}
+
+// Findings is the list of results of validating a policy
+type Findings []Finding
+
+// Blocking returns the findings that prevent a policy from being saved:
+// errors, and also warnings in strict mode
+func (f Findings) Blocking(strict bool) Findings {
+	var blocking Findings
+	for _, finding := range f {
+		if finding.Severity == SeverityError || (strict && finding.Severity == SeverityWarning) {
+			blocking = append(blocking, finding)
+		}
+	}
+	return blocking
+}
+
+// ValidationError is returned by PolicyEngine.Validate when a policy has
+// blocking findings. Findings holds every finding, blocking or not.
+type ValidationError struct {
+	Findings Findings
+	Strict   bool
+}
+
+func (e *ValidationError) Error() string {
+	blocking := e.Findings.Blocking(e.Strict)
+	msgs := make([]string, len(blocking))
+	for i, finding := range blocking {
+		msgs[i] = finding.Error()
+	}
+	return "policy validation failed: " + strings.Join(msgs, "; ")
+}
+
+func errorFinding(path, code, format string, args ...interface{}) Finding {
+	return Finding{Severity: SeverityError, Path: path, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func warningFinding(path, code, format string, args ...interface{}) Finding {
+	return Finding{Severity: SeverityWarning, Path: path, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// tunnelPath returns the JSON path of a tunnel field, e.g. tunnels[2].crypto.dhgroup
+func tunnelPath(index int, field string) string {
+	if field == "" {
+		return fmt.Sprintf("tunnels[%d]", index)
+	}
+	return fmt.Sprintf("tunnels[%d].%s", index, field)
+}
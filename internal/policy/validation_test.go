@@ -0,0 +1,173 @@
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+)
+
+// validPolicy returns a policy no default validator has a finding for
+func validPolicy() *Policy {
+	return &Policy{
+		Name:    "p",
+		Enabled: true,
+		Tunnels: []ipsec.TunnelConfig{
+			{
+				Name:          "t",
+				Mode:          ipsec.ModeESPTunnel,
+				LocalAddress:  "192.0.2.1",
+				RemoteAddress: "198.51.100.1",
+				Crypto: ipsec.CryptoConfig{
+					Encryption: ipsec.EncryptionAES256GCM,
+					Integrity:  ipsec.IntegritySHA256,
+					DHGroup:    ipsec.DHGroupECP256,
+					IKEVersion: ipsec.IKEv2,
+					Lifetime:   time.Hour,
+				},
+				Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: "validation-secret"},
+				TrafficSelectors: []ipsec.TrafficSelector{
+					{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24"},
+				},
+			},
+		},
+	}
+}
+
+func TestFindingsBlocking(t *testing.T) {
+	findings := Findings{
+		errorFinding("name", "basic.required", "policy name is required"),
+		warningFinding("tunnels[0].mode", "platform.ah_limited", "ah"),
+		{Severity: SeverityInfo, Code: "platform.unknown", Message: "unknown"},
+		errorFinding("tunnels[1].crypto.lifetime", "security.required", "lifetime"),
+	}
+
+	tests := []struct {
+		strict bool
+		want   []string
+	}{
+		{false, []string{"name basic.required", "tunnels[1].crypto.lifetime security.required"}},
+		{true, []string{"name basic.required", "tunnels[0].mode platform.ah_limited", "tunnels[1].crypto.lifetime security.required"}},
+	}
+	for _, tt := range tests {
+		if got := findingCodes(findings.Blocking(tt.strict)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Blocking(%v) = %q, want %q", tt.strict, got, tt.want)
+		}
+	}
+
+	advisory := Findings{findings[1], findings[2]}
+	if blocking := advisory.Blocking(false); len(blocking) != 0 {
+		t.Errorf("warnings and info block outside strict mode: %v", blocking)
+	}
+	if blocking := (Findings{findings[2]}).Blocking(true); len(blocking) != 0 {
+		t.Errorf("info blocks in strict mode: %v", blocking)
+	}
+
+	if got := findings[0].Error(); got != "name: policy name is required" {
+		t.Errorf("Error() = %q", got)
+	}
+	if got := findings[2].Error(); got != "unknown" {
+		t.Errorf("Error() without a path = %q", got)
+	}
+}
+
+func TestValidatorFindings(t *testing.T) {
+	engine := NewPolicyEngine()
+	if findings := engine.Check(validPolicy()); len(findings) != 0 {
+		t.Fatalf("valid policy has findings %q", findingCodes(findings))
+	}
+	notBefore := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		change   func(p *Policy)
+		findings []string // "path code"
+		severity Severity
+	}{
+		{name: "missing name", change: func(p *Policy) { p.Name = "" },
+			findings: []string{"name basic.required"}, severity: SeverityError},
+		{name: "newer schema", change: func(p *Policy) { p.SchemaVersion = CurrentSchemaVersion + 1 },
+			findings: []string{"schema_version basic.schema_version"}, severity: SeverityError},
+		{name: "no tunnels", change: func(p *Policy) { p.Tunnels = nil },
+			findings: []string{"tunnels basic.required"}, severity: SeverityError},
+		{name: "missing remote subnet", change: func(p *Policy) { p.Tunnels[0].TrafficSelectors[0].RemoteSubnet = "" },
+			findings: []string{"tunnels[0].traffic_selectors[0].remote_subnet basic.required"}, severity: SeverityError},
+		{name: "invalid address", change: func(p *Policy) { p.Tunnels[0].LocalAddress = "192.0.2.300" },
+			findings: []string{"tunnels[0].local_address address.invalid"}, severity: SeverityError},
+		{name: "address families", change: func(p *Policy) { p.Tunnels[0].RemoteAddress = "2001:db8::1" },
+			findings: []string{"tunnels[0].remote_address address.family_mismatch"}, severity: SeverityError},
+		{name: "host bits", change: func(p *Policy) { p.Tunnels[0].TrafficSelectors[0].LocalSubnet = "10.1.0.1/24" },
+			findings: []string{"tunnels[0].traffic_selectors[0].local_subnet address.host_bits"}, severity: SeverityError},
+		{name: "invalid selector", change: func(p *Policy) { p.AppliesTo = []string{"branch", "expr:site in (a"} },
+			findings: []string{"applies_to[1] selector.invalid"}, severity: SeverityError},
+		{name: "invalid template", change: func(p *Policy) { p.Tunnels[0].LocalID = "{{ .Peer.Nope }}" },
+			findings: []string{"tunnels[0].local_id template.invalid"}, severity: SeverityError},
+		{name: "overlapping selectors", change: func(p *Policy) {
+			second := p.Tunnels[0]
+			second.Name = "t2"
+			p.Tunnels = append(p.Tunnels, second)
+		}, findings: []string{"tunnels[1].traffic_selectors[0] selectors.duplicate"}, severity: SeverityError},
+		{name: "schedule", change: func(p *Policy) { p.NotBefore, p.NotAfter = &notBefore, &notAfter },
+			findings: []string{"not_after schedule.invalid"}, severity: SeverityError},
+		{name: "unused windows", change: func(p *Policy) {
+			p.MaintenanceWindows = []MaintenanceWindow{{Start: "02:00", End: "04:00"}}
+		}, findings: []string{"maintenance_windows schedule.windows_unused"}, severity: SeverityWarning},
+		{name: "short PSK", change: func(p *Policy) { p.Tunnels[0].Auth.Secret = "short" },
+			findings: []string{"tunnels[0].auth.secret security.psk_too_short"}, severity: SeverityError},
+		{name: "no lifetime", change: func(p *Policy) { p.Tunnels[0].Crypto.Lifetime = 0 },
+			findings: []string{"tunnels[0].crypto.lifetime security.required"}, severity: SeverityError},
+		{name: "AH", change: func(p *Policy) { p.Tunnels[0].Mode = ipsec.ModeAHTunnel },
+			findings: []string{"tunnels[0].mode platform.ah_limited"}, severity: SeverityWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol := validPolicy()
+			tt.change(pol)
+			findings := engine.Check(pol)
+			if got := findingCodes(findings); !reflect.DeepEqual(got, tt.findings) {
+				t.Fatalf("got findings %q, want %q", got, tt.findings)
+			}
+			for _, f := range findings {
+				if f.Severity != tt.severity || f.Message == "" {
+					t.Errorf("finding %+v, want severity %s and a message", f, tt.severity)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateStrict(t *testing.T) {
+	engine := NewPolicyEngine()
+	pol := validPolicy()
+	pol.Tunnels[0].Mode = ipsec.ModeAHTunnel
+
+	if err := engine.Validate(pol); err != nil {
+		t.Fatalf("a warning blocked outside strict mode: %v", err)
+	}
+
+	engine.SetStrict(true)
+	err := engine.Validate(pol)
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("Validate in strict mode = %v, want a *ValidationError", err)
+	}
+	if !validation.Strict || len(validation.Findings) != 1 || !strings.Contains(err.Error(), "tunnels[0].mode: ") {
+		t.Errorf("strict validation error %+v: %v", validation, err)
+	}
+
+	// Every finding is returned, but only blocking ones are in the message
+	pol.Name = ""
+	engine.SetStrict(false)
+	err = engine.Validate(pol)
+	if !errors.As(err, &validation) || len(validation.Findings) != 2 {
+		t.Fatalf("Validate = %v, want both findings", err)
+	}
+	if msg := err.Error(); msg != "policy validation failed: name: policy name is required" {
+		t.Errorf("Error() = %q", msg)
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// The server's built-in CA issues the certificates of tunnels with
+// "auth: certificate, issuer: builtin". It is generated the first time it is
+// needed and stored with its key sealed like the PSKs. Agents send a CSR
+// when they register and again, with a new key, when their certificate is
+// due for renewal; either request needs the agent token. Revoking takes the
+// admin token. Revoked certificates are listed in the CRL at /api/ca/crl,
+// which issued certificates name as their distribution point when
+// ca.crl_url is set.
+
+// crlValidity is how long a served CRL is valid for
+const crlValidity = 24 * time.Hour
+
+// errInvalidCertificateRequest marks a CSR the CA will not sign
+var errInvalidCertificateRequest = errors.New("invalid certificate request")
+
+// registerRequest is the body of a peer registration: the peer, and a CSR
+// if the agent wants a certificate from the built-in CA
+type registerRequest struct {
+	policy.PeerInfo
+	CSR string `json:"csr,omitempty"` // PEM; needs the agent token
+}
+
+// registerResponse is the registered peer, with the certificate issued for
+// its CSR or why none was
+type registerResponse struct {
+	policy.PeerInfo
+	Certificate      *policy.IssuedCertificate `json:"certificate,omitempty"`
+	CertificateError string                    `json:"certificate_error,omitempty"`
+}
+
+// certificateRequest is the body of a certificate renewal
+type certificateRequest struct {
+	CSR string `json:"csr"` // PEM
+}
+
+// revokeRequest is the body of a certificate revocation
+type revokeRequest struct {
+	Reason string `json:"reason,omitempty"` // e.g. key_compromise or superseded; unspecified by default
+}
+
+// authority returns the built-in CA, generating it on first use
+func (s *Server) authority(ctx context.Context) (*policy.CertificateAuthority, error) {
+	s.caMu.Lock()
+	defer s.caMu.Unlock()
+	if s.ca != nil {
+		return s.ca, nil
+	}
+
+	pair, err := s.storage.GetCA(ctx)
+	if errors.Is(err, policy.ErrCANotFound) {
+		name := viper.GetString("ca.name")
+		if name == "" {
+			name = policy.DefaultCAName
+		}
+		if pair, err = policy.GenerateCA(name, time.Now()); err != nil {
+			return nil, fmt.Errorf("failed to generate CA: %w", err)
+		}
+		if pair, err = s.storage.InitCA(ctx, pair); err != nil {
+			return nil, err
+		}
+		log.Info().Str("name", name).Msg("Certificate authority generated")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.ca, err = policy.LoadCA(pair); err != nil {
+		return nil, err
+	}
+	return s.ca, nil
+}
+
+// issueCertificate signs a CSR for a registered peer and records the
+// certificate. CSRs the CA will not sign return errInvalidCertificateRequest.
+func (s *Server) issueCertificate(c echo.Context, peer *policy.PeerInfo, csr string) (*policy.IssuedCertificate, error) {
+	ctx := c.Request().Context()
+
+	ca, err := s.authority(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	validity := viper.GetDuration("ca.certificate_validity")
+	if validity <= 0 {
+		validity = 90 * 24 * time.Hour
+	}
+	cert, err := ca.Issue(csr, peer, policy.IssueOptions{
+		Validity: validity,
+		CRLURL:   viper.GetString("ca.crl_url"),
+	}, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidCertificateRequest, err)
+	}
+
+	if err := s.storage.SaveCertificate(ctx, cert); err != nil {
+		return nil, err
+	}
+
+	s.storage.AuditLog(ctx, "issue", "certificate", cert.Serial, "",
+		c.RealIP(), map[string]interface{}{"peer_id": peer.ID, "not_after": cert.NotAfter})
+
+	log.Info().
+		Str("peer_id", peer.ID).
+		Str("serial", cert.Serial).
+		Time("not_after", cert.NotAfter).
+		Msg("Certificate issued")
+
+	return cert, nil
+}
+
+// certificateError maps an error from issuing a certificate to an HTTP
+// status and message
+func certificateError(err error) (int, string) {
+	if errors.Is(err, errInvalidCertificateRequest) {
+		return http.StatusBadRequest, err.Error()
+	}
+	return http.StatusInternalServerError, "Failed to issue certificate"
+}
+
+// registerCertificate issues the certificate a registering agent asked for.
+// Registration succeeds without it, so the reason is returned instead of an
+// error.
+func (s *Server) registerCertificate(c echo.Context, peer *policy.PeerInfo, csr string) (*policy.IssuedCertificate, string) {
+	if s.agentToken == "" {
+		return nil, "No agent token is configured, so the CA does not issue certificates"
+	}
+	if !bearerToken(c, s.agentToken) {
+		return nil, "The agent token is required to request a certificate"
+	}
+
+	cert, err := s.issueCertificate(c, peer, csr)
+	if err != nil {
+		status, message := certificateError(err)
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Str("peer_id", peer.ID).Msg("Failed to issue certificate")
+		}
+		return nil, message
+	}
+	return cert, ""
+}
+
+// Certificate authority handlers
+
+func (s *Server) handleGetCA(c echo.Context) error {
+	ca, err := s.authority(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load certificate authority")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load certificate authority",
+		})
+	}
+
+	return c.JSON(http.StatusOK, ca.Info(viper.GetString("ca.crl_url")))
+}
+
+// handleGetCRL serves the DER-encoded CRL of the built-in CA
+func (s *Server) handleGetCRL(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	ca, err := s.authority(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load certificate authority")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load certificate authority",
+		})
+	}
+
+	now := time.Now()
+	revoked, err := s.storage.ListRevokedCertificates(ctx, now)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list revoked certificates")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list revoked certificates",
+		})
+	}
+
+	crl, err := ca.CRL(revoked, now, crlValidity)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign CRL")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to sign CRL",
+		})
+	}
+
+	return c.Blob(http.StatusOK, "application/pkix-crl", crl)
+}
+
+func (s *Server) handleListCertificates(c echo.Context) error {
+	certs, err := s.storage.ListCertificates(c.Request().Context(), c.QueryParam("peer_id"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list certificates")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list certificates",
+		})
+	}
+
+	return c.JSON(http.StatusOK, certs)
+}
+
+func (s *Server) handleGetCertificate(c echo.Context) error {
+	cert, err := s.storage.GetCertificate(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		if !errors.Is(err, policy.ErrCertificateNotFound) {
+			log.Error().Err(err).Msg("Failed to get certificate")
+		}
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Certificate not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, cert)
+}
+
+// handleRevokeCertificate revokes an issued certificate. Anyone able to
+// revoke could cut peers off, so it takes the admin token.
+func (s *Server) handleRevokeCertificate(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if s.adminToken == "" {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Revoking certificates is disabled: no admin token is configured",
+		})
+	}
+	if !bearerToken(c, s.adminToken) {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "The admin token is required to revoke a certificate",
+		})
+	}
+
+	var req revokeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid revocation format",
+		})
+	}
+	if req.Reason == "" {
+		req.Reason = "unspecified"
+	}
+	if !policy.ValidRevocationReason(req.Reason) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Unknown revocation reason %q", req.Reason),
+		})
+	}
+
+	cert, err := s.storage.RevokeCertificate(ctx, c.Param("id"), req.Reason, time.Now())
+	if err != nil {
+		if errors.Is(err, policy.ErrCertificateNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Certificate not found",
+			})
+		}
+		log.Error().Err(err).Msg("Failed to revoke certificate")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to revoke certificate",
+		})
+	}
+
+	s.storage.AuditLog(ctx, "revoke", "certificate", cert.Serial, "",
+		c.RealIP(), map[string]interface{}{"peer_id": cert.PeerID, "reason": cert.RevocationReason})
+
+	log.Info().
+		Str("peer_id", cert.PeerID).
+		Str("serial", cert.Serial).
+		Str("reason", cert.RevocationReason).
+		Msg("Certificate revoked")
+
+	return c.JSON(http.StatusOK, cert)
+}
+
+// handleRenewCertificate issues a registered peer a new certificate for a
+// CSR. Agents call it when their certificate is due for renewal.
+func (s *Server) handleRenewCertificate(c echo.Context) error {
+	if s.agentToken == "" {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Issuing certificates is disabled: no agent token is configured",
+		})
+	}
+	if !bearerToken(c, s.agentToken) {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "The agent token is required to request a certificate",
+		})
+	}
+
+	var req certificateRequest
+	if err := c.Bind(&req); err != nil || req.CSR == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "csr is required",
+		})
+	}
+
+	peer, err := s.storage.GetPeer(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Peer not found",
+		})
+	}
+
+	cert, err := s.issueCertificate(c, peer, req.CSR)
+	if err != nil {
+		status, message := certificateError(err)
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Str("peer_id", peer.ID).Msg("Failed to issue certificate")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
+		})
+	}
+
+	return c.JSON(http.StatusCreated, cert)
+}
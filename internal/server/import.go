@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// ImportOptions controls how policies from a policy file are stored
+type ImportOptions struct {
+	Upsert bool   // Update existing policies with the same name instead of failing
+	DryRun bool   // Validate and report, but do not write anything
+	Source string // Recorded in the audit log, e.g. the file name
+}
+
+// ImportResult lists the names of the imported policies by outcome
+type ImportResult struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged"` // Identical to the stored policy; not saved again
+}
+
+// ImportError lists every policy in a file that could not be imported
+type ImportError struct {
+	Problems []ImportProblem
+}
+
+// ImportProblem is why one policy could not be imported
+type ImportProblem struct {
+	Index    int // Position in the file, from 1; 0 for a stored policy
+	Name     string
+	Message  string
+	Findings policy.Findings // Blocking validation findings, if any
+}
+
+func (e *ImportError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		msgs[i] = fmt.Sprintf("policy %d (%s): %s", problem.Index, problem.Name, problem.Message)
+	}
+	return "import failed: " + strings.Join(msgs, "; ")
+}
+
+// ImportPolicies validates every policy with the engine and checks it against
+// the registered peers as the API does, then stores them. New policies are
+// created; a policy whose name is already stored is updated with Upsert and
+// rejected otherwise. If any policy is rejected, nothing is written and the
+// error is an *ImportError listing all of them. The policies are saved in one
+// transaction, so a failed save writes none either.
+func ImportPolicies(ctx context.Context, storage *policy.Storage, engine *policy.PolicyEngine,
+	policies []policy.Policy, opts ImportOptions) (*ImportResult, error) {
+	existing, err := storage.ListPolicies(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*policy.Policy, len(existing))
+	byID := make(map[string]*policy.Policy, len(existing))
+	for i := range existing {
+		byName[existing[i].Name] = &existing[i]
+		byID[existing[i].ID] = &existing[i]
+	}
+
+	type plannedWrite struct {
+		policy  policy.Policy
+		created bool
+	}
+
+	// New policies get their IDs up front so that the checks against peers
+	// can tell them apart
+	policies = append([]policy.Policy(nil), policies...)
+	for i := range policies {
+		if current := byName[policies[i].Name]; current == nil && policies[i].ID == "" {
+			policies[i].ID = uuid.New().String()
+		}
+	}
+
+	// Policies may extend stored policies or other policies in the file
+	bases := existing
+	var imported []policy.Policy
+	for _, pol := range policies {
+		if current := byName[pol.Name]; current != nil {
+			pol.ID = current.ID
+		}
+		bases = policy.WithPolicy(bases, pol)
+		imported = append(imported, pol)
+	}
+
+	result := &ImportResult{Created: []string{}, Updated: []string{}, Unchanged: []string{}}
+	var writes []plannedWrite
+	var problems []ImportProblem
+	seen := make(map[string]bool, len(policies))
+
+	for i := range policies {
+		pol := policies[i]
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, ImportProblem{Index: i + 1, Name: pol.Name, Message: fmt.Sprintf(format, args...)})
+		}
+
+		if seen[pol.Name] {
+			problem("name appears more than once in the file")
+			continue
+		}
+		seen[pol.Name] = true
+
+		current := byName[pol.Name]
+		policy.KeepRotationState(&pol, current)
+		switch {
+		case current != nil && !opts.Upsert:
+			problem("a policy with this name already exists (use upsert to update it)")
+			continue
+		case current != nil:
+			pol.ID = current.ID
+			pol.Version = current.Version
+		case pol.ID != "" && byID[pol.ID] != nil:
+			problem("ID %s is already used by policy %q", pol.ID, byID[pol.ID].Name)
+			continue
+		}
+
+		resolved, _, err := policy.FlattenPolicy(&pol, bases)
+		if err != nil {
+			problem("%v", err)
+			continue
+		}
+
+		findings := engine.Check(resolved)
+		if blocking := findings.Blocking(engine.Strict()); len(blocking) > 0 {
+			problems = append(problems, ImportProblem{
+				Index: i + 1, Name: pol.Name, Message: "validation failed", Findings: blocking,
+			})
+			continue
+		}
+
+		// Selector overlaps, peer compliance and platforms are checked with
+		// the rest of the file in place
+		_, failure, err := checkPolicyOnPeers(ctx, storage, engine, &pol, resolved, imported)
+		var inheritance *policy.InheritanceError
+		if errors.As(err, &inheritance) {
+			problem("%v", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if failure != nil {
+			problem("%s", failure.Message)
+			continue
+		}
+
+		if current == nil {
+			writes = append(writes, plannedWrite{policy: pol, created: true})
+			continue
+		}
+
+		changes, err := policy.DiffPolicies(current, &pol)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			result.Unchanged = append(result.Unchanged, pol.Name)
+			continue
+		}
+
+		rollouts, err := storage.ListRollouts(ctx, pol.ID, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(rollouts) > 0 {
+			problem("policy has a rollout in progress (%s)", rollouts[0].ID)
+			continue
+		}
+		rotations, err := storage.ListRotations(ctx, pol.ID, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(rotations) > 0 {
+			problem("policy has a PSK rotation in progress (%s)", rotations[0].ID)
+			continue
+		}
+		writes = append(writes, plannedWrite{policy: pol})
+	}
+
+	// Stored policies extending an imported one must still validate with it
+	affected := make(map[string]bool)
+	for _, write := range writes {
+		for _, id := range policy.Descendants(bases, write.policy.ID) {
+			affected[id] = true
+		}
+	}
+	for i := range bases {
+		if !affected[bases[i].ID] || seen[bases[i].Name] {
+			continue
+		}
+		resolved, _, err := policy.FlattenPolicy(&bases[i], bases)
+		if err != nil {
+			problems = append(problems, ImportProblem{Name: bases[i].Name, Message: err.Error()})
+			continue
+		}
+		if blocking := engine.Check(resolved).Blocking(engine.Strict()); len(blocking) > 0 {
+			problems = append(problems, ImportProblem{
+				Name: bases[i].Name, Message: "stored policy extending an imported one fails validation", Findings: blocking,
+			})
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, &ImportError{Problems: problems}
+	}
+
+	// Every policy is written in one transaction, so a failed save leaves
+	// the stored policies as they were
+	if !opts.DryRun && len(writes) > 0 {
+		batch := make([]*policy.Policy, len(writes))
+		for i := range writes {
+			batch[i] = &writes[i].policy
+		}
+		if err := storage.SavePolicies(ctx, batch); err != nil {
+			return nil, fmt.Errorf("failed to save policies: %w", err)
+		}
+	}
+
+	for _, write := range writes {
+		pol := write.policy
+		if !opts.DryRun {
+			storage.AuditLog(ctx, "import", "policy", pol.ID, "", "",
+				map[string]interface{}{"name": pol.Name, "version": pol.Version, "source": opts.Source})
+		}
+
+		if write.created {
+			result.Created = append(result.Created, pol.Name)
+		} else {
+			result.Updated = append(result.Updated, pol.Name)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// newImportStorage opens a storage on a scratch database and returns it
+// with the database path
+func newImportStorage(t *testing.T) (*policy.Storage, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ipsec.db")
+	storage, err := policy.NewStorage(path, nil)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage, path
+}
+
+// importPolicy returns an enabled policy holding the given tunnels
+func importPolicy(id, name string, tunnels ...ipsec.TunnelConfig) policy.Policy {
+	return policy.Policy{ID: id, Name: name, Enabled: true, Tunnels: tunnels}
+}
+
+// selectorTunnel returns a valid tunnel between two subnets
+func selectorTunnel(name, local, remote string) ipsec.TunnelConfig {
+	tunnel := checkTunnel(name, "test-psk-secret")
+	tunnel.TrafficSelectors = []ipsec.TrafficSelector{{LocalSubnet: local, RemoteSubnet: remote}}
+	return tunnel
+}
+
+// seedPolicies stores policies as they are, failing the test on error
+func seedPolicies(t *testing.T, storage *policy.Storage, policies ...policy.Policy) {
+	t.Helper()
+	for i := range policies {
+		if err := storage.SavePolicy(context.Background(), &policies[i]); err != nil {
+			t.Fatalf("SavePolicy %s: %v", policies[i].Name, err)
+		}
+	}
+}
+
+// exportPolicies encodes every stored policy as YAML
+func exportPolicies(t *testing.T, storage *policy.Storage) []byte {
+	t.Helper()
+	policies, err := storage.ListPolicies(context.Background(), false)
+	if err != nil {
+		t.Fatalf("ListPolicies: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := policy.EncodePolicies(&buf, policies, policy.FormatYAML); err != nil {
+		t.Fatalf("EncodePolicies: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// importProblems returns the problems of an import as "index name message"
+func importProblems(t *testing.T, err error) []string {
+	t.Helper()
+	var importErr *ImportError
+	if !errors.As(err, &importErr) {
+		t.Fatalf("ImportPolicies error = %v, want an *ImportError", err)
+	}
+	var got []string
+	for _, problem := range importErr.Problems {
+		got = append(got, fmt.Sprintf("%d %s %s", problem.Index, problem.Name, problem.Message))
+	}
+	return got
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewPolicyEngine()
+
+	source, _ := newImportStorage(t)
+	child := importPolicy("child", "child", selectorTunnel("c", "10.3.0.0/24", "10.4.0.0/24"))
+	child.Extends = "base"
+	seedPolicies(t, source,
+		importPolicy("base", "base", selectorTunnel("b", "10.1.0.0/24", "10.2.0.0/24")),
+		child,
+		importPolicy("other", "other", selectorTunnel("o", "10.5.0.0/24", "10.6.0.0/24")),
+	)
+	exported := exportPolicies(t, source)
+
+	policies, err := policy.DecodePolicies(bytes.NewReader(exported), policy.FormatYAML)
+	if err != nil {
+		t.Fatalf("DecodePolicies: %v", err)
+	}
+
+	target, _ := newImportStorage(t)
+	result, err := ImportPolicies(ctx, target, engine, policies, ImportOptions{Source: "test"})
+	if err != nil {
+		t.Fatalf("ImportPolicies: %v", err)
+	}
+	if strings.Join(result.Created, ",") != "base,child,other" || len(result.Updated) != 0 {
+		t.Errorf("import created %v and updated %v, want base, child and other created", result.Created, result.Updated)
+	}
+	if again := exportPolicies(t, target); !bytes.Equal(again, exported) {
+		t.Errorf("export after import differs:\n%s\nwant:\n%s", again, exported)
+	}
+
+	// Importing the same file again changes nothing
+	result, err = ImportPolicies(ctx, target, engine, policies, ImportOptions{Upsert: true})
+	if err != nil {
+		t.Fatalf("ImportPolicies: %v", err)
+	}
+	if len(result.Unchanged) != 3 || len(result.Created)+len(result.Updated) != 0 {
+		t.Errorf("second import: %+v, want all unchanged", result)
+	}
+	if pol, err := target.GetPolicy(ctx, "base"); err != nil || pol.Version != 1 {
+		t.Errorf("base after the second import: %+v, %v, want version 1", pol, err)
+	}
+}
+
+func TestImportPolicies(t *testing.T) {
+	stored := importPolicy("a", "a", selectorTunnel("a", "10.1.0.0/24", "10.2.0.0/24"))
+	changed := importPolicy("", "a", selectorTunnel("a", "10.1.0.0/24", "10.9.0.0/24"))
+	added := importPolicy("", "b", selectorTunnel("b", "10.3.0.0/24", "10.4.0.0/24"))
+
+	tests := []struct {
+		name     string
+		policies []policy.Policy
+		opts     ImportOptions
+		created  string
+		updated  string
+		problems []string
+		versions map[string]int // Stored version by name afterwards; 0 for none
+	}{
+		{
+			name:     "create",
+			policies: []policy.Policy{added},
+			created:  "b",
+			versions: map[string]int{"a": 1, "b": 1},
+		},
+		{
+			name:     "existing name without upsert",
+			policies: []policy.Policy{changed, added},
+			problems: []string{"1 a a policy with this name already exists (use upsert to update it)"},
+			versions: map[string]int{"a": 1, "b": 0},
+		},
+		{
+			name:     "upsert",
+			policies: []policy.Policy{changed, added},
+			opts:     ImportOptions{Upsert: true},
+			created:  "b",
+			updated:  "a",
+			versions: map[string]int{"a": 2, "b": 1},
+		},
+		{
+			name:     "dry run",
+			policies: []policy.Policy{changed, added},
+			opts:     ImportOptions{Upsert: true, DryRun: true},
+			created:  "b",
+			updated:  "a",
+			versions: map[string]int{"a": 1, "b": 0},
+		},
+		{
+			name:     "name twice in the file",
+			policies: []policy.Policy{added, added},
+			problems: []string{"2 b name appears more than once in the file"},
+			versions: map[string]int{"a": 1, "b": 0},
+		},
+		{
+			name:     "ID of another policy",
+			policies: []policy.Policy{importPolicy("a", "b", selectorTunnel("b", "10.3.0.0/24", "10.4.0.0/24"))},
+			problems: []string{`1 b ID a is already used by policy "a"`},
+			versions: map[string]int{"a": 1, "b": 0},
+		},
+		{
+			name: "invalid policy",
+			policies: []policy.Policy{added, importPolicy("", "c",
+				selectorTunnel("c", "10.5.0.0/24", "10.6.0.0/24"), selectorTunnel("d", "10.5.0.0/24", "10.6.0.0/24"))},
+			problems: []string{"2 c validation failed"},
+			versions: map[string]int{"a": 1, "b": 0, "c": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			storage, _ := newImportStorage(t)
+			seedPolicies(t, storage, stored)
+
+			result, err := ImportPolicies(ctx, storage, policy.NewPolicyEngine(), tt.policies, tt.opts)
+			if tt.problems != nil {
+				if got := importProblems(t, err); strings.Join(got, "\n") != strings.Join(tt.problems, "\n") {
+					t.Errorf("got problems %q, want %q", got, tt.problems)
+				}
+				if result != nil {
+					t.Errorf("failed import returned %+v", result)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("ImportPolicies: %v", err)
+				}
+				if strings.Join(result.Created, ",") != tt.created || strings.Join(result.Updated, ",") != tt.updated {
+					t.Errorf("created %v and updated %v, want %q and %q", result.Created, result.Updated, tt.created, tt.updated)
+				}
+			}
+
+			policies, err := storage.ListPolicies(ctx, false)
+			if err != nil {
+				t.Fatalf("ListPolicies: %v", err)
+			}
+			versions := make(map[string]int)
+			for _, pol := range policies {
+				versions[pol.Name] = pol.Version
+			}
+			for name, want := range tt.versions {
+				if versions[name] != want {
+					t.Errorf("policy %s is at version %d, want %d", name, versions[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestImportBreaksDescendant(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newImportStorage(t)
+
+	child := importPolicy("child", "child", selectorTunnel("c", "10.3.0.0/24", "10.4.0.0/24"))
+	child.Extends = "base"
+	seedPolicies(t, storage, importPolicy("base", "base", selectorTunnel("b", "10.1.0.0/24", "10.2.0.0/24")), child)
+
+	// Valid on its own, but its tunnel now overlaps the child's
+	base := importPolicy("base", "base", selectorTunnel("b", "10.3.0.0/24", "10.4.0.0/24"))
+	_, err := ImportPolicies(ctx, storage, policy.NewPolicyEngine(), []policy.Policy{base}, ImportOptions{Upsert: true})
+
+	want := []string{"0 child stored policy extending an imported one fails validation"}
+	if got := importProblems(t, err); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got problems %q, want %q", got, want)
+	}
+	if stored, err := storage.GetPolicy(ctx, "base"); err != nil || stored.Version != 1 {
+		t.Errorf("base after the rejected import: %+v, %v, want version 1", stored, err)
+	}
+}
+
+func TestImportChecksPeers(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newImportStorage(t)
+
+	peer := &policy.PeerInfo{ID: "peer-1", Hostname: "peer-1", Platform: "linux", IPAddress: "192.0.2.1"}
+	if err := storage.RegisterPeer(ctx, peer); err != nil {
+		t.Fatalf("RegisterPeer: %v", err)
+	}
+	seedPolicies(t, storage, importPolicy("a", "a", selectorTunnel("a", "10.1.0.0/24", "10.2.0.0/24")))
+
+	tests := []struct {
+		name     string
+		policies []policy.Policy
+		problems []string
+	}{
+		{
+			name:     "overlaps a stored policy",
+			policies: []policy.Policy{importPolicy("", "b", selectorTunnel("b", "10.1.0.0/24", "10.2.0.0/24"))},
+			problems: []string{"1 b traffic selectors overlap other tunnels on some peers"},
+		},
+		{
+			name: "overlaps another policy in the file",
+			policies: []policy.Policy{
+				importPolicy("", "b", selectorTunnel("b", "10.3.0.0/24", "10.4.0.0/24")),
+				importPolicy("", "c", selectorTunnel("c", "10.3.0.0/24", "10.4.0.0/24")),
+			},
+			problems: []string{
+				"1 b traffic selectors overlap other tunnels on some peers",
+				"2 c traffic selectors overlap other tunnels on some peers",
+			},
+		},
+		{
+			name: "separate subnets",
+			policies: []policy.Policy{
+				importPolicy("", "b", selectorTunnel("b", "10.3.0.0/24", "10.4.0.0/24")),
+				importPolicy("", "c", selectorTunnel("c", "10.5.0.0/24", "10.6.0.0/24")),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ImportPolicies(ctx, storage, policy.NewPolicyEngine(), tt.policies, ImportOptions{DryRun: true})
+			if tt.problems == nil {
+				if err != nil {
+					t.Fatalf("ImportPolicies: %v", err)
+				}
+				return
+			}
+			if got := importProblems(t, err); strings.Join(got, "\n") != strings.Join(tt.problems, "\n") {
+				t.Errorf("got problems %q, want %q", got, tt.problems)
+			}
+		})
+	}
+}
+
+func TestImportAllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	storage, path := newImportStorage(t)
+	seedPolicies(t, storage, importPolicy("a", "a", selectorTunnel("a", "10.1.0.0/24", "10.2.0.0/24")))
+
+	// Make the database refuse the last policy of the file once it is valid
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TRIGGER refuse_c BEFORE INSERT ON policies WHEN NEW.name = 'c'
+		BEGIN SELECT RAISE(ABORT, 'refused'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	policies := []policy.Policy{
+		importPolicy("", "a", selectorTunnel("a", "10.1.0.0/24", "10.9.0.0/24")),
+		importPolicy("", "b", selectorTunnel("b", "10.3.0.0/24", "10.4.0.0/24")),
+		importPolicy("", "c", selectorTunnel("c", "10.5.0.0/24", "10.6.0.0/24")),
+	}
+	result, err := ImportPolicies(ctx, storage, policy.NewPolicyEngine(), policies, ImportOptions{Upsert: true})
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("ImportPolicies error = %v, want the refused save", err)
+	}
+	if result != nil {
+		t.Errorf("failed import returned %+v", result)
+	}
+
+	stored, err := storage.ListPolicies(ctx, false)
+	if err != nil {
+		t.Fatalf("ListPolicies: %v", err)
+	}
+	if len(stored) != 1 || stored[0].Version != 1 || stored[0].Tunnels[0].TrafficSelectors[0].RemoteSubnet != "10.2.0.0/24" {
+		t.Errorf("stored policies after the failed import: %+v, want only a at version 1", stored)
+	}
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// The OpenAPI document is built from apiOperations, which lists every route
+// RegisterRoutes registers, and from the request and response types the
+// handlers bind and return. Schemas come from the Go types, so a new field
+// shows up on its own; a new route has to be added to apiOperations, and
+// TestOpenAPIRoutes reports any route that is missing on either side.
+
+// apiVersion is the API version reported by the health check and the
+// OpenAPI document
+const apiVersion = "0.1.0"
+
+// apiOperation documents one route
+type apiOperation struct {
+	Method   string
+	Path     string // Relative to /api, with echo's :param placeholders
+	Tag      string
+	Summary  string
+	Query    []apiParameter
+	IfMatch  string      // "required" or "optional"; empty if the ETag is not checked
+	Request  interface{} // Zero value of the request body type; nil for none
+	Status   int         // Success status
+	Response interface{} // Zero value of the response body type; nil for no content
+	ETag     bool        // The response carries the ETag of the written or read version
+	Secrets  bool        // The response carries tunnel secrets, redacted unless revealed
+	Token    string      // "required" or "optional": the operation, or part of it, needs the agent token; "admin": it needs the admin token
+	Media    string      // Media type of a response that is not JSON; Response is then ignored
+}
+
+// apiParameter is a query parameter
+type apiParameter struct {
+	Name        string
+	Description string
+}
+
+// errorResponse is the body of every error response. Some errors add details,
+// such as the policies extending one that cannot be deleted.
+type errorResponse struct {
+	Error    string          `json:"error"`
+	Findings policy.Findings `json:"findings,omitempty"` // Validation findings, when validation failed
+}
+
+var apiOperations = []apiOperation{
+	// Policy endpoints
+	{Method: http.MethodGet, Path: "/policies", Tag: "policies", Summary: "List policies",
+		Query: []apiParameter{
+			{"enabled", "true to list enabled policies only"},
+			{"peer_id", "List the policies distributed to this peer, resolved as the agent receives them; with the agent token, secrets are included"},
+		},
+		Status: http.StatusOK, Response: []policy.Policy{}, Secrets: true},
+	{Method: http.MethodPost, Path: "/policies", Tag: "policies", Summary: "Create a policy",
+		Request: policy.Policy{}, Status: http.StatusCreated, Response: policyResponse{}, ETag: true, Secrets: true},
+	{Method: http.MethodPost, Path: "/policies/preview", Tag: "policies", Summary: "Preview the tunnels a policy change would add, change or remove on each peer",
+		Request: previewRequest{}, Status: http.StatusOK, Response: policy.PolicyPreview{}, Secrets: true},
+	{Method: http.MethodGet, Path: "/policies/:id", Tag: "policies", Summary: "Get a policy as stored",
+		Status: http.StatusOK, Response: policy.Policy{}, ETag: true, Secrets: true},
+	{Method: http.MethodPut, Path: "/policies/:id", Tag: "policies", Summary: "Update a policy",
+		IfMatch: "required", Request: policy.Policy{}, Status: http.StatusOK, Response: policyResponse{}, ETag: true, Secrets: true},
+	{Method: http.MethodDelete, Path: "/policies/:id", Tag: "policies", Summary: "Delete a policy",
+		IfMatch: "required", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/policies/:id/revisions", Tag: "policies", Summary: "List a policy's revisions",
+		Status: http.StatusOK, Response: []policy.PolicyRevision{}, Secrets: true},
+	{Method: http.MethodGet, Path: "/policies/:id/revisions/:rev", Tag: "policies", Summary: "Get a policy revision",
+		Status: http.StatusOK, Response: policy.PolicyRevision{}, Secrets: true},
+	{Method: http.MethodGet, Path: "/policies/:id/diff", Tag: "policies", Summary: "Diff two revisions of a policy",
+		Query: []apiParameter{
+			{"from", "Revision to diff from; the one before to by default"},
+			{"to", "Revision to diff to; the latest by default"},
+		},
+		Status: http.StatusOK, Response: policy.PolicyDiff{}, Secrets: true},
+	{Method: http.MethodPost, Path: "/policies/:id/rollback", Tag: "policies", Summary: "Roll a policy back to a revision",
+		IfMatch: "required", Request: rollbackRequest{}, Status: http.StatusOK, Response: policyResponse{}, ETag: true, Secrets: true},
+	{Method: http.MethodGet, Path: "/policies/:id/compatibility", Tag: "policies", Summary: "Check which peers can configure a policy",
+		Status: http.StatusOK, Response: policy.CompatibilityReport{}},
+	{Method: http.MethodGet, Path: "/policies/:id/schedule", Tag: "policies", Summary: "Get a policy's activation schedule",
+		Status: http.StatusOK, Response: scheduleResponse{}},
+	{Method: http.MethodGet, Path: "/policies/:id/resolved", Tag: "policies", Summary: "Get a policy merged with the policies it extends",
+		Status: http.StatusOK, Response: resolvedPolicy{}, ETag: true, Secrets: true},
+
+	// Peer endpoints
+	{Method: http.MethodPost, Path: "/peers/register", Tag: "peers", Summary: "Register a peer, and have the built-in CA sign its CSR",
+		Request: registerRequest{}, Status: http.StatusCreated, Response: registerResponse{}, Token: "optional"},
+	{Method: http.MethodGet, Path: "/peers", Tag: "peers", Summary: "List peers",
+		Status: http.StatusOK, Response: []policy.PeerInfo{}},
+	{Method: http.MethodGet, Path: "/peers/:id", Tag: "peers", Summary: "Get a peer",
+		Status: http.StatusOK, Response: policy.PeerInfo{}},
+	{Method: http.MethodGet, Path: "/peers/:id/tunnels", Tag: "peers", Summary: "Get the merged tunnels a peer configures",
+		Status: http.StatusOK, Response: policy.MergeResult{}, Secrets: true},
+	{Method: http.MethodPut, Path: "/peers/:id/status", Tag: "peers", Summary: "Set a peer's status",
+		Request: peerStatusRequest{}, Status: http.StatusNoContent},
+	{Method: http.MethodPost, Path: "/peers/:id/report", Tag: "peers", Summary: "Report applied policy versions and tunnel health",
+		Request: policy.PeerReport{}, Status: http.StatusNoContent, Token: "required"},
+	{Method: http.MethodPost, Path: "/peers/:id/certificate", Tag: "peers", Summary: "Renew a peer's certificate from the built-in CA",
+		Request: certificateRequest{}, Status: http.StatusCreated, Response: policy.IssuedCertificate{}, Token: "required"},
+
+	// Staged rollouts
+	{Method: http.MethodGet, Path: "/rollouts", Tag: "rollouts", Summary: "List rollouts",
+		Query: []apiParameter{
+			{"policy_id", "List the rollouts of this policy only"},
+			{"active", "true to list running and paused rollouts only"},
+		},
+		Status: http.StatusOK, Response: []policy.Rollout{}, Secrets: true},
+	{Method: http.MethodPost, Path: "/rollouts", Tag: "rollouts", Summary: "Update a policy through a staged rollout",
+		IfMatch: "required", Request: rolloutRequest{}, Status: http.StatusCreated, Response: rolloutResponse{}, ETag: true, Secrets: true},
+	{Method: http.MethodGet, Path: "/rollouts/:id", Tag: "rollouts", Summary: "Get a rollout",
+		Status: http.StatusOK, Response: policy.Rollout{}, Secrets: true},
+	{Method: http.MethodPost, Path: "/rollouts/:id/:action", Tag: "rollouts", Summary: "Pause, resume, promote or roll back a rollout",
+		Status: http.StatusOK, Response: policy.Rollout{}, Secrets: true},
+
+	// PSK rotations
+	{Method: http.MethodGet, Path: "/rotations", Tag: "rotations", Summary: "List PSK rotations",
+		Query: []apiParameter{
+			{"policy_id", "List the rotations of this policy's tunnels only"},
+			{"active", "true to list rotations still in progress only"},
+		},
+		Status: http.StatusOK, Response: []policy.PSKRotation{}},
+	{Method: http.MethodPost, Path: "/rotations", Tag: "rotations", Summary: "Rotate a tunnel's PSK now",
+		Request: rotationRequest{}, Status: http.StatusCreated, Response: policy.PSKRotation{}},
+	{Method: http.MethodGet, Path: "/rotations/:id", Tag: "rotations", Summary: "Get a PSK rotation",
+		Status: http.StatusOK, Response: policy.PSKRotation{}},
+	{Method: http.MethodPost, Path: "/rotations/:id/cancel", Tag: "rotations", Summary: "Cancel a PSK rotation that is still staging",
+		Status: http.StatusOK, Response: policy.PSKRotation{}},
+
+	// Secret store
+	{Method: http.MethodGet, Path: "/secrets", Tag: "secrets", Summary: "List secret store entries, without their secrets",
+		Status: http.StatusOK, Response: []policy.StoredSecret{}},
+	{Method: http.MethodPost, Path: "/secrets", Tag: "secrets", Summary: "Create a secret store entry",
+		Request: policy.StoredSecret{}, Status: http.StatusCreated, Response: policy.StoredSecret{}, ETag: true, Secrets: true},
+	{Method: http.MethodGet, Path: "/secrets/:id", Tag: "secrets", Summary: "Get a secret store entry by name",
+		Status: http.StatusOK, Response: policy.StoredSecret{}, ETag: true, Secrets: true},
+	{Method: http.MethodPut, Path: "/secrets/:id", Tag: "secrets", Summary: "Update a secret store entry",
+		IfMatch: "required", Request: policy.StoredSecret{}, Status: http.StatusOK, Response: policy.StoredSecret{}, ETag: true, Secrets: true},
+	{Method: http.MethodDelete, Path: "/secrets/:id", Tag: "secrets", Summary: "Delete a secret store entry no tunnel refers to",
+		IfMatch: "required", Status: http.StatusNoContent},
+
+	// Built-in certificate authority
+	{Method: http.MethodGet, Path: "/ca", Tag: "certificates", Summary: "Get the built-in CA's certificate",
+		Status: http.StatusOK, Response: policy.CAInfo{}},
+	{Method: http.MethodGet, Path: "/ca/crl", Tag: "certificates", Summary: "Get the built-in CA's CRL, DER-encoded",
+		Status: http.StatusOK, Media: "application/pkix-crl"},
+	{Method: http.MethodGet, Path: "/certificates", Tag: "certificates", Summary: "List certificates issued by the built-in CA",
+		Query: []apiParameter{
+			{"peer_id", "List the certificates of this peer only"},
+		},
+		Status: http.StatusOK, Response: []policy.IssuedCertificate{}},
+	{Method: http.MethodGet, Path: "/certificates/:id", Tag: "certificates", Summary: "Get an issued certificate by serial",
+		Status: http.StatusOK, Response: policy.IssuedCertificate{}},
+	{Method: http.MethodPost, Path: "/certificates/:id/revoke", Tag: "certificates", Summary: "Revoke an issued certificate",
+		Request: revokeRequest{}, Status: http.StatusOK, Response: policy.IssuedCertificate{}, Token: "admin"},
+
+	// Generated topologies
+	{Method: http.MethodGet, Path: "/topologies", Tag: "topologies", Summary: "List topologies",
+		Query: []apiParameter{
+			{"enabled", "true to list enabled topologies only"},
+		},
+		Status: http.StatusOK, Response: []policy.Topology{}, Secrets: true},
+	{Method: http.MethodPost, Path: "/topologies", Tag: "topologies", Summary: "Create a topology",
+		Request: policy.Topology{}, Status: http.StatusCreated, Response: topologyResponse{}, ETag: true, Secrets: true},
+	{Method: http.MethodGet, Path: "/topologies/:id", Tag: "topologies", Summary: "Get a topology",
+		Status: http.StatusOK, Response: policy.Topology{}, ETag: true, Secrets: true},
+	{Method: http.MethodPut, Path: "/topologies/:id", Tag: "topologies", Summary: "Update a topology",
+		IfMatch: "required", Request: policy.Topology{}, Status: http.StatusOK, Response: topologyResponse{}, ETag: true, Secrets: true},
+	{Method: http.MethodDelete, Path: "/topologies/:id", Tag: "topologies", Summary: "Delete a topology",
+		IfMatch: "required", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/topologies/:id/expansion", Tag: "topologies", Summary: "Get the tunnels a topology generates for each peer",
+		Status: http.StatusOK, Response: policy.TopologyExpansion{}, Secrets: true},
+
+	// Tunnel status endpoints
+	{Method: http.MethodGet, Path: "/tunnels", Tag: "tunnels", Summary: "List tunnel status across peers",
+		Status: http.StatusOK, Response: []ipsec.TunnelStatus{}},
+	{Method: http.MethodGet, Path: "/tunnels/:name", Tag: "tunnels", Summary: "Get a tunnel's status",
+		Status: http.StatusOK, Response: ipsec.TunnelStatus{}},
+
+	// Analysis endpoints
+	{Method: http.MethodGet, Path: "/analysis/selectors", Tag: "analysis", Summary: "Find overlapping traffic selectors across policies",
+		Status: http.StatusOK, Response: policy.SelectorAnalysis{}},
+
+	// Compliance endpoints
+	{Method: http.MethodGet, Path: "/compliance/profiles", Tag: "compliance", Summary: "List compliance profiles",
+		Status: http.StatusOK, Response: []policy.ComplianceProfile{}},
+
+	// Validation rule endpoints
+	{Method: http.MethodGet, Path: "/rules", Tag: "rules", Summary: "List validation rules",
+		Status: http.StatusOK, Response: ruleSetResponse{}},
+	{Method: http.MethodPost, Path: "/rules/reload", Tag: "rules", Summary: "Reload validation rules",
+		Status: http.StatusOK, Response: ruleSetResponse{}},
+
+	// API description
+	{Method: http.MethodGet, Path: "/openapi.json", Tag: "meta", Summary: "Get this OpenAPI document",
+		Status: http.StatusOK, Response: policy.JSONSchema{}},
+	{Method: http.MethodGet, Path: "/schemas/policy.json", Tag: "meta", Summary: "Get the JSON Schema of policy files",
+		Status: http.StatusOK, Response: policy.JSONSchema{}},
+
+	// Health check
+	{Method: http.MethodGet, Path: "/health", Tag: "meta", Summary: "Check that the server is up",
+		Status: http.StatusOK, Response: healthResponse{}},
+}
+
+// OpenAPISpec returns the OpenAPI 3.1 document of the REST API
+func OpenAPISpec() policy.JSONSchema {
+	g := policy.NewSchemaGenerator("#/components/schemas/", false)
+	errorBody := policy.JSONSchema{
+		"description": "Error",
+		"content": policy.JSONSchema{
+			"application/json": policy.JSONSchema{"schema": g.Schema(reflect.TypeOf(errorResponse{}))},
+		},
+	}
+
+	paths := make(map[string]policy.JSONSchema)
+	for _, op := range apiOperations {
+		var parameters []interface{}
+		for _, segment := range strings.Split(op.Path, "/") {
+			if name, ok := strings.CutPrefix(segment, ":"); ok {
+				parameters = append(parameters, policy.JSONSchema{
+					"name": name, "in": "path", "required": true,
+					"schema": policy.JSONSchema{"type": "string"},
+				})
+			}
+		}
+		for _, param := range op.Query {
+			parameters = append(parameters, policy.JSONSchema{
+				"name": param.Name, "in": "query", "description": param.Description,
+				"schema": policy.JSONSchema{"type": "string"},
+			})
+		}
+		if op.Secrets {
+			parameters = append(parameters, policy.JSONSchema{
+				"name": "reveal", "in": "query",
+				"description": "\"secrets\" to return tunnel secrets instead of " + strconv.Quote(policy.RedactedSecret) + "; needs the admin token and is audited",
+				"schema":      policy.JSONSchema{"type": "string", "enum": []string{"secrets"}},
+			})
+		}
+		if op.IfMatch != "" {
+			parameters = append(parameters, policy.JSONSchema{
+				"name": "If-Match", "in": "header", "required": op.IfMatch == "required",
+				"description": "ETag of the version the change is based on",
+				"schema":      policy.JSONSchema{"type": "string"},
+			})
+		}
+
+		success := policy.JSONSchema{"description": http.StatusText(op.Status)}
+		if op.Media != "" {
+			success["content"] = policy.JSONSchema{
+				op.Media: policy.JSONSchema{"schema": policy.JSONSchema{"type": "string", "contentEncoding": "binary"}},
+			}
+		} else if op.Response != nil {
+			success["content"] = policy.JSONSchema{
+				"application/json": policy.JSONSchema{"schema": g.Schema(reflect.TypeOf(op.Response))},
+			}
+		}
+		if op.ETag {
+			success["headers"] = policy.JSONSchema{
+				"ETag": policy.JSONSchema{
+					"description": "Version of the returned resource, for If-Match",
+					"schema":      policy.JSONSchema{"type": "string"},
+				},
+			}
+		}
+
+		operation := policy.JSONSchema{
+			"tags":    []string{op.Tag},
+			"summary": op.Summary,
+			"responses": policy.JSONSchema{
+				strconv.Itoa(op.Status): success,
+				"default":               errorBody,
+			},
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if op.Secrets || op.Token == "optional" {
+			// Anonymous, or with a token that reveals secrets or allows more
+			operation["security"] = []interface{}{policy.JSONSchema{}, policy.JSONSchema{"bearerToken": []string{}}}
+		} else if op.Token == "required" || op.Token == "admin" {
+			operation["security"] = []interface{}{policy.JSONSchema{"bearerToken": []string{}}}
+		}
+		if op.Request != nil {
+			operation["requestBody"] = policy.JSONSchema{
+				"required": true,
+				"content": policy.JSONSchema{
+					"application/json": policy.JSONSchema{"schema": g.Schema(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+
+		path := "/api" + openAPIPath(op.Path)
+		if paths[path] == nil {
+			paths[path] = policy.JSONSchema{}
+		}
+		paths[path][strings.ToLower(op.Method)] = operation
+	}
+
+	return policy.JSONSchema{
+		"openapi": "3.1.0",
+		"info": policy.JSONSchema{
+			"title":   "IPsec Manager API",
+			"version": apiVersion,
+		},
+		"paths": paths,
+		"components": policy.JSONSchema{
+			"schemas": g.Defs,
+			"securitySchemes": policy.JSONSchema{
+				"bearerToken": policy.JSONSchema{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "The agent token (auth.agent_token) or the admin token (auth.admin_token)",
+				},
+			},
+		},
+	}
+}
+
+// openAPIPath turns echo's :param placeholders into OpenAPI's {param}
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// API description handlers
+
+func (s *Server) handleOpenAPI(c echo.Context) error {
+	return c.JSON(http.StatusOK, OpenAPISpec())
+}
+
+func (s *Server) handlePolicySchema(c echo.Context) error {
+	return c.JSON(http.StatusOK, policy.PolicyFileSchema())
+}
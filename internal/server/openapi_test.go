@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// TestOpenAPIRoutes compares the routes RegisterRoutes registers with the
+// operations the OpenAPI document describes.
+func TestOpenAPIRoutes(t *testing.T) {
+	e := echo.New()
+	(&Server{}).RegisterRoutes(e)
+
+	registered := make(map[string]bool)
+	for _, route := range e.Routes() {
+		// Group middleware adds catch-all not-found routes
+		if route.Method == echo.RouteNotFound {
+			continue
+		}
+		registered[route.Method+" "+route.Path] = true
+	}
+	documented := make(map[string]bool)
+	for _, op := range apiOperations {
+		documented[op.Method+" /api"+op.Path] = true
+	}
+
+	for route := range registered {
+		if !documented[route] {
+			t.Errorf("%s is registered but not in the OpenAPI document", route)
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			t.Errorf("%s is in the OpenAPI document but not registered", route)
+		}
+	}
+}
+
+// TestCheckedInSchemas checks that the checked-in schemas hold what the
+// server generates today.
+func TestCheckedInSchemas(t *testing.T) {
+	tests := []struct {
+		file   string
+		schema policy.JSONSchema
+	}{
+		{"docs/openapi.json", OpenAPISpec()},
+		{"configs/policy.schema.json", policy.PolicyFileSchema()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			current, err := os.ReadFile(filepath.Join("..", "..", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Encoded the way "ipsec-server schema" writes them
+			var generated bytes.Buffer
+			encoder := json.NewEncoder(&generated)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(tt.schema); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(current, generated.Bytes()) {
+				t.Errorf("%s is out of date, regenerate it with \"make schemas\"", tt.file)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// Tunnel secrets are redacted from every JSON response. The serializer the
+// routes are registered with replaces the value of every "secret" field and
+// of fields ending in "_secret", such as the standby secret of a rotation,
+// and the old and new values of diff entries whose path ends in "secret",
+// with policy.RedactedSecret. Two kinds of request get the real values:
+//
+//   - an agent fetching its policies (GET /api/policies?peer_id=) with the
+//     agent token from auth.agent_token
+//   - any request with ?reveal=secrets and the admin token from
+//     auth.admin_token; every such request is audited
+//
+// Both tokens are sent as "Authorization: Bearer <token>". A side with no
+// token configured cannot reveal secrets at all.
+
+// revealSecretsKey marks a request whose response may carry secrets
+const revealSecretsKey = "reveal_secrets"
+
+// redactingSerializer encodes responses like echo's default serializer,
+// then redacts secrets unless the request was marked with revealSecretsKey
+type redactingSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (r redactingSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if indent != "" {
+		enc.SetIndent("", indent)
+	}
+	if err := enc.Encode(i); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	if reveal, _ := c.Get(revealSecretsKey).(bool); !reveal {
+		data = redactJSON(data)
+	}
+	_, err := c.Response().Write(data)
+	return err
+}
+
+// jsonFrame is an object or array being scanned by redactJSON
+type jsonFrame struct {
+	object       bool
+	key          string // Key of the value being read, in objects
+	expectKey    bool
+	secretChange bool // A diff entry whose path ends in "secret"
+}
+
+// redactJSON replaces secret string values in an encoded JSON document,
+// leaving the rest of the document byte for byte as it was. Documents that
+// do not decode are returned as they are.
+func redactJSON(data []byte) []byte {
+	if !bytes.Contains(data, []byte(`"secret`)) && !bytes.Contains(data, []byte(`secret"`)) {
+		return data
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var out []byte
+	copied := 0
+	var stack []*jsonFrame
+
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return data
+		}
+
+		var frame *jsonFrame
+		if len(stack) > 0 {
+			frame = stack[len(stack)-1]
+		}
+
+		if delim, ok := token.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				stack = append(stack, &jsonFrame{object: delim == '{', expectKey: delim == '{'})
+			case '}', ']':
+				stack = stack[:len(stack)-1]
+				if len(stack) > 0 && stack[len(stack)-1].object {
+					stack[len(stack)-1].expectKey = true
+				}
+			}
+			continue
+		}
+
+		if frame != nil && frame.object && frame.expectKey {
+			frame.key, _ = token.(string)
+			frame.expectKey = false
+			continue
+		}
+
+		value, isString := token.(string)
+		if frame != nil && frame.object {
+			frame.expectKey = true
+			if isString && frame.key == "path" && strings.HasSuffix(value, "secret") {
+				frame.secretChange = true
+			}
+		}
+		if !isString || value == "" || frame == nil || !frame.object {
+			continue
+		}
+		if !secretKey(frame.key) && !(frame.secretChange && (frame.key == "old" || frame.key == "new")) {
+			continue
+		}
+
+		// The token ends at the decoder's offset; find its opening quote
+		end := int(dec.InputOffset())
+		start := stringStart(data, end)
+		if start < 0 {
+			return data
+		}
+		out = append(out, data[copied:start]...)
+		out = append(out, '"')
+		out = append(out, policy.RedactedSecret...)
+		out = append(out, '"')
+		copied = end
+	}
+
+	if out == nil {
+		return data
+	}
+	return append(out, data[copied:]...)
+}
+
+// secretKey reports whether values of an object key are secrets
+func secretKey(key string) bool {
+	return key == "secret" || strings.HasSuffix(key, "_secret")
+}
+
+// stringStart returns the offset of the opening quote of the JSON string
+// that ends at end, or -1
+func stringStart(data []byte, end int) int {
+	if end < 2 || end > len(data) || data[end-1] != '"' {
+		return -1
+	}
+	for i := end - 2; i >= 0; i-- {
+		if data[i] != '"' {
+			continue
+		}
+		backslashes := 0
+		for j := i - 1; j >= 0 && data[j] == '\\'; j-- {
+			backslashes++
+		}
+		if backslashes%2 == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// bearerToken reports whether the request carries the given bearer token.
+// An empty token matches nothing.
+func bearerToken(c echo.Context, token string) bool {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	presented, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(presented)), []byte(token)) == 1
+}
+
+// revealSecrets authorises ?reveal=secrets with the admin token
+func (s *Server) revealSecrets(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		reveal := c.QueryParam("reveal")
+		if reveal == "" {
+			return next(c)
+		}
+		if reveal != "secrets" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "reveal must be \"secrets\"",
+			})
+		}
+
+		if s.adminToken == "" {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "Revealing secrets is disabled: no admin token is configured",
+			})
+		}
+		if !bearerToken(c, s.adminToken) {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"error": "The admin token is required to reveal secrets",
+			})
+		}
+
+		s.storage.AuditLog(c.Request().Context(), "reveal_secrets", "api", c.Param("id"), "",
+			c.RealIP(), map[string]string{"method": c.Request().Method, "path": c.Request().URL.Path})
+
+		c.Set(revealSecretsKey, true)
+		return next(c)
+	}
+}
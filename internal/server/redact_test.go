@@ -0,0 +1,425 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// TestSecretsDoNotLeak runs a server on a scratch database, stores policies,
+// a topology, a rollout and a secret store entry with known PSKs through the
+// API, rotates a PSK and has the built-in CA issue and revoke a certificate,
+// and then looks for those PSKs and private keys where they must never
+// appear: in the response of every route the OpenAPI document lists, in the
+// log output at debug level, and in the database files, audit log included.
+// It also checks that the agent and the admin token do get the secrets.
+func TestSecretsDoNotLeak(t *testing.T) {
+	dir := t.TempDir()
+
+	keyText, err := policy.GenerateMasterKey("check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := policy.ParseKeyring(keyText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := policy.NewStorage(filepath.Join(dir, "ipsec.db"), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	previousLogger, previousLevel := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&logs)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	defer func() {
+		log.Logger = previousLogger
+		zerolog.SetGlobalLevel(previousLevel)
+	}()
+
+	s := &Server{
+		storage:    storage,
+		engine:     policy.NewPolicyEngine(),
+		stop:       make(chan struct{}),
+		agentToken: "check-agent-token",
+		adminToken: "check-admin-token",
+		secretDir:  policy.DefaultSecretDir,
+
+		secretAccess: make(map[string]int),
+	}
+	e := echo.New()
+	s.RegisterRoutes(e)
+
+	check := &leakCheck{t: t, echo: e, secrets: checkSecrets}
+	check.run(s)
+
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check.scan("log output", logs.Bytes())
+
+	files, err := filepath.Glob(filepath.Join(dir, "ipsec.db*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check.scan(filepath.Base(file), data)
+	}
+}
+
+// checkSecrets are the PSKs the check stores, in the order it stores them
+var checkSecrets = []string{"check-psk-policy-a1", "check-psk-policy-b2", "check-psk-topology-c3", "check-psk-rollout-d4", "check-psk-rotation-e5", "check-psk-store-f6"}
+
+// leakCheck holds the state of TestSecretsDoNotLeak
+type leakCheck struct {
+	t       *testing.T
+	echo    *echo.Echo
+	secrets []string // checkSecrets, the PSKs the server generated, and parts of private keys
+}
+
+func (l *leakCheck) failf(format string, args ...interface{}) {
+	l.t.Helper()
+	l.t.Errorf(format, args...)
+}
+
+// scan reports any stored PSK or private key found in data
+func (l *leakCheck) scan(where string, data []byte) {
+	l.t.Helper()
+	if l.contains(data) {
+		l.failf("%s contains a secret", where)
+	}
+}
+
+func (l *leakCheck) contains(data []byte) bool {
+	for _, secret := range l.secrets {
+		if bytes.Contains(data, []byte(secret)) {
+			return true
+		}
+	}
+	return false
+}
+
+// do sends a request to the server. Responses of anonymous requests are
+// scanned for secrets.
+func (l *leakCheck) do(method, path string, body interface{}, header map[string]string) (int, []byte) {
+	l.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	l.echo.ServeHTTP(rec, req)
+
+	if header[echo.HeaderAuthorization] == "" {
+		l.scan(method+" "+path, rec.Body.Bytes())
+	}
+	return rec.Code, rec.Body.Bytes()
+}
+
+// expect sends a request and reports an unexpected status
+func (l *leakCheck) expect(status int, method, path string, body interface{}, header map[string]string) []byte {
+	l.t.Helper()
+	code, data := l.do(method, path, body, header)
+	if code != status {
+		l.failf("%s %s: expected status %d, got %d: %s", method, path, status, code, strings.TrimSpace(string(data)))
+	}
+	return data
+}
+
+func (l *leakCheck) run(s *Server) {
+	for _, peer := range []policy.PeerInfo{
+		{ID: "check-a", Hostname: "check-a", Platform: "linux", IPAddress: "192.0.2.1",
+			Tags: []string{"check"}, Metadata: map[string]string{"subnets": "10.1.0.0/24"}},
+		{ID: "check-b", Hostname: "check-b", Platform: "linux", IPAddress: "192.0.2.2",
+			Tags: []string{"check"}, Metadata: map[string]string{"subnets": "10.2.0.0/24"}},
+	} {
+		l.expect(http.StatusCreated, http.MethodPost, "/api/peers/register", peer, nil)
+	}
+
+	base := policy.Policy{
+		ID:        "check-base",
+		Name:      "Secret check base",
+		Enabled:   true,
+		AppliesTo: []string{"check-a"},
+		Tunnels:   []ipsec.TunnelConfig{checkTunnel("check-a-to-b", checkSecrets[0])},
+	}
+	child := policy.Policy{
+		ID:        "check-child",
+		Name:      "Secret check child",
+		Enabled:   true,
+		Extends:   base.ID,
+		AppliesTo: []string{"check-b"},
+	}
+	l.expect(http.StatusCreated, http.MethodPost, "/api/policies", base, nil)
+	l.expect(http.StatusCreated, http.MethodPost, "/api/policies", child, nil)
+
+	// A redacted policy saves as it is and keeps its secret
+	var stored policy.Policy
+	json.Unmarshal(l.expect(http.StatusOK, http.MethodGet, "/api/policies/check-base", nil, nil), &stored)
+	if len(stored.Tunnels) != 1 || stored.Tunnels[0].Auth.Secret != policy.RedactedSecret {
+		l.failf("GET /api/policies/check-base: secret is not redacted")
+	}
+	stored.Description = "Saved from its redacted form"
+	l.expect(http.StatusOK, http.MethodPut, "/api/policies/check-base", stored, map[string]string{"If-Match": policyETag(1)})
+
+	// A new secret, so that diffs and previews cover a changed secret
+	base.Tunnels[0].Auth.Secret = checkSecrets[1]
+	l.expect(http.StatusOK, http.MethodPost, "/api/policies/preview", previewRequest{Policy: &base}, nil)
+	l.expect(http.StatusOK, http.MethodPut, "/api/policies/check-base", base, map[string]string{"If-Match": policyETag(2)})
+
+	topology := policy.Topology{
+		ID:      "check-mesh",
+		Name:    "Secret check mesh",
+		Enabled: true,
+		Mode:    policy.TopologyMesh,
+		Members: []string{"check"},
+		Crypto:  checkTunnel("", "").Crypto,
+		Auth:    ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: checkSecrets[2]},
+	}
+	l.expect(http.StatusCreated, http.MethodPost, "/api/topologies", topology, nil)
+
+	base.Tunnels[0].Auth.Secret = checkSecrets[3]
+	var started rolloutResponse
+	json.Unmarshal(l.expect(http.StatusCreated, http.MethodPost, "/api/rollouts",
+		rolloutRequest{Policy: base, Strategy: policy.RolloutStrategy{Canary: 1, Pause: "1h"}},
+		map[string]string{"If-Match": policyETag(3)}), &started)
+	rolloutID := "none"
+	if started.Rollout != nil {
+		rolloutID = started.Rollout.ID
+	}
+
+	rotationID := l.rotate(s)
+
+	// A tunnel of check-a reads its PSK from the secret store
+	l.expect(http.StatusCreated, http.MethodPost, "/api/secrets",
+		policy.StoredSecret{Name: "check-store", Secret: checkSecrets[5]}, nil)
+	referring := policy.Policy{
+		ID:        "check-ref",
+		Name:      "Secret check reference",
+		Enabled:   true,
+		AppliesTo: []string{"check-a"},
+		Tunnels:   []ipsec.TunnelConfig{checkTunnel("check-referring", "")},
+	}
+	referring.Tunnels[0].Auth.SecretRef = "store:check-store"
+	referring.Tunnels[0].TrafficSelectors = []ipsec.TrafficSelector{{LocalSubnet: "10.3.0.0/24", RemoteSubnet: "10.4.0.0/24"}}
+	l.expect(http.StatusCreated, http.MethodPost, "/api/policies", referring, nil)
+	l.expect(http.StatusConflict, http.MethodDelete, "/api/secrets/check-store", nil, map[string]string{"If-Match": policyETag(1)})
+
+	serial := l.certify(s)
+
+	// Every documented read, anonymously
+	ids := map[string]string{
+		"certificates": serial,
+		"policies":     base.ID,
+		"peers":        "check-a",
+		"rollouts":     rolloutID,
+		"rotations":    rotationID,
+		"secrets":      "check-store",
+		"topologies":   topology.ID,
+	}
+	for _, op := range apiOperations {
+		if op.Method != http.MethodGet {
+			continue
+		}
+		segments := strings.Split(op.Path, "/")
+		for i, segment := range segments {
+			switch segment {
+			case ":id":
+				segments[i] = ids[segments[1]]
+			case ":rev":
+				segments[i] = "1"
+			case ":name":
+				segments[i] = "check-a-to-b"
+			}
+		}
+		path := "/api" + strings.Join(segments, "/")
+		l.do(http.MethodGet, path, nil, nil)
+	}
+	l.do(http.MethodGet, "/api/policies?peer_id=check-a", nil, nil)
+
+	// The agent and the admin get the secrets, and only with their tokens
+	agent := map[string]string{echo.HeaderAuthorization: "Bearer " + s.agentToken}
+	admin := map[string]string{echo.HeaderAuthorization: "Bearer " + s.adminToken}
+	if data := l.expect(http.StatusOK, http.MethodGet, "/api/policies?peer_id=check-b", nil, agent); !l.contains(data) {
+		l.failf("GET /api/policies?peer_id=check-b: the agent does not get the PSK")
+	}
+	if data := l.expect(http.StatusOK, http.MethodGet, "/api/policies?peer_id=check-a", nil, agent); !bytes.Contains(data, []byte(checkSecrets[5])) {
+		l.failf("GET /api/policies?peer_id=check-a: the agent does not get the PSK from the secret store")
+	}
+	if data := l.expect(http.StatusOK, http.MethodGet, "/api/topologies/check-mesh?reveal=secrets", nil, admin); !l.contains(data) {
+		l.failf("GET /api/topologies/check-mesh?reveal=secrets: the admin does not get the PSK")
+	}
+	if data := l.expect(http.StatusOK, http.MethodGet, "/api/secrets/check-store?reveal=secrets", nil, admin); !l.contains(data) {
+		l.failf("GET /api/secrets/check-store?reveal=secrets: the admin does not get the PSK")
+	}
+	l.expect(http.StatusUnauthorized, http.MethodGet, "/api/policies?peer_id=check-b", nil, admin)
+	l.expect(http.StatusUnauthorized, http.MethodGet, "/api/policies/check-base?reveal=secrets", nil, agent)
+	l.expect(http.StatusUnauthorized, http.MethodGet, "/api/policies/check-base?reveal=secrets", nil, nil)
+}
+
+// certify has the built-in CA issue check-a a certificate at registration
+// and renew it, revokes the first one, and checks the CRL lists it. It adds
+// parts of the CA's and the peer's private keys to the secrets to look for,
+// and returns the serial of the revoked certificate.
+func (l *leakCheck) certify(s *Server) string {
+	agent := map[string]string{echo.HeaderAuthorization: "Bearer " + s.agentToken}
+	keyPEM, csrPEM, err := policy.NewPeerKey("check-a")
+	if err != nil {
+		l.failf("failed to generate a peer key: %v", err)
+		return "none"
+	}
+	l.secrets = append(l.secrets, pemFragment(keyPEM))
+
+	peer := policy.PeerInfo{ID: "check-a", Hostname: "check-a", Platform: "linux", IPAddress: "192.0.2.1",
+		Tags: []string{"check"}, Metadata: map[string]string{"subnets": "10.1.0.0/24"}}
+	var anonymous registerResponse
+	json.Unmarshal(l.expect(http.StatusCreated, http.MethodPost, "/api/peers/register",
+		registerRequest{PeerInfo: peer, CSR: csrPEM}, nil), &anonymous)
+	if anonymous.Certificate != nil || anonymous.CertificateError == "" {
+		l.failf("POST /api/peers/register: a certificate is issued without the agent token")
+	}
+
+	var registered registerResponse
+	json.Unmarshal(l.expect(http.StatusCreated, http.MethodPost, "/api/peers/register",
+		registerRequest{PeerInfo: peer, CSR: csrPEM}, agent), &registered)
+	if registered.Certificate == nil {
+		l.failf("POST /api/peers/register: no certificate issued: %s", registered.CertificateError)
+		return "none"
+	}
+	if pair, err := s.storage.GetCA(context.Background()); err == nil {
+		l.secrets = append(l.secrets, pemFragment(pair.Key))
+	} else {
+		l.failf("failed to read the CA: %v", err)
+	}
+
+	l.expect(http.StatusUnauthorized, http.MethodPost, "/api/peers/check-a/certificate", certificateRequest{CSR: csrPEM}, nil)
+	l.expect(http.StatusCreated, http.MethodPost, "/api/peers/check-a/certificate", certificateRequest{CSR: csrPEM}, agent)
+
+	// A tunnel may use the certificate without naming any files
+	builtin := policy.Policy{
+		ID:        "check-builtin",
+		Name:      "Secret check certificate",
+		Enabled:   true,
+		AppliesTo: []string{"check-none"},
+		Tunnels:   []ipsec.TunnelConfig{checkTunnel("check-certified", "")},
+	}
+	builtin.Tunnels[0].Auth = ipsec.AuthConfig{Type: ipsec.AuthCertificate, Issuer: ipsec.IssuerBuiltin}
+	l.expect(http.StatusCreated, http.MethodPost, "/api/policies", builtin, nil)
+
+	serial := registered.Certificate.Serial
+	admin := map[string]string{echo.HeaderAuthorization: "Bearer " + s.adminToken}
+	l.expect(http.StatusUnauthorized, http.MethodPost, "/api/certificates/"+serial+"/revoke",
+		revokeRequest{Reason: "key_compromise"}, agent)
+	l.expect(http.StatusOK, http.MethodPost, "/api/certificates/"+serial+"/revoke",
+		revokeRequest{Reason: "key_compromise"}, admin)
+	_, data := l.do(http.MethodGet, "/api/ca/crl", nil, nil)
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		l.failf("GET /api/ca/crl: %v", err)
+		return serial
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Text(16) != serial {
+		l.failf("GET /api/ca/crl: the revoked certificate is not listed")
+	}
+	return serial
+}
+
+// pemFragment returns a line of a PEM document's body, which only a copy of
+// the document contains
+func pemFragment(text string) string {
+	lines := strings.Split(text, "\n")
+	if len(lines) < 3 {
+		return text
+	}
+	return lines[1]
+}
+
+// rotate rotates the PSK of a policy of its own through every step, learning
+// the generated PSK from the admin, and returns the rotation's ID
+func (l *leakCheck) rotate(s *Server) string {
+	rotated := policy.Policy{
+		ID:        "check-rotate",
+		Name:      "Secret check rotation",
+		Enabled:   true,
+		AppliesTo: []string{"check-none"},
+		Tunnels:   []ipsec.TunnelConfig{checkTunnel("check-rotated", checkSecrets[4])},
+	}
+	l.expect(http.StatusCreated, http.MethodPost, "/api/policies", rotated, nil)
+
+	var rotation policy.PSKRotation
+	json.Unmarshal(l.expect(http.StatusCreated, http.MethodPost, "/api/rotations",
+		rotationRequest{PolicyID: rotated.ID, Tunnel: "check-rotated"}, nil), &rotation)
+	if rotation.ID == "" {
+		return "none"
+	}
+
+	admin := map[string]string{echo.HeaderAuthorization: "Bearer " + s.adminToken}
+	var staged policy.Policy
+	json.Unmarshal(l.expect(http.StatusOK, http.MethodGet, "/api/policies/check-rotate?reveal=secrets", nil, admin), &staged)
+	if len(staged.Tunnels) != 1 || staged.Tunnels[0].Auth.StandbySecret == "" || staged.Tunnels[0].Auth.StandbySecret == policy.RedactedSecret {
+		l.failf("GET /api/policies/check-rotate?reveal=secrets: the admin does not get the new PSK")
+		return rotation.ID
+	}
+	l.secrets = append(l.secrets, staged.Tunnels[0].Auth.StandbySecret)
+
+	// No peer receives the policy, so each step is confirmed straight away
+	for _, state := range []policy.RotationState{policy.RotationSwitching, policy.RotationFinishing, policy.RotationCompleted} {
+		s.advanceRotations(context.Background())
+		l.do(http.MethodGet, "/api/policies/check-rotate", nil, nil)
+		l.do(http.MethodGet, "/api/policies/check-rotate/diff", nil, nil)
+		json.Unmarshal(l.expect(http.StatusOK, http.MethodGet, "/api/rotations/"+rotation.ID, nil, nil), &rotation)
+		if rotation.State != state {
+			l.failf("rotation %s is %s, expected %s", rotation.ID, rotation.State, state)
+		}
+	}
+	return rotation.ID
+}
+
+// checkTunnel returns a valid PSK tunnel from check-a to check-b
+func checkTunnel(name, secret string) ipsec.TunnelConfig {
+	return ipsec.TunnelConfig{
+		Name:          name,
+		Mode:          ipsec.ModeESPTunnel,
+		LocalAddress:  "192.0.2.1",
+		RemoteAddress: "192.0.2.2",
+		Crypto: ipsec.CryptoConfig{
+			Encryption: ipsec.EncryptionAES256GCM,
+			Integrity:  ipsec.IntegritySHA256,
+			DHGroup:    ipsec.DHGroupECP256,
+			IKEVersion: ipsec.IKEv2,
+			Lifetime:   time.Hour,
+		},
+		Auth: ipsec.AuthConfig{Type: ipsec.AuthPSK, Secret: secret},
+		TrafficSelectors: []ipsec.TrafficSelector{
+			{LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24"},
+		},
+	}
+}
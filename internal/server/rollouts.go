@@ -0,0 +1,418 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// Rollouts are advanced by a background loop from the agents' health reports
+// and can be controlled through the API. rolloutMu serialises every change
+// to a rollout, and also the reads that decide which version a peer gets, so
+// that an agent never sees an updated policy before its rollout exists.
+
+// distributedPolicies returns the policies a peer should apply: the stored
+// policies, with the baseline in place of any policy whose rollout has not
+// reached the peer yet and merged with their bases, plus the peer's share of
+// every topology, filtered and resolved for the peer
+func (s *Server) distributedPolicies(ctx context.Context, peer *policy.PeerInfo) ([]policy.Policy, error) {
+	s.rolloutMu.Lock()
+	policies, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		s.rolloutMu.Unlock()
+		return nil, err
+	}
+	rollouts, err := s.storage.ListRollouts(ctx, "", true)
+	s.rolloutMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// A policy extending one under rollout follows the version its base has for the peer
+	policies, err = policy.ResolveInheritance(policy.ApplyRollouts(policies, rollouts, peer.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err = s.withTopologies(ctx, policies, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.engine.PoliciesForPeer(policies, peer)
+}
+
+// checkActiveRollout rejects changes to a policy while a rollout of it is in
+// progress; the rollout has to complete or be rolled back first
+func (s *Server) checkActiveRollout(ctx context.Context, policyID string) (int, interface{}) {
+	rollouts, err := s.storage.ListRollouts(ctx, policyID, true)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list rollouts")
+		return http.StatusInternalServerError, map[string]string{
+			"error": "Failed to check rollouts",
+		}
+	}
+	if len(rollouts) > 0 {
+		return http.StatusConflict, map[string]interface{}{
+			"error":      "Policy has a rollout in progress",
+			"rollout_id": rollouts[0].ID,
+		}
+	}
+	return 0, nil
+}
+
+// runRollouts advances running rollouts every interval until the server stops
+func (s *Server) runRollouts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.advanceRollouts(context.Background())
+		}
+	}
+}
+
+// advanceRollouts starts, promotes or fails the current wave of every
+// running rollout, rolling back the ones that failed
+func (s *Server) advanceRollouts(ctx context.Context) {
+	s.rolloutMu.Lock()
+	defer s.rolloutMu.Unlock()
+
+	rollouts, err := s.storage.ListRollouts(ctx, "", true)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list rollouts")
+		return
+	}
+	if len(rollouts) == 0 {
+		return
+	}
+
+	reports, err := s.storage.ListPeerReports(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peer reports")
+		return
+	}
+
+	now := time.Now()
+	for i := range rollouts {
+		rollout := &rollouts[i]
+
+		event := rollout.Advance(now, reports)
+		switch event {
+		case policy.RolloutNoChange:
+			continue
+		case policy.RolloutFailed:
+			wave := rollout.Waves[rollout.CurrentWave]
+			log.Warn().
+				Str("rollout_id", rollout.ID).
+				Str("policy_id", rollout.PolicyID).
+				Interface("unhealthy", wave.Unhealthy).
+				Msg("Rollout wave failed, rolling back")
+			if err := s.rollbackRollout(ctx, rollout, rollout.Message, ""); err != nil {
+				log.Error().Err(err).Str("rollout_id", rollout.ID).Msg("Failed to roll back rollout")
+			}
+			continue
+		}
+
+		if err := s.storage.SaveRollout(ctx, rollout); err != nil {
+			log.Error().Err(err).Str("rollout_id", rollout.ID).Msg("Failed to save rollout")
+			continue
+		}
+		s.auditRollout(ctx, string(event), rollout, "")
+	}
+}
+
+// rollbackRollout restores the baseline as a new version of the policy, so
+// that every peer gets it back, and marks the rollout rolled back. The
+// baseline is not validated again: it was in force before the rollout and
+// restoring it must not be blocked by rules added since.
+func (s *Server) rollbackRollout(ctx context.Context, rollout *policy.Rollout, reason, ip string) error {
+	current, err := s.storage.GetPolicy(ctx, rollout.PolicyID)
+	switch {
+	case errors.Is(err, policy.ErrPolicyNotFound):
+		// Deleted since; nothing to restore
+	case err != nil:
+		return err
+	default:
+		restored := rollout.Baseline
+		restored.Version = current.Version
+		if err := s.storage.SavePolicy(ctx, &restored); err != nil {
+			return fmt.Errorf("failed to restore baseline: %w", err)
+		}
+		s.storage.AuditLog(ctx, "rollback", "policy", restored.ID, "", ip, map[string]interface{}{
+			"name":     restored.Name,
+			"rollout":  rollout.ID,
+			"restored": rollout.FromVersion,
+		})
+	}
+
+	rollout.RolledBack(time.Now(), reason)
+	if err := s.storage.SaveRollout(ctx, rollout); err != nil {
+		return err
+	}
+	s.auditRollout(ctx, "rollback", rollout, ip)
+	return nil
+}
+
+func (s *Server) auditRollout(ctx context.Context, action string, rollout *policy.Rollout, ip string) {
+	log.Info().
+		Str("rollout_id", rollout.ID).
+		Str("policy_id", rollout.PolicyID).
+		Str("state", string(rollout.State)).
+		Int("wave", rollout.CurrentWave+1).
+		Msgf("Rollout: %s", action)
+
+	s.storage.AuditLog(ctx, action, "rollout", rollout.ID, "", ip, map[string]interface{}{
+		"policy_id":  rollout.PolicyID,
+		"to_version": rollout.ToVersion,
+		"state":      rollout.State,
+		"wave":       rollout.CurrentWave + 1,
+		"message":    rollout.Message,
+	})
+}
+
+// Rollout handlers
+
+func (s *Server) handleListRollouts(c echo.Context) error {
+	rollouts, err := s.storage.ListRollouts(c.Request().Context(),
+		c.QueryParam("policy_id"), c.QueryParam("active") == "true")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list rollouts")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list rollouts",
+		})
+	}
+
+	return c.JSON(http.StatusOK, rollouts)
+}
+
+// rolloutRequest is a policy update to stage and how to stage it
+type rolloutRequest struct {
+	Policy   policy.Policy          `json:"policy"`
+	Strategy policy.RolloutStrategy `json:"strategy"`
+}
+
+// rolloutResponse is a new rollout together with the saved policy
+type rolloutResponse struct {
+	Rollout *policy.Rollout `json:"rollout"`
+	Policy  policyResponse  `json:"policy"`
+}
+
+// handleCreateRollout saves a policy update and stages it across the peers
+// it targets. Like a plain update, it requires If-Match with the version the
+// update is based on, and runs the same checks before saving.
+func (s *Server) handleCreateRollout(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	version, ok := parseIfMatch(c)
+	if !ok {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"error": "If-Match header with the current policy ETag is required",
+		})
+	}
+
+	var req rolloutRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request format",
+		})
+	}
+
+	if err := req.Strategy.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid rollout strategy: %v", err),
+		})
+	}
+
+	pol := req.Policy
+	baseline, err := s.storage.GetPolicy(ctx, pol.ID)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy not found",
+		})
+	}
+	pol.Version = version
+	policy.RestoreSecrets(&pol, baseline)
+	policy.KeepRotationState(&pol, baseline)
+
+	if status, body := s.checkActiveRollout(ctx, pol.ID); status != 0 {
+		return c.JSON(status, body)
+	}
+	if status, body := s.checkActiveRotation(ctx, pol.ID); status != 0 {
+		return c.JSON(status, body)
+	}
+
+	resolved, status, body := s.resolvePolicy(ctx, &pol)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	findings, failed := s.validatePolicy(resolved)
+	if failed != nil {
+		return c.JSON(http.StatusBadRequest, failed)
+	}
+
+	compatibility, status, body := s.checkPeers(ctx, &pol, resolved)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	children, status, body := s.checkDescendants(ctx, &pol)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	// Waves are planned over the peers the flattened versions target
+	resolvedBaseline, status, body := s.resolvePolicy(ctx, baseline)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peers")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list peers",
+		})
+	}
+
+	s.rolloutMu.Lock()
+	defer s.rolloutMu.Unlock()
+
+	if err := s.storage.SavePolicy(ctx, &pol); err != nil {
+		status, message := policyWriteError(err, "Failed to update policy")
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Msg("Failed to update policy")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
+		})
+	}
+
+	rollout, err := policy.NewRollout(resolvedBaseline, resolved, peers, req.Strategy)
+	if err == nil {
+		// Rolling back restores the stored overlay, not its flattened form
+		rollout.Baseline = *baseline
+		rollout.ToVersion = pol.Version
+		err = s.storage.SaveRollout(ctx, rollout)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("policy_id", pol.ID).Msg("Failed to save rollout; update is live for all peers")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Policy was updated but the rollout could not be saved",
+		})
+	}
+
+	s.storage.AuditLog(ctx, "update", "policy", pol.ID, "",
+		c.RealIP(), map[string]string{"name": pol.Name, "rollout": rollout.ID})
+	s.auditRollout(ctx, "start", rollout, c.RealIP())
+
+	// The canary wave starts right away rather than on the next tick
+	if event := rollout.Advance(time.Now(), nil); event != policy.RolloutNoChange {
+		if err := s.storage.SaveRollout(ctx, rollout); err != nil {
+			log.Error().Err(err).Str("rollout_id", rollout.ID).Msg("Failed to save rollout")
+		}
+		s.auditRollout(ctx, string(event), rollout, c.RealIP())
+	}
+
+	c.Response().Header().Set("ETag", policyETag(pol.Version))
+	return c.JSON(http.StatusCreated, rolloutResponse{
+		Rollout: rollout,
+		Policy:  policyResponse{Policy: pol, Findings: findings, Compatibility: compatibility, Children: children},
+	})
+}
+
+func (s *Server) handleGetRollout(c echo.Context) error {
+	rollout, err := s.storage.GetRollout(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Rollout not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, rollout)
+}
+
+// handleRolloutAction pauses, resumes, promotes or rolls back a rollout
+func (s *Server) handleRolloutAction(c echo.Context) error {
+	ctx := c.Request().Context()
+	action := c.Param("action")
+
+	s.rolloutMu.Lock()
+	defer s.rolloutMu.Unlock()
+
+	rollout, err := s.storage.GetRollout(ctx, c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Rollout not found",
+		})
+	}
+
+	if !rollout.Active() {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": fmt.Sprintf("Rollout is %s", rollout.State),
+		})
+	}
+
+	now := time.Now()
+	switch action {
+	case "pause":
+		if rollout.State != policy.RolloutRunning {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": "Rollout is not running",
+			})
+		}
+		rollout.State = policy.RolloutPaused
+		rollout.UpdatedAt = now
+
+	case "resume":
+		if rollout.State != policy.RolloutPaused {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": "Rollout is not paused",
+			})
+		}
+		rollout.State = policy.RolloutRunning
+		rollout.UpdatedAt = now
+
+	case "promote":
+		if _, err := rollout.Promote(now); err != nil {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": err.Error(),
+			})
+		}
+
+	case "rollback":
+		if err := s.rollbackRollout(ctx, rollout, "rolled back by request", c.RealIP()); err != nil {
+			log.Error().Err(err).Str("rollout_id", rollout.ID).Msg("Failed to roll back rollout")
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to roll back rollout",
+			})
+		}
+		return c.JSON(http.StatusOK, rollout)
+
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Action must be pause, resume, promote or rollback",
+		})
+	}
+
+	if err := s.storage.SaveRollout(ctx, rollout); err != nil {
+		log.Error().Err(err).Str("rollout_id", rollout.ID).Msg("Failed to save rollout")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save rollout",
+		})
+	}
+	s.auditRollout(ctx, action, rollout, c.RealIP())
+
+	return c.JSON(http.StatusOK, rollout)
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// PSK rotations are started on demand through the API or by the same
+// background loop that advances them, for tunnels whose rotate_every came
+// due. rotationMu serialises every change to a rotation. Each step is saved
+// to all of the rotation's policies in one transaction, so an agent never
+// receives one end of a tunnel at a different step from the other. Steps
+// advance on agent reports, so rotations need the agent token, and every
+// peer receiving the tunnels must be able to hold a standby PSK.
+
+// runRotations starts due rotations and advances active ones every interval
+// until the server stops
+func (s *Server) runRotations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			ctx := context.Background()
+			s.advanceRotations(ctx)
+			s.scheduleRotations(ctx)
+		}
+	}
+}
+
+// checkActiveRotation rejects changes to a policy while a rotation of one of
+// its tunnels is in progress
+func (s *Server) checkActiveRotation(ctx context.Context, policyID string) (int, interface{}) {
+	rotations, err := s.storage.ListRotations(ctx, policyID, true)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list rotations")
+		return http.StatusInternalServerError, map[string]string{
+			"error": "Failed to check rotations",
+		}
+	}
+	if len(rotations) > 0 {
+		return http.StatusConflict, map[string]interface{}{
+			"error":       "Policy has a PSK rotation in progress",
+			"rotation_id": rotations[0].ID,
+		}
+	}
+	return 0, nil
+}
+
+// startRotation plans a rotation of a tunnel's PSK and stages the new PSK on
+// the tunnel and its other ends. It fails with a status and body if the
+// tunnel cannot be rotated, or one of the policies involved has a rollout
+// or another rotation in progress.
+func (s *Server) startRotation(ctx context.Context, policyID, tunnel, trigger, ip string) (*policy.PSKRotation, int, interface{}) {
+	if s.agentToken == "" {
+		return nil, http.StatusForbidden, map[string]string{
+			"error": "PSK rotation is disabled: no agent token is configured to authenticate agent reports",
+		}
+	}
+
+	s.rotationMu.Lock()
+	defer s.rotationMu.Unlock()
+
+	policies, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return nil, http.StatusInternalServerError, map[string]string{"error": "Failed to list policies"}
+	}
+
+	rotation, err := policy.NewPSKRotation(policies, policyID, tunnel, trigger)
+	switch {
+	case errors.Is(err, policy.ErrPolicyNotFound):
+		return nil, http.StatusNotFound, map[string]string{"error": "Policy not found"}
+	case errors.Is(err, policy.ErrTunnelNotFound):
+		return nil, http.StatusNotFound, map[string]string{"error": "Tunnel not found"}
+	case err != nil:
+		return nil, http.StatusBadRequest, map[string]string{"error": err.Error()}
+	}
+
+	if status, body := s.checkRotationPlatforms(ctx, rotation); status != 0 {
+		return nil, status, body
+	}
+
+	checked := make(map[string]bool)
+	for _, t := range rotation.Tunnels {
+		if checked[t.PolicyID] {
+			continue
+		}
+		checked[t.PolicyID] = true
+		if status, body := s.checkActiveRollout(ctx, t.PolicyID); status != 0 {
+			return nil, status, body
+		}
+		if status, body := s.checkActiveRotation(ctx, t.PolicyID); status != 0 {
+			return nil, status, body
+		}
+	}
+
+	secret, err := policy.GeneratePSK()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate PSK")
+		return nil, http.StatusInternalServerError, map[string]string{"error": "Failed to generate PSK"}
+	}
+
+	// The rotation is saved first, so that the tunnels never carry a
+	// rotation the server does not know about
+	now := time.Now()
+	rotation.StepStartedAt = now
+	if err := s.storage.SaveRotation(ctx, rotation); err != nil {
+		log.Error().Err(err).Msg("Failed to save rotation")
+		return nil, http.StatusInternalServerError, map[string]string{"error": "Failed to save rotation"}
+	}
+	if err := s.storage.SavePolicies(ctx, rotation.Apply(policies, secret)); err != nil {
+		log.Error().Err(err).Str("rotation_id", rotation.ID).Msg("Failed to stage the new PSK")
+		rotation.Cancel(now, "failed to stage the new PSK")
+		if err := s.storage.SaveRotation(ctx, rotation); err != nil {
+			log.Error().Err(err).Str("rotation_id", rotation.ID).Msg("Failed to save rotation")
+		}
+		status, message := policyWriteError(err, "Failed to stage the new PSK")
+		return nil, status, map[string]string{"error": message}
+	}
+
+	s.auditRotation(ctx, "start", rotation, ip)
+	return rotation, 0, nil
+}
+
+// checkRotationPlatforms rejects a rotation if a peer receiving one of its
+// tunnels is on a platform whose backend cannot hold a standby PSK: its end
+// would switch to the new PSK alone, and drop the tunnel until the other end
+// switches too
+func (s *Server) checkRotationPlatforms(ctx context.Context, rotation *policy.PSKRotation) (int, interface{}) {
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peers")
+		return http.StatusInternalServerError, map[string]string{"error": "Failed to list peers"}
+	}
+
+	var incapable []string
+	for i := range peers {
+		peer := &peers[i]
+		caps, ok := policy.LookupPlatformCapabilities(peer.Platform)
+		if ok && caps.Rotation {
+			continue
+		}
+		policies, err := s.distributedPolicies(ctx, peer)
+		if err != nil {
+			log.Warn().Err(err).Str("peer_id", peer.ID).Msg("Failed to build policies for peer")
+			continue
+		}
+		for name, source := range s.engine.MergeTunnels(policies).Sources {
+			if rotation.Includes(source, name) {
+				incapable = append(incapable, peer.ID)
+				break
+			}
+		}
+	}
+	if len(incapable) > 0 {
+		slices.Sort(incapable)
+		return http.StatusConflict, map[string]interface{}{
+			"error": "Peers receiving the tunnels cannot hold a standby PSK, so their PSK cannot be rotated",
+			"peers": incapable,
+		}
+	}
+	return 0, nil
+}
+
+// advanceRotations moves every active rotation whose peers all confirmed
+// the current step on to the next one
+func (s *Server) advanceRotations(ctx context.Context) {
+	s.rotationMu.Lock()
+	defer s.rotationMu.Unlock()
+
+	rotations, err := s.storage.ListRotations(ctx, "", true)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list rotations")
+		return
+	}
+	if len(rotations) == 0 {
+		return
+	}
+
+	tunnels, err := s.rotationTunnels(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list the tunnels of rotations")
+		return
+	}
+	reports, err := s.storage.ListPeerReports(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peer reports")
+		return
+	}
+
+	for i := range rotations {
+		rotation := &rotations[i]
+
+		peers, confirmed := rotation.Peers, rotation.Confirmed
+		if !rotation.Confirm(tunnels[rotation.ID], reports) {
+			if !slices.Equal(peers, rotation.Peers) || !slices.Equal(confirmed, rotation.Confirmed) {
+				if err := s.storage.SaveRotation(ctx, rotation); err != nil {
+					log.Error().Err(err).Str("rotation_id", rotation.ID).Msg("Failed to save rotation")
+				}
+			}
+			continue
+		}
+
+		if err := s.nextRotationStep(ctx, rotation); err != nil {
+			log.Error().Err(err).Str("rotation_id", rotation.ID).Msg("Failed to advance rotation")
+		}
+	}
+}
+
+// nextRotationStep writes the rotation's next step to its policies
+func (s *Server) nextRotationStep(ctx context.Context, rotation *policy.PSKRotation) error {
+	rotation.Next(time.Now())
+
+	if rotation.State != policy.RotationCompleted {
+		policies, err := s.storage.ListPolicies(ctx, false)
+		if err != nil {
+			return err
+		}
+		if err := s.storage.SavePolicies(ctx, rotation.Apply(policies, "")); err != nil {
+			return err
+		}
+	}
+
+	if err := s.storage.SaveRotation(ctx, rotation); err != nil {
+		return err
+	}
+
+	action := map[policy.RotationState]string{
+		policy.RotationSwitching: "switch",
+		policy.RotationFinishing: "finish",
+		policy.RotationCompleted: "complete",
+	}[rotation.State]
+	s.auditRotation(ctx, action, rotation, "")
+	return nil
+}
+
+// rotationTunnels returns, per active rotation, the peers receiving one of
+// its tunnels and the names of those tunnels, as the agents merge them
+func (s *Server) rotationTunnels(ctx context.Context) (map[string]map[string][]string, error) {
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnels := make(map[string]map[string][]string)
+	for i := range peers {
+		peer := &peers[i]
+		policies, err := s.distributedPolicies(ctx, peer)
+		if err != nil {
+			// A peer whose policies cannot be built keeps its current tunnels
+			log.Warn().Err(err).Str("peer_id", peer.ID).Msg("Failed to build policies for peer")
+			continue
+		}
+		for _, tunnel := range s.engine.MergeTunnels(policies).Tunnels {
+			id, _, found := strings.Cut(tunnel.Auth.Rotation, "/")
+			if !found {
+				continue
+			}
+			if tunnels[id] == nil {
+				tunnels[id] = make(map[string][]string)
+			}
+			tunnels[id][peer.ID] = append(tunnels[id][peer.ID], tunnel.Name)
+		}
+	}
+	return tunnels, nil
+}
+
+// scheduleRotations starts a rotation for every tunnel of an enabled policy
+// whose rotate_every has passed since its last rotation, or since the
+// policy was created. Tunnels that cannot be rotated right now are tried
+// again on the next tick.
+func (s *Server) scheduleRotations(ctx context.Context) {
+	policies, err := s.storage.ListPolicies(ctx, true)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return
+	}
+	rotations, err := s.storage.ListRotations(ctx, "", false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list rotations")
+		return
+	}
+
+	now := time.Now()
+	for _, pol := range policies {
+		for _, tunnel := range pol.Tunnels {
+			if tunnel.Auth.RotateEvery == "" || tunnel.Auth.Secret == "" {
+				continue
+			}
+			interval, err := policy.ParseRotationInterval(tunnel.Auth.RotateEvery)
+			if err != nil {
+				continue
+			}
+
+			last := pol.CreatedAt
+			for _, rotation := range rotations {
+				if rotation.State == policy.RotationCancelled || !rotation.Includes(pol.ID, tunnel.Name) {
+					continue
+				}
+				if rotation.CreatedAt.After(last) {
+					last = rotation.CreatedAt
+				}
+			}
+			if now.Before(last.Add(interval)) {
+				continue
+			}
+
+			rotation, status, body := s.startRotation(ctx, pol.ID, tunnel.Name, policy.RotationScheduled, "")
+			if status != 0 {
+				log.Debug().Str("policy_id", pol.ID).Str("tunnel", tunnel.Name).
+					Interface("reason", body).Msg("Scheduled PSK rotation postponed")
+				continue
+			}
+			// Rotations started here cover other tunnels too
+			rotations = append(rotations, *rotation)
+		}
+	}
+}
+
+func (s *Server) auditRotation(ctx context.Context, action string, rotation *policy.PSKRotation, ip string) {
+	log.Info().
+		Str("rotation_id", rotation.ID).
+		Str("state", string(rotation.State)).
+		Int("tunnels", len(rotation.Tunnels)).
+		Msgf("PSK rotation: %s", action)
+
+	s.storage.AuditLog(ctx, action, "psk_rotation", rotation.ID, "", ip, map[string]interface{}{
+		"tunnels": rotation.Tunnels,
+		"trigger": rotation.Trigger,
+		"state":   rotation.State,
+		"peers":   rotation.Peers,
+		"message": rotation.Message,
+	})
+}
+
+// Rotation handlers
+
+func (s *Server) handleListRotations(c echo.Context) error {
+	rotations, err := s.storage.ListRotations(c.Request().Context(),
+		c.QueryParam("policy_id"), c.QueryParam("active") == "true")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list rotations")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list rotations",
+		})
+	}
+
+	return c.JSON(http.StatusOK, rotations)
+}
+
+// rotationRequest names the tunnel whose PSK to rotate
+type rotationRequest struct {
+	PolicyID string `json:"policy_id"`
+	Tunnel   string `json:"tunnel"`
+}
+
+// handleCreateRotation rotates a tunnel's PSK now
+func (s *Server) handleCreateRotation(c echo.Context) error {
+	var req rotationRequest
+	if err := c.Bind(&req); err != nil || req.PolicyID == "" || req.Tunnel == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "policy_id and tunnel are required",
+		})
+	}
+
+	rotation, status, body := s.startRotation(c.Request().Context(), req.PolicyID, req.Tunnel, policy.RotationManual, c.RealIP())
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	return c.JSON(http.StatusCreated, rotation)
+}
+
+func (s *Server) handleGetRotation(c echo.Context) error {
+	rotation, err := s.storage.GetRotation(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Rotation not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, rotation)
+}
+
+// handleCancelRotation drops the new PSK of a rotation that is still staging
+func (s *Server) handleCancelRotation(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	s.rotationMu.Lock()
+	defer s.rotationMu.Unlock()
+
+	rotation, err := s.storage.GetRotation(ctx, c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Rotation not found",
+		})
+	}
+
+	if err := rotation.Cancel(time.Now(), "cancelled by request"); err != nil {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": fmt.Sprintf("Rotation is %s; only a staging rotation can be cancelled", rotation.State),
+		})
+	}
+
+	policies, err := s.storage.ListPolicies(ctx, false)
+	if err == nil {
+		err = s.storage.SavePolicies(ctx, rotation.Apply(policies, ""))
+	}
+	if err == nil {
+		err = s.storage.SaveRotation(ctx, rotation)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("rotation_id", rotation.ID).Msg("Failed to cancel rotation")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to cancel rotation",
+		})
+	}
+	s.auditRotation(ctx, "cancel", rotation, c.RealIP())
+
+	return c.JSON(http.StatusOK, rotation)
+}
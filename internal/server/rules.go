@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// Custom validation rules come from "validation.rules" in the server config
+// and from every *.yaml, *.yml or *.json file in "validation.rules_dir", each
+// holding a top-level "rules" list. Both are polled for changes and reloaded
+// without a restart; a set that fails to load leaves the previous rules active.
+// Reloads read the config file into their own viper instance, so the rest of
+// the server keeps reading the global one without locking.
+
+// ruleStatus records the outcome of the last rule load
+type ruleStatus struct {
+	mu          sync.Mutex
+	sources     []string
+	loadedAt    time.Time
+	err         error
+	dir         string // validation.rules_dir as of the last load
+	fingerprint string
+}
+
+// rulesConfig returns the current server configuration: the config file read
+// afresh, or the global configuration if the server was started without one
+func rulesConfig() (*viper.Viper, error) {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return viper.GetViper(), nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to re-read config file: %w", err)
+	}
+	return v, nil
+}
+
+// loadRules reads the inline rules followed by the rule files, in name order
+func loadRules(config *viper.Viper) ([]policy.Rule, []string, error) {
+	var rules []policy.Rule
+	var sources []string
+
+	if config.IsSet("validation.rules") {
+		if err := config.UnmarshalKey("validation.rules", &rules); err != nil {
+			return nil, nil, fmt.Errorf("validation.rules: %w", err)
+		}
+		sources = append(sources, "config")
+	}
+
+	files, err := ruleFiles(config.GetString("validation.rules_dir"))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range files {
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		var fileRules []policy.Rule
+		if err := v.UnmarshalKey("rules", &fileRules); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		rules = append(rules, fileRules...)
+		sources = append(sources, path)
+	}
+
+	return rules, sources, nil
+}
+
+func ruleFiles(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules directory: %w", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// rulesFingerprint summarises the config file and rule files, so that the
+// watcher only reloads when one of them changes
+func rulesFingerprint(dir string) string {
+	paths := []string{viper.ConfigFileUsed()}
+	files, _ := ruleFiles(dir)
+	paths = append(paths, files...)
+
+	var sb strings.Builder
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&sb, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return sb.String()
+}
+
+// reloadRules loads the custom rules and installs them in the policy engine
+func (s *Server) reloadRules() error {
+	s.rules.mu.Lock()
+	defer s.rules.mu.Unlock()
+
+	// Recorded first, so that a config file that fails to read is not retried
+	// until it changes again
+	s.rules.fingerprint = rulesFingerprint(s.rules.dir)
+
+	config, err := rulesConfig()
+	if err != nil {
+		s.rules.err = err
+		log.Error().Err(err).Msg("Failed to load validation rules, keeping previous rules")
+		return err
+	}
+
+	s.rules.dir = config.GetString("validation.rules_dir")
+	s.rules.fingerprint = rulesFingerprint(s.rules.dir)
+
+	rules, sources, err := loadRules(config)
+	if err == nil {
+		err = s.engine.SetRules(rules)
+	}
+	if err != nil {
+		s.rules.err = err
+		log.Error().Err(err).Msg("Failed to load validation rules, keeping previous rules")
+		return err
+	}
+
+	s.rules.sources = sources
+	s.rules.loadedAt = time.Now()
+	s.rules.err = nil
+	log.Info().Int("rules", len(rules)).Strs("sources", sources).Msg("Validation rules loaded")
+	return nil
+}
+
+// watchRules polls the config file and rules directory and reloads the rules
+// when either changes
+func (s *Server) watchRules(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.rules.mu.Lock()
+			changed := rulesFingerprint(s.rules.dir) != s.rules.fingerprint
+			s.rules.mu.Unlock()
+			if !changed {
+				continue
+			}
+
+			s.reloadRules()
+		}
+	}
+}
+
+// Rule handlers
+
+func (s *Server) handleListRules(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.rulesResponse())
+}
+
+func (s *Server) handleReloadRules(c echo.Context) error {
+	if err := s.reloadRules(); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Failed to load validation rules: %v", err),
+		})
+	}
+
+	s.storage.AuditLog(c.Request().Context(), "reload", "rules", "", "", c.RealIP(), nil)
+
+	return c.JSON(http.StatusOK, s.rulesResponse())
+}
+
+// ruleSetResponse lists the loaded validation rules and where they came from
+type ruleSetResponse struct {
+	Rules    []policy.Rule `json:"rules"`
+	Sources  []string      `json:"sources"`
+	LoadedAt time.Time     `json:"loaded_at"`
+	Error    string        `json:"error,omitempty"` // Why the last reload failed; the previous rules stay in force
+}
+
+func (s *Server) rulesResponse() ruleSetResponse {
+	s.rules.mu.Lock()
+	defer s.rules.mu.Unlock()
+
+	body := ruleSetResponse{
+		Rules:    s.engine.Rules(),
+		Sources:  s.rules.sources,
+		LoadedAt: s.rules.loadedAt,
+	}
+	if s.rules.err != nil {
+		body.Error = s.rules.err.Error()
+	}
+	return body
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// Policies with NotBefore or NotAfter start and stop being distributed on
+// their own; agents pick the change up on their next sync. The scheduler only
+// observes those transitions, so that each activation and expiry leaves an
+// audit event. The last state it saw for each policy is stored, which keeps
+// transitions that happen while the server is down from being lost.
+
+// runScheduler checks policy schedules every interval until the server stops
+func (s *Server) runScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.checkSchedules(context.Background())
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.checkSchedules(context.Background())
+		}
+	}
+}
+
+// checkSchedules records the schedule state of every policy and audits the
+// ones that activated or expired since the last check
+func (s *Server) checkSchedules(ctx context.Context) {
+	policies, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies for scheduler")
+		return
+	}
+
+	// Schedules may be inherited from a base policy
+	policies, err = policy.ResolveInheritance(policies)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to resolve policy inheritance for scheduler")
+		return
+	}
+
+	states, err := s.storage.ScheduleStates(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load policy schedule states")
+		return
+	}
+
+	now := time.Now()
+	for i := range policies {
+		pol := &policies[i]
+		schedule := policy.ScheduleAt(pol, now)
+
+		previous, seen := states[pol.ID]
+		delete(states, pol.ID)
+		if !seen {
+			// Not seen yet: compare with the state it was saved in
+			previous = policy.ScheduleAt(pol, pol.UpdatedAt).State
+		}
+		if seen && previous == schedule.State {
+			continue
+		}
+
+		switch {
+		case schedule.State == policy.ScheduleActive && previous == policy.SchedulePending:
+			s.auditSchedule(ctx, "activate", pol, schedule)
+		case schedule.State == policy.ScheduleExpired &&
+			(previous == policy.ScheduleActive || previous == policy.SchedulePending):
+			s.auditSchedule(ctx, "expire", pol, schedule)
+		}
+
+		if err := s.storage.SetScheduleState(ctx, pol.ID, schedule.State); err != nil {
+			log.Error().Err(err).Str("policy_id", pol.ID).Msg("Failed to save policy schedule state")
+		}
+	}
+
+	// Whatever is left belongs to deleted policies
+	for id := range states {
+		if err := s.storage.DeleteScheduleState(ctx, id); err != nil {
+			log.Error().Err(err).Str("policy_id", id).Msg("Failed to delete policy schedule state")
+		}
+	}
+}
+
+func (s *Server) auditSchedule(ctx context.Context, action string, pol *policy.Policy, schedule policy.PolicySchedule) {
+	log.Info().
+		Str("policy_id", pol.ID).
+		Str("name", pol.Name).
+		Str("state", string(schedule.State)).
+		Msgf("Policy schedule: %s", action)
+
+	s.storage.AuditLog(ctx, action, "policy", pol.ID, "", "", map[string]interface{}{
+		"name":         pol.Name,
+		"version":      pol.Version,
+		"activates_at": schedule.ActivatesAt,
+		"expires_at":   schedule.ExpiresAt,
+	})
+}
+
+// Schedule handlers
+
+// scheduleResponse is a policy's schedule as of the server's clock
+type scheduleResponse struct {
+	PolicyID           string                     `json:"policy_id"`
+	ServerTime         time.Time                  `json:"server_time"`
+	Schedule           policy.PolicySchedule      `json:"schedule"`
+	NotBefore          *time.Time                 `json:"not_before"`
+	NotAfter           *time.Time                 `json:"not_after"`
+	MaintenanceWindows []policy.MaintenanceWindow `json:"maintenance_windows"`
+}
+
+func (s *Server) handleGetPolicySchedule(c echo.Context) error {
+	pol, err := s.storage.GetPolicy(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy not found",
+		})
+	}
+
+	now := time.Now()
+	return c.JSON(http.StatusOK, scheduleResponse{
+		PolicyID:           pol.ID,
+		ServerTime:         now,
+		Schedule:           policy.ScheduleAt(pol, now),
+		NotBefore:          pol.NotBefore,
+		NotAfter:           pol.NotAfter,
+		MaintenanceWindows: pol.MaintenanceWindows,
+	})
+}
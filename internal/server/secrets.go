@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// Tunnels can name their PSK with secret_ref rather than carry it. The
+// server resolves store:, file: and env: references into auth.secret as it
+// serves a peer's policies, and leaves agent: references for the agent. A
+// reference it cannot resolve fails the peer's fetch like an unresolved
+// template, so the agent keeps its current tunnels. Each store entry handed
+// to a peer is audited once per version.
+
+// resolveSecretRefs fills in the PSK of each tunnel in a peer's policies
+// whose secret_ref the server resolves. It returns policy.TemplateErrors
+// listing the references it could not resolve.
+func (s *Server) resolveSecretRefs(c echo.Context, peer *policy.PeerInfo, policies []policy.Policy) error {
+	ctx := c.Request().Context()
+	revealed, _ := c.Get(revealSecretsKey).(bool)
+
+	var errs policy.TemplateErrors
+	for i := range policies {
+		for j := range policies[i].Tunnels {
+			auth := &policies[i].Tunnels[j].Auth
+			if auth.Type != ipsec.AuthPSK || auth.SecretRef == "" {
+				continue
+			}
+			ref, err := policy.ParseSecretRef(auth.SecretRef)
+			if err == nil && ref.Agent {
+				continue
+			}
+
+			var secret string
+			if err == nil {
+				secret, err = s.readSecretRef(ctx, ref, peer, revealed)
+			}
+			if err != nil {
+				errs = append(errs, policy.TemplateError{
+					PolicyID: policies[i].ID,
+					Tunnel:   policies[i].Tunnels[j].Name,
+					Field:    "auth.secret_ref",
+					Message:  err.Error(),
+				})
+				continue
+			}
+			auth.Secret = secret
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// readSecretRef reads a reference the server resolves. Store entries read
+// for a response that carries secrets are audited.
+func (s *Server) readSecretRef(ctx context.Context, ref policy.SecretRef, peer *policy.PeerInfo, revealed bool) (string, error) {
+	if ref.Kind != policy.SecretRefStore {
+		return ref.ReadLocal(s.secretDir)
+	}
+
+	entry, err := s.storage.GetSecret(ctx, ref.Name)
+	if errors.Is(err, policy.ErrSecretNotFound) {
+		return "", fmt.Errorf("secret store has no entry %s", ref.Name)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("secret", ref.Name).Msg("Failed to read secret")
+		return "", fmt.Errorf("failed to read secret store entry %s", ref.Name)
+	}
+	if revealed {
+		s.auditSecretAccess(ctx, entry, peer)
+	}
+	return entry.Secret, nil
+}
+
+// auditSecretAccess records that a store entry was handed to a peer, once
+// for each version of the entry and peer
+func (s *Server) auditSecretAccess(ctx context.Context, entry *policy.StoredSecret, peer *policy.PeerInfo) {
+	key := entry.Name + "\x00" + peer.ID
+
+	s.secretAccessMu.Lock()
+	seen := s.secretAccess[key] == entry.Version
+	s.secretAccess[key] = entry.Version
+	s.secretAccessMu.Unlock()
+	if seen {
+		return
+	}
+
+	s.storage.AuditLog(ctx, "resolve", "secret", entry.Name, "", "", map[string]interface{}{
+		"peer_id": peer.ID,
+		"version": entry.Version,
+	})
+}
+
+// secretUsers returns the IDs of the policies and topologies whose tunnels
+// refer to a store entry
+func (s *Server) secretUsers(ctx context.Context, name string) ([]string, error) {
+	ref := policy.SecretRef{Kind: policy.SecretRefStore, Name: name}.String()
+
+	policies, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, pol := range policies {
+		for _, tunnel := range pol.Tunnels {
+			if tunnel.Auth.SecretRef == ref {
+				users = append(users, pol.ID)
+				break
+			}
+		}
+	}
+
+	topologies, err := s.storage.ListTopologies(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, topology := range topologies {
+		if topology.Auth.SecretRef == ref {
+			users = append(users, topology.PolicyID())
+		}
+	}
+	return users, nil
+}
+
+// secretWriteError maps an error from a conditional secret write to an HTTP
+// status and message, falling back to 500 with the given message
+func secretWriteError(err error, fallback string) (int, string) {
+	switch {
+	case errors.Is(err, policy.ErrVersionConflict):
+		return http.StatusPreconditionFailed, "Secret has been modified since it was read"
+	case errors.Is(err, policy.ErrSecretNotFound):
+		return http.StatusNotFound, "Secret not found"
+	}
+	return http.StatusInternalServerError, fallback
+}
+
+// Secret store handlers
+
+func (s *Server) handleListSecrets(c echo.Context) error {
+	entries, err := s.storage.ListSecrets(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list secrets")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list secrets",
+		})
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+func (s *Server) handleCreateSecret(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var entry policy.StoredSecret
+	if err := c.Bind(&entry); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid secret format",
+		})
+	}
+	if err := entry.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Secret validation failed: %v", err),
+		})
+	}
+
+	// The server owns the version; a new entry always starts at 1
+	entry.Version = 0
+
+	if err := s.storage.SaveSecret(ctx, &entry); err != nil {
+		if errors.Is(err, policy.ErrVersionConflict) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": "Secret already exists",
+			})
+		}
+		log.Error().Err(err).Msg("Failed to save secret")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save secret",
+		})
+	}
+
+	s.storage.AuditLog(ctx, "create", "secret", entry.Name, "",
+		c.RealIP(), map[string]interface{}{"version": entry.Version})
+
+	log.Info().Str("secret", entry.Name).Msg("Secret created")
+
+	c.Response().Header().Set("ETag", policyETag(entry.Version))
+	return c.JSON(http.StatusCreated, entry)
+}
+
+func (s *Server) handleGetSecret(c echo.Context) error {
+	entry, err := s.storage.GetSecret(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		if !errors.Is(err, policy.ErrSecretNotFound) {
+			log.Error().Err(err).Msg("Failed to get secret")
+		}
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Secret not found",
+		})
+	}
+
+	c.Response().Header().Set("ETag", policyETag(entry.Version))
+	return c.JSON(http.StatusOK, entry)
+}
+
+func (s *Server) handleUpdateSecret(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	version, ok := parseIfMatch(c)
+	if !ok {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"error": "If-Match header with the current secret ETag is required",
+		})
+	}
+
+	var entry policy.StoredSecret
+	if err := c.Bind(&entry); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid secret format",
+		})
+	}
+
+	entry.Name = c.Param("id") // Ensure the name matches URL
+	entry.Version = version
+
+	// A redacted secret keeps the stored one, so the description can be
+	// changed without revealing it
+	if entry.Secret == policy.RedactedSecret {
+		if stored, err := s.storage.GetSecret(ctx, entry.Name); err == nil {
+			entry.Secret = stored.Secret
+		}
+	}
+
+	if err := entry.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Secret validation failed: %v", err),
+		})
+	}
+
+	if err := s.storage.SaveSecret(ctx, &entry); err != nil {
+		status, message := secretWriteError(err, "Failed to update secret")
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Msg("Failed to update secret")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
+		})
+	}
+
+	s.storage.AuditLog(ctx, "update", "secret", entry.Name, "",
+		c.RealIP(), map[string]interface{}{"version": entry.Version})
+
+	log.Info().Str("secret", entry.Name).Msg("Secret updated")
+
+	c.Response().Header().Set("ETag", policyETag(entry.Version))
+	return c.JSON(http.StatusOK, entry)
+}
+
+func (s *Server) handleDeleteSecret(c echo.Context) error {
+	ctx := c.Request().Context()
+	name := c.Param("id")
+
+	version, ok := parseIfMatch(c)
+	if !ok {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"error": "If-Match header with the current secret ETag is required",
+		})
+	}
+
+	users, err := s.secretUsers(ctx, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to check secret references")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to check secret references",
+		})
+	}
+	if len(users) > 0 {
+		return c.JSON(http.StatusConflict, map[string]interface{}{
+			"error":       "Secret is referenced by tunnels",
+			"referred_by": users,
+		})
+	}
+
+	if err := s.storage.DeleteSecret(ctx, name, version); err != nil {
+		status, message := secretWriteError(err, "Failed to delete secret")
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Msg("Failed to delete secret")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
+		})
+	}
+
+	s.storage.AuditLog(ctx, "delete", "secret", name, "",
+		c.RealIP(), nil)
+
+	log.Info().Str("secret", name).Msg("Secret deleted")
+
+	return c.NoContent(http.StatusNoContent)
+}
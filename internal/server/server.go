@@ -1,10 +1,16 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
@@ -16,62 +22,285 @@ import (
 type Server struct {
 	storage *policy.Storage
 	engine  *policy.PolicyEngine
+	rules   ruleStatus
+	stop    chan struct{}
+
+	agentToken string // Lets agents fetch their policies with secrets
+	adminToken string // Authorises ?reveal=secrets
+	secretDir  string // Directory file: secret references are read from
+
+	// Store secrets already delivered to each peer, to audit each version once
+	secretAccess   map[string]int
+	secretAccessMu sync.Mutex
+
+	ca   *policy.CertificateAuthority // Built-in CA, loaded on first use
+	caMu sync.Mutex
+
+	rolloutMu  sync.Mutex
+	rotationMu sync.Mutex
 }
 
 // New creates a new server instance
 func New() (*Server, error) {
-	// Get database path
+	// Create storage
+	storage, err := OpenStorage()
+	if err != nil {
+		return nil, err
+	}
+	dbPath := viper.GetString("server.db_path")
+
+	// Create policy engine
+	engine, err := newEngine()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	s := &Server{
+		storage:    storage,
+		engine:     engine,
+		stop:       make(chan struct{}),
+		agentToken: viper.GetString("auth.agent_token"),
+		adminToken: viper.GetString("auth.admin_token"),
+		secretDir:  viper.GetString("secrets.ref_dir"),
+
+		secretAccess: make(map[string]int),
+	}
+	if s.secretDir == "" {
+		s.secretDir = policy.DefaultSecretDir
+	}
+	if s.agentToken == "" {
+		log.Warn().Msg("No agent token configured, agents receive redacted secrets and cannot configure PSK tunnels")
+	}
+
+	// Load custom validation rules and watch them for changes
+	if err := s.reloadRules(); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("invalid validation rules: %w", err)
+	}
+	interval := viper.GetDuration("validation.rules_reload_interval")
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go s.watchRules(interval)
+
+	// Audit scheduled policy activation and expiry
+	scheduleInterval := viper.GetDuration("scheduler.interval")
+	if scheduleInterval <= 0 {
+		scheduleInterval = 30 * time.Second
+	}
+	go s.runScheduler(scheduleInterval)
+
+	// Advance staged rollouts from agent health reports
+	rolloutInterval := viper.GetDuration("rollouts.interval")
+	if rolloutInterval <= 0 {
+		rolloutInterval = 15 * time.Second
+	}
+	go s.runRollouts(rolloutInterval)
+
+	// Start scheduled PSK rotations and advance them from agent reports
+	rotationInterval := viper.GetDuration("rotations.interval")
+	if rotationInterval <= 0 {
+		rotationInterval = 30 * time.Second
+	}
+	go s.runRotations(rotationInterval)
+
+	log.Info().Str("db_path", dbPath).Msg("Server initialized")
+
+	return s, nil
+}
+
+// OpenStorage opens the database configured in server.db_path, creating its
+// directory if needed
+func OpenStorage() (*policy.Storage, error) {
 	dbPath := viper.GetString("server.db_path")
-	
+
 	// Ensure directory exists
 	dir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
-	// Create storage
-	storage, err := policy.NewStorage(dbPath)
+	keys, err := LoadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		log.Warn().Msg("No master key configured, tunnel secrets are stored in plaintext")
+	}
+
+	storage, err := policy.NewStorage(dbPath, keys)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create storage: %w", err)
 	}
+	return storage, nil
+}
 
-	// Create policy engine
-	engine := policy.NewPolicyEngine()
+// LoadKeyring reads the master keys that encrypt secrets at rest from the
+// IPSEC_MASTER_KEY environment variable or, failing that, from the file
+// named by secrets.master_key_file. It returns nil if neither is set.
+func LoadKeyring() (*policy.Keyring, error) {
+	if text := os.Getenv("IPSEC_MASTER_KEY"); text != "" {
+		keys, err := policy.ParseKeyring(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IPSEC_MASTER_KEY: %w", err)
+		}
+		return keys, nil
+	}
 
-	log.Info().Str("db_path", dbPath).Msg("Server initialized")
+	path := viper.GetString("secrets.master_key_file")
+	if path == "" {
+		return nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Warn().Str("path", path).Msg("Master key file is readable by other users")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %w", err)
+	}
+	keys, err := policy.ParseKeyring(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// NewPolicyEngine creates a policy engine that validates like the server:
+// with the configured compliance profiles, strict mode and custom rules. It
+// is meant for CLI commands that run without a server.
+func NewPolicyEngine() (*policy.PolicyEngine, error) {
+	engine, err := newEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, _, err := loadRules(viper.GetViper())
+	if err == nil {
+		err = engine.SetRules(rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid validation rules: %w", err)
+	}
+	return engine, nil
+}
+
+// newEngine creates a policy engine with the configured compliance settings
+// and strict mode
+func newEngine() (*policy.PolicyEngine, error) {
+	engine := policy.NewPolicyEngine()
+	err := engine.SetCompliance(policy.ComplianceSettings{
+		Default: viper.GetString("compliance.profile"),
+		Tags:    viper.GetStringMapString("compliance.tags"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid compliance configuration: %w", err)
+	}
+	engine.SetStrict(viper.GetBool("validation.strict"))
 
-	return &Server{
-		storage: storage,
-		engine:  engine,
-	}, nil
+	allowInline := true
+	if viper.IsSet("secrets.allow_inline") {
+		allowInline = viper.GetBool("secrets.allow_inline")
+	}
+	engine.SetSecretSettings(policy.SecretSettings{AllowInline: allowInline})
+	return engine, nil
 }
 
 // Close closes the server and its resources
 func (s *Server) Close() error {
+	close(s.stop)
 	return s.storage.Close()
 }
 
 // RegisterRoutes registers all API routes
 func (s *Server) RegisterRoutes(e *echo.Echo) {
-	api := e.Group("/api")
+	// Secrets are redacted from every response unless a request is
+	// authorised to see them
+	e.JSONSerializer = redactingSerializer{}
+	api := e.Group("/api", s.revealSecrets)
 
 	// Policy endpoints
 	api.GET("/policies", s.handleListPolicies)
 	api.POST("/policies", s.handleCreatePolicy)
+	api.POST("/policies/preview", s.handlePreviewPolicy)
 	api.GET("/policies/:id", s.handleGetPolicy)
 	api.PUT("/policies/:id", s.handleUpdatePolicy)
 	api.DELETE("/policies/:id", s.handleDeletePolicy)
+	api.GET("/policies/:id/revisions", s.handleListPolicyRevisions)
+	api.GET("/policies/:id/revisions/:rev", s.handleGetPolicyRevision)
+	api.GET("/policies/:id/diff", s.handleDiffPolicyRevisions)
+	api.POST("/policies/:id/rollback", s.handleRollbackPolicy)
+	api.GET("/policies/:id/compatibility", s.handlePolicyCompatibility)
+	api.GET("/policies/:id/schedule", s.handleGetPolicySchedule)
+	api.GET("/policies/:id/resolved", s.handleGetResolvedPolicy)
 
 	// Peer endpoints
 	api.POST("/peers/register", s.handleRegisterPeer)
 	api.GET("/peers", s.handleListPeers)
 	api.GET("/peers/:id", s.handleGetPeer)
+	api.GET("/peers/:id/tunnels", s.handleGetPeerTunnels)
 	api.PUT("/peers/:id/status", s.handleUpdatePeerStatus)
+	api.POST("/peers/:id/report", s.handlePeerReport)
+	api.POST("/peers/:id/certificate", s.handleRenewCertificate)
+
+	// Staged rollouts
+	api.GET("/rollouts", s.handleListRollouts)
+	api.POST("/rollouts", s.handleCreateRollout)
+	api.GET("/rollouts/:id", s.handleGetRollout)
+	api.POST("/rollouts/:id/:action", s.handleRolloutAction)
+
+	// PSK rotations
+	api.GET("/rotations", s.handleListRotations)
+	api.POST("/rotations", s.handleCreateRotation)
+	api.GET("/rotations/:id", s.handleGetRotation)
+	api.POST("/rotations/:id/cancel", s.handleCancelRotation)
+
+	// Secret store, for tunnels with secret_ref: store:NAME
+	api.GET("/secrets", s.handleListSecrets)
+	api.POST("/secrets", s.handleCreateSecret)
+	api.GET("/secrets/:id", s.handleGetSecret)
+	api.PUT("/secrets/:id", s.handleUpdateSecret)
+	api.DELETE("/secrets/:id", s.handleDeleteSecret)
+
+	// Built-in certificate authority, for tunnels with issuer: builtin
+	api.GET("/ca", s.handleGetCA)
+	api.GET("/ca/crl", s.handleGetCRL)
+	api.GET("/certificates", s.handleListCertificates)
+	api.GET("/certificates/:id", s.handleGetCertificate)
+	api.POST("/certificates/:id/revoke", s.handleRevokeCertificate)
+
+	// Generated topologies
+	api.GET("/topologies", s.handleListTopologies)
+	api.POST("/topologies", s.handleCreateTopology)
+	api.GET("/topologies/:id", s.handleGetTopology)
+	api.PUT("/topologies/:id", s.handleUpdateTopology)
+	api.DELETE("/topologies/:id", s.handleDeleteTopology)
+	api.GET("/topologies/:id/expansion", s.handleGetTopologyExpansion)
 
 	// Tunnel status endpoints
 	api.GET("/tunnels", s.handleListTunnels)
 	api.GET("/tunnels/:name", s.handleGetTunnel)
 
+	// Analysis endpoints
+	api.GET("/analysis/selectors", s.handleAnalyzeSelectors)
+
+	// Compliance endpoints
+	api.GET("/compliance/profiles", s.handleListComplianceProfiles)
+
+	// Validation rule endpoints
+	api.GET("/rules", s.handleListRules)
+	api.POST("/rules/reload", s.handleReloadRules)
+
+	// API description
+	api.GET("/openapi.json", s.handleOpenAPI)
+	api.GET("/schemas/policy.json", s.handlePolicySchema)
+
 	// Health check
 	api.GET("/health", s.handleHealth)
 }
@@ -82,16 +311,21 @@ func (s *Server) handleListPolicies(c echo.Context) error {
 	enabledOnly := c.QueryParam("enabled") == "true"
 	peerID := c.QueryParam("peer_id")
 
-	policies, err := s.storage.ListPolicies(c.Request().Context(), enabledOnly)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to list policies")
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to list policies",
-		})
-	}
-
-	// Filter for specific peer if requested
+	// Filter for specific peer if requested, as the agent would receive them
 	if peerID != "" {
+		// The agent authenticates to receive its secrets; other callers
+		// get them redacted
+		revealed, _ := c.Get(revealSecretsKey).(bool)
+		if c.Request().Header.Get(echo.HeaderAuthorization) != "" && !revealed {
+			if !bearerToken(c, s.agentToken) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": "Invalid agent token",
+				})
+			}
+			c.Set(revealSecretsKey, true)
+		}
+
 		peer, err := s.storage.GetPeer(c.Request().Context(), peerID)
 		if err != nil {
 			log.Error().Err(err).Str("peer_id", peerID).Msg("Failed to get peer")
@@ -100,7 +334,22 @@ func (s *Server) handleListPolicies(c echo.Context) error {
 			})
 		}
 
-		policies = s.engine.FilterPoliciesForPeer(policies, peer)
+		policies, err := s.distributedPolicies(c.Request().Context(), peer)
+		if err == nil {
+			err = s.resolveSecretRefs(c, peer, policies)
+		}
+		if err != nil {
+			return s.peerTemplateError(c, peer, err)
+		}
+		return c.JSON(http.StatusOK, policies)
+	}
+
+	policies, err := s.storage.ListPolicies(c.Request().Context(), enabledOnly)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list policies",
+		})
 	}
 
 	return c.JSON(http.StatusOK, policies)
@@ -115,15 +364,46 @@ func (s *Server) handleCreatePolicy(c echo.Context) error {
 		})
 	}
 
-	// Validate policy
-	if err := s.engine.Validate(&pol); err != nil {
+	// Generated policies are identified by their topology's ID
+	if policy.IsTopologyPolicy(pol.ID) {
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": fmt.Sprintf("Policy validation failed: %v", err),
+			"error": "Policy IDs starting with \"topology:\" are reserved for topologies",
 		})
 	}
 
+	// Checks run on the policy with its bases merged in
+	resolved, status, body := s.resolvePolicy(c.Request().Context(), &pol)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	// Validate policy
+	findings, failed := s.validatePolicy(resolved)
+	if failed != nil {
+		return c.JSON(http.StatusBadRequest, failed)
+	}
+
+	compatibility, status, body := s.checkPeers(c.Request().Context(), &pol, resolved)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	// The server owns the version and rotation state; a new policy always starts at 1
+	pol.Version = 0
+	policy.KeepRotationState(&pol, nil)
+
 	// Save policy
 	if err := s.storage.SavePolicy(c.Request().Context(), &pol); err != nil {
+		if errors.Is(err, policy.ErrVersionConflict) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": "Policy already exists",
+			})
+		}
+		if errors.Is(err, policy.ErrDuplicateName) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": fmt.Sprintf("A policy named %q already exists", pol.Name),
+			})
+		}
 		log.Error().Err(err).Msg("Failed to save policy")
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to save policy",
@@ -136,7 +416,93 @@ func (s *Server) handleCreatePolicy(c echo.Context) error {
 
 	log.Info().Str("policy_id", pol.ID).Str("name", pol.Name).Msg("Policy created")
 
-	return c.JSON(http.StatusCreated, pol)
+	c.Response().Header().Set("ETag", policyETag(pol.Version))
+	return c.JSON(http.StatusCreated, policyResponse{Policy: pol, Findings: findings, Compatibility: compatibility})
+}
+
+// previewRequest names the change to preview: exactly one of a candidate
+// policy or a policy to delete
+type previewRequest struct {
+	Policy *policy.Policy `json:"policy,omitempty"` // Candidate to create or update
+	Delete string         `json:"delete,omitempty"` // ID of a policy to delete
+}
+
+func (s *Server) handlePreviewPolicy(c echo.Context) error {
+	var req previewRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request format",
+		})
+	}
+
+	if (req.Policy == nil) == (req.Delete == "") {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Exactly one of policy or delete is required",
+		})
+	}
+
+	ctx := c.Request().Context()
+
+	current, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list policies",
+		})
+	}
+
+	var candidate []policy.Policy
+	if req.Policy != nil {
+		for i := range current {
+			if current[i].ID == req.Policy.ID {
+				policy.RestoreSecrets(req.Policy, &current[i])
+			}
+		}
+		resolved, status, body := s.resolvePolicy(ctx, req.Policy)
+		if status != 0 {
+			return c.JSON(status, body)
+		}
+		if _, failed := s.validatePolicy(resolved); failed != nil {
+			return c.JSON(http.StatusBadRequest, failed)
+		}
+		candidate = policy.WithPolicy(current, *req.Policy)
+	} else {
+		if _, err := s.storage.GetPolicy(ctx, req.Delete); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Policy not found",
+			})
+		}
+		candidate = policy.WithoutPolicy(current, req.Delete)
+	}
+
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peers")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list peers",
+		})
+	}
+
+	// Both sides are compared with every policy's bases merged in, so that
+	// the preview of a base shows the changes to the policies extending it
+	current, err = policy.ResolveInheritance(current)
+	if err == nil {
+		candidate, err = policy.ResolveInheritance(candidate)
+	}
+	if err != nil {
+		status, body := inheritanceErrorStatus(err)
+		return c.JSON(status, body)
+	}
+
+	preview, err := s.engine.Preview(current, candidate, peers)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to preview policy change")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to preview policy change",
+		})
+	}
+
+	return c.JSON(http.StatusOK, preview)
 }
 
 func (s *Server) handleGetPolicy(c echo.Context) error {
@@ -149,12 +515,50 @@ func (s *Server) handleGetPolicy(c echo.Context) error {
 		})
 	}
 
+	c.Response().Header().Set("ETag", policyETag(pol.Version))
 	return c.JSON(http.StatusOK, pol)
 }
 
+// handleGetResolvedPolicy returns a policy flattened with its bases, as it
+// is validated and served to agents
+func (s *Server) handleGetResolvedPolicy(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	pol, err := s.storage.GetPolicy(ctx, c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy not found",
+		})
+	}
+
+	current, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list policies",
+		})
+	}
+
+	resolved, chain, err := policy.FlattenPolicy(pol, current)
+	if err != nil {
+		status, body := inheritanceErrorStatus(err)
+		return c.JSON(status, body)
+	}
+
+	c.Response().Header().Set("ETag", policyETag(pol.Version))
+	return c.JSON(http.StatusOK, resolvedPolicy{Policy: resolved, Chain: chain})
+}
+
 func (s *Server) handleUpdatePolicy(c echo.Context) error {
 	id := c.Param("id")
 
+	version, ok := parseIfMatch(c)
+	if !ok {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"error": "If-Match header with the current policy ETag is required",
+		})
+	}
+
 	var pol policy.Policy
 	if err := c.Bind(&pol); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
@@ -163,19 +567,54 @@ func (s *Server) handleUpdatePolicy(c echo.Context) error {
 	}
 
 	pol.ID = id // Ensure ID matches URL
+	pol.Version = version
+
+	// Redacted secrets keep the stored ones, and rotations are the server's
+	stored, err := s.storage.GetPolicy(c.Request().Context(), id)
+	if err != nil {
+		stored = nil
+	}
+	policy.RestoreSecrets(&pol, stored)
+	policy.KeepRotationState(&pol, stored)
+
+	if status, body := s.checkActiveRollout(c.Request().Context(), id); status != 0 {
+		return c.JSON(status, body)
+	}
+	if status, body := s.checkActiveRotation(c.Request().Context(), id); status != 0 {
+		return c.JSON(status, body)
+	}
+
+	// Checks run on the policy with its bases merged in
+	resolved, status, body := s.resolvePolicy(c.Request().Context(), &pol)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
 
 	// Validate policy
-	if err := s.engine.Validate(&pol); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": fmt.Sprintf("Policy validation failed: %v", err),
-		})
+	findings, failed := s.validatePolicy(resolved)
+	if failed != nil {
+		return c.JSON(http.StatusBadRequest, failed)
+	}
+
+	compatibility, status, body := s.checkPeers(c.Request().Context(), &pol, resolved)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	// Policies extending this one change with it
+	children, status, body := s.checkDescendants(c.Request().Context(), &pol)
+	if status != 0 {
+		return c.JSON(status, body)
 	}
 
 	// Save policy
 	if err := s.storage.SavePolicy(c.Request().Context(), &pol); err != nil {
-		log.Error().Err(err).Msg("Failed to update policy")
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to update policy",
+		status, message := policyWriteError(err, "Failed to update policy")
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Msg("Failed to update policy")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
 		})
 	}
 
@@ -185,15 +624,49 @@ func (s *Server) handleUpdatePolicy(c echo.Context) error {
 
 	log.Info().Str("policy_id", pol.ID).Str("name", pol.Name).Msg("Policy updated")
 
-	return c.JSON(http.StatusOK, pol)
+	c.Response().Header().Set("ETag", policyETag(pol.Version))
+	return c.JSON(http.StatusOK, policyResponse{Policy: pol, Findings: findings, Compatibility: compatibility, Children: children})
 }
 
 func (s *Server) handleDeletePolicy(c echo.Context) error {
 	id := c.Param("id")
 
-	if err := s.storage.DeletePolicy(c.Request().Context(), id); err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Policy not found",
+	version, ok := parseIfMatch(c)
+	if !ok {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"error": "If-Match header with the current policy ETag is required",
+		})
+	}
+
+	if status, body := s.checkActiveRollout(c.Request().Context(), id); status != 0 {
+		return c.JSON(status, body)
+	}
+	if status, body := s.checkActiveRotation(c.Request().Context(), id); status != 0 {
+		return c.JSON(status, body)
+	}
+
+	// Policies extending this one would lose their base
+	current, err := s.storage.ListPolicies(c.Request().Context(), false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list policies",
+		})
+	}
+	if children := policy.Descendants(current, id); len(children) > 0 {
+		return c.JSON(http.StatusConflict, map[string]interface{}{
+			"error":    "Policy is extended by other policies",
+			"children": children,
+		})
+	}
+
+	if err := s.storage.DeletePolicy(c.Request().Context(), id, version); err != nil {
+		status, message := policyWriteError(err, "Failed to delete policy")
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Msg("Failed to delete policy")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
 		})
 	}
 
@@ -206,16 +679,445 @@ func (s *Server) handleDeletePolicy(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+func (s *Server) handleListPolicyRevisions(c echo.Context) error {
+	id := c.Param("id")
+
+	revisions, err := s.storage.ListPolicyRevisions(c.Request().Context(), id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, revisions)
+}
+
+func (s *Server) handleGetPolicyRevision(c echo.Context) error {
+	id := c.Param("id")
+
+	rev, err := strconv.Atoi(c.Param("rev"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid revision number",
+		})
+	}
+
+	revision, err := s.storage.GetPolicyRevision(c.Request().Context(), id, rev)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy revision not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, revision)
+}
+
+func (s *Server) handleDiffPolicyRevisions(c echo.Context) error {
+	id := c.Param("id")
+
+	revisions, err := s.storage.ListPolicyRevisions(c.Request().Context(), id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy not found",
+		})
+	}
+
+	// Default to comparing the latest revision with the one before it
+	latest := revisions[len(revisions)-1].Revision
+	from, to := latest-1, latest
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid from revision",
+			})
+		}
+	}
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid to revision",
+			})
+		}
+	}
+
+	var fromRev, toRev *policy.PolicyRevision
+	for i := range revisions {
+		if revisions[i].Revision == from {
+			fromRev = &revisions[i]
+		}
+		if revisions[i].Revision == to {
+			toRev = &revisions[i]
+		}
+	}
+	if fromRev == nil || toRev == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy revision not found",
+		})
+	}
+
+	changes, err := policy.DiffPolicies(&fromRev.Policy, &toRev.Policy)
+	if err != nil {
+		log.Error().Err(err).Str("policy_id", id).Msg("Failed to diff policy revisions")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to diff policy revisions",
+		})
+	}
+
+	return c.JSON(http.StatusOK, policy.PolicyDiff{
+		PolicyID: id,
+		From:     from,
+		To:       to,
+		Changes:  changes,
+	})
+}
+
+// rollbackRequest names the revision a policy is rolled back to
+type rollbackRequest struct {
+	Revision int `json:"revision"`
+}
+
+func (s *Server) handleRollbackPolicy(c echo.Context) error {
+	id := c.Param("id")
+
+	version, ok := parseIfMatch(c)
+	if !ok {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"error": "If-Match header with the current policy ETag is required",
+		})
+	}
+
+	var req rollbackRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request format",
+		})
+	}
+
+	revision, err := s.storage.GetPolicyRevision(c.Request().Context(), id, req.Revision)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy revision not found",
+		})
+	}
+
+	if status, body := s.checkActiveRollout(c.Request().Context(), id); status != 0 {
+		return c.JSON(status, body)
+	}
+	if status, body := s.checkActiveRotation(c.Request().Context(), id); status != 0 {
+		return c.JSON(status, body)
+	}
+
+	// Rolling back saves the old content as a new revision; history is never rewritten
+	pol := revision.Policy
+	pol.Version = version
+	current, err := s.storage.GetPolicy(c.Request().Context(), id)
+	if err != nil {
+		current = nil
+	}
+	// Rotated PSKs are not rolled back, as the tunnels' other ends have them too
+	policy.KeepRotatedSecrets(&pol, current)
+	policy.KeepRotationState(&pol, current)
+
+	// Validators may have tightened, and bases changed, since the revision was saved
+	resolved, status, body := s.resolvePolicy(c.Request().Context(), &pol)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	findings, failed := s.validatePolicy(resolved)
+	if failed != nil {
+		return c.JSON(http.StatusBadRequest, failed)
+	}
+
+	compatibility, status, body := s.checkPeers(c.Request().Context(), &pol, resolved)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	children, status, body := s.checkDescendants(c.Request().Context(), &pol)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	if err := s.storage.SavePolicy(c.Request().Context(), &pol); err != nil {
+		status, message := policyWriteError(err, "Failed to roll back policy")
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Msg("Failed to roll back policy")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
+		})
+	}
+
+	// Audit log
+	s.storage.AuditLog(c.Request().Context(), "rollback", "policy", pol.ID, "",
+		c.RealIP(), map[string]interface{}{"name": pol.Name, "revision": req.Revision})
+
+	log.Info().Str("policy_id", pol.ID).Int("revision", req.Revision).Msg("Policy rolled back")
+
+	c.Response().Header().Set("ETag", policyETag(pol.Version))
+	return c.JSON(http.StatusOK, policyResponse{Policy: pol, Findings: findings, Compatibility: compatibility, Children: children})
+}
+
+// policyResponse is a saved policy together with its validation findings
+type policyResponse struct {
+	policy.Policy
+	Findings      policy.Findings             `json:"findings"`
+	Compatibility *policy.CompatibilityReport `json:"compatibility,omitempty"` // Per peer, for the peers the policy reaches
+	Children      []string                    `json:"children,omitempty"`      // Policies extending this one, revalidated with it
+}
+
+// resolvedPolicy is a policy flattened with its bases
+type resolvedPolicy struct {
+	Policy *policy.Policy `json:"policy"`
+	Chain  []string       `json:"chain"` // The policy first, then its bases, the root last
+}
+
+// resolvePolicy merges a policy about to be saved with its stored bases. If
+// the chain of bases is broken or loops back to the policy, it also returns
+// a 400 status and body.
+func (s *Server) resolvePolicy(ctx context.Context, pol *policy.Policy) (*policy.Policy, int, interface{}) {
+	current, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return nil, http.StatusInternalServerError, map[string]string{"error": "Failed to list policies"}
+	}
+
+	resolved, _, err := policy.FlattenPolicy(pol, current)
+	if err != nil {
+		status, body := inheritanceErrorStatus(err)
+		return nil, status, body
+	}
+	return resolved, 0, nil
+}
+
+// checkDescendants re-resolves and validates the policies that extend a
+// policy about to be saved, as they would be with it saved. It returns their
+// IDs and, if any of them would no longer validate, a 400 status and body.
+func (s *Server) checkDescendants(ctx context.Context, pol *policy.Policy) ([]string, int, interface{}) {
+	current, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return nil, http.StatusInternalServerError, map[string]string{"error": "Failed to list policies"}
+	}
+
+	candidate := policy.WithPolicy(current, *pol)
+	children := policy.Descendants(candidate, pol.ID)
+	for _, id := range children {
+		var child *policy.Policy
+		for i := range candidate {
+			if candidate[i].ID == id {
+				child = &candidate[i]
+			}
+		}
+
+		resolved, _, err := policy.FlattenPolicy(child, candidate)
+		if err != nil {
+			status, body := inheritanceErrorStatus(err)
+			return nil, status, body
+		}
+		if _, failed := s.validatePolicy(resolved); failed != nil {
+			failed["error"] = fmt.Sprintf("Policy %s extends this policy: %s", id, failed["error"])
+			failed["policy_id"] = id
+			return nil, http.StatusBadRequest, failed
+		}
+	}
+	return children, 0, nil
+}
+
+// inheritanceErrorStatus maps an error from resolving a policy's bases to an
+// HTTP status and body
+func inheritanceErrorStatus(err error) (int, interface{}) {
+	var inheritance *policy.InheritanceError
+	if !errors.As(err, &inheritance) {
+		log.Error().Err(err).Msg("Failed to resolve policy inheritance")
+		return http.StatusInternalServerError, map[string]string{"error": "Failed to resolve policy inheritance"}
+	}
+	finding := inheritance.Finding()
+	return http.StatusBadRequest, map[string]interface{}{
+		"error":    fmt.Sprintf("Policy validation failed: %s", finding.Error()),
+		"findings": policy.Findings{finding},
+	}
+}
+
+// validatePolicy runs every validator on a policy. If the policy may not be
+// saved, it also returns the 400 response body, which lists all findings.
+func (s *Server) validatePolicy(pol *policy.Policy) (policy.Findings, map[string]interface{}) {
+	findings := s.engine.Check(pol)
+
+	blocking := findings.Blocking(s.engine.Strict())
+	if len(blocking) == 0 {
+		return findings, nil
+	}
+
+	msgs := make([]string, len(blocking))
+	for i, finding := range blocking {
+		msgs[i] = finding.Error()
+	}
+	return findings, map[string]interface{}{
+		"error":    fmt.Sprintf("Policy validation failed: %s", strings.Join(msgs, "; ")),
+		"findings": findings,
+	}
+}
+
+// peerCheckFailure is why a policy cannot go to the registered peers: a
+// message and the details, reported in the error body under Field
+type peerCheckFailure struct {
+	Message string
+	Field   string
+	Detail  interface{}
+}
+
+// body formats the failure as an HTTP error body
+func (f *peerCheckFailure) body() map[string]interface{} {
+	return map[string]interface{}{
+		"error": fmt.Sprintf("Policy validation failed: %s", f.Message),
+		f.Field: f.Detail,
+	}
+}
+
+// peerComplianceViolations lists the compliance violations of a policy on one peer
+type peerComplianceViolations struct {
+	PeerID     string                       `json:"peer_id"`
+	Hostname   string                       `json:"hostname"`
+	Violations []policy.ComplianceViolation `json:"violations"`
+}
+
+// checkPolicyOnPeers runs the checks that need the stored policies and the
+// registered peers, in order:
+//
+//   - the policy's traffic selectors must not overlap another tunnel on any
+//     peer that receives it;
+//   - it must meet the compliance profile required by the tags of every peer
+//     it applies to;
+//   - every peer it applies to must be able to configure its tunnels.
+//
+// pol is the policy as it will be stored and resolved the same with its
+// bases merged in; pending are other policies written along with it. It
+// returns the compatibility report and, if the policy is rejected, why. An
+// error means the checks could not run; it is an *policy.InheritanceError if
+// the stored policies with pol cannot be resolved.
+func checkPolicyOnPeers(ctx context.Context, storage *policy.Storage, engine *policy.PolicyEngine,
+	pol, resolved *policy.Policy, pending []policy.Policy) (*policy.CompatibilityReport, *peerCheckFailure, error) {
+	current, err := storage.ListPolicies(ctx, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+
+	peers, err := storage.ListPeers(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list peers: %w", err)
+	}
+
+	for _, other := range pending {
+		current = policy.WithPolicy(current, other)
+	}
+	candidate, err := policy.ResolveInheritance(policy.WithPolicy(current, *pol))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	analysis := engine.AnalyzeSelectors(candidate, peers)
+	if conflicts := analysis.ConflictsInvolving(pol.ID); len(conflicts) > 0 {
+		return nil, &peerCheckFailure{
+			Message: "traffic selectors overlap other tunnels on some peers",
+			Field:   "conflicts",
+			Detail:  conflicts,
+		}, nil
+	}
+
+	var failures []peerComplianceViolations
+	for i := range peers {
+		if violations := engine.CheckPeerCompliance(resolved, &peers[i]); len(violations) > 0 {
+			failures = append(failures, peerComplianceViolations{
+				PeerID:     peers[i].ID,
+				Hostname:   peers[i].Hostname,
+				Violations: violations,
+			})
+		}
+	}
+	if len(failures) > 0 {
+		return nil, &peerCheckFailure{
+			Message: fmt.Sprintf("peer %s: %s", failures[0].PeerID, failures[0].Violations[0].Error()),
+			Field:   "peers",
+			Detail:  failures,
+		}, nil
+	}
+
+	report := engine.CheckCompatibility(resolved, peers)
+	if report.Incompatible > 0 {
+		return report, &peerCheckFailure{
+			Message: fmt.Sprintf("%d peer(s) cannot configure its tunnels", report.Incompatible),
+			Field:   "compatibility",
+			Detail:  report,
+		}, nil
+	}
+	return report, nil, nil
+}
+
+// checkPeers runs checkPolicyOnPeers for a handler. It returns the
+// compatibility report and, if the policy is rejected or the checks could
+// not run, a non-zero status and error body.
+func (s *Server) checkPeers(ctx context.Context, pol, resolved *policy.Policy) (*policy.CompatibilityReport, int, interface{}) {
+	report, failure, err := checkPolicyOnPeers(ctx, s.storage, s.engine, pol, resolved, nil)
+	var inheritance *policy.InheritanceError
+	if errors.As(err, &inheritance) {
+		status, body := inheritanceErrorStatus(err)
+		return nil, status, body
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to check policy against peers")
+		return nil, http.StatusInternalServerError, map[string]string{"error": "Failed to check policy against peers"}
+	}
+	if failure != nil {
+		return nil, http.StatusBadRequest, failure.body()
+	}
+	return report, 0, nil
+}
+
+// policyETag formats a policy version as an HTTP entity tag
+func policyETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// parseIfMatch extracts the expected policy version from the If-Match header
+func parseIfMatch(c echo.Context) (int, bool) {
+	tag := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	tag = strings.TrimPrefix(tag, "W/")
+	tag = strings.Trim(tag, `"`)
+
+	version, err := strconv.Atoi(tag)
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// policyWriteError maps an error from a conditional policy write to an HTTP
+// status and message, falling back to 500 with the given message
+func policyWriteError(err error, fallback string) (int, string) {
+	switch {
+	case errors.Is(err, policy.ErrVersionConflict):
+		return http.StatusPreconditionFailed, "Policy has been modified since it was read"
+	case errors.Is(err, policy.ErrPolicyNotFound):
+		return http.StatusNotFound, "Policy not found"
+	case errors.Is(err, policy.ErrDuplicateName):
+		return http.StatusConflict, "Another policy already has this name"
+	}
+	return http.StatusInternalServerError, fallback
+}
+
 // Peer handlers
 
 func (s *Server) handleRegisterPeer(c echo.Context) error {
-	var peer policy.PeerInfo
-	if err := c.Bind(&peer); err != nil {
+	var req registerRequest
+	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error": "Invalid peer format",
 		})
 	}
 
+	peer := req.PeerInfo
 	peer.Status = policy.PeerStatusOnline
 
 	if err := s.storage.RegisterPeer(c.Request().Context(), &peer); err != nil {
@@ -231,7 +1133,12 @@ func (s *Server) handleRegisterPeer(c echo.Context) error {
 		Str("platform", peer.Platform).
 		Msg("Peer registered")
 
-	return c.JSON(http.StatusCreated, peer)
+	resp := registerResponse{PeerInfo: peer}
+	if req.CSR != "" {
+		resp.Certificate, resp.CertificateError = s.registerCertificate(c, &peer, req.CSR)
+	}
+
+	return c.JSON(http.StatusCreated, resp)
 }
 
 func (s *Server) handleListPeers(c echo.Context) error {
@@ -259,13 +1166,58 @@ func (s *Server) handleGetPeer(c echo.Context) error {
 	return c.JSON(http.StatusOK, peer)
 }
 
-func (s *Server) handleUpdatePeerStatus(c echo.Context) error {
+func (s *Server) handleGetPeerTunnels(c echo.Context) error {
 	id := c.Param("id")
 
-	var req struct {
-		Status policy.PeerStatus `json:"status"`
+	peer, err := s.storage.GetPeer(c.Request().Context(), id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Peer not found",
+		})
+	}
+
+	policies, err := s.distributedPolicies(c.Request().Context(), peer)
+	if err == nil {
+		err = s.resolveSecretRefs(c, peer, policies)
+	}
+	if err != nil {
+		return s.peerTemplateError(c, peer, err)
+	}
+
+	// Same merge path the agent uses, so both sides agree on the result
+	merged := s.engine.MergeTunnels(policies)
+
+	return c.JSON(http.StatusOK, merged)
+}
+
+// peerTemplateError reports policies whose tunnel templates or secret
+// references cannot be resolved for a peer. The agent keeps its current
+// tunnels rather than applying half-rendered ones.
+func (s *Server) peerTemplateError(c echo.Context, peer *policy.PeerInfo, err error) error {
+	var details policy.TemplateErrors
+	if !errors.As(err, &details) {
+		log.Error().Err(err).Str("peer_id", peer.ID).Msg("Failed to resolve policies for peer")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to resolve policies for peer",
+		})
 	}
 
+	log.Warn().Err(err).Str("peer_id", peer.ID).Msg("Unresolved tunnel fields for peer")
+	return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":   fmt.Sprintf("Policies cannot be resolved for peer %s", peer.ID),
+		"details": details,
+	})
+}
+
+// peerStatusRequest sets a peer's status
+type peerStatusRequest struct {
+	Status policy.PeerStatus `json:"status"`
+}
+
+func (s *Server) handleUpdatePeerStatus(c echo.Context) error {
+	id := c.Param("id")
+
+	var req peerStatusRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error": "Invalid request format",
@@ -281,6 +1233,56 @@ func (s *Server) handleUpdatePeerStatus(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+// handlePeerReport stores the applied policy versions and tunnel health an
+// agent reports; rollouts promote waves from these reports
+// handlePeerReport records an agent's report. Rollouts and rotations advance
+// on reports, so when an agent token is configured only agents may send them.
+func (s *Server) handlePeerReport(c echo.Context) error {
+	id := c.Param("id")
+
+	if s.agentToken != "" && !bearerToken(c, s.agentToken) {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "The agent token is required to report",
+		})
+	}
+
+	var report policy.PeerReport
+	if err := c.Bind(&report); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid report format",
+		})
+	}
+	if report.PeerID != "" && report.PeerID != id {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Report is for peer %s, not %s", report.PeerID, id),
+		})
+	}
+
+	if _, err := s.storage.GetPeer(c.Request().Context(), id); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Peer not found",
+		})
+	}
+
+	// Server time, since waves are timed with it
+	report.PeerID = id
+	report.ReportedAt = time.Now()
+
+	if err := s.storage.SavePeerReport(c.Request().Context(), &report); err != nil {
+		log.Error().Err(err).Str("peer_id", id).Msg("Failed to save peer report")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save peer report",
+		})
+	}
+
+	if err := s.storage.UpdatePeerStatus(c.Request().Context(), id, policy.PeerStatusOnline); err != nil {
+		log.Warn().Err(err).Str("peer_id", id).Msg("Failed to update peer status")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 // Tunnel handlers
 
 func (s *Server) handleListTunnels(c echo.Context) error {
@@ -296,11 +1298,90 @@ func (s *Server) handleGetTunnel(c echo.Context) error {
 	})
 }
 
+// handlePolicyCompatibility reports which peers can configure a saved policy
+func (s *Server) handlePolicyCompatibility(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	pol, err := s.storage.GetPolicy(ctx, c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Policy not found",
+		})
+	}
+
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peers")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list peers",
+		})
+	}
+
+	current, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list policies",
+		})
+	}
+
+	resolved, _, err := policy.FlattenPolicy(pol, current)
+	if err != nil {
+		status, body := inheritanceErrorStatus(err)
+		return c.JSON(status, body)
+	}
+
+	return c.JSON(http.StatusOK, s.engine.CheckCompatibility(resolved, peers))
+}
+
+// Analysis handlers
+
+func (s *Server) handleAnalyzeSelectors(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	// Disabled policies are analysed as bases only
+	policies, err := s.storage.ListPolicies(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list policies",
+		})
+	}
+
+	policies, err = policy.ResolveInheritance(policies)
+	if err != nil {
+		status, body := inheritanceErrorStatus(err)
+		return c.JSON(status, body)
+	}
+
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peers")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list peers",
+		})
+	}
+
+	return c.JSON(http.StatusOK, s.engine.AnalyzeSelectors(policies, peers))
+}
+
+// Compliance handlers
+
+func (s *Server) handleListComplianceProfiles(c echo.Context) error {
+	return c.JSON(http.StatusOK, policy.ComplianceProfiles())
+}
+
 // Health check
 
+// healthResponse reports that the server is up
+type healthResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+}
+
 func (s *Server) handleHealth(c echo.Context) error {
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"status":  "healthy",
-		"version": "0.1.0",
+	return c.JSON(http.StatusOK, healthResponse{
+		Status:  "healthy",
+		Version: apiVersion,
 	})
 }
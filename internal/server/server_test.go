@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/swavlamban/ipsec-manager/internal/ipsec"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// newTestServer returns the routes of a server on a scratch database
+func newTestServer(t *testing.T) *echo.Echo {
+	t.Helper()
+	storage, err := policy.NewStorage(filepath.Join(t.TempDir(), "ipsec.db"), nil)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	s := &Server{
+		storage:    storage,
+		engine:     policy.NewPolicyEngine(),
+		stop:       make(chan struct{}),
+		agentToken: "test-agent-token",
+		adminToken: "test-admin-token",
+		secretDir:  policy.DefaultSecretDir,
+
+		secretAccess: make(map[string]int),
+	}
+	e := echo.New()
+	s.RegisterRoutes(e)
+	return e
+}
+
+// serve sends a JSON request with an optional If-Match header
+func serve(e *echo.Echo, method, path, ifMatch string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		header  string
+		version int
+		ok      bool
+	}{
+		{`"3"`, 3, true},
+		{`W/"3"`, 3, true},
+		{` "12" `, 12, true},
+		{`3`, 3, true},
+		{``, 0, false},
+		{`"0"`, 0, false},
+		{`"-1"`, 0, false},
+		{`*`, 0, false},
+		{`"abc"`, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/", nil)
+			req.Header.Set("If-Match", tt.header)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			version, ok := parseIfMatch(c)
+			if version != tt.version || ok != tt.ok {
+				t.Errorf("parseIfMatch(%q) = %d, %v, want %d, %v", tt.header, version, ok, tt.version, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPolicyIfMatch(t *testing.T) {
+	e := newTestServer(t)
+
+	pol := policy.Policy{ID: "p", Name: "p", Tunnels: []ipsec.TunnelConfig{checkTunnel("a", "test-psk-secret")}}
+	missing := pol
+	missing.ID, missing.Name = "none", "none"
+
+	rec := serve(e, http.MethodPost, "/api/policies", "", pol)
+	if rec.Code != http.StatusCreated || rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("create: %d with ETag %q: %s", rec.Code, rec.Header().Get("ETag"), rec.Body)
+	}
+
+	steps := []struct {
+		name    string
+		method  string
+		path    string
+		ifMatch string
+		body    interface{}
+		status  int
+		etag    string
+	}{
+		{"update without If-Match", http.MethodPut, "/api/policies/p", "", pol, http.StatusPreconditionRequired, ""},
+		{"update at a stale version", http.MethodPut, "/api/policies/p", `"2"`, pol, http.StatusPreconditionFailed, ""},
+		{"update", http.MethodPut, "/api/policies/p", `"1"`, pol, http.StatusOK, `"2"`},
+		{"update a missing policy", http.MethodPut, "/api/policies/none", `"1"`, missing, http.StatusNotFound, ""},
+		{"rollback without If-Match", http.MethodPost, "/api/policies/p/rollback", "", rollbackRequest{Revision: 1}, http.StatusPreconditionRequired, ""},
+		{"rollback at a stale version", http.MethodPost, "/api/policies/p/rollback", `"1"`, rollbackRequest{Revision: 1}, http.StatusPreconditionFailed, ""},
+		{"rollback", http.MethodPost, "/api/policies/p/rollback", `"2"`, rollbackRequest{Revision: 1}, http.StatusOK, `"3"`},
+		{"delete without If-Match", http.MethodDelete, "/api/policies/p", "", nil, http.StatusPreconditionRequired, ""},
+		{"delete at a stale version", http.MethodDelete, "/api/policies/p", `"2"`, nil, http.StatusPreconditionFailed, ""},
+		{"delete", http.MethodDelete, "/api/policies/p", `"3"`, nil, http.StatusNoContent, ""},
+	}
+
+	for _, step := range steps {
+		rec := serve(e, step.method, step.path, step.ifMatch, step.body)
+		if rec.Code != step.status {
+			t.Errorf("%s: status %d, want %d: %s", step.name, rec.Code, step.status, rec.Body)
+		}
+		if etag := rec.Header().Get("ETag"); etag != step.etag {
+			t.Errorf("%s: ETag %q, want %q", step.name, etag, step.etag)
+		}
+	}
+}
+
+func TestCreatePolicyDuplicateName(t *testing.T) {
+	e := newTestServer(t)
+
+	first := policy.Policy{ID: "a", Name: "shared", Tunnels: []ipsec.TunnelConfig{checkTunnel("a", "test-psk-secret")}}
+	if rec := serve(e, http.MethodPost, "/api/policies", "", first); rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d: %s", rec.Code, rec.Body)
+	}
+
+	second := first
+	second.ID = "b"
+	if rec := serve(e, http.MethodPost, "/api/policies", "", second); rec.Code != http.StatusConflict {
+		t.Errorf("create with a taken name: %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+
+	second.Name = "other"
+	if rec := serve(e, http.MethodPost, "/api/policies", "", second); rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d: %s", rec.Code, rec.Body)
+	}
+	second.Name = "shared"
+	if rec := serve(e, http.MethodPut, "/api/policies/b", `"1"`, second); rec.Code != http.StatusConflict {
+		t.Errorf("rename to a taken name: %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+}
+
+func TestPeerReportAuth(t *testing.T) {
+	e := newTestServer(t)
+
+	peer := policy.PeerInfo{ID: "peer-1", Hostname: "peer-1", Platform: "linux", IPAddress: "192.0.2.1"}
+	if rec := serve(e, http.MethodPost, "/api/peers/register", "", peer); rec.Code != http.StatusCreated {
+		t.Fatalf("register: %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		report policy.PeerReport
+		status int
+	}{
+		{"no token", "/api/peers/peer-1/report", "", policy.PeerReport{}, http.StatusUnauthorized},
+		{"admin token", "/api/peers/peer-1/report", "test-admin-token", policy.PeerReport{}, http.StatusUnauthorized},
+		{"another peer's report", "/api/peers/peer-1/report", "test-agent-token", policy.PeerReport{PeerID: "peer-2"}, http.StatusBadRequest},
+		{"unknown peer", "/api/peers/peer-2/report", "test-agent-token", policy.PeerReport{}, http.StatusNotFound},
+		{"agent token", "/api/peers/peer-1/report", "test-agent-token", policy.PeerReport{PeerID: "peer-1"}, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := json.Marshal(tt.report)
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(data))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			if tt.token != "" {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusUnauthorized && rec.Header().Get(echo.HeaderWWWAuthenticate) != "Bearer" {
+				t.Errorf("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
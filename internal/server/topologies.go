@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/swavlamban/ipsec-manager/internal/policy"
+)
+
+// Topologies are stored as they are written and expanded against the
+// registered peers whenever a peer's policies are requested, so their
+// generated tunnels follow peers joining and leaving without being saved.
+// Saving a topology runs the policy checks on what it expands to today.
+
+// topologyResponse is returned by topology writes
+type topologyResponse struct {
+	Topology  policy.Topology           `json:"topology"`
+	Findings  policy.Findings           `json:"findings,omitempty"` // Non-blocking findings, e.g. warnings outside strict mode
+	Expansion *policy.TopologyExpansion `json:"expansion"`          // With the peers registered at save time
+}
+
+// withTopologies adds the policies generated by the enabled topologies for a
+// peer to the peer's stored policies
+func (s *Server) withTopologies(ctx context.Context, policies []policy.Policy, peer *policy.PeerInfo) ([]policy.Policy, error) {
+	topologies, err := s.storage.ListTopologies(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(topologies) == 0 {
+		return policies, nil
+	}
+
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return policy.WithTopologies(policies, topologies, peers, peer.ID), nil
+}
+
+// validateTopology checks a topology. If it may not be saved, it also
+// returns the 400 response body, which lists all findings.
+func (s *Server) validateTopology(topology *policy.Topology) (policy.Findings, map[string]interface{}) {
+	findings := s.engine.CheckTopology(topology)
+
+	blocking := findings.Blocking(s.engine.Strict())
+	if len(blocking) == 0 {
+		return findings, nil
+	}
+
+	msgs := make([]string, len(blocking))
+	for i, finding := range blocking {
+		msgs[i] = finding.Error()
+	}
+	return findings, map[string]interface{}{
+		"error":    fmt.Sprintf("Topology validation failed: %s", strings.Join(msgs, "; ")),
+		"findings": findings,
+	}
+}
+
+// checkTopologyPeers expands a topology against the registered peers and
+// checks each generated policy against its peer's compliance profiles and
+// platform. It returns the peers it checked and, if any peer cannot take its
+// tunnels, a non-zero status and error body.
+func (s *Server) checkTopologyPeers(ctx context.Context, topology *policy.Topology) ([]policy.PeerInfo, int, interface{}) {
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peers")
+		return nil, http.StatusInternalServerError, map[string]string{"error": "Failed to list peers"}
+	}
+
+	expansion := policy.ExpandTopology(topology, peers)
+
+	var compliance []peerComplianceViolations
+	var compatibility []policy.PeerCompatibility
+	for i := range peers {
+		pol, ok := expansion.PolicyFor(peers[i].ID)
+		if !ok {
+			continue
+		}
+		if violations := s.engine.CheckPeerCompliance(&pol, &peers[i]); len(violations) > 0 {
+			compliance = append(compliance, peerComplianceViolations{
+				PeerID:     peers[i].ID,
+				Hostname:   peers[i].Hostname,
+				Violations: violations,
+			})
+		}
+		report := s.engine.CheckCompatibility(&pol, peers[i:i+1])
+		if report.Incompatible > 0 {
+			compatibility = append(compatibility, report.Peers...)
+		}
+	}
+
+	switch {
+	case len(compliance) > 0:
+		return nil, http.StatusBadRequest, map[string]interface{}{
+			"error": fmt.Sprintf("Topology validation failed: peer %s: %s", compliance[0].PeerID, compliance[0].Violations[0].Error()),
+			"peers": compliance,
+		}
+	case len(compatibility) > 0:
+		return nil, http.StatusBadRequest, map[string]interface{}{
+			"error": fmt.Sprintf("Topology validation failed: %d peer(s) cannot configure its tunnels", len(compatibility)),
+			"compatibility": policy.CompatibilityReport{
+				Peers:        compatibility,
+				Incompatible: len(compatibility),
+			},
+		}
+	}
+	return peers, 0, nil
+}
+
+// topologyWriteError maps an error from a conditional topology write to an
+// HTTP status and message, falling back to 500 with the given message
+func topologyWriteError(err error, fallback string) (int, string) {
+	switch {
+	case errors.Is(err, policy.ErrVersionConflict):
+		return http.StatusPreconditionFailed, "Topology has been modified since it was read"
+	case errors.Is(err, policy.ErrTopologyNotFound):
+		return http.StatusNotFound, "Topology not found"
+	}
+	return http.StatusInternalServerError, fallback
+}
+
+// Topology handlers
+
+func (s *Server) handleListTopologies(c echo.Context) error {
+	topologies, err := s.storage.ListTopologies(c.Request().Context(), c.QueryParam("enabled") == "true")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list topologies")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list topologies",
+		})
+	}
+
+	return c.JSON(http.StatusOK, topologies)
+}
+
+func (s *Server) handleCreateTopology(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var topology policy.Topology
+	if err := c.Bind(&topology); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid topology format: %v", err),
+		})
+	}
+
+	findings, failed := s.validateTopology(&topology)
+	if failed != nil {
+		return c.JSON(http.StatusBadRequest, failed)
+	}
+
+	peers, status, body := s.checkTopologyPeers(ctx, &topology)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	// The server owns the version; a new topology always starts at 1
+	topology.Version = 0
+
+	if err := s.storage.SaveTopology(ctx, &topology); err != nil {
+		if errors.Is(err, policy.ErrVersionConflict) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": "Topology already exists",
+			})
+		}
+		log.Error().Err(err).Msg("Failed to save topology")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save topology",
+		})
+	}
+
+	s.storage.AuditLog(ctx, "create", "topology", topology.ID, "",
+		c.RealIP(), map[string]interface{}{"name": topology.Name, "mode": topology.Mode})
+
+	log.Info().Str("topology_id", topology.ID).Str("name", topology.Name).Msg("Topology created")
+
+	c.Response().Header().Set("ETag", policyETag(topology.Version))
+	return c.JSON(http.StatusCreated, topologyResponse{
+		Topology:  topology,
+		Findings:  findings,
+		Expansion: policy.ExpandTopology(&topology, peers),
+	})
+}
+
+func (s *Server) handleGetTopology(c echo.Context) error {
+	topology, err := s.storage.GetTopology(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Topology not found",
+		})
+	}
+
+	c.Response().Header().Set("ETag", policyETag(topology.Version))
+	return c.JSON(http.StatusOK, topology)
+}
+
+func (s *Server) handleUpdateTopology(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	version, ok := parseIfMatch(c)
+	if !ok {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"error": "If-Match header with the current topology ETag is required",
+		})
+	}
+
+	var topology policy.Topology
+	if err := c.Bind(&topology); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid topology format",
+		})
+	}
+
+	topology.ID = c.Param("id") // Ensure ID matches URL
+	topology.Version = version
+
+	// A redacted secret keeps the stored one
+	if stored, err := s.storage.GetTopology(ctx, topology.ID); err == nil {
+		policy.RestoreTopologySecret(&topology, stored)
+	}
+
+	findings, failed := s.validateTopology(&topology)
+	if failed != nil {
+		return c.JSON(http.StatusBadRequest, failed)
+	}
+
+	peers, status, body := s.checkTopologyPeers(ctx, &topology)
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	if err := s.storage.SaveTopology(ctx, &topology); err != nil {
+		status, message := topologyWriteError(err, "Failed to update topology")
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Msg("Failed to update topology")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
+		})
+	}
+
+	s.storage.AuditLog(ctx, "update", "topology", topology.ID, "",
+		c.RealIP(), map[string]interface{}{"name": topology.Name, "mode": topology.Mode})
+
+	log.Info().Str("topology_id", topology.ID).Str("name", topology.Name).Msg("Topology updated")
+
+	c.Response().Header().Set("ETag", policyETag(topology.Version))
+	return c.JSON(http.StatusOK, topologyResponse{
+		Topology:  topology,
+		Findings:  findings,
+		Expansion: policy.ExpandTopology(&topology, peers),
+	})
+}
+
+func (s *Server) handleDeleteTopology(c echo.Context) error {
+	id := c.Param("id")
+
+	version, ok := parseIfMatch(c)
+	if !ok {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"error": "If-Match header with the current topology ETag is required",
+		})
+	}
+
+	if err := s.storage.DeleteTopology(c.Request().Context(), id, version); err != nil {
+		status, message := topologyWriteError(err, "Failed to delete topology")
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Msg("Failed to delete topology")
+		}
+		return c.JSON(status, map[string]string{
+			"error": message,
+		})
+	}
+
+	s.storage.AuditLog(c.Request().Context(), "delete", "topology", id, "",
+		c.RealIP(), nil)
+
+	log.Info().Str("topology_id", id).Msg("Topology deleted")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// handleGetTopologyExpansion shows the tunnels a topology currently
+// generates for each peer and the peers and links it had to skip
+func (s *Server) handleGetTopologyExpansion(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	topology, err := s.storage.GetTopology(ctx, c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Topology not found",
+		})
+	}
+
+	peers, err := s.storage.ListPeers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list peers")
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list peers",
+		})
+	}
+
+	return c.JSON(http.StatusOK, policy.ExpandTopology(topology, peers))
+}
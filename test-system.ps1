@@ -255,7 +255,7 @@ Test-Assertion "POST /api/policies creates new policy" {
                     integrity = "sha256"
                     dhgroup = "modp2048"
                     ikeversion = "ikev2"
-                    lifetime = 3600000000000  # 1 hour in nanoseconds
+                    lifetime = "1h"
                 }
                 auth = @{
                     type = "psk"
@@ -268,7 +268,7 @@ Test-Assertion "POST /api/policies creates new policy" {
                     }
                 )
                 dpd = @{
-                    delay = 30000000000  # 30s in nanoseconds
+                    delay = "30s"
                     action = "restart"
                 }
                 autostart = $true
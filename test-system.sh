@@ -178,7 +178,7 @@ test_assertion "POST /api/policies creates new policy" bash -c '
       "integrity": "sha256",
       "dhgroup": "modp2048",
       "ikeversion": "ikev2",
-      "lifetime": 3600000000000
+      "lifetime": "1h"
     },
     "auth": {
       "type": "psk",
@@ -189,7 +189,7 @@ test_assertion "POST /api/policies creates new policy" bash -c '
       "remote_subnet": "10.20.0.0/24"
     }],
     "dpd": {
-      "delay": 30000000000,
+      "delay": "30s",
       "action": "restart"
     },
     "autostart": true
@@ -235,7 +235,8 @@ echo -e "\n${MAGENTA}═══ Phase 6: Cleanup & Verification ═══${NC}\n"
 if [ -f /tmp/test-policy-id.txt ]; then
     test_assertion "DELETE /api/policies/:id removes policy" bash -c '
         POLICY_ID=$(cat /tmp/test-policy-id.txt)
-        curl -sf -X DELETE "http://localhost:8080/api/policies/$POLICY_ID" > /dev/null
+        ETAG=$(curl -sf -D - -o /dev/null "http://localhost:8080/api/policies/$POLICY_ID" | grep -i "^etag:" | cut -d" " -f2 | tr -d "\r")
+        curl -sf -X DELETE -H "If-Match: $ETAG" "http://localhost:8080/api/policies/$POLICY_ID" > /dev/null
         ! curl -sf "http://localhost:8080/api/policies/$POLICY_ID" > /dev/null 2>&1
     '
 fi